@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/config"
+)
+
+// configCheck load a config file with the environment overrides and print its problems
+func configCheck(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		log.Printf("usage: waldb config check [config file]\n" +
+			"the config is the default one, overridden by the file (.json, .toml, .yaml or .yml)\n" +
+			"then by the WALDB_* environment variables, for example WALDB_SHARD_COUNT")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || fs.NArg() > 2 || fs.Arg(0) != "check" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := config.Load(fs.Arg(1)); err != nil {
+		verr, ok := err.(*config.ValidationError)
+		if !ok {
+			log.Fatalf("could not load config: %s", err.Error())
+		}
+		for _, problem := range verr.Problems {
+			log.Print(problem)
+		}
+		os.Exit(1)
+	}
+	log.Printf("config is valid")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/wal"
+)
+
+// deadLetter list, inspect, replay or discard the commands dropped after the max retry count
+func deadLetter(args []string) {
+	conf := config.InitDefaultConfig()
+	var data bool
+	var keyFile string
+	fs := flag.NewFlagSet("dead-letter", flag.ExitOnError)
+	fs.StringVar(&conf.DeadLetterFolder, "folder", "data/dead-letter", "dead letter folder")
+	fs.StringVar(&conf.ActiveFolder, "active", conf.ActiveFolder, "active folder, for replay")
+	fs.StringVar(&conf.ArchiveFolder, "archive", conf.ArchiveFolder, "archive folder, for replay")
+	fs.StringVar(&conf.Layout, "layout", config.DefaultLayout.String(), "layout of the active and archive folders, for replay")
+	fs.BoolVar(&data, "data", false, "dump the data of the write commands, for inspect")
+	fs.StringVar(&keyFile, "keys", "", "key file of the encrypted files")
+	fs.Usage = func() {
+		log.Printf("usage: waldb dead-letter [-folder folder] [-keys file] list\n" +
+			"       waldb dead-letter [-folder folder] [-keys file] [-data] inspect <id>...\n" +
+			"       waldb dead-letter [-folder folder] [-keys file] [-active folder] [-archive folder] [-layout spec] replay <id>...\n" +
+			"       waldb dead-letter [-folder folder] discard <id>...\n" +
+			"replay applies the commands on the files of a stopped database")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || (fs.Arg(0) != "list" && fs.NArg() < 2) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf.KeyProvider = loadKeyFile(keyFile)
+	ids := fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "list":
+		dls, err := wal.ListDeadLetters(*conf)
+		if err != nil {
+			log.Fatalf("could not list dead letters: %s", err.Error())
+		}
+		for _, dl := range dls {
+			fmt.Printf("%s\tshard %d\twal index %d\t%s\t%d commands\n", dl.ID, dl.ShardIndex, dl.WalIndex, dl.CreatedAt.Format("2006-01-02T15:04:05Z07:00"), len(dl.Commands))
+		}
+	case "inspect":
+		for _, id := range ids {
+			dl, err := wal.ReadDeadLetter(*conf, id)
+			if err != nil {
+				log.Fatalf("could not read dead letter %s: %s", id, err.Error())
+			}
+			fmt.Printf("%s: shard %d, wal index %d, %s\n", dl.ID, dl.ShardIndex, dl.WalIndex, dl.CreatedAt.Format("2006-01-02T15:04:05Z07:00"))
+			for i, cmd := range dl.Commands {
+				fmt.Printf("  %d\t%s\t%s\toffset %d\tfile size %d\tdata %d bytes\tretries %d\terror: %s\n", i, cmd.Key, cmd.Op, cmd.Offset, cmd.FileSize, cmd.DataSize, cmd.RetryCount, cmd.Error)
+				if data && len(cmd.Data) > 0 {
+					fmt.Print(hex.Dump(cmd.Data))
+				}
+			}
+		}
+	case "replay":
+		for _, id := range ids {
+			if err := wal.ColdReplayDeadLetter(*conf, id); err != nil {
+				log.Fatalf("replay of dead letter %s failed: %s", id, err.Error())
+			}
+			log.Printf("dead letter %s replayed", id)
+		}
+	case "discard":
+		for _, id := range ids {
+			if err := wal.DiscardDeadLetter(*conf, id); err != nil {
+				log.Fatalf("could not discard dead letter %s: %s", id, err.Error())
+			}
+			log.Printf("dead letter %s discarded", id)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
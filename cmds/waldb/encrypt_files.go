@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/tablepacked"
+)
+
+// encryptFiles encrypt the plaintext files of a stopped database written before the encryption was
+// enabled. The encrypted storage rejects them until then.
+func encryptFiles(args []string) {
+	conf := config.InitDefaultConfig()
+	var keyFile string
+	fs := flag.NewFlagSet("encrypt-files", flag.ExitOnError)
+	fs.StringVar(&keyFile, "keys", "", "key file: encrypt the files with its current key")
+	fs.StringVar(&conf.ActiveFolder, "active", conf.ActiveFolder, "active folder")
+	fs.StringVar(&conf.ArchiveFolder, "archive", conf.ArchiveFolder, "archive folder")
+	fs.StringVar(&conf.DeadLetterFolder, "dead-letter", "", "dead letter folder")
+	fs.StringVar(&conf.IndexFolder, "index", "", "index folder")
+	fs.StringVar(&conf.ParquetFolder, "parquet", "", "parquet folder")
+	fs.StringVar(&conf.ArchiveAcksFolder, "archive-acks", "", "archive acknowledgements folder")
+	fs.StringVar(&conf.SqliteFolder, "sqlite", conf.SqliteFolder, "sqlite folder")
+	fs.Usage = func() {
+		log.Printf("usage: waldb encrypt-files -keys file [-active folder] [-archive folder] [-dead-letter folder] [-index folder]\n" +
+			"    [-parquet folder] [-archive-acks folder] [-sqlite folder]\n" +
+			"the wal files are encrypted by wal-upgrade")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 || keyFile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	keys := loadKeyFile(keyFile)
+
+	encrypted, err := storage.EncryptFiles(storage.Local{}, keys, conf.ActiveFolder, conf.ArchiveFolder, conf.DeadLetterFolder,
+		conf.IndexFolder, conf.ParquetFolder, conf.ArchiveAcksFolder)
+	if err == nil {
+		var sqliteFiles []string
+		sqliteFiles, err = tablepacked.EncryptSqliteFiles(conf.SqliteFolder, keys)
+		encrypted = append(encrypted, sqliteFiles...)
+	}
+	for _, p := range encrypted {
+		log.Printf("encrypted %s", p)
+	}
+	if err != nil {
+		log.Fatalf("%d files encrypted before the error: %s", len(encrypted), err.Error())
+	}
+	log.Printf("%d files encrypted", len(encrypted))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/crypt"
+)
+
+// loadKeyFile keys of a -keys flag, nil without key file
+func loadKeyFile(p string) crypt.KeyProvider {
+	if p == "" {
+		return nil
+	}
+	keys, err := crypt.LoadKeyFile(p)
+	if err != nil {
+		log.Fatalf("could not load key file: %s", err.Error())
+	}
+	return keys
+}
+
+// keyRotate append a new random key to a key file. The new files are encrypted with it, the files
+// encrypted with the previous keys stay readable.
+func keyRotate(args []string) {
+	fs := flag.NewFlagSet("key-rotate", flag.ExitOnError)
+	fs.Usage = func() {
+		log.Printf("usage: waldb key-rotate <key file>\n" +
+			"the key file is created if missing. Restart the database to use the new key.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	p := fs.Arg(0)
+	keys, err := crypt.LoadKeyFile(p)
+	if os.IsNotExist(err) {
+		keys, err = crypt.NewKeyRing(), nil
+	}
+	if err != nil {
+		log.Fatalf("could not load key file: %s", err.Error())
+	}
+	id, key, err := keys.Rotate()
+	if err != nil {
+		log.Fatalf("could not create key: %s", err.Error())
+	}
+	if err := crypt.AppendKeyFile(p, id, key); err != nil {
+		log.Fatalf("could not write key file: %s", err.Error())
+	}
+	log.Printf("key %d added to %s", id, p)
+}
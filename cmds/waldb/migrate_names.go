@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/chamot1111/waldb/config"
+)
+
+// migrateNames rename the files of a stopped database to the escaped container file names
+func migrateNames(args []string) {
+	conf := config.InitDefaultConfig()
+	var tables string
+	fs := flag.NewFlagSet("migrate-names", flag.ExitOnError)
+	fs.StringVar(&conf.ActiveFolder, "active", conf.ActiveFolder, "active folder")
+	fs.StringVar(&conf.ArchiveFolder, "archive", conf.ArchiveFolder, "archive folder")
+	fs.StringVar(&conf.ReplicationActiveFolder, "replication-active", conf.ReplicationActiveFolder, "replicated active folder")
+	fs.StringVar(&conf.ReplicationArchiveFolder, "replication-archive", conf.ReplicationArchiveFolder, "replicated archive folder")
+	fs.StringVar(&conf.ArchiveAcksFolder, "archive-acks", "data/archive-acks", "acknowledgements of the archived files by the fan out sinks")
+	fs.StringVar(&tables, "tables", "", "comma separated table names, to resolve the names with more than two '_'")
+	fs.Usage = func() {
+		log.Printf("usage: waldb migrate-names [-active folder] [-archive folder] [-replication-active folder] [-replication-archive folder] [-archive-acks folder] [-tables t1,t2]\n" +
+			"the names with a '_', ':', '%%' or '/' in a component or with a container named \"default\" are renamed")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	tableNames := make([]string, 0)
+	if tables != "" {
+		tableNames = strings.Split(tables, ",")
+	}
+
+	res, err := config.MigrateContainerFileNames(*conf, tableNames)
+	if res != nil {
+		for _, r := range res.Renamed {
+			log.Printf("renamed %s to %s", r.From, r.To)
+		}
+	}
+	if err != nil {
+		log.Fatalf("migration failed: %s", err.Error())
+	}
+	for _, p := range res.Unresolved {
+		log.Printf("could not resolve %s: rename it by hand or give its table with -tables", p)
+	}
+	log.Printf("%d files renamed, %d unresolved", len(res.Renamed), len(res.Unresolved))
+	if len(res.Unresolved) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/config"
+)
+
+// relayout move the active and archived files of a stopped database to another layout
+func relayout(args []string) {
+	conf := config.InitDefaultConfig()
+	var from, to string
+	fs := flag.NewFlagSet("relayout", flag.ExitOnError)
+	fs.StringVar(&from, "from", config.DefaultLayout.String(), "current layout")
+	fs.StringVar(&to, "to", "", "new layout: prefix:<length> or hashed:<levels>x<width>")
+	fs.StringVar(&conf.ActiveFolder, "active", conf.ActiveFolder, "active folder")
+	fs.StringVar(&conf.ArchiveFolder, "archive", conf.ArchiveFolder, "archive folder")
+	fs.Usage = func() {
+		log.Printf("usage: waldb relayout [-from spec] -to spec [-active folder] [-archive folder]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if to == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fromLayout, err := config.ParseLayout(from)
+	if err != nil {
+		log.Fatalf("bad -from: %s", err.Error())
+	}
+	toLayout, err := config.ParseLayout(to)
+	if err != nil {
+		log.Fatalf("bad -to: %s", err.Error())
+	}
+
+	res, err := config.Relayout(*conf, fromLayout, toLayout)
+	if err != nil {
+		log.Fatalf("relayout failed after %d files moved: %s", len(res.Renamed), err.Error())
+	}
+	for _, p := range res.Unresolved {
+		log.Printf("%s is in neither layout: left as is", p)
+	}
+	log.Printf("%d files moved to %s: set Layout to %s in the config", len(res.Renamed), toLayout, toLayout)
+	if len(res.Unresolved) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/wal"
+	"go.uber.org/zap"
+)
+
+// replicationSecretEnv environment variable of the replication secret, as overridden by config.Load
+const replicationSecretEnv = "WALDB_REPLICATION_SECRET"
+
+// replicationLeader serve the archived wal files of a folder to the followers until interrupted
+func replicationLeader(args []string) {
+	conf := config.InitDefaultConfig()
+	fs := flag.NewFlagSet("replication-leader", flag.ExitOnError)
+	fs.StringVar(&conf.ReplicationLeaderAddr, "listen", "127.0.0.1:7070", "tcp address to listen on")
+	fs.StringVar(&conf.WalArchiveFolder, "wal-archive", "", "folder of the archived wal files")
+	fs.IntVar(&conf.ShardCount, "shards", conf.ShardCount, "shard count of the database")
+	fs.Usage = func() {
+		log.Printf("usage: waldb replication-leader -wal-archive <folder> [-listen addr] [-shards n]\n" +
+			"the secret shared with the followers is read from WALDB_REPLICATION_SECRET. The database must\n" +
+			"have ReplicationLeaderAddr set to keep the wal files until the followers have applied them")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if conf.WalArchiveFolder == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf.ReplicationSecret = os.Getenv(replicationSecretEnv)
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("could not create logger: %s", err.Error())
+	}
+	leader := wal.InitReplicationLeader(*conf, logger)
+	if err := leader.Listen(conf.ReplicationLeaderAddr); err != nil {
+		log.Fatalf("could not listen on %s: %s", conf.ReplicationLeaderAddr, err.Error())
+	}
+	log.Printf("serving %s on %s", conf.WalArchiveFolder, leader.Addr().String())
+	waitInterrupt()
+	leader.Close()
+}
+
+// replicationFollower replay the wal files of a leader until interrupted
+func replicationFollower(args []string) {
+	conf := config.InitDefaultConfig()
+	fs := flag.NewFlagSet("replication-follower", flag.ExitOnError)
+	fs.StringVar(&conf.ReplicationFollowOf, "leader", "127.0.0.1:7070", "tcp address of the leader")
+	fs.StringVar(&conf.ReplicationActiveFolder, "active", "", "folder of the replicated active files")
+	fs.StringVar(&conf.ReplicationArchiveFolder, "archive", "", "folder of the replicated archived files")
+	fs.StringVar(&conf.WALFolder, "state", conf.WALFolder, "folder of the follower position")
+	fs.StringVar(&conf.ReplicationFollowerName, "name", "", "name of the follower on the leader, the host name if empty")
+	fs.IntVar(&conf.ShardCount, "shards", conf.ShardCount, "shard count of the database")
+	fs.Usage = func() {
+		log.Printf("usage: waldb replication-follower -active <folder> [-archive folder] [-leader addr] [-state folder] [-name name] [-shards n]\n" +
+			"the secret shared with the leader is read from WALDB_REPLICATION_SECRET")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if conf.ReplicationActiveFolder == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf.ReplicationSecret = os.Getenv(replicationSecretEnv)
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("could not create logger: %s", err.Error())
+	}
+	follower, err := wal.InitReplicationFollower(*conf, logger)
+	if err != nil {
+		log.Fatalf("could not init follower: %s", err.Error())
+	}
+	follower.Start()
+	waitInterrupt()
+	if err := follower.Stop(); err != nil {
+		log.Fatalf("could not stop follower: %s", err.Error())
+	}
+}
+
+// replicationSlots list or drop the followers the wal files are kept for
+func replicationSlots(args []string) {
+	var walArchiveFolder string
+	fs := flag.NewFlagSet("replication-slots", flag.ExitOnError)
+	fs.StringVar(&walArchiveFolder, "wal-archive", "", "folder of the archived wal files")
+	fs.Usage = func() {
+		log.Printf("usage: waldb replication-slots -wal-archive <folder> list\n" +
+			"       waldb replication-slots -wal-archive <folder> drop <name>...\n" +
+			"a dropped follower must be resynced from a snapshot")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if walArchiveFolder == "" || fs.NArg() == 0 || (fs.Arg(0) != "list" && fs.NArg() < 2) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch fs.Arg(0) {
+	case "list":
+		slots, err := wal.ReplicationSlots(walArchiveFolder)
+		if err != nil {
+			log.Fatalf("could not list replication slots: %s", err.Error())
+		}
+		for _, slot := range slots {
+			fmt.Printf("%s\tnext wal index per shard %v\n", slot.Name, slot.Next)
+		}
+	case "drop":
+		for _, name := range fs.Args()[1:] {
+			if err := wal.DropReplicationSlot(walArchiveFolder, name); err != nil {
+				log.Fatalf("could not drop replication slot %s: %s", name, err.Error())
+			}
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func waitInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/wal"
+	"go.uber.org/zap"
+)
+
+// reshard change the shard count of a stopped database
+func reshard(args []string) {
+	flags := config.InitDefaultConfig()
+	var configPath string
+	var to int
+	fs := flag.NewFlagSet("reshard", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "", "config file of the database (.json, .toml, .yaml or .yml), overridden by the WALDB_* environment variables then by the flags")
+	fs.IntVar(&flags.ShardCount, "from", 0, "current shard count, ShardCount of the config by default")
+	fs.IntVar(&to, "to", 0, "new shard count")
+	fs.StringVar(&flags.WALFolder, "wal", flags.WALFolder, "wal folder")
+	fs.StringVar(&flags.ActiveFolder, "active", flags.ActiveFolder, "active folder")
+	fs.StringVar(&flags.ArchiveFolder, "archive", flags.ArchiveFolder, "archive folder")
+	fs.StringVar(&flags.WalArchiveFolder, "wal-archive", flags.WalArchiveFolder, "wal archive folder")
+	fs.BoolVar(&flags.DeleteInsteadOfArchiving, "delete-instead-of-archiving", flags.DeleteInsteadOfArchiving, "delete the archived files")
+	fs.Usage = func() {
+		log.Printf("usage: waldb reshard [-config file] [-from <shard count>] -to <shard count> [-wal folder] [-active folder] [-archive folder] [-wal-archive folder]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	conf, err := config.Load(configPath)
+	if err != nil {
+		log.Fatalf("could not load config: %s", err.Error())
+	}
+	if configPath == "" {
+		// the default shard count is not the one of the database: -from is required
+		conf.ShardCount = 0
+	}
+	// the flags override the config
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "from":
+			conf.ShardCount = flags.ShardCount
+		case "wal":
+			conf.WALFolder = flags.WALFolder
+		case "active":
+			conf.ActiveFolder = flags.ActiveFolder
+		case "archive":
+			conf.ArchiveFolder = flags.ArchiveFolder
+		case "wal-archive":
+			conf.WalArchiveFolder = flags.WalArchiveFolder
+		case "delete-instead-of-archiving":
+			conf.DeleteInsteadOfArchiving = flags.DeleteInsteadOfArchiving
+		}
+	})
+	if conf.ShardCount <= 0 || to <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// the archived files are resumed by the database at its next start
+	conf.DisableResumeArchiving = true
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("could not create logger: %s", err.Error())
+	}
+	if err := wal.Reshard(*conf, to, logger); err != nil {
+		log.Fatalf("reshard failed: %s", err.Error())
+	}
+	log.Printf("resharded from %d to %d shards: set ShardCount to %d in the config", conf.ShardCount, to, to)
+}
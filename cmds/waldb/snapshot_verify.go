@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/wal"
+)
+
+// snapshotVerify check the files of snapshots against their manifest
+func snapshotVerify(args []string) {
+	var keyFile string
+	fs := flag.NewFlagSet("snapshot-verify", flag.ExitOnError)
+	fs.StringVar(&keyFile, "keys", "", "key file of the encrypted files")
+	fs.Usage = func() {
+		log.Printf("usage: waldb snapshot-verify [-keys file] <snapshot folder>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	keys := loadKeyFile(keyFile)
+	failed := 0
+	for _, p := range fs.Args() {
+		manifest, err := wal.VerifySnapshot(p, keys)
+		if err != nil {
+			log.Printf("snapshot %s is invalid: %s", p, err.Error())
+			failed++
+			continue
+		}
+		fileCount := 0
+		for _, shard := range manifest.Shards {
+			fileCount += len(shard.Files)
+			log.Printf("%s: shard %d at wal index %d", p, shard.ShardIndex, shard.WalIndex)
+		}
+		log.Printf("%s: snapshot of %s is valid, %d files", p, manifest.CreatedAt.Format("2006-01-02T15:04:05Z07:00"), fileCount)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wal"
+	"go.uber.org/zap"
+)
+
+// walRestore replay the archived wal files on a base copy of the active folder
+func walRestore(args []string) {
+	opts := wal.RestoreOptions{}
+	var from, to, until, layout, keyFile string
+	fs := flag.NewFlagSet("wal-restore", flag.ExitOnError)
+	fs.StringVar(&opts.WalArchiveFolder, "wal-archive", "", "folder of the archived wal files")
+	fs.StringVar(&opts.ActiveFolder, "active", "", "active folder holding the base copy, updated in place")
+	fs.StringVar(&opts.ArchiveFolder, "archive", "", "archive folder of the restored database")
+	fs.StringVar(&from, "from", "", "first wal index to replay per shard: shard:walIndex,...")
+	fs.StringVar(&to, "to", "", "last wal index to replay per shard: shard:walIndex,...")
+	fs.StringVar(&until, "time", "", "replay the wal files created at or before this RFC3339 time")
+	fs.StringVar(&layout, "layout", config.DefaultLayout.String(), "layout of the active and archive folders")
+	fs.StringVar(&keyFile, "keys", "", "key file of the encrypted files")
+	fs.Usage = func() {
+		log.Printf("usage: waldb wal-restore -wal-archive <folder> -active <folder> [-archive folder] [-from shard:walIndex,...] [-to shard:walIndex,...] [-time RFC3339] [-layout spec] [-keys file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if opts.WalArchiveFolder == "" || opts.ActiveFolder == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if opts.FromWalIndex, err = parseShardWalIndexes(from); err != nil {
+		log.Fatalf("bad -from: %s", err.Error())
+	}
+	if opts.ToWalIndex, err = parseShardWalIndexes(to); err != nil {
+		log.Fatalf("bad -to: %s", err.Error())
+	}
+	if opts.Layout, err = config.ParseLayout(layout); err != nil {
+		log.Fatalf("bad -layout: %s", err.Error())
+	}
+	if until != "" {
+		if opts.ToTime, err = time.Parse(time.RFC3339, until); err != nil {
+			log.Fatalf("bad -time: %s", err.Error())
+		}
+	}
+
+	if opts.KeyProvider = loadKeyFile(keyFile); opts.KeyProvider != nil {
+		opts.Storage = storage.Encrypted(storage.Local{}, opts.KeyProvider)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("could not create logger: %s", err.Error())
+	}
+	restored, err := wal.Restore(opts, logger)
+	for _, r := range restored {
+		log.Printf("shard %d: %d wal files replayed, wal index %d to %d", r.ShardIndex, r.Count, r.FirstWalIndex, r.LastWalIndex)
+	}
+	if err != nil {
+		log.Fatalf("restore failed: %s", err.Error())
+	}
+}
+
+// parseShardWalIndexes parse shard:walIndex,...
+func parseShardWalIndexes(s string) (map[uint64]uint64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	res := make(map[uint64]uint64)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not shard:walIndex", part)
+		}
+		shardIndex, err := strconv.ParseUint(kv[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		walIndex, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		res[shardIndex] = walIndex
+	}
+	return res, nil
+}
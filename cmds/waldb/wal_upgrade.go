@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/chamot1111/waldb/wal"
+)
+
+// walUpgrade rewrite the archived wal files given as arguments. A folder argument
+// upgrades all the archived wal files it contains. With a key file, the plaintext wal files are encrypted.
+func walUpgrade(args []string) {
+	var keyFile string
+	fs := flag.NewFlagSet("wal-upgrade", flag.ExitOnError)
+	fs.StringVar(&keyFile, "keys", "", "key file: encrypt the wal files with its current key")
+	fs.Usage = func() {
+		log.Printf("usage: waldb wal-upgrade [-keys file] <wal file or wal archive folder>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	keys := loadKeyFile(keyFile)
+	paths := make([]string, 0)
+	for _, p := range fs.Args() {
+		st, err := os.Stat(p)
+		if err != nil {
+			log.Fatalf("could not stat %s: %s", p, err.Error())
+		}
+		if !st.IsDir() {
+			paths = append(paths, p)
+			continue
+		}
+		folderPaths, err := wal.ArchivedWALFiles(p)
+		if err != nil {
+			log.Fatalf("could not list wal files of %s: %s", p, err.Error())
+		}
+		paths = append(paths, folderPaths...)
+	}
+
+	failed := 0
+	upgradedCount := 0
+	for _, p := range paths {
+		upgraded, err := wal.UpgradeFile(p, keys)
+		if err != nil {
+			log.Printf("could not upgrade wal file %s: %s", p, err.Error())
+			failed++
+			continue
+		}
+		if upgraded {
+			upgradedCount++
+			log.Printf("upgraded %s", p)
+		}
+	}
+	log.Printf("%d wal files upgraded, %d already up to date, %d failed", upgradedCount, len(paths)-upgradedCount-failed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	run   func(args []string)
+}
+
+var commands = map[string]command{
+	"config": {
+		usage: "load a config file with the environment overrides and check it",
+		run:   configCheck,
+	},
+	"dead-letter": {
+		usage: "list, inspect, replay or discard the commands dropped after the max retry count",
+		run:   deadLetter,
+	},
+	"encrypt-files": {
+		usage: "encrypt the plaintext files of a stopped database written before the encryption",
+		run:   encryptFiles,
+	},
+	"key-rotate": {
+		usage: "add a new encryption key to a key file",
+		run:   keyRotate,
+	},
+	"migrate-names": {
+		usage: "rename the files of a stopped database to the escaped container file names",
+		run:   migrateNames,
+	},
+	"relayout": {
+		usage: "move the files of a stopped database to another layout of the active and archive folders",
+		run:   relayout,
+	},
+	"replication-follower": {
+		usage: "replay the wal files streamed by a replication leader",
+		run:   replicationFollower,
+	},
+	"replication-leader": {
+		usage: "stream the archived wal files to the replication followers",
+		run:   replicationLeader,
+	},
+	"replication-slots": {
+		usage: "list or drop the replication followers the wal files are kept for",
+		run:   replicationSlots,
+	},
+	"reshard": {
+		usage: "change the shard count of a stopped database",
+		run:   reshard,
+	},
+	"snapshot-verify": {
+		usage: "check the files of a snapshot against its manifest",
+		run:   snapshotVerify,
+	},
+	"wal-restore": {
+		usage: "replay archived wal files on a base copy up to a wal index or a time",
+		run:   walRestore,
+	},
+	"wal-upgrade": {
+		usage: "rewrite archived wal files with the newest wal version",
+		run:   walUpgrade,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: waldb <command> [arguments]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-22s %s\n", name, commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, exists := commands[os.Args[1]]
+	if !exists {
+		usage()
+	}
+	cmd.run(os.Args[2:])
+}
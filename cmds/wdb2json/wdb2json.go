@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"flag"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 
+	"github.com/chamot1111/waldb/crypt"
 	"github.com/chamot1111/waldb/fileop"
+	"github.com/chamot1111/waldb/storage"
 	"github.com/chamot1111/waldb/tablepacked"
 	"github.com/chamot1111/waldb/wutils"
 )
@@ -17,7 +18,9 @@ func main() {
 	var tableDescriptorJSONPath string
 	var headers string
 	var crc bool
+	var keyFile string
 	flag.StringVar(&tableDescriptorJSONPath, "table", "", "path to the json table file descriptor")
+	flag.StringVar(&keyFile, "keys", "", "key file of the encrypted files")
 	flag.BoolVar(&crc, "crc", false, "read crc corrupted file")
 	flag.StringVar(&headers, "headers", "", "headers for columns")
 	flag.Parse()
@@ -31,13 +34,22 @@ func main() {
 		}
 	}
 
+	var store storage.Storage = storage.Local{}
+	if keyFile != "" {
+		keys, err := crypt.LoadKeyFile(keyFile)
+		if err != nil {
+			log.Fatalf("could not load key file: %s", err.Error())
+		}
+		store = storage.Encrypted(store, keys)
+	}
+
 	files := flag.Args()
 
 	rowDataPool := tablepacked.NewRowDataPool()
 	bufferPool := tablepacked.NewBufPool()
 
 	for _, p := range files {
-		f, err := os.Open(p)
+		f, err := store.OpenFile(p, false)
 		if err != nil {
 			log.Fatalf("could not open file %s: %s", p, err.Error())
 		}
@@ -53,7 +65,12 @@ func main() {
 			log.Fatalf("could not close file %s: %s", p, err.Error())
 		}
 
-		table, err := tablepacked.ReadAllRowDataFromFileBuffer(buffer, rowDataPool)
+		var table *tablepacked.TableData
+		if tableDescr != nil {
+			table, err = tablepacked.ReadAllRowDataFromFileBufferForTable(buffer, rowDataPool, *tableDescr)
+		} else {
+			table, err = tablepacked.ReadAllRowDataFromFileBuffer(buffer, rowDataPool)
+		}
 		if err != nil {
 			if _, ok := err.(*tablepacked.ErrBadEndingCRC); !ok {
 				log.Fatalf("could not parse file %s: %s", p, err.Error())
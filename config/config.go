@@ -1,11 +1,39 @@
 package config
 
+import (
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+)
+
+// Durability modes of the writes
+const (
+	// WALDurabilityCheckpoint writes are durable once the wal is checkpointed
+	WALDurabilityCheckpoint = "checkpoint"
+	// WALDurabilitySync writes are written and fsynced to the wal before returning.
+	// Concurrent writers of a shard share the fsync.
+	WALDurabilitySync = "sync"
+	// WALDurabilityGroupCommit same as WALDurabilitySync but the fsync waits WALGroupCommitWindowMs
+	// to gather more writes
+	WALDurabilityGroupCommit = "group"
+)
+
+// Compressions of the data of the wal commands
+const (
+	// WALCompressionNone the data is written raw
+	WALCompressionNone = "none"
+	// WALCompressionSnappy fast compression, the default choice
+	WALCompressionSnappy = "snappy"
+	// WALCompressionFlate better ratio but slower writes
+	WALCompressionFlate = "flate"
+)
+
 // Config config
 type Config struct {
 	DeleteInsteadOfArchiving  bool
 	ActiveFolder              string
 	ArchiveFolder             string
 	SqliteFolder              string
+	ParquetFolder             string
 	WalArchiveFolder          string
 	ReplicationActiveFolder   string
 	ReplicationArchiveFolder  string
@@ -19,6 +47,86 @@ type Config struct {
 	SqliteArchiverJournalMode string
 	SqliteArchiverSynchronous string
 	DisableResumeArchiving    bool
+	WALDurability             string
+	WALGroupCommitWindowMs    int
+	// WALCompression compression of the data of the wal commands, empty is WALCompressionNone
+	WALCompression string
+	// WALCompressionMinSize the data of the wal commands smaller than this are not compressed
+	WALCompressionMinSize int
+	// WalArchiveRetentionS if not zero, the archived wal files are kept this duration after being
+	// replicated instead of being deleted. They can be used by a point-in-time recovery.
+	WalArchiveRetentionS int
+	// ReplicationLeaderAddr tcp address where the archived wal files are served to the followers. The
+	// archived wal files are kept until the followers have applied them.
+	ReplicationLeaderAddr string
+	// ReplicationFollowOf tcp address of the leader followed by a replication follower
+	ReplicationFollowOf string
+	// ReplicationFollowerName name of the follower, unique per leader: the leader keeps the wal files
+	// for it under this name. Empty is the host name.
+	ReplicationFollowerName string
+	// ReplicationSecret shared secret authenticating the replication leader and its followers. The
+	// connection is not encrypted: the wal files are sent as they are on the disk.
+	ReplicationSecret string
+	// DeadLetterFolder the commands failing after the max retry count are saved there, in Storage, instead of
+	// being dropped. Empty drops them.
+	DeadLetterFolder string
+	// IndexFolder the secondary indexes of the tables are saved there. Empty rebuilds them from the active
+	// files at each start.
+	IndexFolder string
+	// ArchiveAcksFolder the sinks of a wal.FanOut having processed an archived file are saved there until
+	// all of them have. Empty sends a file kept after a failure again to all the sinks.
+	ArchiveAcksFolder string
+	// Layout spec of the layout of the active, archive and replication folders, see ParseLayout. Empty is DefaultLayout.
+	Layout string
+	// EncryptionKeyFile key file of KeyProvider, see crypt.LoadKeyFile. It is loaded by Load.
+	EncryptionKeyFile string
+	// KeyProvider if not nil, the wal files, the files of Storage and the values of the sqlite files are
+	// encrypted at rest. The files written before must be encrypted by storage.EncryptFiles and
+	// tablepacked.EncryptSqliteFiles.
+	KeyProvider crypt.KeyProvider `json:"-"`
+	// Router shard of the container files, HashRouter if nil
+	Router Router `json:"-"`
+	// Storage of the files of ActiveFolder, ArchiveFolder, ParquetFolder, DeadLetterFolder, IndexFolder and
+	// ArchiveAcksFolder, the local disk if nil. The wal files, the sqlite files and the snapshots stay on the
+	// local disk.
+	Storage storage.Storage `json:"-"`
+	// Faults injected in the wal and the storage, for the tests
+	Faults *storage.FaultInjector `json:"-"`
+}
+
+// GetStorage storage of the active and archived files
+func (c Config) GetStorage() storage.Storage {
+	s := c.Storage
+	if s == nil {
+		s = storage.Local{}
+	}
+	if c.Faults != nil {
+		s = storage.WithFaults(s, c.Faults)
+	}
+	if c.KeyProvider != nil {
+		s = storage.Encrypted(s, c.KeyProvider)
+	}
+	return s
+}
+
+// GetLayout layout of the active and archive folders. A bad spec, rejected by Validate, is DefaultLayout.
+func (c Config) GetLayout() Layout {
+	if c.Layout == "" {
+		return DefaultLayout
+	}
+	l, err := ParseLayout(c.Layout)
+	if err != nil {
+		return DefaultLayout
+	}
+	return l
+}
+
+// GetRouter router of the container files
+func (c Config) GetRouter() Router {
+	if c.Router == nil {
+		return HashRouter{}
+	}
+	return c.Router
 }
 
 // InitDefaultConfig init config with default parameters
@@ -27,15 +135,22 @@ func InitDefaultConfig() *Config {
 		ActiveFolder:              "data/active",
 		ArchiveFolder:             "data/archive",
 		SqliteFolder:              "data/sqlite-archive",
+		ParquetFolder:             "data/parquet",
 		WalArchiveFolder:          "",
 		ShardCount:                4,
 		MaxFileOpen:               100,
 		WALFolder:                 ".",
+		DeadLetterFolder:          "",
+		IndexFolder:               "",
+		ArchiveAcksFolder:         "",
 		MaxWALFileSize:            16000000,
 		MaxWALFileDurationS:       10 * 60,
 		SqliteArchiverJournalMode: "WAL",
 		SqliteArchiverSynchronous: "normal",
 		DisableResumeArchiving:    false,
+		WALDurability:             WALDurabilityCheckpoint,
+		WALGroupCommitWindowMs:    2,
+		WALCompressionMinSize:     256,
 	}
 }
 
@@ -43,6 +158,7 @@ func InitDefaultConfig() *Config {
 func InitDefaultTestConfig() *Config {
 	return &Config{
 		SqliteFolder:              "data-test/sqlite-archive",
+		ParquetFolder:             "data-test/parquet",
 		ActiveFolder:              "data-test/active",
 		ArchiveFolder:             "data-test/archive",
 		WalArchiveFolder:          "data-test/wal-archive",
@@ -51,10 +167,16 @@ func InitDefaultTestConfig() *Config {
 		ShardCount:                8,
 		MaxFileOpen:               10,
 		WALFolder:                 "data-test",
+		DeadLetterFolder:          "data-test/dead-letter",
+		IndexFolder:               "data-test/index",
+		ArchiveAcksFolder:         "data-test/archive-acks",
 		MaxWALFileSize:            16000000,
 		MaxWALFileDurationS:       1000000000000,
 		SqliteArchiverJournalMode: "WAL",
 		SqliteArchiverSynchronous: "normal",
 		DisableResumeArchiving:    false,
+		WALDurability:             WALDurabilityCheckpoint,
+		WALGroupCommitWindowMs:    2,
+		WALCompressionMinSize:     256,
 	}
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"os"
@@ -19,18 +20,132 @@ type ContainerFile struct {
 const digitsPrefix = 4
 const emptyContainerReplacement = "default"
 
-func containerOrDefault(s string) string {
-	if s == "" {
+// maxEscapedFilenameLen leave room for the wal info of the archived file names in the 255 bytes of a name
+const maxEscapedFilenameLen = 192
+
+// ErrInvalidContainerFile a component of the container file can not be stored
+var ErrInvalidContainerFile = errors.New("invalid container file")
+
+// shouldEscape '_' and ':' separate the components in the file names and the keys, '%' is the escape
+// character and a leading '.' would hide the file or make a relative folder
+func shouldEscape(c byte, first bool) bool {
+	return c == '%' || c == '_' || c == ':' || c == '/' || c == '\\' || c < 0x20 || c == 0x7f || (first && c == '.')
+}
+
+// escapeComponent percent encode a component for the keys and the paths. The other bytes are kept
+// so the names without special characters are unchanged.
+func escapeComponent(s string) string {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if shouldEscape(s[i], i == 0) {
+			n++
+		}
+	}
+	if n == 0 {
+		return s
+	}
+	const hexDigits = "0123456789ABCDEF"
+	res := make([]byte, 0, len(s)+2*n)
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; shouldEscape(c, i == 0) {
+			res = append(res, '%', hexDigits[c>>4], hexDigits[c&0x0f])
+		} else {
+			res = append(res, c)
+		}
+	}
+	return string(res)
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// unescapeComponent decode a component encoded by escapeComponent
+func unescapeComponent(s string) (string, error) {
+	if strings.IndexByte(s, '%') < 0 {
+		return s, nil
+	}
+	res := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			res = append(res, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("bad escape in '%s'", s)
+		}
+		h, ok1 := unhex(s[i+1])
+		l, ok2 := unhex(s[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("bad escape in '%s'", s)
+		}
+		res = append(res, h<<4|l)
+		i += 2
+	}
+	return string(res), nil
+}
+
+// containerFolder folder of a container: the empty container is stored in "default", so a container
+// named "default" has its first letter escaped
+func containerFolder(container string) string {
+	switch container {
+	case "":
 		return emptyContainerReplacement
+	case emptyContainerReplacement:
+		return "%64" + emptyContainerReplacement[1:]
 	}
-	return s
+	return escapeComponent(container)
 }
 
-// NewContainerFileWTableName new container file
+func parseContainerFolder(folder string) (string, error) {
+	if folder == emptyContainerReplacement {
+		return "", nil
+	}
+	return unescapeComponent(folder)
+}
+
+// NewContainerFileWTableName new container file. The components are not validated, see NewContainerFile.
 func NewContainerFileWTableName(container string, bucket string, subBucket string, table string) ContainerFile {
 	return ContainerFile{Container: container, Bucket: bucket, SubBucket: subBucket, TableName: table}
 }
 
+// NewContainerFile new container file with validated components
+func NewContainerFile(container string, bucket string, subBucket string, table string) (ContainerFile, error) {
+	cf := NewContainerFileWTableName(container, bucket, subBucket, table)
+	return cf, cf.Validate()
+}
+
+// Validate check the container file can be stored. Every character is allowed: the components are
+// escaped in the keys and the paths.
+func (cf ContainerFile) Validate() error {
+	if cf.Bucket == "" {
+		return fmt.Errorf("%w: empty bucket", ErrInvalidContainerFile)
+	}
+	if cf.TableName == "" {
+		return fmt.Errorf("%w: empty table name", ErrInvalidContainerFile)
+	}
+	if _, filename := cf.PrefixAndFilename(); len(filename) > maxEscapedFilenameLen {
+		return fmt.Errorf("%w: escaped file name of %d bytes, more than %d", ErrInvalidContainerFile, len(filename), maxEscapedFilenameLen)
+	}
+	if folder := cf.ContainerFolder(); len(folder) > 255 {
+		return fmt.Errorf("%w: escaped container of %d bytes, more than 255", ErrInvalidContainerFile, len(folder))
+	}
+	return nil
+}
+
+// ContainerFolder name of the folder of the container in the active and archive folders
+func (cf ContainerFile) ContainerFolder() string {
+	return containerFolder(cf.Container)
+}
+
 // DataSize path to file
 func (cf ContainerFile) DataSize() int {
 	return len(cf.Container) + len(cf.Bucket) + len(cf.SubBucket) + len(cf.TableName)
@@ -38,101 +153,128 @@ func (cf ContainerFile) DataSize() int {
 
 // PathToFile path to file
 func (cf ContainerFile) PathToFile(c Config) string {
-	prefix, filename := cf.PrefixAndFilename()
-	return path.Join(c.ActiveFolder, containerOrDefault(cf.Container), prefix, filename)
+	return cf.PathInLayout(c.GetLayout(), c.ActiveFolder)
 }
 
-// PathToFileFromFolder path to file
+// PathToFileFromFolder path to file with the default layout
 func (cf ContainerFile) PathToFileFromFolder(folder string) string {
-	prefix, filename := cf.PrefixAndFilename()
-	return path.Join(folder, containerOrDefault(cf.Container), prefix, filename)
+	return cf.PathInLayout(DefaultLayout, folder)
+}
+
+// PathInLayout path to file under folder with the layout l
+func (cf ContainerFile) PathInLayout(l Layout, folder string) string {
+	_, filename := cf.PrefixAndFilename()
+	return path.Join(folder, cf.ContainerFolder(), l.Folders(cf), filename)
 }
 
 // BaseFolder to file
 func (cf ContainerFile) BaseFolder(c Config) string {
-	prefix, _ := cf.PrefixAndFilename()
-	return path.Join(c.ActiveFolder, containerOrDefault(cf.Container), prefix)
+	return path.Join(c.ActiveFolder, cf.ContainerFolder(), c.GetLayout().Folders(cf))
 }
 
 // PrefixAndFilename give prefix use as a frst folder to limit the count of file per folder
-// and the filename
+// and the filename. The components are escaped. The prefix is the folder of the default layout.
 func (cf ContainerFile) PrefixAndFilename() (prefix string, filename string) {
-	prefix = cf.Bucket
-	if len(cf.Bucket) > digitsPrefix {
-		prefix = cf.Bucket[0:digitsPrefix]
+	bucket := escapeComponent(cf.Bucket)
+	prefix = bucket
+	if len(bucket) > digitsPrefix {
+		prefix = bucket[0:digitsPrefix]
 	}
-	filename = cf.Bucket + "_" + cf.SubBucket + "_" + cf.TableName
+	filename = bucket + "_" + escapeComponent(cf.SubBucket) + "_" + escapeComponent(cf.TableName)
 	return
 }
 
-// Key string representing the config
+// Key string representing the config, with the components escaped
 func (cf ContainerFile) Key() string {
-	return strings.Join([]string{cf.Container, cf.Bucket, cf.SubBucket, cf.TableName}, ":")
+	return strings.Join([]string{escapeComponent(cf.Container), escapeComponent(cf.Bucket), escapeComponent(cf.SubBucket), escapeComponent(cf.TableName)}, ":")
 }
 
-// ArchivePath path to the archive folder
+// parseFilename parse the escaped components of a file name
+func parseFilename(filename string, container string) (*ContainerFile, error) {
+	comps := strings.Split(filename, "_")
+	if len(comps) != 3 {
+		return nil, fmt.Errorf("could not parse container comps '%s'", filename)
+	}
+	cf := &ContainerFile{Container: container}
+	for i, dst := range []*string{&cf.Bucket, &cf.SubBucket, &cf.TableName} {
+		v, err := unescapeComponent(comps[i])
+		if err != nil {
+			return nil, err
+		}
+		*dst = v
+	}
+	return cf, nil
+}
+
+// ArchivePath path to the archive folder with the default layout
 func (cf ContainerFile) ArchivePath(archiveFolder string, shardIndex, walIndex, operationIndex int) string {
-	prefix, filename := cf.PrefixAndFilename()
+	return cf.ArchivePathInLayout(DefaultLayout, archiveFolder, shardIndex, walIndex, operationIndex)
+}
+
+// ArchivePathInLayout path to the archive folder with the layout l
+func (cf ContainerFile) ArchivePathInLayout(l Layout, archiveFolder string, shardIndex, walIndex, operationIndex int) string {
+	_, filename := cf.PrefixAndFilename()
 	v := fmt.Sprintf("%s:%d:%d:%d", filename, shardIndex, walIndex, operationIndex)
-	return path.Join(archiveFolder, containerOrDefault(cf.Container), prefix, v)
+	return path.Join(archiveFolder, cf.ContainerFolder(), l.Folders(cf), v)
 }
 
-// ParseContainerFileFromArchivePath parse file path
+// ParseContainerFileFromArchivePath parse file path with the default layout
 func ParseContainerFileFromArchivePath(b string) (*ContainerFile, error) {
+	return ParseArchivePathInLayout(DefaultLayout, b)
+}
+
+// ParseArchivePathInLayout parse archived file path with the layout l
+func ParseArchivePathInLayout(l Layout, b string) (*ContainerFile, error) {
 	baseName := path.Base(b)
 	removeWalInfo := strings.Split(baseName, ":")
 	if len(removeWalInfo) != 4 {
 		return nil, fmt.Errorf("could not parse wal info from archive name '%s'", string(b))
 	}
-	comps := strings.Split(removeWalInfo[0], "_")
-
-	if len(comps) != 3 {
-		return nil, fmt.Errorf("could not parse container comps '%s'", string(b))
-	}
-	dir := strings.Split(string(path.Dir(b)), string(os.PathSeparator))
-	if len(dir) < 2 {
-		return nil, fmt.Errorf("could not get app container from path '%s'", string(b))
+	container, err := parseContainerFromPath(l, b)
+	if err != nil {
+		return nil, err
 	}
-	container := dir[len(dir)-2]
-	if container == emptyContainerReplacement {
-		container = ""
+	cf, err := parseFilename(removeWalInfo[0], container)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse archive path '%s': %w", b, err)
 	}
-	return &ContainerFile{
-		Container: container,
-		Bucket:    comps[0],
-		SubBucket: comps[1],
-		TableName: comps[2],
-	}, nil
+	return cf, nil
 }
 
-// ParseContainerFileFromActivePath parse file path
+// ParseContainerFileFromActivePath parse file path with the default layout
 func ParseContainerFileFromActivePath(b string) (*ContainerFile, error) {
-	baseName := path.Base(b)
-	comps := strings.Split(baseName, "_")
+	return ParseActivePathInLayout(DefaultLayout, b)
+}
 
-	if len(comps) != 3 {
-		return nil, fmt.Errorf("could not parse container comps '%s'", string(b))
+// ParseActivePathInLayout parse active file path with the layout l
+func ParseActivePathInLayout(l Layout, b string) (*ContainerFile, error) {
+	container, err := parseContainerFromPath(l, b)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := parseFilename(path.Base(b), container)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse active path '%s': %w", b, err)
 	}
+	return cf, nil
+}
+
+// parseContainerFromPath container of a file at <container>/<layout folders>/<file>
+func parseContainerFromPath(l Layout, b string) (string, error) {
 	dir := strings.Split(string(path.Dir(b)), string(os.PathSeparator))
-	if len(dir) < 2 {
-		return nil, fmt.Errorf("could not get app container from path '%s'", string(b))
+	if len(dir) < l.Depth()+1 {
+		return "", fmt.Errorf("could not get app container from path '%s'", string(b))
 	}
-	container := dir[len(dir)-2]
-	if container == emptyContainerReplacement {
-		container = ""
+	container, err := parseContainerFolder(dir[len(dir)-1-l.Depth()])
+	if err != nil {
+		return "", fmt.Errorf("could not get app container from path '%s': %w", b, err)
 	}
-	return &ContainerFile{
-		Container: container,
-		Bucket:    comps[0],
-		SubBucket: comps[1],
-		TableName: comps[2],
-	}, nil
+	return container, nil
 }
 
-// ArchiveFolder path to the archive file
+// ArchiveFolder path to the archive file with the default layout
 func (cf ContainerFile) ArchiveFolder(archiveFolder string) string {
-	prefix, _ := cf.PrefixAndFilename()
-	return path.Join(archiveFolder, containerOrDefault(cf.Container), prefix)
+	return path.Join(archiveFolder, cf.ContainerFolder(), DefaultLayout.Folders(cf))
 }
 
 // ParseContainerFileKey parse a container file from string
@@ -141,15 +283,18 @@ func ParseContainerFileKey(b string) (*ContainerFile, error) {
 	if len(comps) != 4 {
 		return nil, fmt.Errorf("could not parse container file key '%s'", string(b))
 	}
-	return &ContainerFile{
-		Container: comps[0],
-		Bucket:    comps[1],
-		SubBucket: comps[2],
-		TableName: comps[3],
-	}, nil
+	cf := &ContainerFile{}
+	for i, dst := range []*string{&cf.Container, &cf.Bucket, &cf.SubBucket, &cf.TableName} {
+		v, err := unescapeComponent(comps[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse container file key '%s': %w", b, err)
+		}
+		*dst = v
+	}
+	return cf, nil
 }
 
-// ShardIndex compute the shard index for a container file
+// ShardIndex compute the shard index for a container file with HashRouter
 func (cf ContainerFile) ShardIndex(shardCount uint32) uint32 {
 	return hash(cf.Container+":"+cf.Bucket) % shardCount
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -35,3 +37,41 @@ func TestActiveParser(t *testing.T) {
 		t.Fatalf("not equals: %+v -> %+v", cf, nCf)
 	}
 }
+
+func TestEscapedNames(t *testing.T) {
+	conf := InitDefaultTestConfig()
+	cfs := []ContainerFile{
+		NewContainerFileWTableName("", "b_0", "s:b", "table"),
+		NewContainerFileWTableName("default", "b%41", "", "t_1"),
+		NewContainerFileWTableName("a/b", "..", "\n", "table"),
+		NewContainerFileWTableName("c", "bucket", "sb", "table"),
+	}
+	for _, cf := range cfs {
+		if err := cf.Validate(); err != nil {
+			t.Fatalf("%+v: %v", cf, err)
+		}
+		if _, filename := cf.PrefixAndFilename(); strings.Count(filename, "_") != 2 || strings.ContainsAny(filename, ":/") {
+			t.Fatalf("%+v: bad file name %s", cf, filename)
+		}
+		parsers := map[string]func(string) (*ContainerFile, error){
+			cf.ArchivePath(conf.ArchiveFolder, 1, 2, 3): ParseContainerFileFromArchivePath,
+			cf.PathToFile(*conf):                        ParseContainerFileFromActivePath,
+			cf.Key():                                    ParseContainerFileKey,
+		}
+		for p, parse := range parsers {
+			nCf, err := parse(p)
+			if err != nil {
+				t.Fatalf("could not parse %s: %v", p, err)
+			}
+			if *nCf != cf {
+				t.Fatalf("not equals: %+v -> %s -> %+v", cf, p, nCf)
+			}
+		}
+	}
+	if NewContainerFileWTableName("", "b", "sb", "t").PathToFile(*conf) != "data-test/active/default/b/b_sb_t" {
+		t.Fatalf("names without special characters should not change")
+	}
+	if _, err := NewContainerFile("c", "", "sb", "t"); !errors.Is(err, ErrInvalidContainerFile) {
+		t.Fatalf("empty bucket should be invalid: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Layout folders of the container files between their container folder and their file in the active
+// and archive folders. Changing the layout of a database needs waldb relayout.
+type Layout interface {
+	// Folders slash separated folders of the container file, Depth of them
+	Folders(cf ContainerFile) string
+	// Depth count of folders of each container file
+	Depth() int
+	// String spec of the layout, parsed by ParseLayout
+	String() string
+}
+
+// DefaultLayout layout when Config.Layout is nil
+var DefaultLayout Layout = PrefixLayout{Length: digitsPrefix}
+
+// PrefixLayout one folder with the first characters of the escaped bucket. Spec: prefix:<length>.
+type PrefixLayout struct {
+	Length int
+}
+
+// Folders prefix of the bucket
+func (l PrefixLayout) Folders(cf ContainerFile) string {
+	bucket := escapeComponent(cf.Bucket)
+	if len(bucket) > l.Length {
+		return bucket[0:l.Length]
+	}
+	return bucket
+}
+
+// Depth one folder
+func (l PrefixLayout) Depth() int {
+	return 1
+}
+
+func (l PrefixLayout) String() string {
+	return fmt.Sprintf("prefix:%d", l.Length)
+}
+
+// HashedLayout Levels folders of Width hex digits of the hash of the bucket, so short or sequential
+// buckets are spread evenly. The files of a bucket stay in the same folder. Spec: hashed:<levels>x<width>.
+type HashedLayout struct {
+	Levels int
+	Width  int
+}
+
+// Folders hex digits of the hash of the bucket
+func (l HashedLayout) Folders(cf ContainerFile) string {
+	h := fnv.New64a()
+	h.Write([]byte(cf.Bucket))
+	digits := fmt.Sprintf("%016x", h.Sum64())
+	folders := make([]string, l.Levels)
+	for i := range folders {
+		folders[i] = digits[i*l.Width : (i+1)*l.Width]
+	}
+	return path.Join(folders...)
+}
+
+// Depth Levels folders
+func (l HashedLayout) Depth() int {
+	return l.Levels
+}
+
+func (l HashedLayout) String() string {
+	return fmt.Sprintf("hashed:%dx%d", l.Levels, l.Width)
+}
+
+// ParseLayout parse the spec of a layout: prefix:<length> or hashed:<levels>x<width>
+func ParseLayout(spec string) (Layout, error) {
+	kind, args := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "prefix":
+		length, err := strconv.Atoi(args)
+		if err != nil || length < 1 {
+			return nil, fmt.Errorf("bad prefix layout '%s': expected prefix:<length>", spec)
+		}
+		return PrefixLayout{Length: length}, nil
+	case "hashed":
+		comps := strings.Split(args, "x")
+		if len(comps) == 2 {
+			levels, errLevels := strconv.Atoi(comps[0])
+			width, errWidth := strconv.Atoi(comps[1])
+			if errLevels == nil && errWidth == nil && levels >= 1 && width >= 1 && levels*width <= 16 {
+				return HashedLayout{Levels: levels, Width: width}, nil
+			}
+		}
+		return nil, fmt.Errorf("bad hashed layout '%s': expected hashed:<levels>x<width> with at most 16 digits", spec)
+	}
+	return nil, fmt.Errorf("unknown layout '%s'", spec)
+}
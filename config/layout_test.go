@@ -0,0 +1,84 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLayouts(t *testing.T) {
+	for _, spec := range []string{"prefix:4", "prefix:1", "hashed:1x2", "hashed:3x2", "hashed:2x8"} {
+		l, err := ParseLayout(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if l.String() != spec {
+			t.Fatalf("%s: bad spec %s", spec, l.String())
+		}
+		for _, cf := range []ContainerFile{NewContainerFileWTableName("", "b_0", "sb", "t"), NewContainerFileWTableName("c", "1", "sb", "t")} {
+			p := cf.PathInLayout(l, "active")
+			if strings.Count(p, "/") != 2+l.Depth() {
+				t.Fatalf("%s: bad depth of %s", spec, p)
+			}
+			nCf, err := ParseActivePathInLayout(l, p)
+			if err != nil || *nCf != cf {
+				t.Fatalf("%s: %s parsed as %+v: %v", spec, p, nCf, err)
+			}
+			p = cf.ArchivePathInLayout(l, "archive", 1, 2, 3)
+			nCf, err = ParseArchivePathInLayout(l, p)
+			if err != nil || *nCf != cf {
+				t.Fatalf("%s: %s parsed as %+v: %v", spec, p, nCf, err)
+			}
+		}
+	}
+	for _, spec := range []string{"", "prefix", "prefix:0", "hashed:3", "hashed:3x6", "flat"} {
+		if _, err := ParseLayout(spec); err == nil {
+			t.Fatalf("%s should be invalid", spec)
+		}
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	conf := InitDefaultTestConfig()
+	os.RemoveAll("data-test")
+	defer os.RemoveAll("data-test")
+
+	to := HashedLayout{Levels: 2, Width: 2}
+	cfs := []ContainerFile{NewContainerFileWTableName("", "b0", "sb", "t"), NewContainerFileWTableName("c", "bucket1", "sb", "t")}
+	paths := []string{
+		cfs[0].PathToFile(*conf),
+		cfs[1].PathToFile(*conf),
+		cfs[0].ArchivePath(conf.ArchiveFolder, 0, 1, 2),
+		// already moved
+		cfs[1].ArchivePathInLayout(to, conf.ArchiveFolder, 0, 1, 3),
+		// in neither layout
+		path.Join(conf.ArchiveFolder, "unknown"),
+		// replicated
+		cfs[0].PathInLayout(DefaultLayout, conf.ReplicationActiveFolder),
+	}
+	for _, p := range paths {
+		os.MkdirAll(path.Dir(p), 0744)
+		if err := ioutil.WriteFile(p, []byte{1}, 0744); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	res, err := Relayout(*conf, DefaultLayout, to)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(res.Renamed) != 4 || len(res.Unresolved) != 1 {
+		t.Fatalf("bad relayout %+v", res)
+	}
+	conf.Layout = to.String()
+	for _, p := range []string{cfs[0].PathToFile(*conf), cfs[1].PathToFile(*conf), cfs[0].ArchivePathInLayout(to, conf.ArchiveFolder, 0, 1, 2), cfs[0].PathInLayout(to, conf.ReplicationActiveFolder)} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s should exist: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(conf.ActiveFolder, "default", "b0")); !os.IsNotExist(err) {
+		t.Fatalf("empty folders of the previous layout should be removed: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/chamot1111/waldb/crypt"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefix of the environment variables overriding the config, for example WALDB_SHARD_COUNT
+// overrides ShardCount
+const envPrefix = "WALDB_"
+
+// Load init config with default parameters, the file at p if not empty then the WALDB_* environment
+// variables. The format of the file depends on its extension: .json, .toml, .yaml or .yml. The keys of
+// the TOML and YAML files are the field names or their snake case, with scalar values only. The keys of EncryptionKeyFile are
+// loaded in KeyProvider. The loaded config is returned with the *ValidationError of Validate if it is invalid.
+func Load(p string) (*Config, error) {
+	c := InitDefaultConfig()
+	if p != "" {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(path.Ext(p)) {
+		case ".json":
+			dec := json.NewDecoder(bytes.NewReader(content))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(c); err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+		case ".toml":
+			values := make(map[string]interface{})
+			if _, err = toml.Decode(string(content), &values); err == nil {
+				err = setFields(c, values)
+			}
+		case ".yaml", ".yml":
+			values := make(map[string]interface{})
+			if err = yaml.Unmarshal(content, &values); err == nil {
+				err = setFields(c, values)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown config format %s", p, path.Ext(p))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	if err := applyEnv(c); err != nil {
+		return nil, err
+	}
+	if c.EncryptionKeyFile != "" {
+		keys, err := crypt.LoadKeyFile(c.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("EncryptionKeyFile: %w", err)
+		}
+		c.KeyProvider = keys
+	}
+	return c, c.Validate()
+}
+
+// loadableFields fields of the config set by Load, by normalized name
+func loadableFields(c *Config) map[string]reflect.Value {
+	res := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("json") == "-" {
+			continue
+		}
+		res[normalizeKey(f.Name)] = v.Field(i)
+	}
+	return res
+}
+
+func normalizeKey(k string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(k))
+}
+
+// snakeCase ShardCount -> SHARD_COUNT, MaxWALFileSize -> MAX_WAL_FILE_SIZE
+func snakeCase(name string) string {
+	r := []rune(name)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && (!unicode.IsUpper(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+func setField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int:
+		v, err := strconv.Atoi(strings.Replace(s, "_", "", -1))
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(v))
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(v)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// applyEnv override the fields with the WALDB_<SNAKE_CASE_NAME> environment variables
+func applyEnv(c *Config) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("json") == "-" {
+			continue
+		}
+		name := envPrefix + snakeCase(f.Name)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setFields set the fields from the keys of a decoded TOML or YAML file. Only the scalar values are
+// supported.
+func setFields(c *Config, values map[string]interface{}) error {
+	fields := loadableFields(c)
+	seen := make(map[string]string)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f, ok := fields[normalizeKey(key)]
+		if !ok {
+			return fmt.Errorf("unknown key %s", key)
+		}
+		if other, dup := seen[normalizeKey(key)]; dup {
+			return fmt.Errorf("keys %s and %s set the same field", other, key)
+		}
+		seen[normalizeKey(key)] = key
+		if err := setFieldValue(f, values[key]); err != nil {
+			return fmt.Errorf("key %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// setFieldValue set a field from a decoded scalar value of the same kind
+func setFieldValue(f reflect.Value, value interface{}) error {
+	v := reflect.ValueOf(value)
+	switch {
+	case f.Kind() == reflect.String && v.Kind() == reflect.String:
+		f.SetString(v.String())
+	case f.Kind() == reflect.Bool && v.Kind() == reflect.Bool:
+		f.SetBool(v.Bool())
+	case f.Kind() == reflect.Int && (v.Kind() == reflect.Int || v.Kind() == reflect.Int64):
+		if f.OverflowInt(v.Int()) {
+			return fmt.Errorf("%d overflows %s", v.Int(), f.Type())
+		}
+		f.SetInt(v.Int())
+	default:
+		return fmt.Errorf("expected a %s, got %v", f.Type(), value)
+	}
+	return nil
+}
+
+// ValidationError problems of an invalid config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+var sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+var sqliteSynchronousModes = []string{"OFF", "NORMAL", "FULL", "EXTRA", "0", "1", "2", "3"}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate return a *ValidationError with all the problems of the config, nil if it is valid
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.ShardCount < 1 {
+		addf("ShardCount must be at least 1, got %d", c.ShardCount)
+	}
+	if c.MaxFileOpen < 1 {
+		addf("MaxFileOpen must be at least 1, got %d", c.MaxFileOpen)
+	}
+	if c.MaxWALFileSize < 1 {
+		addf("MaxWALFileSize must be at least 1, got %d", c.MaxWALFileSize)
+	}
+	if c.MaxWALFileDurationS < 1 {
+		addf("MaxWALFileDurationS must be at least 1, got %d", c.MaxWALFileDurationS)
+	}
+	if c.WALGroupCommitWindowMs < 0 {
+		addf("WALGroupCommitWindowMs must not be negative, got %d", c.WALGroupCommitWindowMs)
+	}
+	if c.WalArchiveRetentionS < 0 {
+		addf("WalArchiveRetentionS must not be negative, got %d", c.WalArchiveRetentionS)
+	}
+	switch c.WALDurability {
+	case "", WALDurabilityCheckpoint, WALDurabilitySync, WALDurabilityGroupCommit:
+	default:
+		addf("WALDurability must be %s, %s or %s, got %q", WALDurabilityCheckpoint, WALDurabilitySync, WALDurabilityGroupCommit, c.WALDurability)
+	}
+	switch c.WALCompression {
+	case "", WALCompressionNone, WALCompressionSnappy, WALCompressionFlate:
+	default:
+		addf("WALCompression must be %s, %s or %s, got %q", WALCompressionNone, WALCompressionSnappy, WALCompressionFlate, c.WALCompression)
+	}
+	if c.WALCompressionMinSize < 0 {
+		addf("WALCompressionMinSize must not be negative, got %d", c.WALCompressionMinSize)
+	}
+	// both are interpolated in sqlite pragmas
+	if !containsFold(sqliteJournalModes, c.SqliteArchiverJournalMode) {
+		addf("SqliteArchiverJournalMode must be one of %s, got %q", strings.Join(sqliteJournalModes, ", "), c.SqliteArchiverJournalMode)
+	}
+	if !containsFold(sqliteSynchronousModes, c.SqliteArchiverSynchronous) {
+		addf("SqliteArchiverSynchronous must be one of %s, got %q", strings.Join(sqliteSynchronousModes, ", "), c.SqliteArchiverSynchronous)
+	}
+
+	if c.EncryptionKeyFile != "" && c.KeyProvider == nil {
+		addf("EncryptionKeyFile %s is not loaded in KeyProvider, see Load", c.EncryptionKeyFile)
+	}
+
+	if c.Layout != "" {
+		if _, err := ParseLayout(c.Layout); err != nil {
+			addf("Layout: %s", err.Error())
+		}
+	}
+
+	if c.ActiveFolder == "" {
+		addf("ActiveFolder must not be empty")
+	}
+	if c.ArchiveFolder == "" && !c.DeleteInsteadOfArchiving {
+		addf("ArchiveFolder must not be empty")
+	}
+	if c.WALFolder == "" {
+		addf("WALFolder must not be empty")
+	}
+	folders := []struct {
+		name string
+		path string
+	}{
+		{"ActiveFolder", c.ActiveFolder},
+		{"ArchiveFolder", c.ArchiveFolder},
+		{"SqliteFolder", c.SqliteFolder},
+		{"ParquetFolder", c.ParquetFolder},
+		{"WalArchiveFolder", c.WalArchiveFolder},
+		{"ReplicationActiveFolder", c.ReplicationActiveFolder},
+		{"ReplicationArchiveFolder", c.ReplicationArchiveFolder},
+		{"DeadLetterFolder", c.DeadLetterFolder},
+		{"IndexFolder", c.IndexFolder},
+		{"ArchiveAcksFolder", c.ArchiveAcksFolder},
+	}
+	for i, f := range folders {
+		if f.path == "" {
+			continue
+		}
+		for _, other := range folders[i+1:] {
+			if other.path != "" && path.Clean(f.path) == path.Clean(other.path) {
+				addf("%s and %s must be different folders, both are %s", f.name, other.name, f.path)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"c.json": `{"ShardCount": 2, "ActiveFolder": "a", "DisableResumeArchiving": true}`,
+		"c.toml": "# waldb\nshard_count = 2\nActiveFolder = \"a\" # comment\ndisable_resume_archiving = true\n",
+		"c.yaml": "---\nshard_count: 2\nactive_folder: 'a'\nDisableResumeArchiving: true\n",
+	}
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		conf, err := Load(p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if conf.ShardCount != 2 || conf.ActiveFolder != "a" || !conf.DisableResumeArchiving || conf.MaxFileOpen != InitDefaultConfig().MaxFileOpen {
+			t.Fatalf("%s: bad config %+v", name, conf)
+		}
+	}
+
+	p := path.Join(dir, "bad.toml")
+	ioutil.WriteFile(p, []byte("shard_cnt = 2\n"), 0644)
+	if _, err := Load(p); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("unknown key should fail: %v", err)
+	}
+
+	// values the real parsers read, and the non scalar ones
+	p = path.Join(dir, "quoted.yaml")
+	ioutil.WriteFile(p, []byte("active_folder: \"a: #b\"\nwal_folder: >-\n  w\n"), 0644)
+	if conf, err := Load(p); err != nil || conf.ActiveFolder != "a: #b" || conf.WALFolder != "w" {
+		t.Fatalf("quoted yaml values: %+v %v", conf, err)
+	}
+	invalids := map[string]string{
+		"table.toml":  "[wal]\nshard_count = 2\n",
+		"type.toml":   "shard_count = \"2\"\n",
+		"list.yaml":   "active_folder: [a, b]\n",
+		"syntax.toml": "shard_count = = 2\n",
+	}
+	for name, content := range invalids {
+		p := path.Join(dir, name)
+		ioutil.WriteFile(p, []byte(content), 0644)
+		if _, err := Load(p); err == nil {
+			t.Fatalf("%s should fail", name)
+		}
+	}
+
+	os.Setenv("WALDB_SHARD_COUNT", "6")
+	os.Setenv("WALDB_MAX_WAL_FILE_SIZE", "1000")
+	defer os.Unsetenv("WALDB_SHARD_COUNT")
+	defer os.Unsetenv("WALDB_MAX_WAL_FILE_SIZE")
+	conf, err := Load(path.Join(dir, "c.yaml"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if conf.ShardCount != 6 || conf.MaxWALFileSize != 1000 {
+		t.Fatalf("environment should override the file: %+v", conf)
+	}
+	os.Setenv("WALDB_SHARD_COUNT", "six")
+	if _, err := Load(""); err == nil {
+		t.Fatalf("bad environment value should fail")
+	}
+	os.Unsetenv("WALDB_SHARD_COUNT")
+	// the loaded config is validated
+	os.Setenv("WALDB_SQLITE_ARCHIVER_JOURNAL_MODE", "WAL; DROP TABLE x")
+	if _, err := Load(""); err == nil {
+		t.Fatalf("an invalid config should fail")
+	} else if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("an invalid config should return the problems: %v", err)
+	}
+	os.Unsetenv("WALDB_SQLITE_ARCHIVER_JOURNAL_MODE")
+
+	keyFile := path.Join(dir, "keys")
+	ioutil.WriteFile(keyFile, []byte("1 000102030405060708090a0b0c0d0e0f\n"), 0600)
+	os.Setenv("WALDB_ENCRYPTION_KEY_FILE", keyFile)
+	defer os.Unsetenv("WALDB_ENCRYPTION_KEY_FILE")
+	conf, err = Load("")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if id, _, err := conf.KeyProvider.CurrentKey(); err != nil || id != 1 {
+		t.Fatalf("the key file should be loaded: %d %v", id, err)
+	}
+	os.Setenv("WALDB_ENCRYPTION_KEY_FILE", path.Join(dir, "missing"))
+	if _, err := Load(""); err == nil {
+		t.Fatalf("missing key file should fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := InitDefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config should be valid: %v", err)
+	}
+	if err := InitDefaultTestConfig().Validate(); err != nil {
+		t.Fatalf("default test config should be valid: %v", err)
+	}
+
+	conf := InitDefaultTestConfig()
+	conf.ShardCount = 0
+	conf.MaxFileOpen = 0
+	conf.ReplicationActiveFolder = conf.ActiveFolder + "/"
+	conf.SqliteArchiverJournalMode = "WAL; DROP TABLE x"
+	conf.WALCompression = "zip"
+	err := conf.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 5 {
+		t.Fatalf("should return all the problems: %v", err)
+	}
+}
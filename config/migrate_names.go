@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/chamot1111/waldb/storage"
+)
+
+// RenamedFile file renamed by MigrateContainerFileNames
+type RenamedFile struct {
+	From string
+	To   string
+}
+
+// NameMigration result of MigrateContainerFileNames
+type NameMigration struct {
+	Renamed []RenamedFile
+	// Unresolved files whose legacy name does not give a single container file: they are left as is
+	Unresolved []string
+}
+
+// legacyPrefixAndFilename unescaped layout of the container files before the escaping
+func legacyPrefixAndFilename(cf ContainerFile) (prefix string, filename string) {
+	prefix = cf.Bucket
+	if len(cf.Bucket) > digitsPrefix {
+		prefix = cf.Bucket[0:digitsPrefix]
+	}
+	filename = cf.Bucket + "_" + cf.SubBucket + "_" + cf.TableName
+	return
+}
+
+// legacyCandidates container files whose legacy path relative to its folder is rel. A file name with
+// more than two '_' has several splits: only the ones whose legacy path is rel and whose table is one
+// of tables, if not empty, are kept.
+func legacyCandidates(rel string, filename string, tables []string) []ContainerFile {
+	separators := make([]int, 0, 2)
+	for i := 0; i < len(filename); i++ {
+		if filename[i] == '_' {
+			separators = append(separators, i)
+		}
+	}
+	res := make([]ContainerFile, 0, 1)
+	for si, i := range separators {
+		for _, j := range separators[si+1:] {
+			cf := ContainerFile{Bucket: filename[:i], SubBucket: filename[i+1 : j], TableName: filename[j+1:]}
+			if len(tables) > 0 && !containsString(tables, cf.TableName) {
+				continue
+			}
+			// the legacy container folder is everything before the prefix folder, even with '/'
+			prefix, _ := legacyPrefixAndFilename(cf)
+			dir := path.Dir(rel)
+			container := strings.TrimSuffix(dir, "/"+prefix)
+			if prefix == "" || container == dir {
+				continue
+			}
+			if container != emptyContainerReplacement {
+				cf.Container = container
+			}
+			res = append(res, cf)
+		}
+	}
+	return res
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// splitWalInfo split an archived file name into its file name and its ":shard:wal:op" suffix
+func splitWalInfo(name string) (string, [3]int, bool) {
+	var info [3]int
+	for k := 2; k >= 0; k-- {
+		i := strings.LastIndexByte(name, ':')
+		if i < 0 {
+			return "", info, false
+		}
+		v, err := strconv.Atoi(name[i+1:])
+		if err != nil {
+			return "", info, false
+		}
+		info[k] = v
+		name = name[:i]
+	}
+	return name, info, true
+}
+
+// migrateFolder rename the files of folder with a legacy name. A file whose name round trips with the
+// escaped layout is already migrated.
+func migrateFolder(store storage.Storage, layout Layout, folder string, archive bool, tables []string, res *NameMigration) error {
+	paths, err := store.List(folder)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if archive {
+			if cf, err := ParseArchivePathInLayout(layout, p); err == nil {
+				if _, info, ok := splitWalInfo(path.Base(p)); ok && cf.ArchivePathInLayout(layout, folder, info[0], info[1], info[2]) == p {
+					continue
+				}
+			}
+		} else if cf, err := ParseActivePathInLayout(layout, p); err == nil && cf.PathInLayout(layout, folder) == p {
+			continue
+		}
+
+		rel := strings.TrimPrefix(p, strings.TrimSuffix(folder, "/")+"/")
+		filename := path.Base(rel)
+		var info [3]int
+		if archive {
+			var ok bool
+			if filename, info, ok = splitWalInfo(filename); !ok {
+				res.Unresolved = append(res.Unresolved, p)
+				continue
+			}
+		}
+		candidates := legacyCandidates(rel, filename, tables)
+		if len(candidates) != 1 {
+			res.Unresolved = append(res.Unresolved, p)
+			continue
+		}
+		cf := candidates[0]
+		newPath := cf.PathInLayout(layout, folder)
+		if archive {
+			newPath = cf.ArchivePathInLayout(layout, folder, info[0], info[1], info[2])
+		}
+		if newPath == p {
+			continue
+		}
+		if _, err := store.Stat(newPath); err == nil {
+			return fmt.Errorf("could not rename %s: %s already exists", p, newPath)
+		}
+		if err := store.Rename(p, newPath); err != nil {
+			return err
+		}
+		res.Renamed = append(res.Renamed, RenamedFile{From: p, To: newPath})
+	}
+	return nil
+}
+
+// MigrateContainerFileNames rename the files of a stopped database named before the escaping of the
+// container file components: the active and archive folders, the replication folders and the
+// acknowledgements of ArchiveAcksFolder. The legacy names have the default layout, they are renamed in the
+// layout of the config. A legacy name with more than two '_' is resolved with the
+// table names and the prefix folder; the files it does not resolve are reported in Unresolved.
+// The keys of the wal files are unchanged when the components have no ':' or '%'.
+func MigrateContainerFileNames(conf Config, tables []string) (*NameMigration, error) {
+	res := &NameMigration{}
+	folders := []struct {
+		store   storage.Storage
+		layout  Layout
+		folder  string
+		archive bool
+	}{
+		{conf.GetStorage(), conf.GetLayout(), conf.ActiveFolder, false},
+		{conf.GetStorage(), conf.GetLayout(), conf.ArchiveFolder, true},
+		{conf.GetStorage(), conf.GetLayout(), conf.ReplicationActiveFolder, false},
+		{conf.GetStorage(), conf.GetLayout(), conf.ReplicationArchiveFolder, true},
+	}
+	for _, f := range folders {
+		if f.folder == "" {
+			continue
+		}
+		before := len(res.Renamed)
+		if err := migrateFolder(f.store, f.layout, f.folder, f.archive, tables, res); err != nil {
+			return res, err
+		}
+		if !f.archive || f.folder != conf.ArchiveFolder || conf.ArchiveAcksFolder == "" {
+			continue
+		}
+		for _, r := range res.Renamed[before:] {
+			from := path.Join(conf.ArchiveAcksFolder, path.Base(r.From)+".json")
+			err := os.Rename(from, path.Join(conf.ArchiveAcksFolder, path.Base(r.To)+".json"))
+			if err != nil && !os.IsNotExist(err) {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
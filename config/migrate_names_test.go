@@ -0,0 +1,59 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMigrateContainerFileNames(t *testing.T) {
+	conf := InitDefaultTestConfig()
+	os.RemoveAll("data-test")
+	defer os.RemoveAll("data-test")
+
+	legacy := []string{
+		// unchanged
+		"active/default/b0/b0_sb_t",
+		// bucket with '_', resolved by the prefix folder
+		"active/c/a_bc/a_bcd_sb_t",
+		// resolved by the table name
+		"archive/default/b1/b1_sb_t_x:0:1:2",
+		// not a container file name
+		"archive/default/b2/b2_t:0:1:3",
+	}
+	for _, p := range legacy {
+		p = path.Join("data-test", p)
+		os.MkdirAll(path.Dir(p), 0744)
+		if err := ioutil.WriteFile(p, []byte{1}, 0744); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	os.MkdirAll(conf.ArchiveAcksFolder, 0744)
+	ioutil.WriteFile(path.Join(conf.ArchiveAcksFolder, "b1_sb_t_x:0:1:2.json"), []byte("{}"), 0744)
+
+	res, err := MigrateContainerFileNames(*conf, []string{"t", "t_x"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(res.Renamed) != 2 || len(res.Unresolved) != 1 {
+		t.Fatalf("bad migration %+v", res)
+	}
+	expected := []string{
+		NewContainerFileWTableName("c", "a_bcd", "sb", "t").PathToFile(*conf),
+		NewContainerFileWTableName("", "b1", "sb", "t_x").ArchivePath(conf.ArchiveFolder, 0, 1, 2),
+		path.Join(conf.ArchiveAcksFolder, "b1_sb_t%5Fx:0:1:2.json"),
+		NewContainerFileWTableName("", "b0", "sb", "t").PathToFile(*conf),
+		path.Join(conf.ArchiveFolder, "default/b2/b2_t:0:1:3"),
+	}
+	for _, p := range expected {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s should exist: %v", p, err)
+		}
+	}
+
+	res, err = MigrateContainerFileNames(*conf, []string{"t", "t_x"})
+	if err != nil || len(res.Renamed) != 0 {
+		t.Fatalf("migration should be idempotent: %+v %v", res, err)
+	}
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/chamot1111/waldb/storage"
+)
+
+// relayoutFolder move the files of folder from the layout from to the layout to. The files already in
+// the layout to are kept.
+func relayoutFolder(store storage.Storage, folder string, archive bool, from, to Layout, res *NameMigration) error {
+	paths, err := store.List(folder)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		var newPath string
+		if archive {
+			_, info, ok := splitWalInfo(path.Base(p))
+			cf, err := ParseArchivePathInLayout(from, p)
+			if !ok || err != nil || cf.ArchivePathInLayout(from, folder, info[0], info[1], info[2]) != p {
+				if cf, err := ParseArchivePathInLayout(to, p); !ok || err != nil || cf.ArchivePathInLayout(to, folder, info[0], info[1], info[2]) != p {
+					res.Unresolved = append(res.Unresolved, p)
+				}
+				continue
+			}
+			newPath = cf.ArchivePathInLayout(to, folder, info[0], info[1], info[2])
+		} else {
+			cf, err := ParseActivePathInLayout(from, p)
+			if err != nil || cf.PathInLayout(from, folder) != p {
+				if cf, err := ParseActivePathInLayout(to, p); err != nil || cf.PathInLayout(to, folder) != p {
+					res.Unresolved = append(res.Unresolved, p)
+				}
+				continue
+			}
+			newPath = cf.PathInLayout(to, folder)
+		}
+		if newPath == p {
+			continue
+		}
+		if _, err := store.Stat(newPath); err == nil {
+			return fmt.Errorf("could not move %s: %s already exists", p, newPath)
+		}
+		if err := store.Rename(p, newPath); err != nil {
+			return err
+		}
+		res.Renamed = append(res.Renamed, RenamedFile{From: p, To: newPath})
+	}
+	return nil
+}
+
+// removeEmptyFolders remove the folders left empty under folder on the local disk
+func removeEmptyFolders(folder string) {
+	dirs := make([]string, 0)
+	filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && p != folder {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	// the deepest first
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, d := range dirs {
+		os.Remove(d)
+	}
+}
+
+// Relayout move the active and archived files and the replicated files of a stopped database from the layout from to the layout
+// to. Layout must then be set to the spec of to in the config. The files in neither layout are reported in
+// Unresolved. The names of the files are unchanged: the wal keys and the acknowledgements of the archived
+// files stay valid.
+func Relayout(conf Config, from, to Layout) (*NameMigration, error) {
+	res := &NameMigration{}
+	store := conf.GetStorage()
+	folders := []struct {
+		folder  string
+		archive bool
+	}{
+		{conf.ActiveFolder, false},
+		{conf.ArchiveFolder, true},
+		{conf.ReplicationActiveFolder, false},
+		{conf.ReplicationArchiveFolder, true},
+	}
+	for _, f := range folders {
+		if f.folder == "" {
+			continue
+		}
+		if err := relayoutFolder(store, f.folder, f.archive, from, to, res); err != nil {
+			return res, err
+		}
+		if _, local := store.(storage.Local); local {
+			removeEmptyFolders(f.folder)
+		}
+	}
+	return res, nil
+}
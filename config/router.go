@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Router shard of the container files. All the files of a bucket must be routed to the same shard.
+// Changing the router of a database is like changing its shard count: it must be stopped and
+// checkpointed, see waldb reshard.
+type Router interface {
+	ShardIndex(cf ContainerFile, shardCount uint32) uint32
+}
+
+// HashRouter fnv32a of the container and the bucket modulo the shard count, the router when
+// Config.Router is nil
+type HashRouter struct{}
+
+// ShardIndex hash of the container and the bucket
+func (HashRouter) ShardIndex(cf ContainerFile, shardCount uint32) uint32 {
+	return cf.ShardIndex(shardCount)
+}
+
+// ringHash fnv32a mixed by the murmur3 finalizer: fnv32a alone clusters the short labels of the points
+func ringHash(s string) uint32 {
+	h := hash(s)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+type ringPoint struct {
+	hash       uint32
+	shardIndex uint32
+}
+
+// ConsistentHashRouter ring of VirtualNodes points by shard: adding a shard only moves the buckets
+// taken by its points
+type ConsistentHashRouter struct {
+	VirtualNodes int
+
+	mu    sync.Mutex
+	rings map[uint32][]ringPoint
+}
+
+// NewConsistentHashRouter init a consistent hash router
+func NewConsistentHashRouter(virtualNodes int) *ConsistentHashRouter {
+	return &ConsistentHashRouter{VirtualNodes: virtualNodes, rings: map[uint32][]ringPoint{}}
+}
+
+func (r *ConsistentHashRouter) ring(shardCount uint32) []ringPoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ring, exists := r.rings[shardCount]; exists {
+		return ring
+	}
+	virtualNodes := r.VirtualNodes
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	ring := make([]ringPoint, 0, int(shardCount)*virtualNodes)
+	for si := uint32(0); si < shardCount; si++ {
+		for v := 0; v < virtualNodes; v++ {
+			ring = append(ring, ringPoint{hash: ringHash(fmt.Sprintf("%d-%d", si, v)), shardIndex: si})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	if r.rings == nil {
+		r.rings = map[uint32][]ringPoint{}
+	}
+	r.rings[shardCount] = ring
+	return ring
+}
+
+// ShardIndex shard of the first point of the ring after the hash of the container and the bucket
+func (r *ConsistentHashRouter) ShardIndex(cf ContainerFile, shardCount uint32) uint32 {
+	ring := r.ring(shardCount)
+	h := ringHash(cf.Container + ":" + cf.Bucket)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].shardIndex
+}
+
+// BucketKey bucket of a container
+type BucketKey struct {
+	Container string
+	Bucket    string
+}
+
+// MappingRouter explicit shards of buckets or containers, for example to isolate a skewed tenant.
+// The others, and the mapped shards out of the shard count, are routed by Fallback, HashRouter if nil.
+type MappingRouter struct {
+	Buckets    map[BucketKey]uint32
+	Containers map[string]uint32
+	Fallback   Router
+}
+
+// ShardIndex mapped shard of the bucket, else of the container, else the fallback shard
+func (r MappingRouter) ShardIndex(cf ContainerFile, shardCount uint32) uint32 {
+	if si, exists := r.Buckets[BucketKey{Container: cf.Container, Bucket: cf.Bucket}]; exists && si < shardCount {
+		return si
+	}
+	if si, exists := r.Containers[cf.Container]; exists && si < shardCount {
+		return si
+	}
+	if r.Fallback != nil {
+		return r.Fallback.ShardIndex(cf, shardCount)
+	}
+	return cf.ShardIndex(shardCount)
+}
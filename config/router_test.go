@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRouters(t *testing.T) {
+	cfs := make([]ContainerFile, 1000)
+	for i := range cfs {
+		cfs[i] = NewContainerFileWTableName("c", fmt.Sprintf("b%d", i), "sb", "t")
+	}
+
+	r := NewConsistentHashRouter(64)
+	counts := make([]int, 8)
+	moved := 0
+	for _, cf := range cfs {
+		si := r.ShardIndex(cf, 8)
+		counts[si]++
+		if other := NewContainerFileWTableName("c", cf.Bucket, "other", "t2"); r.ShardIndex(other, 8) != si {
+			t.Fatalf("the files of a bucket should be in the same shard")
+		}
+		if nsi := r.ShardIndex(cf, 9); nsi != si {
+			if nsi != 8 {
+				t.Fatalf("adding a shard should only move buckets to it: %d -> %d", si, nsi)
+			}
+			moved++
+		}
+	}
+	for si, c := range counts {
+		if c < 50 {
+			t.Fatalf("shard %d is underloaded: %v", si, counts)
+		}
+	}
+	if moved == 0 || moved > 250 {
+		t.Fatalf("adding a shard moved %d buckets of %d", moved, len(cfs))
+	}
+
+	m := MappingRouter{
+		Buckets:    map[BucketKey]uint32{{Container: "c", Bucket: "b1"}: 7, {Container: "c", Bucket: "b2"}: 20},
+		Containers: map[string]uint32{"big": 3},
+	}
+	if si := m.ShardIndex(cfs[1], 8); si != 7 {
+		t.Fatalf("mapped bucket in shard %d", si)
+	}
+	if si := m.ShardIndex(NewContainerFileWTableName("big", "x", "sb", "t"), 8); si != 3 {
+		t.Fatalf("mapped container in shard %d", si)
+	}
+	if m.ShardIndex(cfs[2], 8) != cfs[2].ShardIndex(8) || m.ShardIndex(cfs[5], 8) != cfs[5].ShardIndex(8) {
+		t.Fatalf("the others should use the fallback router")
+	}
+}
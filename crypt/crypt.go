@@ -0,0 +1,195 @@
+// Package crypt provides the keys and the AES-GCM sealing of the files encrypted at rest.
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownKey the key provider has no key with this id
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// ErrDecrypt the sealed data has been altered or sealed with another key
+var ErrDecrypt = errors.New("could not decrypt: data altered or wrong key")
+
+// NonceSize size of the random nonce written before each sealed data
+const NonceSize = 12
+
+// Overhead bytes added by Seal to the plaintext
+const Overhead = NonceSize + 16
+
+// KeyProvider keys of the encryption at rest. The new files are encrypted with the current key and keep
+// its id in their header: a rotated key must stay available until the files encrypted with it are rewritten.
+type KeyProvider interface {
+	// CurrentKey id and AES key, of 16, 24 or 32 bytes, of the new files. The ids are not zero.
+	CurrentKey() (uint32, []byte, error)
+	// Key key of an id, an error wrapping ErrUnknownKey if unknown
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing keys by id, the highest id is the current key
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys map[uint32][]byte
+	cur  uint32
+}
+
+// NewKeyRing init an empty key ring
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[uint32][]byte{}}
+}
+
+// Add a key with its id. It becomes the current key if its id is the highest.
+func (r *KeyRing) Add(id uint32, key []byte) error {
+	if id == 0 {
+		return fmt.Errorf("key id must not be 0")
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("key %d: %w", id, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys == nil {
+		r.keys = map[uint32][]byte{}
+	}
+	if _, exists := r.keys[id]; exists {
+		return fmt.Errorf("key %d already exists", id)
+	}
+	r.keys[id] = append([]byte{}, key...)
+	if id > r.cur {
+		r.cur = id
+	}
+	return nil
+}
+
+// Rotate add a random 32 bytes key after the current one and return its id
+func (r *KeyRing) Rotate() (uint32, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return 0, nil, err
+	}
+	r.mu.RLock()
+	id := r.cur + 1
+	r.mu.RUnlock()
+	return id, key, r.Add(id, key)
+}
+
+// CurrentKey key with the highest id
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cur == 0 {
+		return 0, nil, fmt.Errorf("%w: the key ring is empty", ErrUnknownKey)
+	}
+	return r.cur, r.keys[r.cur], nil
+}
+
+// Key key of an id
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, exists := r.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// LoadKeyFile read a key file: one "<id> <hex key>" line per key, the lines starting with # are comments.
+// The highest id is the current key: a rotation appends a line.
+func LoadKeyFile(p string) (*KeyRing, error) {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	r := NewKeyRing()
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <id> <hex key>", p, lineNum)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key id: %w", p, lineNum, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad hex key: %w", p, lineNum, err)
+		}
+		if err := r.Add(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if r.cur == 0 {
+		return nil, fmt.Errorf("%s: no key", p)
+	}
+	return r, nil
+}
+
+// AppendKeyFile append a key line to a key file, created if missing
+func AppendKeyFile(p string, id uint32, key []byte) error {
+	file, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%d %s\n", id, hex.EncodeToString(key)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// NewAEAD AES-GCM of a key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal append to dst a random nonce and the encryption of plaintext authenticated with additionalData
+func Seal(aead cipher.AEAD, dst, plaintext, additionalData []byte) ([]byte, error) {
+	var nonce [NonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce[:]...)
+	return aead.Seal(dst, nonce[:], plaintext, additionalData), nil
+}
+
+// Open append to dst the plaintext of data sealed by Seal with the same additionalData
+func Open(aead cipher.AEAD, dst, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrDecrypt
+	}
+	res, err := aead.Open(dst, sealed[:NonceSize], sealed[NonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waldb-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "keys")
+
+	if err := ioutil.WriteFile(p, []byte("# keys\n1 000102030405060708090a0b0c0d0e0f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadKeyFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := r.CurrentKey()
+	if err != nil || id != 1 {
+		t.Fatalf("current key should be 1: %d %v", id, err)
+	}
+
+	id, key, err := r.Rotate()
+	if err != nil || id != 2 || len(key) != 32 {
+		t.Fatalf("rotation should add the key 2: %d %v", id, err)
+	}
+	if err := AppendKeyFile(p, id, key); err != nil {
+		t.Fatal(err)
+	}
+	r, err = LoadKeyFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, cur, _ := r.CurrentKey(); id != 2 || !bytes.Equal(cur, key) {
+		t.Fatalf("the rotated key should be current: %d", id)
+	}
+	if _, err := r.Key(1); err != nil {
+		t.Fatalf("the previous key should be kept: %v", err)
+	}
+	if _, err := r.Key(3); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("should get an unknown key error: %v", err)
+	}
+
+	for _, bad := range []string{"", "1 zz", "0 000102030405060708090a0b0c0d0e0f", "1 0001", "x 000102030405060708090a0b0c0d0e0f"} {
+		if err := ioutil.WriteFile(p, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeyFile(p); err == nil {
+			t.Fatalf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	aead, err := NewAEAD(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Seal(aead, nil, []byte("hello"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len("hello")+Overhead || bytes.Contains(sealed, []byte("hello")) {
+		t.Fatalf("bad sealed data")
+	}
+	plain, err := Open(aead, nil, sealed, []byte("ad"))
+	if err != nil || string(plain) != "hello" {
+		t.Fatalf("open failed: %q %v", plain, err)
+	}
+	if _, err := Open(aead, nil, sealed, []byte("other")); err != ErrDecrypt {
+		t.Fatalf("other additional data should fail: %v", err)
+	}
+	sealed[NonceSize] ^= 1
+	if _, err := Open(aead, nil, sealed, []byte("ad")); err != ErrDecrypt {
+		t.Fatalf("altered data should fail: %v", err)
+	}
+}
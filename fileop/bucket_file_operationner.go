@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"sync"
 
 	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
 	"github.com/chamot1111/waldb/wutils"
 	"go.uber.org/zap"
 )
@@ -17,7 +17,7 @@ import (
 const headerSize = 8
 
 type fileData struct {
-	file         *os.File
+	file         storage.File
 	key          string
 	touchElement *list.Element
 }
@@ -29,8 +29,9 @@ type fileBatchOpWithFile struct {
 
 // BucketFileOperationner will manage the concurrency to access files
 type BucketFileOperationner struct {
-	config config.Config
-	logger *zap.Logger
+	config  config.Config
+	logger  *zap.Logger
+	storage storage.Storage
 
 	fileDataMap map[string]*fileData
 	touchOrder  *list.List // values are fileData key
@@ -43,6 +44,7 @@ func InitBucketFileOperationner(c config.Config, logger *zap.Logger) (*BucketFil
 		touchOrder:  list.New(),
 		logger:      logger,
 		config:      c,
+		storage:     c.GetStorage(),
 	}
 
 	return res, nil
@@ -52,6 +54,7 @@ func (bfo *BucketFileOperationner) cleanFileData(fd *fileData) error {
 	f := fd.file
 	fd.file = nil
 	if f != nil {
+		openFilesMetric.Add(-1)
 		if err := f.Close(); err != nil {
 			return err
 		}
@@ -89,17 +92,16 @@ func (bfo *BucketFileOperationner) getFileDataAndTouch(cf config.ContainerFile,
 	fd, exists := bfo.fileDataMap[key]
 	if !exists {
 		path := cf.PathToFile(bfo.config)
-		folder := cf.BaseFolder(bfo.config)
 		if !intentWrite {
-			if _, err := os.Stat(path); os.IsNotExist(err) {
+			if _, err := bfo.storage.Stat(path); os.IsNotExist(err) {
 				return nil, nil
 			}
 		}
-		os.MkdirAll(folder, 0744)
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0744)
+		file, err := bfo.storage.OpenFile(path, true)
 		if err != nil {
 			return nil, fmt.Errorf("could not open file %s: %w", path, err)
 		}
+		openFilesMetric.Add(1)
 
 		e := bfo.touchOrder.PushFront(key)
 		fd = &fileData{
@@ -157,7 +159,13 @@ func (bfo *BucketFileOperationner) Archive(cf *config.ContainerFile, shardIndex,
 		return false, err
 	}
 
-	return ArchiveAtomicOp(fileData.file, cf.PathToFile(bfo.config), cf.ArchivePath(bfo.config.ArchiveFolder, shardIndex, walIndex, operationIndex), deleteActiveFile, false)
+	deletedFile, err = ArchiveAtomicOp(bfo.storage, fileData.file, cf.PathToFile(bfo.config), cf.ArchivePathInLayout(bfo.config.GetLayout(), bfo.config.ArchiveFolder, shardIndex, walIndex, operationIndex), deleteActiveFile, false)
+	if deletedFile {
+		fileData.file = nil
+		openFilesMetric.Add(-1)
+		bfo.removeFileData(fileData.key)
+	}
+	return deletedFile, err
 }
 
 // ApplyBatchOp execute the operations in one atomic operation
@@ -224,57 +232,147 @@ func (bfo *BucketFileOperationner) ApplyBatchOp(files []*FileBatchOp) ErrorFOPLi
 	return errors
 }
 
-// WriteAtomicOp write atomic op
-func WriteAtomicOp(buffer []byte, offset uint64, fileSize uint64, file *os.File) error {
+// WriteAtomicOp write atomic op. The data is synced before the size header is written so the
+// header never counts data not on the disk.
+func WriteAtomicOp(buffer []byte, offset uint64, fileSize uint64, file storage.File) error {
 	_, err := file.WriteAt(buffer, int64(offset+headerSize))
 	if err != nil {
 		return err
 	}
-	var fs [8]byte
-	binary.BigEndian.PutUint64(fs[:], fileSize+headerSize)
-	_, err = file.WriteAt(fs[:], 0)
-	return err
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return writeHeader(file, fileSize)
 }
 
-// TruncateAtomicOp truncate atomic op
-func TruncateAtomicOp(offset uint64, file *os.File) error {
-	if err := file.Truncate(int64(offset) + headerSize); err != nil {
+// TruncateAtomicOp truncate atomic op. The size header is written and synced before the truncation
+// so the header never points past the end of the file.
+func TruncateAtomicOp(offset uint64, file storage.File) error {
+	if err := writeHeader(file, offset); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
 		return err
 	}
+	return file.Truncate(int64(offset) + headerSize)
+}
+
+func writeHeader(file storage.File, dataSize uint64) error {
 	var fs [8]byte
-	binary.BigEndian.PutUint64(fs[:], offset+headerSize)
+	binary.BigEndian.PutUint64(fs[:], dataSize+headerSize)
 	_, err := file.WriteAt(fs[:], 0)
 	return err
 }
 
+// HeaderMismatch active file whose size header disagrees with its length
+type HeaderMismatch struct {
+	Path string
+	// Header data size written in the header
+	Header int64
+	// Length data size given by the length of the file
+	Length int64
+}
+
+// ReadHeader data sizes given by the size header and by the length of the file. An empty file has no header.
+func ReadHeader(file storage.File) (header int64, length int64, err error) {
+	size, err := file.Size()
+	if err != nil {
+		return 0, 0, err
+	}
+	if size == 0 {
+		return 0, 0, nil
+	}
+	if size < headerSize {
+		return -1, size - headerSize, nil
+	}
+	var fs [8]byte
+	if _, err := file.ReadAt(fs[:], 0); err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.BigEndian.Uint64(fs[:])) - headerSize, size - headerSize, nil
+}
+
+// VerifyHeaders check the size header of all the active files against their length
+func (bfo *BucketFileOperationner) VerifyHeaders() ([]HeaderMismatch, error) {
+	paths, err := bfo.storage.List(bfo.config.ActiveFolder)
+	if err != nil {
+		return nil, err
+	}
+	return bfo.VerifyHeadersOf(paths)
+}
+
+// VerifyHeadersOf check the size header of the active files of paths against their length. The
+// missing files are skipped.
+func (bfo *BucketFileOperationner) VerifyHeadersOf(paths []string) ([]HeaderMismatch, error) {
+	res := make([]HeaderMismatch, 0)
+	for _, p := range paths {
+		if _, err := bfo.storage.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		file, err := bfo.storage.OpenFile(p, false)
+		if err != nil {
+			return res, err
+		}
+		header, length, err := ReadHeader(file)
+		file.Close()
+		if err != nil {
+			return res, fmt.Errorf("could not read header of %s: %w", p, err)
+		}
+		if header != length {
+			res = append(res, HeaderMismatch{Path: p, Header: header, Length: length})
+		}
+	}
+	return res, nil
+}
+
+// RepairHeader make the header of an active file agree with its length without the wal: data past
+// the header has never been acknowledged and is truncated, a header pointing past the end of the
+// file is set to the length. The file must not be opened by bfo.
+func (bfo *BucketFileOperationner) RepairHeader(m HeaderMismatch) error {
+	file, err := bfo.storage.OpenFile(m.Path, false)
+	if err != nil {
+		return err
+	}
+	if m.Length < 0 {
+		err = TruncateAtomicOp(0, file)
+	} else if m.Header >= 0 && m.Header < m.Length {
+		err = TruncateAtomicOp(uint64(m.Header), file)
+	} else {
+		err = writeHeader(file, uint64(m.Length))
+		if err == nil {
+			err = file.Sync()
+		}
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 // ArchiveAtomicOp archive atomic op
-func ArchiveAtomicOp(file *os.File, activePath, archivePath string, deleteActiveFile, deleteInsteadOfArchiving bool) (isActiveFileDeeleted bool, err error) {
+func ArchiveAtomicOp(store storage.Storage, file storage.File, activePath, archivePath string, deleteActiveFile, deleteInsteadOfArchiving bool) (isActiveFileDeeleted bool, err error) {
 	destPath := archivePath
 	if !deleteInsteadOfArchiving {
-		if _, err := os.Stat(destPath); os.IsNotExist(err) {
+		if _, err := store.Stat(destPath); os.IsNotExist(err) {
 			destPathTmp := destPath + ".tmp"
-			if err := os.MkdirAll(path.Dir(destPathTmp), 0744); err != nil {
-				return false, err
-			}
-			destFileTmp, err := os.OpenFile(destPathTmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0744)
+			destFileTmp, err := store.OpenFile(destPathTmp, true)
 			if err != nil {
 				return false, fmt.Errorf("could not open file for archiving %s: %w", destPath, err)
 			}
-
-			_, err = file.Seek(0, 0)
-			if err != nil {
+			if err := destFileTmp.Truncate(0); err != nil {
+				destFileTmp.Close()
 				return false, err
 			}
-
-			_, err = io.Copy(destFileTmp, file)
-			if err != nil {
+			if err := storage.Copy(destFileTmp, file); err != nil {
+				destFileTmp.Close()
 				return false, err
 			}
 			err = destFileTmp.Close()
 			if err != nil {
 				return false, err
 			}
-			err = wutils.MoveFile(destPathTmp, destPath)
+			err = store.Rename(destPathTmp, destPath)
 			if err != nil {
 				return false, err
 			}
@@ -285,7 +383,7 @@ func ArchiveAtomicOp(file *os.File, activePath, archivePath string, deleteActive
 		if err := file.Close(); err != nil {
 			return false, err
 		}
-		if err := os.Remove(activePath); err != nil {
+		if err := store.Remove(activePath); err != nil {
 			return false, err
 		}
 		return true, err
@@ -298,57 +396,114 @@ func ArchiveAtomicOp(file *os.File, activePath, archivePath string, deleteActive
 func loopOpApplyer(config config.Config, jobQueue chan fileBatchOpWithFile, errorChan chan ErrorFOP, finishChan chan *fileData, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	store := config.GetStorage()
 	for job := range jobQueue {
-		for iCmd, cmd := range job.op.Ops {
-			switch cmd.OpKind {
-			case WriteOp:
-				cmd.Buffer.ResetRead()
-				err := WriteAtomicOp(cmd.Buffer.Bytes(), uint64(cmd.Offset), uint64(cmd.FileSize), job.fd.file)
-				if err != nil {
-					errorChan <- ErrorFOP{
-						Err:            fmt.Errorf("could not write to the file during loop: %w", err),
-						OperationIndex: int(cmd.OperationIndex),
-						Fbo:            job.op,
-					}
-					goto Next
-				}
-			case ArchiveOp:
-				fileDeleted, err := ArchiveAtomicOp(job.fd.file, cmd.ActiveFileName, cmd.ArchiveFileName, len(job.op.Ops)-1 == iCmd, cmd.ArchiveFileName == "")
-				if fileDeleted {
-					job.fd.file = nil
-				}
-				if err != nil {
-					errorChan <- ErrorFOP{
-						Err:            err,
-						OperationIndex: int(cmd.OperationIndex),
-						Fbo:            job.op,
-					}
-					goto Next
-				}
-			case TruncateOp:
-				err := TruncateAtomicOp(uint64(cmd.Offset), job.fd.file)
-				if err != nil {
-					errorChan <- ErrorFOP{
-						Err:            err,
-						OperationIndex: int(cmd.OperationIndex),
-						Fbo:            job.op,
-					}
-					goto Next
-				}
+		if errFop := applyFileOps(store, job); errFop != nil {
+			errorChan <- *errFop
+		}
+		finishChan <- job.fd
+	}
+}
+
+// applyFileOps apply the operations of a file. The writes and truncations between the archives are applied
+// together by writeOps. The file is synced once at the end.
+func applyFileOps(store storage.Storage, job fileBatchOpWithFile) *ErrorFOP {
+	ops := job.op.Ops
+	for start := 0; start < len(ops); {
+		if ops[start].OpKind == ArchiveOp {
+			cmd := ops[start]
+			fileDeleted, err := ArchiveAtomicOp(store, job.fd.file, cmd.ActiveFileName, cmd.ArchiveFileName, len(ops)-1 == start, cmd.ArchiveFileName == "")
+			if fileDeleted {
+				job.fd.file = nil
+				openFilesMetric.Add(-1)
 			}
+			if err != nil {
+				return &ErrorFOP{Err: err, OperationIndex: int(cmd.OperationIndex), Fbo: job.op}
+			}
+			start++
+			continue
+		}
+		end := start
+		for end < len(ops) && ops[end].OpKind != ArchiveOp {
+			end++
+		}
+		if opIndex, err := writeOps(job.fd.file, ops[start:end]); err != nil {
+			return &ErrorFOP{Err: fmt.Errorf("could not write to the file during loop: %w", err), OperationIndex: opIndex, Fbo: job.op}
+		}
+		start = end
+	}
+	if job.fd.file != nil {
+		if err := job.fd.file.Sync(); err != nil {
+			return &ErrorFOP{Err: err, OperationIndex: -1, Fbo: job.op}
+		}
+	}
+	return nil
+}
+
+// writeOps apply writes and truncations with a single fsync before the size header is written: the header
+// never counts data not on the disk. With truncations, the header is first lowered and synced below all
+// the lengths taken by the file meanwhile so it never points past the end of the file. On error, it returns
+// the operation index from which the operations have not been applied.
+func writeOps(file storage.File, ops []Op) (int, error) {
+	firstIndex := int(ops[0].OperationIndex)
+	lowHeader := int64(-1)
+	for _, op := range ops {
+		if op.OpKind == TruncateOp && (lowHeader < 0 || int64(op.Offset) < lowHeader) {
+			lowHeader = int64(op.Offset)
+		}
+	}
+	if lowHeader >= 0 {
+		header, _, err := ReadHeader(file)
+		if err != nil {
+			return firstIndex, err
 		}
-		if job.fd.file != nil {
-			if err := job.fd.file.Sync(); err != nil {
-				errorChan <- ErrorFOP{
-					Err:            err,
-					OperationIndex: -1,
-					Fbo:            job.op,
+		if header > lowHeader {
+			if err := writeHeader(file, uint64(lowHeader)); err != nil {
+				return firstIndex, err
+			}
+			if err := file.Sync(); err != nil {
+				return firstIndex, err
+			}
+		}
+	}
+
+	// data size after the applied operations
+	size := int64(-1)
+	for _, op := range ops {
+		var err error
+		switch op.OpKind {
+		case WriteOp:
+			op.Buffer.ResetRead()
+			_, err = file.WriteAt(op.Buffer.Bytes(), int64(op.Offset+headerSize))
+		case TruncateOp:
+			err = file.Truncate(int64(op.Offset + headerSize))
+		}
+		if err != nil {
+			if size >= 0 {
+				if err := commitHeader(file, size); err != nil {
+					return firstIndex, err
 				}
 			}
+			return int(op.OperationIndex), err
 		}
-	Next:
-		finishChan <- job.fd
+		if op.OpKind == WriteOp {
+			size = op.FileSize
+		} else {
+			size = int64(op.Offset)
+		}
+	}
+	if err := commitHeader(file, size); err != nil {
+		return firstIndex, err
 	}
+	return 0, nil
+}
+
+// commitHeader sync the written data then write the size header
+func commitHeader(file storage.File, dataSize int64) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return writeHeader(file, uint64(dataSize))
 }
 
 // Sync file
@@ -374,23 +529,23 @@ func (bfo *BucketFileOperationner) GetFileBuffer(cf *config.ContainerFile, fileB
 }
 
 // GetFileBufferFromFile get the file content
-func GetFileBufferFromFile(file *os.File, fileBuf *wutils.Buffer) error {
+func GetFileBufferFromFile(file storage.File, fileBuf *wutils.Buffer) error {
 	fileBuf.Reset()
-	_, err := file.Seek(0, 0)
-	if err != nil {
-		return err
-	}
 	var fileSizeB [8]byte
-	n, err := io.ReadFull(file, fileSizeB[:])
+	n, err := file.ReadAt(fileSizeB[:], 0)
 	if n == 0 && err == io.EOF {
 		return nil
 	}
+	if n < len(fileSizeB) {
+		return io.ErrUnexpectedEOF
+	}
+	fileSize := binary.BigEndian.Uint64(fileSizeB[:])
+	size, err := file.Size()
 	if err != nil {
 		return err
 	}
-	fileSize := binary.BigEndian.Uint64(fileSizeB[:])
 
-	_, err = fileBuf.ReadFrom(file)
+	_, err = fileBuf.ReadFrom(io.NewSectionReader(file, headerSize, size-headerSize))
 	if err != nil {
 		return err
 	}
@@ -399,6 +554,38 @@ func GetFileBufferFromFile(file *os.File, fileBuf *wutils.Buffer) error {
 	return err
 }
 
+// DataSize get the data size written in the file header
+func (bfo *BucketFileOperationner) DataSize(cf *config.ContainerFile) (int64, error) {
+	fileData, err := bfo.getFileDataLimitAndTouch(*cf, false)
+	if err != nil {
+		return 0, err
+	}
+	if fileData == nil {
+		return 0, nil
+	}
+	var fileSizeB [8]byte
+	n, err := fileData.file.ReadAt(fileSizeB[:], 0)
+	if n == 0 && err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(fileSizeB[:])) - headerSize, nil
+}
+
+// ReadAt read the file content at offset. The offset does not take the header into account.
+func (bfo *BucketFileOperationner) ReadAt(cf *config.ContainerFile, buf []byte, offset int64) (int, error) {
+	fileData, err := bfo.getFileDataLimitAndTouch(*cf, false)
+	if err != nil {
+		return 0, err
+	}
+	if fileData == nil {
+		return 0, io.EOF
+	}
+	return fileData.file.ReadAt(buf, offset+headerSize)
+}
+
 // CurFileSize get cur file size
 func (bfo *BucketFileOperationner) CurFileSize(cf *config.ContainerFile) (int64, error) {
 	fileData, err := bfo.getFileDataLimitAndTouch(*cf, false)
@@ -410,7 +597,7 @@ func (bfo *BucketFileOperationner) CurFileSize(cf *config.ContainerFile) (int64,
 		return 0, nil
 	}
 
-	n, err := fileData.file.Seek(0, 2)
+	n, err := fileData.file.Size()
 	if err != nil {
 		return n, err
 	}
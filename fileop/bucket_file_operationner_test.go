@@ -1,11 +1,13 @@
 package fileop
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
 	"github.com/chamot1111/waldb/wutils"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -313,6 +315,87 @@ func TestApplyBatchOp(t *testing.T) {
 	bfo.Close()
 }
 
+type syncCountingStorage struct {
+	storage.Storage
+	syncs *int
+}
+
+type syncCountingFile struct {
+	storage.File
+	syncs *int
+}
+
+func (s syncCountingStorage) OpenFile(p string, create bool) (storage.File, error) {
+	f, err := s.Storage.OpenFile(p, create)
+	if err != nil {
+		return nil, err
+	}
+	return syncCountingFile{File: f, syncs: s.syncs}, nil
+}
+
+func (f syncCountingFile) Sync() error {
+	*f.syncs++
+	return f.File.Sync()
+}
+
+func TestApplyBatchOpSyncs(t *testing.T) {
+	os.RemoveAll("data-test")
+
+	sc := config.InitDefaultTestConfig()
+	syncs := 0
+	sc.Storage = syncCountingStorage{Storage: storage.NewMemory(), syncs: &syncs}
+	bfo, err := InitBucketFileOperationner(*sc, zap.NewNop())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "inter")
+
+	writes := func(first int, count int) []Op {
+		ops := make([]Op, 0, count)
+		for i := first; i < first+count; i++ {
+			buffer := &wutils.Buffer{}
+			buffer.Write([]byte{byte(i)})
+			ops = append(ops, Op{OpKind: WriteOp, Buffer: buffer, Offset: uint64(i), FileSize: int64(i + 1), OperationIndex: uint64(len(ops))})
+		}
+		return ops
+	}
+
+	// the data is synced once before the header, then the header is synced
+	if errors := bfo.ApplyBatchOp([]*FileBatchOp{{ContainerFile: cf, Ops: writes(0, 10)}}); errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+	if syncs != 2 {
+		t.Fatalf("10 writes should take 2 syncs but take %d", syncs)
+	}
+
+	// the header is lowered before the truncation
+	syncs = 0
+	ops := []Op{{OpKind: TruncateOp, Offset: 4, OperationIndex: 0}}
+	for _, op := range writes(4, 3) {
+		op.OperationIndex++
+		ops = append(ops, op)
+	}
+	if errors := bfo.ApplyBatchOp([]*FileBatchOp{{ContainerFile: cf, Ops: ops}}); errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+	if syncs != 3 {
+		t.Fatalf("a truncation and 3 writes should take 3 syncs but take %d", syncs)
+	}
+
+	fileBuf := &wutils.Buffer{}
+	if err := bfo.GetFileBuffer(&cf, fileBuf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(fileBuf.Bytes(), []byte{0, 1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("bad content %v", fileBuf.Bytes())
+	}
+	mismatches, err := bfo.VerifyHeaders()
+	if err != nil || len(mismatches) != 0 {
+		t.Fatalf("the header should match the file: %v %v", mismatches, err)
+	}
+	bfo.Close()
+}
+
 func TestLimitOpenFile(t *testing.T) {
 
 	encoderCfg := zapcore.EncoderConfig{
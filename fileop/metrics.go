@@ -0,0 +1,6 @@
+package fileop
+
+import "github.com/chamot1111/waldb/metrics"
+
+var openFilesMetric = metrics.Default.NewGauge("waldb_open_files",
+	"Files kept open by the bucket file operationners.")
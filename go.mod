@@ -3,8 +3,11 @@ module github.com/chamot1111/waldb
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/buger/jsonparser v1.1.0
+	github.com/golang/snappy v0.0.4
 	github.com/mattn/go-sqlite3 v1.14.6
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.16.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,202 @@
+// Package metrics is a minimal metrics registry exposed in the Prometheus text format.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets default histogram buckets, in seconds
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type float64Value struct {
+	bits uint64
+}
+
+func (v *float64Value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		newBits := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, newBits) {
+			return
+		}
+	}
+}
+
+func (v *float64Value) set(value float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(value))
+}
+
+func (v *float64Value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter value only going up
+type Counter struct {
+	v float64Value
+}
+
+// Inc add one
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.v.add(delta)
+}
+
+// Value current value
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+// Gauge value going up and down
+type Gauge struct {
+	v float64Value
+}
+
+// Set value
+func (g *Gauge) Set(value float64) {
+	g.v.set(value)
+}
+
+// Add delta
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Value current value
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// Histogram count observations in buckets
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64
+	count       uint64
+	sum         float64Value
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	upperBounds := append([]float64(nil), buckets...)
+	sort.Float64s(upperBounds)
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)),
+	}
+}
+
+// Observe a value
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	h.sum.add(value)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count of observations
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// vec children of a metric per label values
+type vec struct {
+	labelNames []string
+	mutex      sync.RWMutex
+	children   map[string]interface{}
+	newChild   func() interface{}
+}
+
+func newVec(labelNames []string, newChild func() interface{}) *vec {
+	return &vec{
+		labelNames: labelNames,
+		children:   make(map[string]interface{}),
+		newChild:   newChild,
+	}
+}
+
+// labelSeparator can not appear in a label value given to WithLabelValues
+const labelSeparator = "\xff"
+
+func (v *vec) child(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic("metrics: bad label values count")
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	v.mutex.RLock()
+	c, exists := v.children[key]
+	v.mutex.RUnlock()
+	if exists {
+		return c
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if c, exists := v.children[key]; exists {
+		return c
+	}
+	c = v.newChild()
+	v.children[key] = c
+	return c
+}
+
+// sortedChildren children ordered by label values
+func (v *vec) sortedChildren() ([][]string, []interface{}) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labelValues := make([][]string, 0, len(keys))
+	children := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		if len(v.labelNames) == 0 {
+			labelValues = append(labelValues, nil)
+		} else {
+			labelValues = append(labelValues, strings.Split(k, labelSeparator))
+		}
+		children = append(children, v.children[k])
+	}
+	return labelValues, children
+}
+
+// CounterVec counters partitioned by labels
+type CounterVec struct {
+	*vec
+}
+
+// WithLabelValues counter for the label values, in the order of the label names
+func (c *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return c.child(labelValues).(*Counter)
+}
+
+// GaugeVec gauges partitioned by labels
+type GaugeVec struct {
+	*vec
+}
+
+// WithLabelValues gauge for the label values, in the order of the label names
+func (g *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return g.child(labelValues).(*Gauge)
+}
+
+// HistogramVec histograms partitioned by labels
+type HistogramVec struct {
+	*vec
+}
+
+// WithLabelValues histogram for the label values, in the order of the label names
+func (h *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return h.child(labelValues).(*Histogram)
+}
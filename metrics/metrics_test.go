@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_commands_total", "Commands.", "shard", "kind")
+	c.WithLabelValues("0", "write").Add(2)
+	c.WithLabelValues("1", "delete").Inc()
+	r.NewGauge("test_queue_depth", "Queue depth.").Set(3)
+	h := r.NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	r.NewCounter("test_unused_total", "Never incremented.")
+
+	var buffer bytes.Buffer
+	if err := r.WriteText(&buffer); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `# HELP test_commands_total Commands.
+# TYPE test_commands_total counter
+test_commands_total{shard="0",kind="write"} 2
+test_commands_total{shard="1",kind="delete"} 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+# HELP test_queue_depth Queue depth.
+# TYPE test_queue_depth gauge
+test_queue_depth 3
+# HELP test_unused_total Never incremented.
+# TYPE test_unused_total counter
+test_unused_total 0
+`
+	if buffer.String() != expected {
+		t.Fatalf("bad text output:\n%s", buffer.String())
+	}
+
+	if r.NewCounterVec("test_commands_total", "Commands.", "shard", "kind") == nil {
+		t.Fatalf("registering twice should return the same counter")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering with other labels should panic")
+		}
+	}()
+	r.NewCounterVec("test_commands_total", "Commands.", "shard")
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeVec("test_gauge", "Gauge.", "table").WithLabelValues("a\"b\\c\nd").Set(1)
+	var buffer bytes.Buffer
+	r.WriteText(&buffer)
+	if !strings.Contains(buffer.String(), `test_gauge{table="a\"b\\c\nd"} 1`) {
+		t.Fatalf("bad escaping:\n%s", buffer.String())
+	}
+}
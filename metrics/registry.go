@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type metric struct {
+	name string
+	help string
+	kind metricKind
+	vec  *vec
+}
+
+// Registry set of metrics
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]*metric
+}
+
+// Default registry of the waldb metrics
+var Default = NewRegistry()
+
+// NewRegistry init an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+func (r *Registry) register(name, help string, kind metricKind, labelNames []string, newChild func() interface{}) *vec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, exists := r.metrics[name]; exists {
+		if m.kind != kind || strings.Join(m.vec.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic(fmt.Sprintf("metrics: %s registered twice with different kinds or labels", name))
+		}
+		return m.vec
+	}
+	v := newVec(labelNames, newChild)
+	r.metrics[name] = &metric{name: name, help: help, kind: kind, vec: v}
+	return v
+}
+
+// NewCounter register a counter. Registering the same name twice returns the same counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return (&CounterVec{r.register(name, help, kindCounter, nil, func() interface{} { return &Counter{} })}).WithLabelValues()
+}
+
+// NewCounterVec register a counter partitioned by labels
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, kindCounter, labelNames, func() interface{} { return &Counter{} })}
+}
+
+// NewGauge register a gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return (&GaugeVec{r.register(name, help, kindGauge, nil, func() interface{} { return &Gauge{} })}).WithLabelValues()
+}
+
+// NewGaugeVec register a gauge partitioned by labels
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, kindGauge, labelNames, func() interface{} { return &Gauge{} })}
+}
+
+// NewHistogram register a histogram. DefBuckets is used when buckets is nil.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return (&HistogramVec{r.registerHistogram(name, help, buckets, nil)}).WithLabelValues()
+}
+
+// NewHistogramVec register a histogram partitioned by labels. DefBuckets is used when buckets is nil.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{r.registerHistogram(name, help, buckets, labelNames)}
+}
+
+func (r *Registry) registerHistogram(name, help string, buckets []float64, labelNames []string) *vec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	return r.register(name, help, kindHistogram, labelNames, func() interface{} { return newHistogram(buckets) })
+}
+
+// WriteText write all the metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mutex.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	buffer := bufio.NewWriter(w)
+	for _, m := range metrics {
+		labelValues, children := m.vec.sortedChildren()
+		if len(children) == 0 {
+			continue
+		}
+		fmt.Fprintf(buffer, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", m.name, m.kind)
+		for i, child := range children {
+			labels := formatLabels(m.vec.labelNames, labelValues[i])
+			switch c := child.(type) {
+			case *Counter:
+				fmt.Fprintf(buffer, "%s%s %s\n", m.name, labels, formatValue(c.Value()))
+			case *Gauge:
+				fmt.Fprintf(buffer, "%s%s %s\n", m.name, labels, formatValue(c.Value()))
+			case *Histogram:
+				writeHistogram(buffer, m, labelValues[i], c)
+			}
+		}
+	}
+	return buffer.Flush()
+}
+
+func writeHistogram(buffer *bufio.Writer, m *metric, labelValues []string, h *Histogram) {
+	labelNames := append(append([]string(nil), m.vec.labelNames...), "le")
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		labels := formatLabels(labelNames, append(append([]string(nil), labelValues...), formatValue(upperBound)))
+		fmt.Fprintf(buffer, "%s_bucket%s %d\n", m.name, labels, cumulative)
+	}
+	count := h.Count()
+	labels := formatLabels(labelNames, append(append([]string(nil), labelValues...), "+Inf"))
+	fmt.Fprintf(buffer, "%s_bucket%s %d\n", m.name, labels, count)
+	labels = formatLabels(m.vec.labelNames, labelValues)
+	fmt.Fprintf(buffer, "%s_sum%s %s\n", m.name, labels, formatValue(h.sum.get()))
+	fmt.Fprintf(buffer, "%s_count%s %d\n", m.name, labels, count)
+}
+
+// Handler serve the metrics over http, typically on /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
@@ -0,0 +1,121 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol types
+const (
+	thriftBoolTrue  = 1
+	thriftBoolFalse = 2
+	thriftByte      = 3
+	thriftI32       = 5
+	thriftI64       = 6
+	thriftBinary    = 8
+	thriftList      = 9
+	thriftStruct    = 12
+)
+
+// thriftWriter encode the parquet metadata with the thrift compact protocol. The fields of a struct
+// must be written by increasing id.
+type thriftWriter struct {
+	buf       bytes.Buffer
+	lastField []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{lastField: []int16{0}}
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &t.lastField[len(t.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) structBegin() {
+	t.lastField = append(t.lastField, 0)
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf.WriteByte(0)
+	t.lastField = t.lastField[0 : len(t.lastField)-1]
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) binary(b []byte) {
+	t.varint(uint64(len(b)))
+	t.buf.Write(b)
+}
+
+func (t *thriftWriter) listBegin(elemType byte, size int) {
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elemType)
+	t.varint(uint64(size))
+}
+
+func (t *thriftWriter) boolField(id int16, v bool) {
+	if v {
+		t.fieldHeader(id, thriftBoolTrue)
+	} else {
+		t.fieldHeader(id, thriftBoolFalse)
+	}
+}
+
+func (t *thriftWriter) byteField(id int16, v int8) {
+	t.fieldHeader(id, thriftByte)
+	t.buf.WriteByte(byte(v))
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) stringField(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary([]byte(s))
+}
+
+// structField begin a struct field, ended by structEnd
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.structBegin()
+}
+
+// emptyStructField struct field without fields
+func (t *thriftWriter) emptyStructField(id int16) {
+	t.structField(id)
+	t.structEnd()
+}
+
+func (t *thriftWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	t.listBegin(elemType, size)
+}
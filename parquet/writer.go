@@ -0,0 +1,375 @@
+// Package parquet writes flat Parquet files: one row group, one uncompressed PLAIN data page by column.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Type of a column
+type Type uint8
+
+const (
+	// Boolean bool values
+	Boolean Type = 0
+	// Int64 int64 values
+	Int64 Type = 1
+	// Uint64 uint64 values, stored as INT64 with the UINT_64 annotation
+	Uint64 Type = 2
+	// Double float64 values
+	Double Type = 3
+	// String string values, stored as BYTE_ARRAY with the UTF8 annotation
+	String Type = 4
+	// Bytes []byte values
+	Bytes Type = 5
+	// TimestampNanos int64 unix nanoseconds, stored as INT64 with the TIMESTAMP(NANOS) annotation
+	TimestampNanos Type = 6
+)
+
+// Parquet physical types
+const (
+	physicalBoolean   = 0
+	physicalInt64     = 2
+	physicalDouble    = 5
+	physicalByteArray = 6
+)
+
+// Parquet enums
+const (
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedUTF8   = 0
+	convertedUint64 = 14
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageTypeData = 0
+)
+
+const magic = "PAR1"
+
+// Column of a file
+type Column struct {
+	Name string
+	Type Type
+	// Optional the column accepts null values
+	Optional bool
+}
+
+func (c Column) physicalType() int32 {
+	switch c.Type {
+	case Boolean:
+		return physicalBoolean
+	case Double:
+		return physicalDouble
+	case String, Bytes:
+		return physicalByteArray
+	}
+	return physicalInt64
+}
+
+// columnBuffer values of a column encoded as a data page
+type columnBuffer struct {
+	values bytes.Buffer
+	// defLevels definition level of each row of an optional column
+	defLevels []bool
+	// bits pending boolean values
+	bits     byte
+	bitCount uint
+}
+
+// Writer buffer rows in memory and write them as a parquet file
+type Writer struct {
+	columns  []Column
+	buffers  []columnBuffer
+	rowCount int64
+}
+
+// NewWriter init a writer of the columns
+func NewWriter(columns []Column) *Writer {
+	return &Writer{
+		columns: columns,
+		buffers: make([]columnBuffer, len(columns)),
+	}
+}
+
+// RowCount count of rows appended
+func (w *Writer) RowCount() int64 {
+	return w.rowCount
+}
+
+// AppendRow append a row with one value by column: bool, int64, uint64, float64, string or []byte
+// depending on the column type. nil is null.
+func (w *Writer) AppendRow(values []interface{}) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("row has %d values for %d columns", len(values), len(w.columns))
+	}
+	for i, c := range w.columns {
+		if err := c.check(values[i]); err != nil {
+			return fmt.Errorf("column %s: %w", c.Name, err)
+		}
+	}
+	for i, c := range w.columns {
+		w.buffers[i].append(c, values[i])
+	}
+	w.rowCount++
+	return nil
+}
+
+// check the value can be appended to the column
+func (c Column) check(v interface{}) error {
+	if v == nil {
+		if !c.Optional {
+			return fmt.Errorf("null value for a required column")
+		}
+		return nil
+	}
+	ok := false
+	switch c.Type {
+	case Boolean:
+		_, ok = v.(bool)
+	case Int64, TimestampNanos:
+		_, ok = v.(int64)
+	case Uint64:
+		_, ok = v.(uint64)
+	case Double:
+		_, ok = v.(float64)
+	case String, Bytes:
+		switch v.(type) {
+		case string, []byte:
+			ok = true
+		}
+	default:
+		return fmt.Errorf("unknown type %d", c.Type)
+	}
+	if !ok {
+		return fmt.Errorf("bad value type %T", v)
+	}
+	return nil
+}
+
+// append a value checked by Column.check
+func (cb *columnBuffer) append(c Column, v interface{}) {
+	if c.Optional {
+		cb.defLevels = append(cb.defLevels, v != nil)
+	}
+	if v == nil {
+		return
+	}
+	var scratch [8]byte
+	switch c.Type {
+	case Boolean:
+		if v.(bool) {
+			cb.bits |= 1 << cb.bitCount
+		}
+		cb.bitCount++
+		if cb.bitCount == 8 {
+			cb.values.WriteByte(cb.bits)
+			cb.bits, cb.bitCount = 0, 0
+		}
+	case Int64, TimestampNanos:
+		binary.LittleEndian.PutUint64(scratch[:], uint64(v.(int64)))
+		cb.values.Write(scratch[:])
+	case Uint64:
+		binary.LittleEndian.PutUint64(scratch[:], v.(uint64))
+		cb.values.Write(scratch[:])
+	case Double:
+		binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(v.(float64)))
+		cb.values.Write(scratch[:])
+	case String, Bytes:
+		var b []byte
+		switch s := v.(type) {
+		case string:
+			b = []byte(s)
+		case []byte:
+			b = s
+		}
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(b)))
+		cb.values.Write(scratch[:4])
+		cb.values.Write(b)
+	}
+}
+
+// pageData definition levels and values of the data page
+func (cb *columnBuffer) pageData(c Column) []byte {
+	var res bytes.Buffer
+	if c.Optional {
+		levels := encodeLevels(cb.defLevels)
+		var l [4]byte
+		binary.LittleEndian.PutUint32(l[:], uint32(len(levels)))
+		res.Write(l[:])
+		res.Write(levels)
+	}
+	res.Write(cb.values.Bytes())
+	if cb.bitCount > 0 {
+		res.WriteByte(cb.bits)
+	}
+	return res.Bytes()
+}
+
+// encodeLevels RLE runs of the RLE/bit-packing hybrid encoding with a bit width of 1
+func encodeLevels(levels []bool) []byte {
+	res := make([]byte, 0, 16)
+	var b [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		res = append(res, b[:binary.PutUvarint(b[:], uint64(j-i)<<1)]...)
+		if levels[i] {
+			res = append(res, 1)
+		} else {
+			res = append(res, 0)
+		}
+		i = j
+	}
+	return res
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// chunkMeta position of a written column chunk
+type chunkMeta struct {
+	offset int64
+	size   int64
+}
+
+// WriteTo write the parquet file with all the appended rows
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	cw := &countingWriter{w: out}
+	if _, err := io.WriteString(cw, magic); err != nil {
+		return cw.n, err
+	}
+	chunks := make([]chunkMeta, len(w.columns))
+	for i, c := range w.columns {
+		data := w.buffers[i].pageData(c)
+		header := newThriftWriter()
+		header.i32Field(1, pageTypeData)
+		header.i32Field(2, int32(len(data)))
+		header.i32Field(3, int32(len(data)))
+		header.structField(5)
+		header.i32Field(1, int32(w.rowCount))
+		header.i32Field(2, encodingPlain)
+		header.i32Field(3, encodingRLE)
+		header.i32Field(4, encodingRLE)
+		header.structEnd()
+		header.buf.WriteByte(0)
+
+		chunks[i].offset = cw.n
+		if _, err := cw.Write(header.buf.Bytes()); err != nil {
+			return cw.n, err
+		}
+		if _, err := cw.Write(data); err != nil {
+			return cw.n, err
+		}
+		chunks[i].size = cw.n - chunks[i].offset
+	}
+
+	footer := w.fileMetaData(chunks)
+	if _, err := cw.Write(footer); err != nil {
+		return cw.n, err
+	}
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(len(footer)))
+	if _, err := cw.Write(l[:]); err != nil {
+		return cw.n, err
+	}
+	_, err := io.WriteString(cw, magic)
+	return cw.n, err
+}
+
+func (w *Writer) fileMetaData(chunks []chunkMeta) []byte {
+	t := newThriftWriter()
+	t.i32Field(1, 1)
+
+	t.listField(2, thriftStruct, len(w.columns)+1)
+	t.structBegin()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(w.columns)))
+	t.structEnd()
+	for _, c := range w.columns {
+		t.structBegin()
+		t.i32Field(1, c.physicalType())
+		if c.Optional {
+			t.i32Field(3, repetitionOptional)
+		} else {
+			t.i32Field(3, repetitionRequired)
+		}
+		t.stringField(4, c.Name)
+		switch c.Type {
+		case String:
+			t.i32Field(6, convertedUTF8)
+			t.structField(10)
+			t.emptyStructField(1)
+			t.structEnd()
+		case Uint64:
+			t.i32Field(6, convertedUint64)
+			t.structField(10)
+			t.structField(10)
+			t.byteField(1, 64)
+			t.boolField(2, false)
+			t.structEnd()
+			t.structEnd()
+		case TimestampNanos:
+			t.structField(10)
+			t.structField(8)
+			t.boolField(1, true)
+			t.structField(2)
+			t.emptyStructField(3)
+			t.structEnd()
+			t.structEnd()
+			t.structEnd()
+		}
+		t.structEnd()
+	}
+
+	t.i64Field(3, w.rowCount)
+
+	var totalSize int64
+	for _, c := range chunks {
+		totalSize += c.size
+	}
+	t.listField(4, thriftStruct, 1)
+	t.structBegin()
+	t.listField(1, thriftStruct, len(w.columns))
+	for i, c := range w.columns {
+		t.structBegin()
+		t.i64Field(2, chunks[i].offset)
+		t.structField(3)
+		t.i32Field(1, c.physicalType())
+		t.listField(2, thriftI32, 2)
+		t.i32(encodingPlain)
+		t.i32(encodingRLE)
+		t.listField(3, thriftBinary, 1)
+		t.binary([]byte(c.Name))
+		t.i32Field(4, 0)
+		t.i64Field(5, w.rowCount)
+		t.i64Field(6, chunks[i].size)
+		t.i64Field(7, chunks[i].size)
+		t.i64Field(9, chunks[i].offset)
+		t.structEnd()
+		t.structEnd()
+	}
+	t.i64Field(2, totalSize)
+	t.i64Field(3, w.rowCount)
+	t.structEnd()
+
+	t.stringField(6, "waldb")
+	t.buf.WriteByte(0)
+	return t.buf.Bytes()
+}
@@ -0,0 +1,221 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// thriftReader decode the thrift compact protocol into maps of field id to value
+type thriftReader struct {
+	b   []byte
+	off int
+}
+
+func (r *thriftReader) byte() byte {
+	v := r.b[r.off]
+	r.off++
+	return v
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b[r.off:])
+	r.off += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftBoolTrue:
+		return true
+	case thriftBoolFalse:
+		return false
+	case thriftByte:
+		return int8(r.byte())
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		l := int(r.varint())
+		v := string(r.b[r.off : r.off+l])
+		r.off += l
+		return v
+	case thriftList:
+		h := r.byte()
+		size := int(h >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		res := make([]interface{}, size)
+		for i := range res {
+			res[i] = r.value(h & 0x0f)
+		}
+		return res
+	case thriftStruct:
+		return r.structValue()
+	}
+	panic(fmt.Sprintf("unknown thrift type %d", typ))
+}
+
+func (r *thriftReader) structValue() map[int16]interface{} {
+	res := make(map[int16]interface{})
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return res
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		res[id] = r.value(h & 0x0f)
+		last = id
+	}
+}
+
+func field(s interface{}, ids ...int16) interface{} {
+	for _, id := range ids {
+		s = s.(map[int16]interface{})[id]
+	}
+	return s
+}
+
+// readColumn decode the values of a column chunk, nil for null
+func readColumn(t *testing.T, file []byte, offset int64, c Column) []interface{} {
+	r := &thriftReader{b: file, off: int(offset)}
+	header := r.structValue()
+	numValues := int(field(header, 5, 1).(int64))
+	data := file[r.off : r.off+int(field(header, 3).(int64))]
+
+	defined := make([]bool, numValues)
+	if c.Optional {
+		l := int(binary.LittleEndian.Uint32(data))
+		levels := &thriftReader{b: data[4 : 4+l]}
+		data = data[4+l:]
+		i := 0
+		for levels.off < len(levels.b) {
+			run := int(levels.varint() >> 1)
+			v := levels.byte() == 1
+			for j := 0; j < run; j++ {
+				defined[i] = v
+				i++
+			}
+		}
+		if i != numValues {
+			t.Fatalf("column %s: %d levels for %d values", c.Name, i, numValues)
+		}
+	} else {
+		for i := range defined {
+			defined[i] = true
+		}
+	}
+
+	res := make([]interface{}, numValues)
+	bit := 0
+	for i := range res {
+		if !defined[i] {
+			continue
+		}
+		switch c.Type {
+		case Boolean:
+			res[i] = data[bit/8]&(1<<(uint(bit)%8)) != 0
+			bit++
+		case Int64, TimestampNanos:
+			res[i] = int64(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case Uint64:
+			res[i] = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case Double:
+			res[i] = math.Float64frombits(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case String, Bytes:
+			l := int(binary.LittleEndian.Uint32(data))
+			if c.Type == String {
+				res[i] = string(data[4 : 4+l])
+			} else {
+				res[i] = data[4 : 4+l]
+			}
+			data = data[4+l:]
+		}
+	}
+	return res
+}
+
+func TestWriter(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Uint64},
+		{Name: "label", Type: String, Optional: true},
+		{Name: "score", Type: Int64},
+		{Name: "ratio", Type: Double, Optional: true},
+		{Name: "ok", Type: Boolean},
+		{Name: "at", Type: TimestampNanos, Optional: true},
+		{Name: "raw", Type: Bytes, Optional: true},
+	}
+	rows := make([][]interface{}, 0)
+	for i := 0; i < 20; i++ {
+		row := []interface{}{uint64(i), fmt.Sprintf("label%d", i), int64(-i), float64(i) / 4, i%3 == 0, int64(i) * 1e9, []byte{byte(i)}}
+		if i%4 == 1 {
+			row[1], row[3], row[5], row[6] = nil, nil, nil, nil
+		}
+		rows = append(rows, row)
+	}
+
+	w := NewWriter(columns)
+	for _, row := range rows {
+		if err := w.AppendRow(row); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := w.AppendRow([]interface{}{nil, nil, int64(0), nil, false, nil, nil}); err == nil {
+		t.Fatalf("null in a required column should fail")
+	}
+	if err := w.AppendRow([]interface{}{uint64(0), nil, int64(0), "1", false, nil, nil}); err == nil {
+		t.Fatalf("bad value type should fail")
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	file := buf.Bytes()
+
+	if string(file[:4]) != magic || string(file[len(file)-4:]) != magic {
+		t.Fatalf("bad magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	r := &thriftReader{b: file[len(file)-8-footerLen : len(file)-8]}
+	meta := r.structValue()
+	if r.off != footerLen {
+		t.Fatalf("footer decoded %d bytes of %d", r.off, footerLen)
+	}
+	if field(meta, 3).(int64) != int64(len(rows)) {
+		t.Fatalf("bad row count %v", field(meta, 3))
+	}
+	schema := field(meta, 2).([]interface{})
+	if len(schema) != len(columns)+1 || field(schema[0], 5).(int64) != int64(len(columns)) {
+		t.Fatalf("bad schema %v", schema)
+	}
+	chunks := field(field(meta, 4).([]interface{})[0], 1).([]interface{})
+	for i, c := range columns {
+		if field(schema[i+1], 4).(string) != c.Name {
+			t.Fatalf("bad schema element %v", schema[i+1])
+		}
+		offset := field(chunks[i], 3, 9).(int64)
+		values := readColumn(t, file, offset, c)
+		for ri, row := range rows {
+			if fmt.Sprint(values[ri]) != fmt.Sprint(row[i]) && !(row[i] == nil && values[ri] == nil) {
+				t.Fatalf("column %s row %d: %v, expected %v", c.Name, ri, values[ri], row[i])
+			}
+		}
+	}
+	if ts := field(schema[6], 10, 8, 2); ts == nil {
+		t.Fatalf("timestamp column should have a logical type")
+	}
+}
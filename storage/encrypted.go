@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/chamot1111/waldb/crypt"
+)
+
+// An encrypted file is a header [magic][version byte][uint32 key id][uint32 block size] followed by the
+// blocks of block size plaintext bytes, the last one may be shorter. Each block is sealed by crypt.Seal
+// with the header and its index as additional data. An empty file has no header: its first write picks
+// the current key, so a file truncated to 0 takes the rotated key.
+// A file without the magic has been written before the encryption was enabled: it is rejected with
+// ErrNotEncrypted until EncryptFiles encrypts it.
+var encryptedMagic = [4]byte{'W', 'D', 'B', 'E'}
+
+const encryptedVersion = 1
+
+const encryptedHeaderLen = len(encryptedMagic) + 1 + 4 + 4
+
+const encryptedBlockSize = 4096
+
+// ErrNotEncrypted the file has been written before the encryption was enabled, see EncryptFiles
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+// Encrypted encrypt with AES-GCM the files of s with the keys of keys
+func Encrypted(s Storage, keys crypt.KeyProvider) Storage {
+	return encryptedStorage{Storage: s, keys: keys}
+}
+
+type encryptedStorage struct {
+	Storage
+	keys crypt.KeyProvider
+}
+
+type encryptedFile struct {
+	file File
+	keys crypt.KeyProvider
+
+	mutex sync.Mutex
+	// header nil until the first write of an empty file
+	header    []byte
+	aead      cipher.AEAD
+	blockSize int64
+}
+
+func (s encryptedStorage) OpenFile(p string, create bool) (File, error) {
+	f, err := s.Storage.OpenFile(p, create)
+	if err != nil {
+		return nil, err
+	}
+	ef := &encryptedFile{file: f, keys: s.keys}
+	if err := ef.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not open encrypted file %s: %w", p, err)
+	}
+	return ef, nil
+}
+
+// Stat the size is the plaintext size
+func (s encryptedStorage) Stat(p string) (os.FileInfo, error) {
+	info, err := s.Storage.Stat(p)
+	if err != nil || info.Size() == 0 {
+		return info, err
+	}
+	f, err := s.OpenFile(p, false)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	return plainFileInfo{FileInfo: info, size: size}, nil
+}
+
+type plainFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi plainFileInfo) Size() int64 { return fi.size }
+
+// load read the header of a not empty file
+func (f *encryptedFile) load() error {
+	f.header = nil
+	f.aead = nil
+	physSize, err := f.file.Size()
+	if err != nil || physSize == 0 {
+		return err
+	}
+	header := make([]byte, encryptedHeaderLen)
+	n, err := f.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < len(encryptedMagic) || !bytes.Equal(header[:len(encryptedMagic)], encryptedMagic[:]) {
+		return ErrNotEncrypted
+	}
+	if n < encryptedHeaderLen {
+		return fmt.Errorf("truncated encryption header")
+	}
+	if version := header[len(encryptedMagic)]; version != encryptedVersion {
+		return fmt.Errorf("unknown encryption version %d", version)
+	}
+	keyID := binary.BigEndian.Uint32(header[len(encryptedMagic)+1:])
+	blockSize := binary.BigEndian.Uint32(header[len(encryptedMagic)+5:])
+	if blockSize == 0 {
+		return fmt.Errorf("bad encryption block size")
+	}
+	key, err := f.keys.Key(keyID)
+	if err != nil {
+		return err
+	}
+	aead, err := crypt.NewAEAD(key)
+	if err != nil {
+		return err
+	}
+	f.header = header
+	f.aead = aead
+	f.blockSize = int64(blockSize)
+	return nil
+}
+
+// init write the header of an empty file with the current key
+func (f *encryptedFile) init() error {
+	keyID, key, err := f.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	aead, err := crypt.NewAEAD(key)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 0, encryptedHeaderLen)
+	header = append(header, encryptedMagic[:]...)
+	header = append(header, encryptedVersion)
+	header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(encryptedMagic)+1:], keyID)
+	binary.BigEndian.PutUint32(header[len(encryptedMagic)+5:], encryptedBlockSize)
+	if _, err := f.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	f.header = header
+	f.aead = aead
+	f.blockSize = encryptedBlockSize
+	return nil
+}
+
+func (f *encryptedFile) physBlockSize() int64 {
+	return f.blockSize + crypt.Overhead
+}
+
+func (f *encryptedFile) blockOffset(i int64) int64 {
+	return int64(encryptedHeaderLen) + i*f.physBlockSize()
+}
+
+// plainSize plaintext size given by the encrypted size. A partially written last block is ignored.
+func (f *encryptedFile) plainSize() (int64, error) {
+	physSize, err := f.file.Size()
+	if err != nil {
+		return 0, err
+	}
+	if f.header == nil {
+		if physSize > 0 {
+			return 0, fmt.Errorf("encryption header missing")
+		}
+		return 0, nil
+	}
+	body := physSize - int64(encryptedHeaderLen)
+	if body <= 0 {
+		return 0, nil
+	}
+	size := body / f.physBlockSize() * f.blockSize
+	if rem := body % f.physBlockSize(); rem > crypt.Overhead {
+		size += rem - crypt.Overhead
+	}
+	return size, nil
+}
+
+func (f *encryptedFile) additionalData(i int64) []byte {
+	ad := make([]byte, len(f.header)+8)
+	copy(ad, f.header)
+	binary.BigEndian.PutUint64(ad[len(f.header):], uint64(i))
+	return ad
+}
+
+// readBlock plaintext of the block i of a file of the plaintext size
+func (f *encryptedFile) readBlock(i int64, size int64) ([]byte, error) {
+	start := i * f.blockSize
+	if start >= size {
+		return nil, nil
+	}
+	l := size - start
+	if l > f.blockSize {
+		l = f.blockSize
+	}
+	sealed := make([]byte, l+crypt.Overhead)
+	if _, err := f.file.ReadAt(sealed, f.blockOffset(i)); err != nil {
+		return nil, err
+	}
+	block, err := crypt.Open(f.aead, nil, sealed, f.additionalData(i))
+	if err != nil {
+		return nil, fmt.Errorf("block %d: %w", i, err)
+	}
+	return block, nil
+}
+
+func (f *encryptedFile) writeBlock(i int64, block []byte) (int64, error) {
+	sealed, err := crypt.Seal(f.aead, nil, block, f.additionalData(i))
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.file.WriteAt(sealed, f.blockOffset(i))
+	return int64(len(sealed)), err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	size, err := f.plainSize()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < size {
+		pos := off + int64(n)
+		i := pos / f.blockSize
+		block, err := f.readBlock(i, size)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos-i*f.blockSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writeAt(p, off)
+}
+
+// writeAt seal again the blocks from the end of the file or off, the skipped bytes are zeros
+func (f *encryptedFile) writeAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.header == nil {
+		if err := f.init(); err != nil {
+			return 0, err
+		}
+	}
+	size, err := f.plainSize()
+	if err != nil {
+		return 0, err
+	}
+	end := off + int64(len(p))
+	newSize := size
+	if end > newSize {
+		newSize = end
+	}
+	first := off
+	if size < first {
+		first = size
+	}
+	for i := first / f.blockSize; i <= (end-1)/f.blockSize; i++ {
+		start := i * f.blockSize
+		blockLen := newSize - start
+		if blockLen > f.blockSize {
+			blockLen = f.blockSize
+		}
+		block := make([]byte, blockLen)
+		old, err := f.readBlock(i, size)
+		if err != nil {
+			return 0, err
+		}
+		copy(block, old)
+		if end > start && off < start+blockLen {
+			from, to := off, end
+			if from < start {
+				from = start
+			}
+			if to > start+blockLen {
+				to = start + blockLen
+			}
+			copy(block[from-start:to-start], p[from-off:to-off])
+		}
+		if _, err := f.writeBlock(i, block); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *encryptedFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if size == 0 {
+		// the next write picks the current key
+		f.header = nil
+		f.aead = nil
+		return f.file.Truncate(0)
+	}
+	curSize, err := f.plainSize()
+	if err != nil {
+		return err
+	}
+	if size > curSize {
+		_, err := f.writeAt(make([]byte, size-curSize), curSize)
+		return err
+	}
+	if size == curSize {
+		return nil
+	}
+	i := (size - 1) / f.blockSize
+	block, err := f.readBlock(i, curSize)
+	if err != nil {
+		return err
+	}
+	n, err := f.writeBlock(i, block[:size-i*f.blockSize])
+	if err != nil {
+		return err
+	}
+	return f.file.Truncate(f.blockOffset(i) + n)
+}
+
+func (f *encryptedFile) Size() (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.plainSize()
+}
+
+func (f *encryptedFile) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *encryptedFile) Close() error {
+	return f.file.Close()
+}
+
+// isEncrypted the file is empty or starts with the encryption header
+func isEncrypted(s Storage, p string) (bool, error) {
+	f, err := s.OpenFile(p, false)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(encryptedMagic))
+	n, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if n == 0 {
+		return true, nil
+	}
+	return n == len(magic) && bytes.Equal(magic, encryptedMagic[:]), nil
+}
+
+// EncryptFiles encrypt with the current key of keys the plaintext files of the folders of s, written
+// before the encryption was enabled. The database must be stopped. A file is encrypted in <path>.tmp then
+// renamed, so an interrupted migration can be run again. It returns the paths of the encrypted files.
+func EncryptFiles(s Storage, keys crypt.KeyProvider, folders ...string) ([]string, error) {
+	enc := Encrypted(s, keys)
+	res := make([]string, 0)
+	for _, folder := range folders {
+		if folder == "" {
+			continue
+		}
+		paths, err := s.List(folder)
+		if err != nil {
+			return res, err
+		}
+		for _, p := range paths {
+			encrypted, err := isEncrypted(s, p)
+			if err != nil {
+				return res, err
+			}
+			if encrypted {
+				continue
+			}
+			if err := encryptFile(s, enc, p); err != nil {
+				return res, fmt.Errorf("could not encrypt %s: %w", p, err)
+			}
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func encryptFile(s, enc Storage, p string) error {
+	tmpPath := p + ".tmp"
+	if err := s.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	src, err := s.OpenFile(p, false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := enc.OpenFile(tmpPath, true)
+	if err != nil {
+		return err
+	}
+	if err := Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return s.Rename(tmpPath, p)
+}
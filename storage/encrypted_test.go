@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/chamot1111/waldb/crypt"
+)
+
+func testKeyRing(t *testing.T) *crypt.KeyRing {
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncrypted(t *testing.T) {
+	testStorage(t, Encrypted(NewMemory(), testKeyRing(t)), "data-test")
+
+	keys := testKeyRing(t)
+	mem := NewMemory()
+	s := Encrypted(mem, keys)
+	f, err := s.OpenFile("data-test/f", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// random writes and truncations across the blocks against a plaintext copy
+	r := rand.New(rand.NewSource(1))
+	expected := make([]byte, 0)
+	for i := 0; i < 300; i++ {
+		if r.Intn(10) == 0 {
+			size := r.Intn(len(expected) + 1)
+			if err := f.Truncate(int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			expected = expected[:size]
+			continue
+		}
+		off := r.Intn(len(expected) + 2*encryptedBlockSize)
+		p := make([]byte, r.Intn(3*encryptedBlockSize))
+		r.Read(p)
+		if _, err := f.WriteAt(p, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if off+len(p) > len(expected) && len(p) > 0 {
+			expected = append(expected, make([]byte, off+len(p)-len(expected))...)
+		}
+		copy(expected[off:], p)
+	}
+	if size, err := f.Size(); err != nil || size != int64(len(expected)) {
+		t.Fatalf("bad size %d, expected %d: %v", size, len(expected), err)
+	}
+	content := make([]byte, len(expected))
+	if _, err := f.ReadAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("bad content after the random writes")
+	}
+	f.Close()
+
+	// the plaintext is not on the underlying storage
+	raw, _ := mem.OpenFile("data-test/f", false)
+	rawSize, _ := raw.Size()
+	rawContent := make([]byte, rawSize)
+	raw.ReadAt(rawContent, 0)
+	if len(expected) > 64 && bytes.Contains(rawContent, expected[:64]) {
+		t.Fatalf("the plaintext should not be stored")
+	}
+
+	// a rotated key is used by the new files, the old ones stay readable
+	if _, _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := s.OpenFile("data-test/g", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.WriteAt([]byte("rotated"), 0)
+	g.Close()
+	if g, err := mem.OpenFile("data-test/g", false); err != nil || keyIDOf(g) != 2 {
+		t.Fatalf("the new file should use the rotated key")
+	}
+	if f, err = s.OpenFile("data-test/f", false); err != nil || keyIDOf(raw) != 1 {
+		t.Fatalf("the old file should be readable: %v", err)
+	}
+	if _, err := f.ReadAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// an altered block is rejected
+	raw.WriteAt([]byte{rawContent[encryptedHeaderLen+20] ^ 1}, int64(encryptedHeaderLen+20))
+	f, _ = s.OpenFile("data-test/f", false)
+	if _, err := f.ReadAt(content[:10], 0); !errors.Is(err, crypt.ErrDecrypt) {
+		t.Fatalf("altered block should not be read: %v", err)
+	}
+	f.Close()
+	raw.Close()
+
+	// a key missing from the provider
+	if _, err := Encrypted(mem, testKeyRing(t)).OpenFile("data-test/g", false); !errors.Is(err, crypt.ErrUnknownKey) {
+		t.Fatalf("should get an unknown key error: %v", err)
+	}
+
+	// a plaintext file written before the encryption
+	p, _ := mem.OpenFile("data-test/plain", true)
+	p.WriteAt([]byte{0, 0, 0, 0, 0, 0, 0, 12, 'a'}, 0)
+	p.Close()
+	if _, err := s.OpenFile("data-test/plain", false); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("plaintext file should be rejected: %v", err)
+	}
+	encrypted, err := EncryptFiles(mem, keys, "data-test")
+	if err != nil || !reflect.DeepEqual(encrypted, []string{"data-test/plain"}) {
+		t.Fatalf("only the plaintext file should be encrypted: %v %v", encrypted, err)
+	}
+	p, err = s.OpenFile("data-test/plain", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 10)
+	if n, _ := p.ReadAt(buffer, 0); n != 9 || buffer[7] != 12 || buffer[8] != 'a' {
+		t.Fatalf("plaintext file should be encrypted as is: %v", buffer)
+	}
+	p.Close()
+	if encrypted, err := EncryptFiles(mem, keys, "data-test"); err != nil || len(encrypted) != 0 {
+		t.Fatalf("the migration should be done: %v %v", encrypted, err)
+	}
+}
+
+func keyIDOf(raw File) int {
+	header := make([]byte, encryptedHeaderLen)
+	raw.ReadAt(header, 0)
+	return int(header[8])
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrInjectedFault error of the calls failed by a FaultInjector
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultPoint call where a fault can be injected
+type FaultPoint string
+
+// Fault points
+const (
+	// FaultWALSync fsync of the wal file
+	FaultWALSync FaultPoint = "wal-sync"
+	// FaultHeaderWrite write of the size header of an active file by WriteAtomicOp and TruncateAtomicOp
+	FaultHeaderWrite FaultPoint = "header-write"
+	// FaultWALMove move of the wal file to the wal archive folder at the end of a checkpoint
+	FaultWALMove FaultPoint = "wal-move"
+	// FaultArchiveRename rename of the temporary archived file to its final path
+	FaultArchiveRename FaultPoint = "archive-rename"
+)
+
+// FaultPoints all the fault points
+var FaultPoints = []FaultPoint{FaultWALSync, FaultHeaderWrite, FaultWALMove, FaultArchiveRename}
+
+// Fault to inject
+type Fault struct {
+	Point FaultPoint
+	// After count of calls at the point succeeding before the failed one
+	After int
+	// ShortWrite bytes written before failing, for the writes
+	ShortWrite int
+	// Crash the process is considered killed at the fault: OnCrash is called and all the next
+	// calls at a fault point fail
+	Crash bool
+}
+
+// FaultInjector fail chosen calls. Each fault fails one call. A nil FaultInjector injects nothing.
+type FaultInjector struct {
+	mutex   sync.Mutex
+	faults  []Fault
+	calls   map[FaultPoint]int
+	crashed bool
+	// OnCrash called once by the crashing call, before it fails. It can save the state of the
+	// files as left by the killed process.
+	OnCrash func()
+}
+
+// NewFaultInjector init an injector of faults
+func NewFaultInjector(faults ...Fault) *FaultInjector {
+	return &FaultInjector{
+		faults: faults,
+		calls:  make(map[FaultPoint]int),
+	}
+}
+
+// Inject must be called before the call at point. It returns ErrInjectedFault if the call must fail.
+// shortWrite, if not nil, is called with the count of bytes to write before failing.
+func (fi *FaultInjector) Inject(point FaultPoint, shortWrite func(n int)) error {
+	if fi == nil {
+		return nil
+	}
+	fi.mutex.Lock()
+	if fi.crashed {
+		fi.mutex.Unlock()
+		return ErrInjectedFault
+	}
+	call := fi.calls[point]
+	fi.calls[point] = call + 1
+	var fault *Fault
+	for i := range fi.faults {
+		if fi.faults[i].Point == point && fi.faults[i].After == call {
+			fault = &fi.faults[i]
+			break
+		}
+	}
+	if fault == nil {
+		fi.mutex.Unlock()
+		return nil
+	}
+	fi.crashed = fault.Crash
+	onCrash := fi.OnCrash
+	fi.mutex.Unlock()
+
+	if shortWrite != nil && fault.ShortWrite > 0 {
+		shortWrite(fault.ShortWrite)
+	}
+	if fault.Crash && onCrash != nil {
+		onCrash()
+	}
+	return ErrInjectedFault
+}
+
+// Crashed a crash fault has been injected
+func (fi *FaultInjector) Crashed() bool {
+	if fi == nil {
+		return false
+	}
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	return fi.crashed
+}
+
+// WithFaults inject the faults of fi in the header writes and the renames of temporary files of s
+func WithFaults(s Storage, fi *FaultInjector) Storage {
+	return faultyStorage{Storage: s, faults: fi}
+}
+
+type faultyStorage struct {
+	Storage
+	faults *FaultInjector
+}
+
+type faultyFile struct {
+	File
+	faults *FaultInjector
+}
+
+func (s faultyStorage) OpenFile(p string, create bool) (File, error) {
+	f, err := s.Storage.OpenFile(p, create)
+	if err != nil {
+		return nil, err
+	}
+	return faultyFile{File: f, faults: s.faults}, nil
+}
+
+func (s faultyStorage) Rename(oldPath, newPath string) error {
+	if strings.HasSuffix(oldPath, ".tmp") {
+		if err := s.faults.Inject(FaultArchiveRename, nil); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+		}
+	}
+	return s.Storage.Rename(oldPath, newPath)
+}
+
+// WriteAt the size header is the only write at offset 0
+func (f faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == 0 {
+		n := 0
+		err := f.faults.Inject(FaultHeaderWrite, func(shortWrite int) {
+			if shortWrite < len(p) {
+				n, _ = f.File.WriteAt(p[:shortWrite], off)
+			}
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return f.File.WriteAt(p, off)
+}
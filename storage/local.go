@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/chamot1111/waldb/wutils"
+)
+
+// Local files of the local disk
+type Local struct{}
+
+type localFile struct {
+	*os.File
+}
+
+func (f localFile) Size() (int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// OpenFile open a file for read and write
+func (Local) OpenFile(p string, create bool) (File, error) {
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(p), 0744); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(p, flag, 0744)
+	if err != nil {
+		return nil, err
+	}
+	return localFile{file}, nil
+}
+
+// Stat a file
+func (Local) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(p)
+}
+
+// Rename a file. It falls back to a copy across devices.
+func (Local) Rename(oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0744); err != nil {
+		return err
+	}
+	return wutils.MoveFile(oldPath, newPath)
+}
+
+// Remove a file
+func (Local) Remove(p string) error {
+	return os.Remove(p)
+}
+
+// List files under folder
+func (Local) List(folder string) ([]string, error) {
+	res := make([]string, 0)
+	err := wutils.WalkFolderUnordered(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == folder {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			res = append(res, p)
+		}
+		return nil
+	})
+	sort.Strings(res)
+	return res, err
+}
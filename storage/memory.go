@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory files kept in memory, for the tests. The files removed or renamed stay usable by the opened
+// handles, as on a POSIX file system.
+type Memory struct {
+	mutex sync.Mutex
+	files map[string]*memoryFile
+}
+
+// NewMemory init an empty memory storage
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]*memoryFile)}
+}
+
+type memoryFile struct {
+	mutex   sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+type memoryHandle struct {
+	f      *memoryFile
+	closed bool
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi memoryFileInfo) Name() string       { return fi.name }
+func (fi memoryFileInfo) Size() int64        { return fi.size }
+func (fi memoryFileInfo) Mode() os.FileMode  { return 0744 }
+func (fi memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memoryFileInfo) IsDir() bool        { return false }
+func (fi memoryFileInfo) Sys() interface{}   { return nil }
+
+func cleanPath(p string) string {
+	return path.Clean(strings.ReplaceAll(p, "\\", "/"))
+}
+
+func notExist(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+// OpenFile open a file for read and write
+func (m *Memory) OpenFile(p string, create bool) (File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := cleanPath(p)
+	f, exists := m.files[key]
+	if !exists {
+		if !create {
+			return nil, notExist("open", p)
+		}
+		f = &memoryFile{modTime: time.Now()}
+		m.files[key] = f
+	}
+	return &memoryHandle{f: f}, nil
+}
+
+// Stat a file
+func (m *Memory) Stat(p string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	f, exists := m.files[cleanPath(p)]
+	m.mutex.Unlock()
+	if !exists {
+		return nil, notExist("stat", p)
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return memoryFileInfo{name: path.Base(cleanPath(p)), size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+// Rename a file
+func (m *Memory) Rename(oldPath, newPath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, exists := m.files[cleanPath(oldPath)]
+	if !exists {
+		return notExist("rename", oldPath)
+	}
+	delete(m.files, cleanPath(oldPath))
+	m.files[cleanPath(newPath)] = f
+	return nil
+}
+
+// Remove a file
+func (m *Memory) Remove(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.files[cleanPath(p)]; !exists {
+		return notExist("remove", p)
+	}
+	delete(m.files, cleanPath(p))
+	return nil
+}
+
+// List files under folder
+func (m *Memory) List(folder string) ([]string, error) {
+	prefix := cleanPath(folder) + "/"
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	res := make([]string, 0)
+	for p := range m.files {
+		if strings.HasPrefix(p, prefix) && !strings.Contains("/"+p[len(prefix):], "/.") {
+			res = append(res, p)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (h *memoryHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	h.f.mutex.RLock()
+	defer h.f.mutex.RUnlock()
+	if off >= int64(len(h.f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memoryHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+	if end := off + int64(len(p)); end > int64(len(h.f.data)) {
+		h.f.data = append(h.f.data, make([]byte, end-int64(len(h.f.data)))...)
+	}
+	copy(h.f.data[off:], p)
+	h.f.modTime = time.Now()
+	return len(p), nil
+}
+
+func (h *memoryHandle) Truncate(size int64) error {
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+	if size < int64(len(h.f.data)) {
+		h.f.data = h.f.data[:size]
+	} else {
+		h.f.data = append(h.f.data, make([]byte, size-int64(len(h.f.data)))...)
+	}
+	h.f.modTime = time.Now()
+	return nil
+}
+
+func (h *memoryHandle) Size() (int64, error) {
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	h.f.mutex.RLock()
+	defer h.f.mutex.RUnlock()
+	return int64(len(h.f.data)), nil
+}
+
+func (h *memoryHandle) Sync() error {
+	if h.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (h *memoryHandle) Close() error {
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.closed = true
+	return nil
+}
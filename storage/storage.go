@@ -0,0 +1,103 @@
+// Package storage abstracts the active and archived files so they can live elsewhere than on the local disk.
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// File opened from a Storage
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Size() (int64, error)
+	Sync() error
+	Close() error
+}
+
+// Storage of the active and archived files. The paths are slash separated.
+type Storage interface {
+	// OpenFile open a file for read and write. With create, a missing file is created with its parent folders.
+	// A missing file gives an error satisfying os.IsNotExist.
+	OpenFile(p string, create bool) (File, error)
+	// Stat a missing file gives an error satisfying os.IsNotExist
+	Stat(p string) (os.FileInfo, error)
+	// Rename move oldPath to newPath, replacing it, and create the parent folders of newPath
+	Rename(oldPath, newPath string) error
+	// Remove a file
+	Remove(p string) error
+	// List paths of the files under folder, recursively and sorted. The names starting with '.' are
+	// skipped. A missing folder is empty.
+	List(folder string) ([]string, error)
+}
+
+const copyBufferSize = 1 << 20
+
+// Copy the content of src to dst, from the start of the files
+func Copy(dst, src File) error {
+	size, err := src.Size()
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, copyBufferSize)
+	for offset := int64(0); offset < size; {
+		n, err := src.ReadAt(buffer, offset)
+		if n > 0 {
+			if _, err := dst.WriteAt(buffer[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile read the whole content of a file
+func ReadFile(s Storage, p string) ([]byte, error) {
+	f, err := s.OpenFile(p, false)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, size)
+	if _, err := f.ReadAt(content, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return content, nil
+}
+
+// WriteFile replace a file by content: it is written and synced in p.tmp then renamed to p
+func WriteFile(s Storage, p string, content []byte) error {
+	tmpPath := p + ".tmp"
+	f, err := s.OpenFile(tmpPath, true)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(content, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.Rename(tmpPath, p)
+}
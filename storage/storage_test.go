@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func testStorage(t *testing.T, s Storage, root string) {
+	if paths, err := s.List(root); err != nil || len(paths) != 0 {
+		t.Fatalf("missing folder should be empty: %v %v", paths, err)
+	}
+	if _, err := s.OpenFile(root+"/a/missing", false); !os.IsNotExist(err) {
+		t.Fatalf("open of a missing file should fail: %v", err)
+	}
+
+	f, err := s.OpenFile(root+"/a/b/f1", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := f.WriteAt([]byte{1, 2, 3}, 2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := f.Truncate(4); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if size, err := f.Size(); err != nil || size != 4 {
+		t.Fatalf("bad size %d %v", size, err)
+	}
+	buffer := make([]byte, 8)
+	n, _ := f.ReadAt(buffer, 0)
+	if !bytes.Equal(buffer[:n], []byte{0, 0, 1, 2}) {
+		t.Fatalf("bad content %v", buffer[:n])
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	g, err := s.OpenFile(root+"/c/.hidden", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := s.Rename(root+"/c/.hidden", root+"/d/f2"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the renamed file is still usable by the opened handle
+	if err := Copy(g, f); err != nil {
+		t.Fatalf("%v", err)
+	}
+	g.Close()
+	f.Close()
+	if _, err := f.WriteAt([]byte{1}, 0); err == nil {
+		t.Fatalf("write to a closed file should fail")
+	}
+
+	paths, err := s.List(root)
+	if err != nil || !reflect.DeepEqual(paths, []string{root + "/a/b/f1", root + "/d/f2"}) {
+		t.Fatalf("bad list %v %v", paths, err)
+	}
+	if st, err := s.Stat(root + "/d/f2"); err != nil || st.Size() != 4 {
+		t.Fatalf("bad stat %v", err)
+	}
+	if err := s.Remove(root + "/a/b/f1"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := s.Stat(root + "/a/b/f1"); !os.IsNotExist(err) {
+		t.Fatalf("removed file should not exist: %v", err)
+	}
+
+	for _, content := range []string{"first content", "second"} {
+		if err := WriteFile(s, root+"/e/f3", []byte(content)); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if read, err := ReadFile(s, root+"/e/f3"); err != nil || string(read) != content {
+			t.Fatalf("bad content %q %v", read, err)
+		}
+	}
+	if _, err := s.Stat(root + "/e/f3.tmp"); !os.IsNotExist(err) {
+		t.Fatalf("the temporary file should be renamed: %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	os.RemoveAll("data-test")
+	testStorage(t, Local{}, "data-test")
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory(), "data-test")
+}
+
+func TestFaults(t *testing.T) {
+	crashed := false
+	faults := NewFaultInjector(Fault{Point: FaultHeaderWrite, After: 1, ShortWrite: 3, Crash: true})
+	faults.OnCrash = func() { crashed = true }
+	s := WithFaults(NewMemory(), faults)
+
+	f, err := s.OpenFile("data-test/f", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := f.WriteAt([]byte{1, 1, 1, 1}, 0); err != nil {
+		t.Fatalf("first header write should succeed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{2, 2, 2, 2}, 8); err != nil {
+		t.Fatalf("data write should succeed: %v", err)
+	}
+	if n, err := f.WriteAt([]byte{3, 3, 3, 3}, 0); n != 3 || !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("second header write should be short: %d %v", n, err)
+	}
+	if !crashed || !faults.Crashed() {
+		t.Fatalf("OnCrash should be called")
+	}
+	buffer := make([]byte, 4)
+	f.ReadAt(buffer, 0)
+	if !bytes.Equal(buffer, []byte{3, 3, 3, 1}) {
+		t.Fatalf("bad content after short write %v", buffer)
+	}
+	if err := faults.Inject(FaultWALSync, nil); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("all the calls should fail after a crash: %v", err)
+	}
+}
@@ -3,6 +3,9 @@ package tablepacked
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
+	"time"
 )
 
 var errOverflow = errors.New("binary: varint overflows a 64-bit integer")
@@ -59,3 +62,34 @@ func writeColumnValueEncoding(buffer []byte, value uint64, isBuffer bool) ([]byt
 	n := binary.PutUvarint(tmpBuffer[:], ux)
 	return append(buffer, tmpBuffer[0:n]...), n
 }
+
+const (
+	// maxVarintInt biggest Tint value encoded in the varint. One bit of the varint is
+	// used to flag buffer encoding and one bit for the zigzag sign.
+	maxVarintInt = 1<<62 - 1
+	// minVarintInt smallest Tint value encoded in the varint
+	minVarintInt = -1 << 62
+	// intBufferLen length of the buffer of the Tint values out of the varint range
+	intBufferLen = 8
+)
+
+func zigzagEncode(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func zigzagDecode(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
+)
+
+// checkTimestampRange the Ttimestamp values are int64 nanoseconds since epoch
+func checkTimestampRange(t time.Time) error {
+	if t.Before(minTimestamp) || t.After(maxTimestamp) {
+		return fmt.Errorf("timestamp out of range: %s", t)
+	}
+	return nil
+}
@@ -15,6 +15,16 @@ const (
 	Tenum = 1
 	// Tstring string type
 	Tstring = 2
+	// Tint signed integer type of the int64 range (zigzag encoded, in a buffer beyond ±2^62)
+	Tint = 3
+	// Tfloat64 float64 type
+	Tfloat64 = 4
+	// Tbool bool type
+	Tbool = 5
+	// Ttimestamp timestamp type with a nanosecond precision
+	Ttimestamp = 6
+	// Tbytes raw bytes type
+	Tbytes = 7
 )
 
 // ColumnDescriptor describe a storage column
@@ -25,12 +35,20 @@ type ColumnDescriptor struct {
 	EnumValues    []string
 	NotNullable   bool
 	Type          DataType
+	// Default json value used when reading rows written before the column was added
+	Default json.RawMessage `json:",omitempty"`
+	// Indexed the rows of the active files can be found by the value of the column with Driver.Lookup
+	Indexed bool `json:",omitempty"`
 }
 
 // Table contains columns
 type Table struct {
 	Name    string
 	Columns []ColumnDescriptor
+	// Version of the columns. It is written in the file before the rows when it is not 0
+	Version uint32
+	// History previous versions of the columns used to read old rows
+	History []TableVersion `json:",omitempty"`
 }
 
 // UnmarshallJSONTableDescriptor unmarshall atable descriptor from a json file
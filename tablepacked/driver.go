@@ -2,9 +2,13 @@ package tablepacked
 
 import (
 	"database/sql"
+	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/metrics"
 	"github.com/chamot1111/waldb/wal"
 	"go.uber.org/zap"
 
@@ -21,67 +25,277 @@ type Driver struct {
 
 	shardWal            *wal.ShardWAL
 	archivedFileFuncter wal.ArchivedFileFuncter
+	tableDescriptorRepo map[string]Table
+
+	// what has been written in each file, by shard. Guarded by the shard lock.
+	writeStateByShard []map[string]fileWriteState
+	// secondary indexes, by shard. Guarded by the shard lock.
+	indexByShard []*shardIndex
+	// sqliteSealer opens the values of the encrypted sqlite files, nil without KeyProvider
+	sqliteSealer *sqliteSealer
+}
+
+// fileWriteState framing of a file and last schema version written in it
+type fileWriteState struct {
+	framing       uint8
+	schemaVersion uint32
 }
 
-// InitDriver init packed table dirver
+// InitDriver init packed table dirver. The archived files are inserted in sqlite.
 func InitDriver(conf config.Config, logger *zap.Logger, tableDescriptorRepo map[string]Table) (*Driver, error) {
-	sqlite3Archiver := &sqlite3Archiver{
+	return InitDriverWithArchiver(conf, logger, tableDescriptorRepo, NewSqliteArchiver(conf, logger, tableDescriptorRepo))
+}
+
+// Archiver archived file functer removing the archived files it has processed. It can also be a sink
+// of a wal.FanOut, which removes the archived files once all its sinks have processed them.
+type Archiver interface {
+	wal.ArchivedFileFuncter
+	wal.ArchivedFileSink
+}
+
+// NewSqliteArchiver archiver inserting the rows of the archived files in one sqlite file by table
+func NewSqliteArchiver(conf config.Config, logger *zap.Logger, tableDescriptorRepo map[string]Table) Archiver {
+	return &sqlite3Archiver{
 		logger:              logger,
 		config:              conf,
 		rowDataPool:         NewRowDataPool(),
 		tableDescriptorRepo: tableDescriptorRepo,
 		bdByTable:           map[string]*sql.DB{},
+		sealer:              newSqliteSealer(conf.KeyProvider),
 	}
-	shardWal, err := wal.InitShardWAL(conf, logger, sqlite3Archiver)
+}
+
+// InitDriverWithArchiver init packed table driver with the archiver of the archived files, for example
+// NewParquetArchiver. A nil archiver keeps the archived files.
+func InitDriverWithArchiver(conf config.Config, logger *zap.Logger, tableDescriptorRepo map[string]Table, archiver wal.ArchivedFileFuncter) (*Driver, error) {
+	shardWal, err := wal.InitShardWAL(conf, logger, archiver)
 	if err != nil {
 		return nil, err
 	}
-	return &Driver{
+	writeStateByShard := make([]map[string]fileWriteState, conf.ShardCount)
+	for i := range writeStateByShard {
+		writeStateByShard[i] = map[string]fileWriteState{}
+	}
+	d := &Driver{
 		conf:                conf,
 		logger:              logger,
 		shardWal:            shardWal,
 		rowDataPool:         NewRowDataPool(),
 		bufferPool:          NewBufPool(),
-		archivedFileFuncter: sqlite3Archiver,
-	}, nil
+		archivedFileFuncter: archiver,
+		tableDescriptorRepo: tableDescriptorRepo,
+		writeStateByShard:   writeStateByShard,
+		sqliteSealer:        newSqliteSealer(conf.KeyProvider),
+	}
+	if err := d.loadIndexes(); err != nil {
+		shardWal.CloseAll()
+		return nil, fmt.Errorf("could not load the indexes: %w", err)
+	}
+	return d, nil
 }
 
 // GetReplicator get replicator
 func (d *Driver) GetReplicator() *wal.Replicator {
-	return wal.InitReplicator(d.shardWal.GetArchiveEventChan(), d.conf.ReplicationActiveFolder, d.conf.ReplicationArchiveFolder, d.conf.ArchiveCommand, d.logger)
+	r := wal.InitReplicator(d.shardWal.GetArchiveEventChan(), d.conf.ReplicationActiveFolder, d.conf.ReplicationArchiveFolder, d.conf.ArchiveCommand, d.logger)
+	r.SetStorage(d.conf.GetStorage())
+	r.SetKeyProvider(d.conf.KeyProvider)
+	r.SetLayout(d.conf.GetLayout())
+	if d.conf.WalArchiveRetentionS > 0 || d.conf.ReplicationLeaderAddr != "" {
+		r.SetRetention(time.Duration(d.conf.WalArchiveRetentionS) * time.Second)
+	}
+	return r
+}
+
+// GetReplicationLeader get a replication leader serving the archived wal files.
+// Call Listen with ReplicationLeaderAddr to start it.
+func (d *Driver) GetReplicationLeader() *wal.ReplicationLeader {
+	return wal.InitReplicationLeader(d.conf, d.logger)
+}
+
+// Snapshot copy the active files and the wal states to dest without stopping the writes
+func (d *Driver) Snapshot(dest string) (*wal.SnapshotManifest, error) {
+	return d.shardWal.Snapshot(dest)
+}
+
+// ListDeadLetters commands dropped after the max retry count
+func (d *Driver) ListDeadLetters() ([]wal.DeadLetter, error) {
+	return wal.ListDeadLetters(d.conf)
 }
 
-// AppendRowData append rows to a container file
+// ReadDeadLetter commands of a dead letter with their data
+func (d *Driver) ReadDeadLetter(id string) (wal.DeadLetter, error) {
+	return wal.ReadDeadLetter(d.conf, id)
+}
+
+// ReplayDeadLetter append the commands of a dead letter to the wal and discard it
+func (d *Driver) ReplayDeadLetter(id string) error {
+	replayed := make(map[string]config.ContainerFile)
+	err := d.shardWal.ReplayDeadLetter(id, func(si uint32, cf config.ContainerFile) {
+		delete(d.writeStateByShard[si], cf.Key())
+		replayed[cf.Key()] = cf
+	})
+	for _, cf := range replayed {
+		si := d.shardWal.ShardIndex(cf)
+		d.shardWal.LockShardIndex(si)
+		errIndex := d.reindexFile(si, cf, d.shardWal.GetWalForShardIndex(si))
+		d.shardWal.UnlockShardIndex(si)
+		if err == nil {
+			err = errIndex
+		}
+	}
+	return err
+}
+
+// DiscardDeadLetter remove a dead letter without replaying it
+func (d *Driver) DiscardDeadLetter(id string) error {
+	return wal.DiscardDeadLetter(d.conf, id)
+}
+
+// MetricsHandler serve the metrics in the Prometheus text format, typically on /metrics
+func (d *Driver) MetricsHandler() http.Handler {
+	return metrics.Default.Handler()
+}
+
+// AppendRowData append rows to a container file. Depending on the durability mode, it returns
+// once the rows are fsynced to the wal.
 func (d *Driver) AppendRowData(cf config.ContainerFile, rows []*RowData) error {
-	si := cf.ShardIndex(uint32(d.conf.ShardCount))
+	si := d.shardWal.ShardIndex(cf)
+	seq, err := d.appendRowData(si, cf, rows)
+	if err != nil {
+		return err
+	}
+	return d.shardWal.WaitDurable(si, seq)
+}
+
+func (d *Driver) appendRowData(si uint32, cf config.ContainerFile, rows []*RowData) (uint64, error) {
 	d.shardWal.LockShardIndex(si)
 	defer d.shardWal.UnlockShardIndex(si)
 
 	wal := d.shardWal.GetWalForShardIndex(si)
 
-	return appendRowDataToFile(cf, wal, rows)
+	state, header, err := d.writeStateAndHeader(si, cf, wal)
+	if err != nil {
+		return 0, err
+	}
+	descriptor := d.tableDescriptor(cf)
+	var base int64
+	if descriptor.hasIndexedColumn() {
+		reader, err := wal.GetFileReader(cf)
+		if err != nil {
+			return 0, err
+		}
+		base = reader.Size()
+	}
+	offsets, err := appendRowDataToFile(cf, wal, rows, state.framing, header)
+	if err != nil {
+		delete(d.writeStateByShard[si], cf.Key())
+		return 0, err
+	}
+	d.writeStateByShard[si][cf.Key()] = state
+	// the rows are in the wal: a failed indexing must not fail the append
+	if descriptor.hasIndexedColumn() {
+		if err := d.indexAppendedRows(si, cf, wal, descriptor, uint64(base), rows, offsets); err != nil {
+			d.logger.Error("could not index the appended rows, the file is indexed again by the next lookup", zap.String("container-file", cf.Key()), zap.Error(err))
+			d.markStale(si, cf)
+		}
+	}
+	return wal.MutationSeq(), nil
+}
+
+// writeStateAndHeader return the state of the file after the append and the meta frames
+// to write before the rows. The framing of a file not written yet by the driver is read from its head.
+// Unversioned tables never write the schema version.
+func (d *Driver) writeStateAndHeader(si uint32, cf config.ContainerFile, wal *wal.WAL) (fileWriteState, []byte, error) {
+	var header []byte
+	state, exists := d.writeStateByShard[si][cf.Key()]
+	if !exists {
+		framing, empty, err := readFileFraming(cf, wal)
+		if err != nil {
+			return state, nil, err
+		}
+		state = fileWriteState{framing: framing}
+		if empty {
+			header = append(header, framingHeader...)
+		}
+	}
+	descriptor, exists := d.tableDescriptorRepo[cf.TableName]
+	if exists && descriptor.Version != 0 && descriptor.Version != state.schemaVersion {
+		header = appendMetaFrame(header, state.framing, metaKindSchemaVersion, uint64(descriptor.Version))
+		state.schemaVersion = descriptor.Version
+	}
+	return state, header, nil
+}
+
+func (d *Driver) tableDescriptor(cf config.ContainerFile) *Table {
+	descriptor, exists := d.tableDescriptorRepo[cf.TableName]
+	if !exists {
+		return nil
+	}
+	return &descriptor
 }
 
 // RemoveContent append rows to a container file
 func (d *Driver) RemoveContent(cf config.ContainerFile) error {
-	si := cf.ShardIndex(uint32(d.conf.ShardCount))
+	si := d.shardWal.ShardIndex(cf)
+	seq, err := d.removeContent(si, cf)
+	if err != nil {
+		return err
+	}
+	return d.shardWal.WaitDurable(si, seq)
+}
+
+func (d *Driver) removeContent(si uint32, cf config.ContainerFile) (uint64, error) {
 	d.shardWal.LockShardIndex(si)
 	defer d.shardWal.UnlockShardIndex(si)
 
 	wal := d.shardWal.GetWalForShardIndex(si)
+	delete(d.writeStateByShard[si], cf.Key())
+	d.removeFileIndex(si, cf)
 
-	return wal.Truncate(cf, 0)
+	err := wal.Truncate(cf, 0)
+	return wal.MutationSeq(), err
 }
 
 // ReadAllRowData from file
 func (d *Driver) ReadAllRowData(cf config.ContainerFile) (TableDataSlice, error) {
-	si := cf.ShardIndex(uint32(d.conf.ShardCount))
+	si := d.shardWal.ShardIndex(cf)
+	d.shardWal.LockShardIndex(si)
+	defer d.shardWal.UnlockShardIndex(si)
+
+	wal := d.shardWal.GetWalForShardIndex(si)
+
+	t, truncated, err := readAllRowDataFromFileCorruptSafe(cf, wal, d.tableDescriptor(cf), d.rowDataPool, d.bufferPool)
+	if truncated {
+		// the truncation of a corrupted file may have removed the meta frames
+		delete(d.writeStateByShard[si], cf.Key())
+		if errIndex := d.reindexFile(si, cf, wal); errIndex != nil && err == nil {
+			err = errIndex
+		}
+	}
+	if err != nil {
+		return TableDataSlice{}, err
+	}
+	return InitTableDataSlice(t), nil
+}
+
+// ScanRows read the rows matching the options without loading the whole file in memory
+func (d *Driver) ScanRows(cf config.ContainerFile, opts ScanOptions) (TableDataSlice, error) {
+	si := d.shardWal.ShardIndex(cf)
 	d.shardWal.LockShardIndex(si)
 	defer d.shardWal.UnlockShardIndex(si)
 
 	wal := d.shardWal.GetWalForShardIndex(si)
 
-	t, err := ReadAllRowDataFromFileCorruptSafe(cf, wal, d.rowDataPool, d.bufferPool)
+	if opts.Table == nil {
+		opts.Table = d.tableDescriptor(cf)
+	}
+	t, truncated, err := scanRowsFromFileCorruptSafe(cf, wal, opts, d.rowDataPool)
+	if truncated {
+		delete(d.writeStateByShard[si], cf.Key())
+		if errIndex := d.reindexFile(si, cf, wal); errIndex != nil && err == nil {
+			err = errIndex
+		}
+	}
 	if err != nil {
 		return TableDataSlice{}, err
 	}
@@ -90,13 +304,24 @@ func (d *Driver) ReadAllRowData(cf config.ContainerFile) (TableDataSlice, error)
 
 // Archive archive the file
 func (d *Driver) Archive(cf config.ContainerFile) error {
-	si := cf.ShardIndex(uint32(d.conf.ShardCount))
+	si := d.shardWal.ShardIndex(cf)
+	seq, err := d.archive(si, cf)
+	if err != nil {
+		return err
+	}
+	return d.shardWal.WaitDurable(si, seq)
+}
+
+func (d *Driver) archive(si uint32, cf config.ContainerFile) (uint64, error) {
 	d.shardWal.LockShardIndex(si)
 	defer d.shardWal.UnlockShardIndex(si)
 
 	wal := d.shardWal.GetWalForShardIndex(si)
+	delete(d.writeStateByShard[si], cf.Key())
+	d.removeFileIndex(si, cf)
 
-	return wal.Archive(cf)
+	err := wal.Archive(cf)
+	return wal.MutationSeq(), err
 }
 
 // FreeTable free table
@@ -112,12 +337,18 @@ func (d *Driver) FreeTable(t TableDataSlice) {
 // Flush all pending action to file
 func (d *Driver) Flush() (errOpsCount int, err error) {
 	errOpsCountL, errors := d.shardWal.FlushAll()
-	return errOpsCountL, errors.Err()
+	if errors.Err() != nil {
+		return errOpsCountL, errors.Err()
+	}
+	return errOpsCountL, d.saveIndexes()
 }
 
 // Close flush all pending action to file and close all files
 func (d *Driver) Close() error {
-	return d.shardWal.CloseAll().Err()
+	if err := d.shardWal.CloseAll().Err(); err != nil {
+		return err
+	}
+	return d.saveIndexes()
 }
 
 // ExecRsyncCommand will clean up, pause, execute the rsync command and resume
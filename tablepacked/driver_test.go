@@ -2,13 +2,16 @@ package tablepacked
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"sync/atomic"
 	"testing"
 
 	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -151,27 +154,27 @@ func TestShardCrc(t *testing.T) {
 
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0744)
 	if err != nil {
-		t.Errorf("could not open file %s: %w", path, err)
+		t.Errorf("could not open file %s: %v", path, err)
 	}
 
 	bytes, err := ioutil.ReadAll(bufio.NewReader(file))
 	if err != nil {
-		t.Errorf("could not open file %s: %w", path, err)
+		t.Errorf("could not open file %s: %v", path, err)
 	}
 
 	_, err = file.Seek(0, 0)
 	if err != nil {
-		t.Errorf("could not open file %s: %w", path, err)
+		t.Errorf("could not open file %s: %v", path, err)
 	}
 
 	_, err = file.WriteAt([]byte{15}, int64(len(bytes))-1)
 	if err != nil {
-		t.Errorf("could not open file %s: %w", path, err)
+		t.Errorf("could not open file %s: %v", path, err)
 	}
 
 	err = file.Sync()
 	if err != nil {
-		t.Errorf("could not open file %s: %w", path, err)
+		t.Errorf("could not open file %s: %v", path, err)
 	}
 
 	resRows, err := bfo.ReadAllRowData(cf)
@@ -331,3 +334,148 @@ func BenchmarkWrites(b *testing.B) {
 		}
 	})
 }
+
+func TestGroupCommit(t *testing.T) {
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
+	logger := zap.New(core).WithOptions()
+
+	sc := config.InitDefaultTestConfig()
+	sc.WALDurability = config.WALDurabilityGroupCommit
+
+	os.RemoveAll("data-test")
+
+	bfo, err := InitDriver(*sc, logger, map[string]Table{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "group")
+	si := cf.ShardIndex(uint32(sc.ShardCount))
+
+	const writerCount = 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writerCount)
+	for i := 0; i < writerCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- bfo.AppendRowData(cf, []*RowData{scanTestRow(i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	wal := bfo.shardWal.GetWalForShardIndex(si)
+	if wal.DurableSeq() < wal.MutationSeq() {
+		t.Fatalf("all the writes should be durable")
+	}
+
+	res, err := bfo.ReadAllRowData(cf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != writerCount {
+		t.Fatalf("should have read %d but get %d", writerCount, res.Len())
+	}
+	bfo.Close()
+}
+
+func TestLayoutAndRouter(t *testing.T) {
+	logger := zap.NewNop()
+	sc := config.InitDefaultTestConfig()
+	sc.Layout = "hashed:2x2"
+	sc.Router = config.MappingRouter{Containers: map[string]uint32{"big": 5}}
+
+	os.RemoveAll("data-test")
+
+	tables := map[string]Table{"query": queryTable}
+	driver, err := InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+
+	cf := config.NewContainerFileWTableName("big", "b1", "bb1", "query")
+	if err := driver.AppendRowData(cf, []*RowData{{Data: []ColumnData{{EncodedRawValue: 1}, {EncodedRawValue: 1, Buffer: []byte("a")}, NewIntColumnData(1)}}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if driver.shardWal.ShardIndex(cf) != 5 || driver.shardWal.GetWalForShardIndex(5).MutationSeq() == 0 {
+		t.Fatalf("the write should be routed to the mapped shard")
+	}
+	if _, err := driver.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(cf.PathInLayout(config.HashedLayout{Levels: 2, Width: 2}, sc.ActiveFolder)); err != nil {
+		t.Fatalf("active file should be in the hashed layout: %v", err)
+	}
+	if err := driver.Archive(cf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := driver.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitArchivedRows(t, driver, 1)
+}
+
+func TestEncryption(t *testing.T) {
+	logger := zap.NewNop()
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	sc := config.InitDefaultTestConfig()
+	sc.KeyProvider = keys
+
+	os.RemoveAll("data-test")
+
+	driver, err := InitDriver(*sc, logger, map[string]Table{"query": queryTable})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "query")
+	if err := driver.AppendRowData(cf, []*RowData{{Data: []ColumnData{{EncodedRawValue: 1}, {EncodedRawValue: 12, Buffer: []byte("secret-value")}, NewIntColumnData(1)}}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := driver.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	raw, err := ioutil.ReadFile(cf.PathToFile(*sc))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if bytes.Contains(raw, []byte("secret-value")) {
+		t.Fatalf("the active file should be encrypted")
+	}
+	rows, err := driver.ReadAllRowData(cf)
+	if err != nil || rows.Len() != 1 {
+		t.Fatalf("the encrypted active file should be read: %v", err)
+	}
+
+	// the sqlite archiver reads the encrypted archived file and encrypts the values it inserts
+	if err := driver.Archive(cf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := driver.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitArchivedRows(t, driver, 1)
+	raw, err = ioutil.ReadFile(SqliteDbPathForTableName(*sc, "query"))
+	if err != nil || bytes.Contains(raw, []byte("secret-value")) {
+		t.Fatalf("the sqlite file should be encrypted: %v", err)
+	}
+}
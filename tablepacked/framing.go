@@ -0,0 +1,98 @@
+package tablepacked
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/wal"
+)
+
+// Row framing versions. A frame is [uint16 len][content][checksum].
+// Files start with the additive framing: a file written with another framing starts
+// with a meta frame giving it. Old files without this meta frame keep the additive framing.
+const (
+	// rowFramingAdditiveCrc the checksum is an 8-bit additive sum of the content
+	rowFramingAdditiveCrc uint8 = 1
+	// rowFramingCrc32c the checksum is a big endian CRC32C (Castagnoli) of the length and the content
+	rowFramingCrc32c uint8 = 2
+)
+
+const curRowFraming = rowFramingCrc32c
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func crcForBuffer(buffer []byte) uint8 {
+	var res uint8 = 128
+	for i := 0; i < len(buffer); i++ {
+		res = res + buffer[i]
+	}
+	return res
+}
+
+func frameChecksumLen(framing uint8) int {
+	if framing == rowFramingAdditiveCrc {
+		return 1
+	}
+	return 4
+}
+
+// frameChecksumOK verify the checksum of a frame
+func frameChecksumOK(framing uint8, lenBuffer []byte, content []byte, checksum []byte) bool {
+	if len(checksum) != frameChecksumLen(framing) {
+		return false
+	}
+	if framing == rowFramingAdditiveCrc {
+		return crcForBuffer(content) == checksum[0]
+	}
+	crc := crc32.Update(0, crc32cTable, lenBuffer)
+	crc = crc32.Update(crc, crc32cTable, content)
+	return crc == binary.BigEndian.Uint32(checksum)
+}
+
+func appendFrame(buffer []byte, content []byte, framing uint8) []byte {
+	var lenBuffer [2]byte
+	binary.BigEndian.PutUint16(lenBuffer[:], uint16(len(content)))
+	buffer = append(buffer, lenBuffer[:]...)
+	buffer = append(buffer, content...)
+	if framing == rowFramingAdditiveCrc {
+		return append(buffer, crcForBuffer(content))
+	}
+	crc := crc32.Update(0, crc32cTable, lenBuffer[:])
+	crc = crc32.Update(crc, crc32cTable, content)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc)
+	return append(buffer, checksum[:]...)
+}
+
+// appendMetaFrame append an empty frame followed by the meta frame
+func appendMetaFrame(buffer []byte, framing uint8, kind uint64, value uint64) []byte {
+	buffer = appendFrame(buffer, nil, framing)
+	return appendFrame(buffer, metaFrameBuffer(kind, value), framing)
+}
+
+// framingHeader meta frames at the start of a file written with the current framing
+var framingHeader = appendMetaFrame(nil, rowFramingAdditiveCrc, metaKindRowFraming, uint64(curRowFraming))
+
+// readFileFraming detect the framing of a file from its first bytes
+func readFileFraming(cf config.ContainerFile, wal *wal.WAL) (framing uint8, empty bool, err error) {
+	reader, err := wal.GetFileReader(cf)
+	if err != nil {
+		return 0, false, err
+	}
+	if reader.Size() == 0 {
+		return curRowFraming, true, nil
+	}
+	if reader.Size() < int64(len(framingHeader)) {
+		return rowFramingAdditiveCrc, false, nil
+	}
+	head := make([]byte, len(framingHeader))
+	if _, err := reader.ReadAt(head, 0); err != nil {
+		return 0, false, err
+	}
+	if bytes.Equal(head, framingHeader) {
+		return curRowFraming, false, nil
+	}
+	return rowFramingAdditiveCrc, false, nil
+}
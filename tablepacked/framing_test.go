@@ -0,0 +1,101 @@
+package tablepacked
+
+import (
+	"os"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/wutils"
+)
+
+func TestRowFramingChecksum(t *testing.T) {
+	rowDataPool := NewRowDataPool()
+
+	rows := []*RowData{scanTestRow(0), scanTestRow(1), scanTestRow(2)}
+	var bBuffer [128]byte
+	buffer := append([]byte{}, framingHeader...)
+	rowOffsets := make([]int, 0)
+	for _, r := range rows {
+		rowOffsets = append(rowOffsets, len(buffer))
+		buffer = appendFrame(buffer, r.WriteToBuffer(bBuffer[0:0]), curRowFraming)
+	}
+
+	table, err := ReadAllRowDataFromFileBuffer(wutils.NewBuffer(append([]byte{}, buffer...)), rowDataPool)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(table.Data) != 3 {
+		t.Fatalf("should have read %d but get %d", 3, len(table.Data))
+	}
+
+	// swap two bytes of the second row: an additive checksum could not detect it
+	corrupted := append([]byte{}, buffer...)
+	s := rowOffsets[1] + 3
+	corrupted[s], corrupted[s+1] = corrupted[s+1], corrupted[s]
+	table, err = ReadAllRowDataFromFileBuffer(wutils.NewBuffer(corrupted), rowDataPool)
+	errCrc, ok := err.(*ErrBadEndingCRC)
+	if !ok {
+		t.Fatalf("should get a crc error: %v", err)
+	}
+	if errCrc.RowIndex != 1 || errCrc.Offset != rowOffsets[1] || errCrc.SaneOffset != rowOffsets[1] || len(table.Data) != 1 {
+		t.Fatalf("bad crc error: %v (sane offset %d)", errCrc, errCrc.SaneOffset)
+	}
+}
+
+func TestRowFramingAdditiveFile(t *testing.T) {
+	logger := schemaTestLogger()
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	bfo, err := InitDriver(*sc, logger, map[string]Table{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "framing")
+
+	// file written before the crc32c framing
+	var bBuffer [128]byte
+	oldContent := appendFrame(nil, scanTestRow(0).WriteToBuffer(bBuffer[0:0]), rowFramingAdditiveCrc)
+	wal := bfo.shardWal.GetWalForShardIndex(cf.ShardIndex(uint32(sc.ShardCount)))
+	if err := wal.AppendWrite(cf, oldContent); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := bfo.AppendRowData(cf, []*RowData{scanTestRow(1)}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	res, err := bfo.ReadAllRowData(cf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != 2 || res.Row(1).Data[0].EncodedRawValue != 1 {
+		t.Fatalf("old file should keep its framing")
+	}
+
+	// an emptied file is written again with the current framing
+	if err := bfo.RemoveContent(cf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := bfo.AppendRowData(cf, []*RowData{scanTestRow(2)}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	framing, _, err := readFileFraming(cf, wal)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if framing != curRowFraming {
+		t.Fatalf("should use the current framing but get %d", framing)
+	}
+	res, err = bfo.ScanRows(cf, ScanOptions{Reverse: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != 1 || res.Row(0).Data[0].EncodedRawValue != 2 {
+		t.Fatalf("bad rows after remove content")
+	}
+
+	bfo.Close()
+}
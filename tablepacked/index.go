@@ -0,0 +1,436 @@
+package tablepacked
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wal"
+	"go.uber.org/zap"
+)
+
+// Secondary indexes give the offsets of the rows of the active files by value of the indexed columns.
+// There is one index per shard, guarded by the shard lock. They are saved in IndexFolder of the storage by Flush and
+// Close, and brought up to date with the active files by InitDriver: a file whose size or modification
+// time is not the one of its saved index is indexed again. A file whose rows could not be indexed on append
+// is indexed again by the next lookup.
+
+// ErrColumnNotIndexed the column of a lookup is not indexed
+var ErrColumnNotIndexed = errors.New("column not indexed")
+
+// IndexMatch rows of a container file found by a lookup
+type IndexMatch struct {
+	ContainerFile config.ContainerFile
+	// Offsets of the row frames in the data of the file
+	Offsets []uint64
+}
+
+// fileIndex index of the rows of a container file
+type fileIndex struct {
+	ContainerFile config.ContainerFile
+	// Size data size of the file covered by the index
+	Size uint64
+	// ModTime modification time in nanoseconds of the active file when the index has been saved
+	ModTime int64
+	// Columns offsets of the rows by column name and value key
+	Columns map[string]map[string][]uint64
+}
+
+// shardIndex indexes of the container files of a shard
+type shardIndex struct {
+	files map[string]*fileIndex
+	// stale files to index again
+	stale map[string]config.ContainerFile
+	dirty bool
+}
+
+func newShardIndex() *shardIndex {
+	return &shardIndex{files: make(map[string]*fileIndex), stale: make(map[string]config.ContainerFile)}
+}
+
+// hasIndexedColumn the table has at least one indexed column
+func (t *Table) hasIndexedColumn() bool {
+	if t == nil {
+		return false
+	}
+	for _, c := range t.Columns {
+		if c.Indexed {
+			return true
+		}
+	}
+	return false
+}
+
+func newFileIndex(cf config.ContainerFile, table *Table) *fileIndex {
+	fi := &fileIndex{
+		ContainerFile: cf,
+		Columns:       make(map[string]map[string][]uint64),
+	}
+	for _, c := range table.Columns {
+		if c.Indexed {
+			fi.Columns[c.Name] = make(map[string][]uint64)
+		}
+	}
+	return fi
+}
+
+// upToDate the index covers size bytes and the indexed columns of table
+func (fi *fileIndex) upToDate(table *Table, size uint64) bool {
+	if fi.Size != size {
+		return false
+	}
+	count := 0
+	for _, c := range table.Columns {
+		if !c.Indexed {
+			continue
+		}
+		if _, exists := fi.Columns[c.Name]; !exists {
+			return false
+		}
+		count++
+	}
+	return count == len(fi.Columns)
+}
+
+// indexValueKey key of a value in the index. Null values are not indexed.
+func indexValueKey(cd ColumnData) (string, bool) {
+	if cd.IsNull() {
+		return "", false
+	}
+	if cd.Buffer != nil {
+		return "b" + base64.RawStdEncoding.EncodeToString(cd.Buffer), true
+	}
+	return "v" + strconv.FormatUint(cd.EncodedRawValue, 10), true
+}
+
+// add the row at offset. The row must have the columns of table.
+func (fi *fileIndex) add(table *Table, row *RowData, offset uint64) {
+	for ci, c := range table.Columns {
+		if !c.Indexed || ci >= len(row.Data) {
+			continue
+		}
+		key, ok := indexValueKey(row.Data[ci])
+		if !ok {
+			continue
+		}
+		values := fi.Columns[c.Name]
+		if values == nil {
+			values = make(map[string][]uint64)
+			fi.Columns[c.Name] = values
+		}
+		values[key] = append(values[key], offset)
+	}
+}
+
+// indexFile index all the rows of a file. The rows following a corruption are not indexed.
+func indexFile(cf config.ContainerFile, r io.ReaderAt, size int64, table *Table) (*fileIndex, error) {
+	fi := newFileIndex(cf, table)
+	fi.Size = uint64(size)
+	upgrader, err := newRowUpgrader(table)
+	if err != nil {
+		return fi, err
+	}
+	fr := newFrameReader(r, size)
+	state := frameState{framing: rowFramingAdditiveCrc}
+	row := &RowData{}
+	var off int64 = 0
+	for off < size {
+		frame, next, err := fr.frameAt(off, state.framing)
+		if err == nil && len(frame) == 0 {
+			state, next, err = fr.metaAt(off, next, state)
+			if err == nil {
+				off = next
+				continue
+			}
+		}
+		if err != nil {
+			if _, ok := err.(*ErrBadEndingCRC); ok {
+				return fi, nil
+			}
+			return fi, err
+		}
+		if err := ReadFromBuffer(frame, row); err != nil {
+			return fi, err
+		}
+		if err := upgrader.upgrade(row, state.version); err != nil {
+			return fi, err
+		}
+		fi.add(table, row, uint64(off))
+		off = next
+	}
+	return fi, nil
+}
+
+// indexAppendedRows add the rows appended at base to the index of cf. The file is indexed again if
+// the index does not end at base. Must be called with the shard lock held.
+func (d *Driver) indexAppendedRows(si uint32, cf config.ContainerFile, w *wal.WAL, table *Table, base uint64, rows []*RowData, offsets []uint64) error {
+	index := d.indexByShard[si]
+	fi, exists := index.files[cf.Key()]
+	if _, stale := index.stale[cf.Key()]; stale {
+		return d.reindexFile(si, cf, w)
+	}
+	if !exists && base == 0 {
+		fi = newFileIndex(cf, table)
+	} else if !exists || !fi.upToDate(table, base) {
+		return d.reindexFile(si, cf, w)
+	}
+	for i, r := range rows {
+		fi.add(table, r, base+offsets[i])
+	}
+	reader, err := w.GetFileReader(cf)
+	if err != nil {
+		delete(index.files, cf.Key())
+		return err
+	}
+	fi.Size = uint64(reader.Size())
+	index.files[cf.Key()] = fi
+	index.dirty = true
+	return nil
+}
+
+// reindexFile index again all the rows of cf. Must be called with the shard lock held.
+func (d *Driver) reindexFile(si uint32, cf config.ContainerFile, w *wal.WAL) error {
+	index := d.indexByShard[si]
+	delete(index.files, cf.Key())
+	index.dirty = true
+	table := d.tableDescriptor(cf)
+	if !table.hasIndexedColumn() {
+		return nil
+	}
+	reader, err := w.GetFileReader(cf)
+	if err != nil {
+		return err
+	}
+	if reader.Size() == 0 {
+		return nil
+	}
+	fi, err := indexFile(cf, reader, reader.Size(), table)
+	if err != nil {
+		return fmt.Errorf("could not index %s: %w", cf.Key(), err)
+	}
+	index.files[cf.Key()] = fi
+	delete(index.stale, cf.Key())
+	return nil
+}
+
+// markStale index again cf at the next lookup. Must be called with the shard lock held.
+func (d *Driver) markStale(si uint32, cf config.ContainerFile) {
+	index := d.indexByShard[si]
+	delete(index.files, cf.Key())
+	index.stale[cf.Key()] = cf
+	index.dirty = true
+}
+
+// reindexStaleFiles index again the stale files of a shard. Must be called with the shard lock held.
+func (d *Driver) reindexStaleFiles(si uint32) error {
+	for _, cf := range d.indexByShard[si].stale {
+		if err := d.reindexFile(si, cf, d.shardWal.GetWalForShardIndex(si)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFileIndex forget the rows of cf. Must be called with the shard lock held.
+func (d *Driver) removeFileIndex(si uint32, cf config.ContainerFile) {
+	index := d.indexByShard[si]
+	delete(index.stale, cf.Key())
+	if _, exists := index.files[cf.Key()]; exists {
+		delete(index.files, cf.Key())
+		index.dirty = true
+	}
+}
+
+// Lookup container files and offsets of the rows of the active files of table whose column equals value.
+// The column must be indexed. Null values are not indexed.
+func (d *Driver) Lookup(table, column string, value ColumnData) ([]IndexMatch, error) {
+	descriptor, exists := d.tableDescriptorRepo[table]
+	if !exists {
+		return nil, fmt.Errorf("unknown table %s", table)
+	}
+	indexed := false
+	for _, c := range descriptor.Columns {
+		if c.Name == column && c.Indexed {
+			indexed = true
+			break
+		}
+	}
+	if !indexed {
+		return nil, fmt.Errorf("%w: %s.%s", ErrColumnNotIndexed, table, column)
+	}
+	res := make([]IndexMatch, 0)
+	key, ok := indexValueKey(value)
+	if !ok {
+		return res, nil
+	}
+	for si := range d.indexByShard {
+		d.shardWal.LockShardIndex(uint32(si))
+		if err := d.reindexStaleFiles(uint32(si)); err != nil {
+			d.shardWal.UnlockShardIndex(uint32(si))
+			return nil, err
+		}
+		for _, fi := range d.indexByShard[si].files {
+			if fi.ContainerFile.TableName != table {
+				continue
+			}
+			offsets := fi.Columns[column][key]
+			if len(offsets) == 0 {
+				continue
+			}
+			res = append(res, IndexMatch{
+				ContainerFile: fi.ContainerFile,
+				Offsets:       append([]uint64(nil), offsets...),
+			})
+		}
+		d.shardWal.UnlockShardIndex(uint32(si))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ContainerFile.Key() < res[j].ContainerFile.Key() })
+	return res, nil
+}
+
+func indexFilePath(folder string, si int) string {
+	return path.Join(folder, fmt.Sprintf("index-s%05d.json", si))
+}
+
+// savedIndexPaths paths of the shard indexes saved in folder
+func savedIndexPaths(store storage.Storage, folder string) ([]string, error) {
+	paths, err := store.List(folder)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if matched, _ := path.Match(path.Join(path.Clean(folder), "index-s*.json"), p); matched {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+// saveIndexes write the modified shard indexes in IndexFolder of the storage, encrypted with the
+// active files
+func (d *Driver) saveIndexes() error {
+	if d.conf.IndexFolder == "" {
+		return nil
+	}
+	for si, index := range d.indexByShard {
+		d.shardWal.LockShardIndex(uint32(si))
+		err := d.saveShardIndex(si, index)
+		d.shardWal.UnlockShardIndex(uint32(si))
+		if err != nil {
+			return fmt.Errorf("could not save index of shard %d: %w", si, err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) saveShardIndex(si int, index *shardIndex) error {
+	if !index.dirty {
+		return nil
+	}
+	store := d.conf.GetStorage()
+	files := make([]*fileIndex, 0, len(index.files))
+	for _, fi := range index.files {
+		// the file is indexed again at the start if modified meanwhile, even to the same size
+		fi.ModTime = 0
+		if st, err := store.Stat(fi.ContainerFile.PathToFile(d.conf)); err == nil {
+			fi.ModTime = st.ModTime().UnixNano()
+		}
+		files = append(files, fi)
+	}
+	content, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFile(store, indexFilePath(d.conf.IndexFolder, si), content); err != nil {
+		return err
+	}
+	index.dirty = false
+	return nil
+}
+
+// loadIndexes read the indexes saved in IndexFolder and index the active files they do not cover.
+// A missing or unreadable saved index only costs the indexing of the files.
+func (d *Driver) loadIndexes() error {
+	d.indexByShard = make([]*shardIndex, d.conf.ShardCount)
+	for i := range d.indexByShard {
+		d.indexByShard[i] = newShardIndex()
+	}
+	indexed := false
+	for _, t := range d.tableDescriptorRepo {
+		if t.hasIndexedColumn() {
+			indexed = true
+			break
+		}
+	}
+
+	store := d.conf.GetStorage()
+	saved := make(map[string]*fileIndex)
+	if d.conf.IndexFolder != "" {
+		paths, err := savedIndexPaths(store, d.conf.IndexFolder)
+		if err != nil {
+			d.logger.Warn("could not list saved indexes", zap.String("folder", d.conf.IndexFolder), zap.Error(err))
+		}
+		for _, p := range paths {
+			content, err := storage.ReadFile(store, p)
+			files := make([]*fileIndex, 0)
+			if err == nil {
+				err = json.Unmarshal(content, &files)
+			}
+			if err != nil {
+				d.logger.Warn("could not read saved index", zap.String("path", p), zap.Error(err))
+				continue
+			}
+			for _, fi := range files {
+				saved[fi.ContainerFile.Key()] = fi
+			}
+		}
+		// the shard of the files may have changed: all the indexes are saved again
+		for _, p := range paths {
+			store.Remove(p)
+		}
+	}
+	if !indexed {
+		return nil
+	}
+
+	paths, err := store.List(d.conf.ActiveFolder)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		cf, err := config.ParseActivePathInLayout(d.conf.GetLayout(), p)
+		if err != nil {
+			continue
+		}
+		table := d.tableDescriptor(*cf)
+		if !table.hasIndexedColumn() {
+			continue
+		}
+		si := d.shardWal.ShardIndex(*cf)
+		index := d.indexByShard[si]
+		index.dirty = true
+		w := d.shardWal.GetWalForShardIndex(si)
+		reader, err := w.GetFileReader(*cf)
+		if err != nil {
+			return err
+		}
+		if fi, exists := saved[cf.Key()]; exists && fi.upToDate(table, uint64(reader.Size())) {
+			if st, err := store.Stat(p); err == nil && st.ModTime().UnixNano() == fi.ModTime {
+				index.files[cf.Key()] = fi
+				continue
+			}
+		}
+		if err := d.reindexFile(si, *cf, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
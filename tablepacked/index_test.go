@@ -0,0 +1,297 @@
+package tablepacked
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+func TestLookup(t *testing.T) {
+	logger := zap.NewNop()
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	tables := map[string]Table{
+		"scan": {
+			Name: "scan",
+			Columns: []ColumnDescriptor{
+				{Name: "id", Type: Tuint},
+				{Name: "status", Type: Tenum, EnumValues: []string{"off", "on"}, Indexed: true},
+				{Name: "user", Type: Tstring, Indexed: true},
+			},
+		},
+	}
+	driver, err := InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf1 := config.NewContainerFileWTableName("app", "b1", "bb1", "scan")
+	cf2 := config.NewContainerFileWTableName("app", "b2", "bb1", "scan")
+	for i := 0; i < 20; i++ {
+		cf := cf1
+		if i%4 == 3 {
+			cf = cf2
+		}
+		if err := driver.AppendRowData(cf, []*RowData{scanTestRow(i)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if i == 10 {
+			// rows on disk and rows pending in the wal
+			if _, err := driver.Flush(); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+
+	user1 := NewStringEqualPredicate(2, "user1").Value
+	checkLookup := func(step string) []IndexMatch {
+		matches, err := driver.Lookup("scan", "user", user1)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if len(matches) != 2 || matches[0].ContainerFile != cf1 || matches[1].ContainerFile != cf2 {
+			t.Fatalf("%s: bad matches %+v", step, matches)
+		}
+		count := 0
+		for _, m := range matches {
+			si := m.ContainerFile.ShardIndex(uint32(sc.ShardCount))
+			reader, err := driver.shardWal.GetWalForShardIndex(si).GetFileReader(m.ContainerFile)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			fr := newFrameReader(reader, reader.Size())
+			for _, off := range m.Offsets {
+				frame, _, err := fr.frameAt(int64(off), curRowFraming)
+				if err != nil {
+					t.Fatalf("%s: bad offset %d: %v", step, off, err)
+				}
+				row := &RowData{}
+				if err := ReadFromBuffer(frame, row); err != nil {
+					t.Fatalf("%v", err)
+				}
+				if string(row.Data[2].Buffer) != "user1" {
+					t.Fatalf("%s: row at offset %d does not match: %s", step, off, row.Data[2].Buffer)
+				}
+				count++
+			}
+		}
+		// i%3 == 1 for 7 rows out of 20
+		if count != 7 {
+			t.Fatalf("%s: should find 7 rows, get %d", step, count)
+		}
+		return matches
+	}
+	matches := checkLookup("append")
+
+	on, err := driver.Lookup("scan", "status", ColumnData{EncodedRawValue: 1})
+	if err != nil || len(on) != 2 || len(on[0].Offsets)+len(on[1].Offsets) != 10 {
+		t.Fatalf("bad lookup of the enum %+v %v", on, err)
+	}
+	if _, err := driver.Lookup("scan", "id", ColumnData{EncodedRawValue: 1}); !errors.Is(err, ErrColumnNotIndexed) {
+		t.Fatalf("lookup of a column not indexed should fail: %v", err)
+	}
+
+	// saved index
+	if err := driver.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	driver, err = InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(matches, checkLookup("reopen")) {
+		t.Fatalf("saved index differs")
+	}
+
+	// index rebuilt from the active files
+	if err := driver.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	os.RemoveAll(sc.IndexFolder)
+	driver, err = InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(matches, checkLookup("rebuild")) {
+		t.Fatalf("rebuilt index differs")
+	}
+
+	if err := driver.Archive(cf2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := driver.RemoveContent(cf1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	matches, err = driver.Lookup("scan", "user", user1)
+	if err != nil || len(matches) != 0 {
+		t.Fatalf("archived and removed files should not be found: %+v %v", matches, err)
+	}
+	if err := driver.AppendRowData(cf1, []*RowData{scanTestRow(1)}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	matches, err = driver.Lookup("scan", "user", user1)
+	if err != nil || len(matches) != 1 || len(matches[0].Offsets) != 1 {
+		t.Fatalf("bad lookup after remove %+v %v", matches, err)
+	}
+	if err := driver.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestLookupStaleIndex(t *testing.T) {
+	logger := zap.NewNop()
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	tables := map[string]Table{
+		"scan": {
+			Name: "scan",
+			Columns: []ColumnDescriptor{
+				{Name: "id", Type: Tuint},
+				{Name: "status", Type: Tenum, EnumValues: []string{"off", "on"}},
+				{Name: "user", Type: Tstring, Indexed: true},
+			},
+		},
+	}
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "scan")
+	si := cf.ShardIndex(uint32(sc.ShardCount))
+	user1 := NewStringEqualPredicate(2, "user1").Value
+	write := func(conf config.Config, ids ...int) {
+		driver, err := InitDriver(conf, logger, tables)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := driver.RemoveContent(cf); err != nil {
+			t.Fatalf("%v", err)
+		}
+		for _, i := range ids {
+			if err := driver.AppendRowData(cf, []*RowData{scanTestRow(i)}); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+		if err := driver.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	checkLookup := func(step string, driver *Driver) {
+		matches, err := driver.Lookup("scan", "user", user1)
+		if err != nil || len(matches) != 1 || len(matches[0].Offsets) != 2 {
+			t.Fatalf("%s: bad matches %+v %v", step, matches, err)
+		}
+		reader, err := driver.shardWal.GetWalForShardIndex(si).GetFileReader(cf)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		fr := newFrameReader(reader, reader.Size())
+		for _, off := range matches[0].Offsets {
+			frame, _, err := fr.frameAt(int64(off), curRowFraming)
+			row := &RowData{}
+			if err == nil {
+				err = ReadFromBuffer(frame, row)
+			}
+			if err != nil || string(row.Data[2].Buffer) != "user1" {
+				t.Fatalf("%s: stale offset %d: %v", step, off, err)
+			}
+		}
+	}
+
+	write(*sc, 0, 1, 2, 3, 4)
+	// the same rows in another order, to the same size, without saving the index
+	withoutIndex := *sc
+	withoutIndex.IndexFolder = ""
+	write(withoutIndex, 4, 3, 2, 1, 0)
+
+	driver, err := InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	checkLookup("modified file", driver)
+
+	// a file whose appended rows could not be indexed
+	driver.shardWal.LockShardIndex(si)
+	driver.markStale(si, cf)
+	driver.shardWal.UnlockShardIndex(si)
+	checkLookup("stale file", driver)
+	if err := driver.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestEncryptedIndex(t *testing.T) {
+	logger := zap.NewNop()
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	mem := storage.NewMemory()
+	sc := config.InitDefaultTestConfig()
+	sc.Storage = mem
+	sc.KeyProvider = keys
+	sc.SqliteFolder = ""
+	sc.ParquetFolder = ""
+
+	os.RemoveAll("data-test")
+
+	tables := map[string]Table{
+		"scan": {
+			Name: "scan",
+			Columns: []ColumnDescriptor{
+				{Name: "id", Type: Tuint},
+				{Name: "status", Type: Tenum, EnumValues: []string{"off", "on"}},
+				{Name: "user", Type: Tstring, Indexed: true},
+			},
+		},
+	}
+	driver, err := InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "scan")
+	for i := 0; i < 3; i++ {
+		if err := driver.AppendRowData(cf, []*RowData{scanTestRow(i)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := driver.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err := os.Stat(sc.IndexFolder); !os.IsNotExist(err) {
+		t.Fatalf("the index should be saved in the storage: %v", err)
+	}
+	paths, err := mem.List(sc.IndexFolder)
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("bad index files %v %v", paths, err)
+	}
+	raw, err := storage.ReadFile(mem, paths[0])
+	if err != nil || json.Valid(raw) {
+		t.Fatalf("the saved index should be encrypted: %v", err)
+	}
+	content, err := storage.ReadFile(sc.GetStorage(), paths[0])
+	if err != nil || !json.Valid(content) {
+		t.Fatalf("the saved index should be decrypted: %v", err)
+	}
+
+	driver, err = InitDriver(*sc, logger, tables)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	matches, err := driver.Lookup("scan", "user", NewStringEqualPredicate(2, "user1").Value)
+	if err != nil || len(matches) != 1 || len(matches[0].Offsets) != 1 {
+		t.Fatalf("bad lookup with the saved index %+v %v", matches, err)
+	}
+	if err := driver.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
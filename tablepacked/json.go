@@ -1,9 +1,13 @@
 package tablepacked
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/chamot1111/waldb/wutils"
@@ -94,6 +98,19 @@ func (t Table) ParseJSON(buffer []byte) (RowData, error) {
 			errors[idx] = err
 			return
 		}
+		switch t.Columns[idx].Type {
+		case Tint, Tfloat64, Tbool, Ttimestamp, Tbytes:
+			cd, perr := t.Columns[idx].parseJSONValue(value, vt)
+			if perr != nil {
+				hasError = true
+				errors[idx] = perr
+				return
+			}
+			res.Data[idx] = cd
+			parsed[idx] = true
+			nullValue[idx] = cd.IsNull()
+			return
+		}
 		if vt == jsonparser.String {
 			if t.Columns[idx].Type == Tenum {
 				cc := t.Columns[idx]
@@ -172,10 +189,84 @@ func (c ColumnDescriptor) maxLenJSONValue(cd ColumnData) int {
 			return 4 // null
 		}
 		return len(cd.Buffer) * 2 // '"' escape
+	case Tint:
+		return wutils.MaxIntStrLen
+	case Tfloat64:
+		return 32
+	case Tbool:
+		return 5 // false
+	case Ttimestamp:
+		return len(time.RFC3339Nano) + 2
+	case Tbytes:
+		return base64.StdEncoding.EncodedLen(len(cd.Buffer)) + 2
 	}
 	return -1
 }
 
+// parseJSONValue parse the json value of the columns not handled by the legacy parsing.
+// A number for a timestamp is a count of milliseconds since epoch.
+func (c ColumnDescriptor) parseJSONValue(value []byte, vt jsonparser.ValueType) (ColumnData, error) {
+	if vt == jsonparser.Null {
+		return NewNullColumnData(), nil
+	}
+	switch c.Type {
+	case Tint:
+		v, err := jsonparser.ParseInt(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		return NewIntColumnData(v), nil
+	case Tfloat64:
+		v, err := jsonparser.ParseFloat(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		return NewFloat64ColumnData(v), nil
+	case Tbool:
+		v, err := jsonparser.ParseBoolean(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		return NewBoolColumnData(v), nil
+	case Ttimestamp:
+		var ts time.Time
+		if vt == jsonparser.String {
+			str, err := jsonparser.ParseString(value)
+			if err != nil {
+				return ColumnData{}, err
+			}
+			ts, err = time.Parse(time.RFC3339Nano, str)
+			if err != nil {
+				return ColumnData{}, err
+			}
+		} else {
+			ms, err := jsonparser.ParseInt(value)
+			if err != nil {
+				return ColumnData{}, err
+			}
+			if ms > math.MaxInt64/int64(time.Millisecond) || ms < math.MinInt64/int64(time.Millisecond) {
+				return ColumnData{}, fmt.Errorf("timestamp out of range: %d ms", ms)
+			}
+			ts = time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond)
+		}
+		if err := checkTimestampRange(ts); err != nil {
+			return ColumnData{}, err
+		}
+		return NewTimestampColumnData(ts), nil
+	case Tbytes:
+		str, err := jsonparser.ParseString(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		buf, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		return NewBytesColumnData(buf), nil
+	}
+	return ColumnData{}, fmt.Errorf("column %s has no json parser for type: %d", c.Name, c.Type)
+}
+
 func (c ColumnDescriptor) appendToJSONValue(inputBuffer *wutils.Buffer, cd ColumnData) error {
 	res := inputBuffer
 	switch c.Type {
@@ -204,6 +295,25 @@ func (c ColumnDescriptor) appendToJSONValue(inputBuffer *wutils.Buffer, cd Colum
 			res.WriteUnsafeByte(b)
 		}
 		res.WriteUnsafeByte('"')
+	case Tint:
+		res.WriteIntAsString(cd.Int())
+	case Tfloat64:
+		f := cd.Float64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			res.WriteString("null")
+			return nil
+		}
+		res.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	case Tbool:
+		res.WriteString(strconv.FormatBool(cd.Bool()))
+	case Ttimestamp:
+		res.WriteUnsafeByte('"')
+		res.WriteString(cd.Timestamp().Format(time.RFC3339Nano))
+		res.WriteUnsafeByte('"')
+	case Tbytes:
+		res.WriteUnsafeByte('"')
+		res.WriteString(base64.StdEncoding.EncodeToString(cd.Buffer))
+		res.WriteUnsafeByte('"')
 	}
 	return nil
 }
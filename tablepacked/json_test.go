@@ -2,6 +2,7 @@ package tablepacked
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -215,3 +216,79 @@ func interactionRnd() RowData {
 		},
 	}
 }
+
+var typedJSONTable = Table{
+	Name: "typed",
+	Columns: []c{
+		{Name: "Int", JSONKey: "int", Type: Tint},
+		{Name: "Float", JSONKey: "float", Type: Tfloat64},
+		{Name: "Bool", JSONKey: "bool", Type: Tbool},
+		{Name: "Timestamp", JSONKey: "ts", Type: Ttimestamp},
+		{Name: "Bytes", JSONKey: "bytes", Type: Tbytes},
+	},
+}
+
+func TestTypedColumnsJSON(t *testing.T) {
+	row, err := typedJSONTable.ParseJSON([]byte(`{"int":-12,"float":1.5e-3,"bool":true,"ts":"2021-03-04T05:06:07.000000008Z","bytes":"AAH/"}`))
+	if err != nil {
+		t.Fatalf("ERR %s", err.Error())
+	}
+	if row.Data[0].Int() != -12 || row.Data[1].Float64() != 1.5e-3 || !row.Data[2].Bool() ||
+		row.Data[3].Timestamp().Nanosecond() != 8 || len(row.Data[4].Buffer) != 3 {
+		t.Fatalf("bad parsing: %v", row.Data)
+	}
+
+	p := NewBufPool()
+	buf, err := RowsDataToJSON([]*RowData{&row}, typedJSONTable, p)
+	if err != nil {
+		t.Fatalf("ERR %s", err.Error())
+	}
+	rows := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatalf("ERR %s: %s", err.Error(), buf.String())
+	}
+	if rows[0]["int"].(float64) != -12 || rows[0]["bool"].(bool) != true ||
+		rows[0]["ts"].(string) != "2021-03-04T05:06:07.000000008Z" || rows[0]["bytes"].(string) != "AAH/" {
+		t.Fatalf("bad json: %s", buf.String())
+	}
+
+	row, err = typedJSONTable.ParseJSON([]byte(`{"int":null,"ts":1000}`))
+	if err != nil {
+		t.Fatalf("ERR %s", err.Error())
+	}
+	if !row.Data[0].IsNull() || row.Data[3].Timestamp().Unix() != 1 {
+		t.Fatalf("bad parsing: %v", row.Data)
+	}
+
+	for _, in := range []string{"9223372036854775807", "-9223372036854775808", "-4611686018427387905"} {
+		row, err = typedJSONTable.ParseJSON([]byte(`{"int":` + in + `,"ts":1000}`))
+		if err != nil {
+			t.Fatalf("ERR %s", err.Error())
+		}
+		buf, err := RowsDataToJSON([]*RowData{&row}, typedJSONTable, p)
+		if err != nil {
+			t.Fatalf("ERR %s", err.Error())
+		}
+		if !strings.Contains(buf.String(), `"int":`+in+`,`) {
+			t.Fatalf("int %s exported as %s", in, buf.String())
+		}
+	}
+	if _, err := typedJSONTable.ParseJSON([]byte(`{"ts":9223372036854775807}`)); err == nil {
+		t.Fatalf("timestamp out of range should fail")
+	}
+
+	// empty bytes are exported, null bytes are not
+	for in, exported := range map[string]bool{`""`: true, `null`: false} {
+		row, err = typedJSONTable.ParseJSON([]byte(`{"ts":1000,"bytes":` + in + `}`))
+		if err != nil {
+			t.Fatalf("ERR %s", err.Error())
+		}
+		buf, err := RowsDataToJSON([]*RowData{&row}, typedJSONTable, p)
+		if err != nil {
+			t.Fatalf("ERR %s", err.Error())
+		}
+		if strings.Contains(buf.String(), `"bytes":""`) != exported {
+			t.Fatalf("bytes %s exported as %s", in, buf.String())
+		}
+	}
+}
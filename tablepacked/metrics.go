@@ -0,0 +1,12 @@
+package tablepacked
+
+import "github.com/chamot1111/waldb/metrics"
+
+var (
+	sqliteInsertDurationMetric = metrics.Default.NewHistogramVec("waldb_sqlite_insert_duration_seconds",
+		"Duration of the insertion of an archived file in sqlite.", nil, "table")
+	sqliteInsertedRowsMetric = metrics.Default.NewCounterVec("waldb_sqlite_inserted_rows_total",
+		"Rows inserted in sqlite by the archiver.", "table")
+	parquetWrittenRowsMetric = metrics.Default.NewCounterVec("waldb_parquet_written_rows_total",
+		"Rows written in parquet files by the archiver.", "table")
+)
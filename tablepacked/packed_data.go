@@ -1,12 +1,15 @@
 package tablepacked
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/chamot1111/waldb/config"
 	"github.com/chamot1111/waldb/wal"
@@ -36,6 +39,75 @@ func (cd ColumnData) IsNull() bool {
 	return cd.EncodedRawValue == 0 && cd.Buffer != nil && len(cd.Buffer) == 0
 }
 
+// NewIntColumnData create a Tint ColumnData. The values beyond ±2^62 do not fit in the varint value
+// encoding: their bits are stored in a buffer.
+func NewIntColumnData(v int64) ColumnData {
+	if v > maxVarintInt || v < minVarintInt {
+		buf := make([]byte, intBufferLen)
+		binary.BigEndian.PutUint64(buf, uint64(v))
+		return ColumnData{EncodedRawValue: intBufferLen, Buffer: buf}
+	}
+	return ColumnData{EncodedRawValue: zigzagEncode(v)}
+}
+
+// Int value of a Tint ColumnData
+func (cd ColumnData) Int() int64 {
+	if len(cd.Buffer) == intBufferLen {
+		return int64(binary.BigEndian.Uint64(cd.Buffer))
+	}
+	return zigzagDecode(cd.EncodedRawValue)
+}
+
+// NewFloat64ColumnData create a Tfloat64 ColumnData. The float bits are stored in a buffer
+// as the varint value encoding can not hold the sign bit.
+func NewFloat64ColumnData(v float64) ColumnData {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+	return ColumnData{EncodedRawValue: 8, Buffer: buf}
+}
+
+// Float64 value of a Tfloat64 ColumnData
+func (cd ColumnData) Float64() float64 {
+	if len(cd.Buffer) != 8 {
+		return 0
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(cd.Buffer))
+}
+
+// NewBoolColumnData create a Tbool ColumnData
+func NewBoolColumnData(v bool) ColumnData {
+	if v {
+		return ColumnData{EncodedRawValue: 1}
+	}
+	return ColumnData{EncodedRawValue: 0}
+}
+
+// Bool value of a Tbool ColumnData
+func (cd ColumnData) Bool() bool {
+	return cd.EncodedRawValue != 0
+}
+
+// NewTimestampColumnData create a Ttimestamp ColumnData
+func NewTimestampColumnData(t time.Time) ColumnData {
+	return NewIntColumnData(t.UnixNano())
+}
+
+// Timestamp value of a Ttimestamp ColumnData
+func (cd ColumnData) Timestamp() time.Time {
+	return time.Unix(0, cd.Int()).UTC()
+}
+
+// NewBytesColumnData create a Tbytes ColumnData. An empty value is encoded without buffer: an empty
+// buffer is null.
+func NewBytesColumnData(b []byte) ColumnData {
+	if len(b) == 0 {
+		return ColumnData{}
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	return ColumnData{EncodedRawValue: uint64(len(buf)), Buffer: buf}
+}
+
 // DebugString create a debug string
 func (cd ColumnData) DebugString(d ColumnDescriptor) string {
 	switch d.Type {
@@ -49,6 +121,21 @@ func (cd ColumnData) DebugString(d ColumnDescriptor) string {
 		}
 		return "null"
 	}
+	if cd.IsNull() {
+		return "null"
+	}
+	switch d.Type {
+	case Tint:
+		return strconv.FormatInt(cd.Int(), 10)
+	case Tfloat64:
+		return strconv.FormatFloat(cd.Float64(), 'g', -1, 64)
+	case Tbool:
+		return strconv.FormatBool(cd.Bool())
+	case Ttimestamp:
+		return cd.Timestamp().Format(time.RFC3339Nano)
+	case Tbytes:
+		return base64.StdEncoding.EncodeToString(cd.Buffer)
+	}
 	return "<error>"
 }
 
@@ -178,33 +265,32 @@ func ReadFromBuffer(buffer []byte, res *RowData) error {
 // have a sane file
 type ErrBadEndingCRC struct {
 	SaneOffset int
+	// Offset of the frame that could not be read
+	Offset int
+	// RowIndex index of the row that could not be read, meta frames excluded
+	RowIndex int
 }
 
-func (e *ErrBadEndingCRC) Error() string { return "ErrBadEndingCRC" }
-
-func crcForBuffer(buffer []byte) uint8 {
-	var res uint8 = 128
-	for i := 0; i < len(buffer); i++ {
-		res = res + buffer[i]
-	}
-	return res
+func (e *ErrBadEndingCRC) Error() string {
+	return fmt.Sprintf("ErrBadEndingCRC: row %d at offset %d", e.RowIndex, e.Offset)
 }
 
-func appendRowDataToFile(cf config.ContainerFile, wal *wal.WAL, rows []*RowData) error {
+// appendRowDataToFile append rows with the framing of the file. The header (meta frames)
+// is written before the rows. It returns the offset of each row frame from the start of the write.
+func appendRowDataToFile(cf config.ContainerFile, wal *wal.WAL, rows []*RowData, framing uint8, header []byte) ([]uint64, error) {
 	buffer := make([]byte, 0, 256)
 	var bBuffer [128]byte
-	var lenBuffer [2]byte
+	offsets := make([]uint64, len(rows))
 
-	for _, r := range rows {
+	buffer = append(buffer, header...)
+
+	for i, r := range rows {
+		offsets[i] = uint64(len(buffer))
 		rBinary := r.WriteToBuffer(bBuffer[0:0])
-		binary.BigEndian.PutUint16(lenBuffer[:], uint16(len(rBinary)))
-		crc := crcForBuffer(rBinary)
-		buffer = append(buffer, lenBuffer[:]...)
-		buffer = append(buffer, rBinary[:]...)
-		buffer = append(buffer, []byte{crc}...)
+		buffer = appendFrame(buffer, rBinary, framing)
 	}
 
-	return wal.AppendWrite(cf, buffer)
+	return offsets, wal.AppendWrite(cf, buffer)
 }
 
 func copyFromFileToByteBuffer(file *os.File, buffer *wutils.Buffer) error {
@@ -234,6 +320,10 @@ func copyFromFileToByteBuffer(file *os.File, buffer *wutils.Buffer) error {
 
 // ReadAllRowDataFromFile append row data
 func ReadAllRowDataFromFile(cf config.ContainerFile, wal *wal.WAL, rowDataPool *sync.Pool, bufferPool *sync.Pool) (*TableData, error) {
+	return readAllRowDataFromFile(cf, wal, nil, rowDataPool, bufferPool)
+}
+
+func readAllRowDataFromFile(cf config.ContainerFile, wal *wal.WAL, descriptor *Table, rowDataPool *sync.Pool, bufferPool *sync.Pool) (*TableData, error) {
 	fileBuf := bufferPool.Get().(*wutils.Buffer)
 	defer bufferPool.Put(fileBuf)
 	fileBuf.Reset()
@@ -244,7 +334,7 @@ func ReadAllRowDataFromFile(cf config.ContainerFile, wal *wal.WAL, rowDataPool *
 		return nil, err
 	}
 
-	return ReadAllRowDataFromFileBuffer(fileBuf, rowDataPool)
+	return readAllRowDataFromFileBuffer(fileBuf, rowDataPool, descriptor)
 }
 
 // NewRowDataPool init row data pool
@@ -267,71 +357,153 @@ func NewBufPool() *sync.Pool {
 	}
 }
 
-// ReadAllRowDataFromFileBuffer append row data
+// ReadAllRowDataFromFileBuffer append row data. Rows are returned as written whatever the version of the table.
 func ReadAllRowDataFromFileBuffer(fileBuf *wutils.Buffer, rowDataPool *sync.Pool) (*TableData, error) {
-	var cCRC uint8
+	return readAllRowDataFromFileBuffer(fileBuf, rowDataPool, nil)
+}
+
+// ReadAllRowDataFromFileBufferForTable append row data and upgrade the rows written with a previous
+// version of the table
+func ReadAllRowDataFromFileBufferForTable(fileBuf *wutils.Buffer, rowDataPool *sync.Pool, descriptor Table) (*TableData, error) {
+	return readAllRowDataFromFileBuffer(fileBuf, rowDataPool, &descriptor)
+}
+
+func readAllRowDataFromFileBuffer(fileBuf *wutils.Buffer, rowDataPool *sync.Pool, descriptor *Table) (*TableData, error) {
 	var table *TableData = &TableData{}
 	table.Data = table.Data[0:0]
 	SaneOffset := 0
+	var version uint32 = 0
+	framing := rowFramingAdditiveCrc
+	isMetaFrame := false
+	metaOffset := 0
+
+	upgrader, err := newRowUpgrader(descriptor)
+	if err != nil {
+		return table, err
+	}
 
 	fileBuf.ResetRead()
 
 	for true {
-		isEOF := false
+		frameOffset := fileBuf.ReadOffset()
 		lenBufferBytes := fileBuf.Next(2)
 		if len(lenBufferBytes) == 0 {
 			break
-		} else if len(lenBufferBytes) == 1 {
-			return table, fmt.Errorf("Could not read lenBufferBytes")
+		}
+		badFrameErr := &ErrBadEndingCRC{
+			SaneOffset: SaneOffset,
+			Offset:     frameOffset,
+			RowIndex:   len(table.Data),
+		}
+		if len(lenBufferBytes) == 1 {
+			return table, badFrameErr
 		}
 
 		lenBuffer := int(binary.BigEndian.Uint16(lenBufferBytes[:]))
 		internalBuffer := fileBuf.Next(lenBuffer)
-		rCRC, err := fileBuf.ReadByte()
-		if err != nil {
-			if err != io.EOF {
-				return table, err
+		checksum := fileBuf.Next(frameChecksumLen(framing))
+
+		if len(internalBuffer) != lenBuffer || !frameChecksumOK(framing, lenBufferBytes, internalBuffer, checksum) {
+			if isMetaFrame {
+				badFrameErr.Offset = metaOffset
 			}
-			isEOF = true
+			return table, badFrameErr
 		}
 
-		cCRC = crcForBuffer(internalBuffer)
-
-		if cCRC != rCRC {
-			return table, &ErrBadEndingCRC{
-				SaneOffset: SaneOffset,
+		if lenBuffer == 0 {
+			isMetaFrame = true
+			metaOffset = frameOffset
+		} else if isMetaFrame {
+			isMetaFrame = false
+			kind, value, err := readMetaFrame(internalBuffer)
+			if err != nil {
+				return table, err
 			}
-		}
+			switch kind {
+			case metaKindSchemaVersion:
+				version = uint32(value)
+			case metaKindRowFraming:
+				framing = uint8(value)
+			}
+			SaneOffset = fileBuf.ReadOffset()
+		} else {
+			rd := rowDataPool.Get().(*RowData)
 
-		rd := rowDataPool.Get().(*RowData)
+			err = ReadFromBuffer(internalBuffer, rd)
+			if err != nil {
+				return table, err
+			}
+			if err := upgrader.upgrade(rd, version); err != nil {
+				return table, err
+			}
 
-		err = ReadFromBuffer(internalBuffer, rd)
-		if err != nil {
-			return table, err
+			table.Data = append(table.Data, rd)
+			SaneOffset = fileBuf.ReadOffset()
 		}
+	}
+	return table, nil
+}
+
+// ScanRowsFromFile scan the rows of a file, pending wal commands included
+func ScanRowsFromFile(cf config.ContainerFile, wal *wal.WAL, opts ScanOptions, rowDataPool *sync.Pool) (*TableData, error) {
+	reader, err := wal.GetFileReader(cf)
+	if err != nil {
+		return nil, err
+	}
+	return ScanRowsFromReader(reader, reader.Size(), opts, rowDataPool)
+}
 
-		table.Data = append(table.Data, rd)
-		SaneOffset = fileBuf.ReadOffset()
+// ScanRowsFromFileCorruptSafe scan the rows of a file and repair file if corruption happened
+func ScanRowsFromFileCorruptSafe(cf config.ContainerFile, wal *wal.WAL, opts ScanOptions, rowDataPool *sync.Pool) (*TableData, error) {
+	table, _, err := scanRowsFromFileCorruptSafe(cf, wal, opts, rowDataPool)
+	return table, err
+}
 
-		if isEOF {
-			break
+// scanRowsFromFileCorruptSafe also return whether the file has been truncated
+func scanRowsFromFileCorruptSafe(cf config.ContainerFile, wal *wal.WAL, opts ScanOptions, rowDataPool *sync.Pool) (*TableData, bool, error) {
+	truncated := false
+	for {
+		table, err := ScanRowsFromFile(cf, wal, opts, rowDataPool)
+		if err == nil {
+			return table, truncated, nil
+		}
+		errCrc, ok := err.(*ErrBadEndingCRC)
+		if !ok {
+			return table, truncated, err
+		}
+		if err := wal.Truncate(cf, int64(errCrc.SaneOffset)); err != nil {
+			return table, truncated, fmt.Errorf("Could not sanitize crc error, truncate fail: %w", errCrc)
+		}
+		truncated = true
+		if !opts.Reverse {
+			return table, truncated, nil
+		}
+		// rows after the corruption may have been collected: scan again the sane file
+		for _, r := range table.Data {
+			r.Data = r.Data[0:0]
+			rowDataPool.Put(r)
 		}
 	}
-	return table, nil
 }
 
 // ReadAllRowDataFromFileCorruptSafe append row data and repair file if corruption happened
 func ReadAllRowDataFromFileCorruptSafe(cf config.ContainerFile, wal *wal.WAL, rowDataPool *sync.Pool, bufferPool *sync.Pool) (*TableData, error) {
-	table, err := ReadAllRowDataFromFile(cf, wal, rowDataPool, bufferPool)
+	table, _, err := readAllRowDataFromFileCorruptSafe(cf, wal, nil, rowDataPool, bufferPool)
+	return table, err
+}
+
+// readAllRowDataFromFileCorruptSafe also return whether the file has been truncated
+func readAllRowDataFromFileCorruptSafe(cf config.ContainerFile, wal *wal.WAL, descriptor *Table, rowDataPool *sync.Pool, bufferPool *sync.Pool) (*TableData, bool, error) {
+	table, err := readAllRowDataFromFile(cf, wal, descriptor, rowDataPool, bufferPool)
 	if err != nil {
 		if errCrc, ok := err.(*ErrBadEndingCRC); ok {
 			err := wal.Truncate(cf, int64(errCrc.SaneOffset))
 			if err != nil {
-				return table, fmt.Errorf("Could not sanitize crc error, truncate fail: %w", errCrc)
+				return table, false, fmt.Errorf("Could not sanitize crc error, truncate fail: %w", errCrc)
 			}
-		} else {
-			return table, err
+			return table, true, nil
 		}
+		return table, false, err
 	}
-	return table, nil
+	return table, false, nil
 }
@@ -0,0 +1,192 @@
+package tablepacked
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/fileop"
+	"github.com/chamot1111/waldb/parquet"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wutils"
+	"go.uber.org/zap"
+)
+
+// parquetArchiver convert the archived files to parquet files of ParquetFolder in the storage, partitioned
+// by table, container and day of archiving: table=<table>/container=<container>/day=<yyyy-mm-dd>/<file>.parquet
+type parquetArchiver struct {
+	config              config.Config
+	logger              *zap.Logger
+	tableDescriptorRepo map[string]Table
+	rowDataPool         *sync.Pool
+}
+
+// NewParquetArchiver archiver converting the archived files to parquet files. Use a wal.FanOut to also
+// insert them in sqlite.
+func NewParquetArchiver(conf config.Config, logger *zap.Logger, tableDescriptorRepo map[string]Table) Archiver {
+	return &parquetArchiver{
+		config:              conf,
+		logger:              logger,
+		tableDescriptorRepo: tableDescriptorRepo,
+		rowDataPool:         NewRowDataPool(),
+	}
+}
+
+// ParquetPathForArchivedFile path of the parquet file of an archived file archived at t
+func ParquetPathForArchivedFile(conf config.Config, archivedPath string, file config.ContainerFile, t time.Time) string {
+	container := file.ContainerFolder()
+	name := strings.Replace(path.Base(archivedPath), ":", "-", -1) + ".parquet"
+	return path.Join(conf.ParquetFolder, "table="+file.TableName, "container="+container, "day="+t.UTC().Format("2006-01-02"), name)
+}
+
+// parquetColumns schema of the parquet files of a table
+func parquetColumns(descriptor Table) []parquet.Column {
+	res := make([]parquet.Column, len(descriptor.Columns))
+	for i, c := range descriptor.Columns {
+		pc := parquet.Column{Name: c.Name, Optional: !c.NotNullable}
+		switch c.Type {
+		case Tuint:
+			pc.Type, pc.Optional = parquet.Uint64, false
+		case Tenum:
+			pc.Type, pc.Optional = parquet.String, false
+		case Tstring:
+			pc.Type = parquet.String
+		case Tint:
+			pc.Type = parquet.Int64
+		case Tfloat64:
+			pc.Type = parquet.Double
+		case Tbool:
+			pc.Type = parquet.Boolean
+		case Ttimestamp:
+			pc.Type = parquet.TimestampNanos
+		case Tbytes:
+			pc.Type = parquet.Bytes
+		}
+		res[i] = pc
+	}
+	return res
+}
+
+// parquetValue value of a column for the parquet writer. A null value of a required column is written
+// as the zero value.
+func parquetValue(c ColumnDescriptor, pc parquet.Column, cd ColumnData) interface{} {
+	switch c.Type {
+	case Tuint:
+		return cd.EncodedRawValue
+	case Tenum:
+		if int(cd.EncodedRawValue) < len(c.EnumValues) {
+			return c.EnumValues[cd.EncodedRawValue]
+		}
+		return strconv.FormatUint(cd.EncodedRawValue, 10)
+	case Tstring:
+		if cd.Buffer == nil && pc.Optional {
+			return nil
+		}
+		return string(cd.Buffer)
+	}
+	if cd.IsNull() && pc.Optional {
+		return nil
+	}
+	switch c.Type {
+	case Tint, Ttimestamp:
+		return cd.Int()
+	case Tfloat64:
+		return cd.Float64()
+	case Tbool:
+		return cd.Bool()
+	case Tbytes:
+		if cd.Buffer == nil {
+			return []byte{}
+		}
+		return cd.Buffer
+	}
+	return nil
+}
+
+func (pa *parquetArchiver) Close() {}
+
+// Do convert the archived file and remove it. The file is kept if the conversion fails.
+func (pa *parquetArchiver) Do(p string, file config.ContainerFile) {
+	if err := pa.convert(p, file); err != nil {
+		pa.logger.Error("could not convert archived file to parquet", zap.String("path", p), zap.Error(err))
+		return
+	}
+	if err := pa.config.GetStorage().Remove(p); err != nil {
+		pa.logger.Error("could not delete archive file", zap.String("path", p), zap.Error(err))
+	}
+}
+
+// Send convert the archived file, as a sink of a wal.FanOut
+func (pa *parquetArchiver) Send(p string, file config.ContainerFile) error {
+	return pa.convert(p, file)
+}
+
+// convert write the parquet file of an archived file. An existing parquet file of the same archived
+// file is replaced.
+func (pa *parquetArchiver) convert(p string, file config.ContainerFile) error {
+	descriptor, exist := pa.tableDescriptorRepo[file.TableName]
+	if !exist {
+		return fmt.Errorf("could not found table descriptor %s", file.TableName)
+	}
+	store := pa.config.GetStorage()
+	info, err := store.Stat(p)
+	if err != nil {
+		return err
+	}
+	f, err := store.OpenFile(p, false)
+	if err != nil {
+		return err
+	}
+	buffer := &wutils.Buffer{}
+	err = fileop.GetFileBufferFromFile(f, buffer)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	tableData, err := ReadAllRowDataFromFileBufferForTable(buffer, pa.rowDataPool, descriptor)
+	if err != nil {
+		if _, ok := err.(*ErrBadEndingCRC); !ok {
+			return err
+		}
+		pa.logger.Warn("crc error happened on file", zap.String("path", p))
+	}
+	defer func() {
+		for _, r := range tableData.Data {
+			r.Data = r.Data[0:0]
+			pa.rowDataPool.Put(r)
+		}
+	}()
+
+	columns := parquetColumns(descriptor)
+	writer := parquet.NewWriter(columns)
+	values := make([]interface{}, len(columns))
+	for _, r := range tableData.Data {
+		for i, c := range descriptor.Columns {
+			cd := NewNullColumnData()
+			if i < len(r.Data) {
+				cd = r.Data[i]
+			}
+			values[i] = parquetValue(c, columns[i], cd)
+		}
+		if err := writer.AppendRow(values); err != nil {
+			return err
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if _, err := writer.WriteTo(out); err != nil {
+		return err
+	}
+	dest := ParquetPathForArchivedFile(pa.config, p, file, info.ModTime())
+	if err := storage.WriteFile(store, dest, out.Bytes()); err != nil {
+		return err
+	}
+	parquetWrittenRowsMetric.WithLabelValues(file.TableName).Add(float64(writer.RowCount()))
+	return nil
+}
@@ -0,0 +1,117 @@
+package tablepacked
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wal"
+	"go.uber.org/zap"
+)
+
+func TestParquetArchiver(t *testing.T) {
+	logger := zap.NewNop()
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	tables := map[string]Table{"query": queryTable}
+	// the archived files are converted to parquet and inserted in sqlite
+	archiver := wal.NewFanOut(*sc, logger,
+		wal.FanOutSink{Name: "parquet", Sink: NewParquetArchiver(*sc, logger, tables), Retry: wal.RetryPolicy{MaxAttempts: 1}},
+		wal.FanOutSink{Name: "sqlite", Sink: NewSqliteArchiver(*sc, logger, tables), Retry: wal.RetryPolicy{MaxAttempts: 1}},
+	)
+	driver, err := InitDriverWithArchiver(*sc, logger, tables, archiver)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+
+	cf := config.NewContainerFileWTableName("", "b1", "bb1", "query")
+	rows := []*RowData{
+		{Data: []ColumnData{{EncodedRawValue: 1}, {EncodedRawValue: 1, Buffer: []byte("a")}, NewIntColumnData(-1)}},
+		{Data: []ColumnData{{EncodedRawValue: 2}, NewNullColumnData(), NewNullColumnData()}},
+	}
+	if err := driver.AppendRowData(cf, rows); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := driver.Archive(cf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := driver.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitArchivedRows(t, driver, 2)
+
+	files, err := filepath.Glob(filepath.Join(sc.ParquetFolder, "table=query", "container=default", "day=*", "*.parquet"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("should have one parquet file: %v %v", files, err)
+	}
+	if day := filepath.Base(filepath.Dir(files[0])); day != "day="+time.Now().UTC().Format("2006-01-02") {
+		t.Fatalf("bad day partition %s", day)
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.HasPrefix(content, []byte("PAR1")) || !bytes.HasSuffix(content, []byte("PAR1")) || !bytes.Contains(content, []byte("Label")) {
+		t.Fatalf("bad parquet file")
+	}
+	archived, _ := sc.GetStorage().List(sc.ArchiveFolder)
+	if len(archived) != 0 {
+		t.Fatalf("archived files should be removed once both sinks have processed them: %v", archived)
+	}
+}
+
+func TestParquetArchiverStorage(t *testing.T) {
+	logger := zap.NewNop()
+	sc := config.InitDefaultTestConfig()
+	mem := storage.NewMemory()
+	sc.Storage = mem
+	sc.KeyProvider = testKeyRing(t)
+
+	os.RemoveAll("data-test")
+
+	tables := map[string]Table{"query": queryTable}
+	driver, err := InitDriverWithArchiver(*sc, logger, tables, NewParquetArchiver(*sc, logger, tables))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+
+	cf := config.NewContainerFileWTableName("", "b1", "bb1", "query")
+	if err := driver.AppendRowData(cf, []*RowData{{Data: []ColumnData{{EncodedRawValue: 1}, {EncodedRawValue: 6, Buffer: []byte("secret")}, NewIntColumnData(1)}}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := driver.Archive(cf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := driver.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var files []string
+	for len(files) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the parquet file should be written in the storage")
+		}
+		time.Sleep(20 * time.Millisecond)
+		files, _ = mem.List(sc.ParquetFolder)
+	}
+	if _, err := os.Stat(sc.ParquetFolder); !os.IsNotExist(err) {
+		t.Fatalf("the parquet file should not be written on the local disk: %v", err)
+	}
+	raw, err := storage.ReadFile(mem, files[0])
+	if err != nil || bytes.Contains(raw, []byte("secret")) {
+		t.Fatalf("the parquet file should be encrypted: %v", err)
+	}
+	content, err := storage.ReadFile(sc.GetStorage(), files[0])
+	if err != nil || !bytes.HasPrefix(content, []byte("PAR1")) || !bytes.Contains(content, []byte("secret")) {
+		t.Fatalf("bad decrypted parquet file: %v", err)
+	}
+}
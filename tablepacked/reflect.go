@@ -4,11 +4,14 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"math"
 	"reflect"
+	"time"
 )
 
 var _scannerInterface = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
 var _valuerInterface = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+var _timeType = reflect.TypeOf(time.Time{})
 
 // StructToRow take a struct and fill the row data equivalent
 func StructToRow(s interface{}, row *RowData, table Table) error {
@@ -159,6 +162,12 @@ func StructToRow(s interface{}, row *RowData, table Table) error {
 				row.Data[ic].Buffer = make([]byte, len(stringVal))
 				copy(row.Data[ic].Buffer, stringVal)
 			}
+		case Tint, Tfloat64, Tbool, Ttimestamp, Tbytes:
+			cd, err := fieldToColumnData(c, v.FieldByName(c.Name), fieldType)
+			if err != nil {
+				return err
+			}
+			row.Data[ic] = cd
 		default:
 			if !reflect.PtrTo(fieldType.Type).Implements(_valuerInterface) {
 				return fmt.Errorf("undefined column %s type: %d", c.Name, c.Type)
@@ -289,9 +298,225 @@ func RowToStruct(dst interface{}, row *RowData, table Table) error {
 					scannableValue.Scan(rc.EncodedRawValue)
 				}
 			}
+		case Tint, Tfloat64, Tbool, Ttimestamp, Tbytes:
+			if err := columnDataToField(c, rc, v.FieldByName(c.Name), fieldType); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("undefined column %s type: %d", c.Name, c.Type)
 		}
 	}
 	return nil
 }
+
+func fieldValuerValue(c ColumnDescriptor, fieldValue reflect.Value, fieldType reflect.StructField) (driver.Value, error) {
+	if !reflect.PtrTo(fieldType.Type).Implements(_valuerInterface) {
+		return nil, fmt.Errorf("could not set %s with field kind: %s", c.Name, fieldType.Type.Kind().String())
+	}
+	var valuerValue driver.Valuer
+	if fieldType.Type.Implements(_valuerInterface) {
+		valuerValue = fieldValue.Interface().(driver.Valuer)
+	} else if fieldValue.CanAddr() {
+		valuerValue = fieldValue.Addr().Interface().(driver.Valuer)
+	} else {
+		return nil, fmt.Errorf("could not get Valuer from unaddressable field: %s", c.Name)
+	}
+	vv, err := valuerValue.Value()
+	if err != nil {
+		return nil, fmt.Errorf("fail to get value from Valuer: %s", c.Name)
+	}
+	return vv, nil
+}
+
+func fieldToColumnData(c ColumnDescriptor, fieldValue reflect.Value, fieldType reflect.StructField) (ColumnData, error) {
+	fieldKind := fieldType.Type.Kind()
+	switch c.Type {
+	case Tint:
+		var intVal int64
+		switch fieldKind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			intVal = fieldValue.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			uintVal := fieldValue.Uint()
+			if uintVal > math.MaxInt64 {
+				return ColumnData{}, fmt.Errorf("could not set %s with value: %d", c.Name, uintVal)
+			}
+			intVal = int64(uintVal)
+		default:
+			vv, err := fieldValuerValue(c, fieldValue, fieldType)
+			if err != nil {
+				return ColumnData{}, err
+			}
+			switch s := vv.(type) {
+			case int64:
+				intVal = s
+			case nil:
+				return NewNullColumnData(), nil
+			default:
+				return ColumnData{}, fmt.Errorf("value from Valuer is not comatible with int: %v", s)
+			}
+		}
+		return NewIntColumnData(intVal), nil
+	case Tfloat64:
+		switch fieldKind {
+		case reflect.Float32, reflect.Float64:
+			return NewFloat64ColumnData(fieldValue.Float()), nil
+		}
+		vv, err := fieldValuerValue(c, fieldValue, fieldType)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		switch s := vv.(type) {
+		case float64:
+			return NewFloat64ColumnData(s), nil
+		case nil:
+			return NewNullColumnData(), nil
+		default:
+			return ColumnData{}, fmt.Errorf("value from Valuer is not comatible with float: %v", s)
+		}
+	case Tbool:
+		if fieldKind == reflect.Bool {
+			return NewBoolColumnData(fieldValue.Bool()), nil
+		}
+		vv, err := fieldValuerValue(c, fieldValue, fieldType)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		switch s := vv.(type) {
+		case bool:
+			return NewBoolColumnData(s), nil
+		case nil:
+			return NewNullColumnData(), nil
+		default:
+			return ColumnData{}, fmt.Errorf("value from Valuer is not comatible with bool: %v", s)
+		}
+	case Ttimestamp:
+		var t time.Time
+		switch {
+		case fieldType.Type == _timeType:
+			t = fieldValue.Interface().(time.Time)
+		case fieldKind == reflect.Int64:
+			t = time.Unix(0, fieldValue.Int())
+		default:
+			vv, err := fieldValuerValue(c, fieldValue, fieldType)
+			if err != nil {
+				return ColumnData{}, err
+			}
+			switch s := vv.(type) {
+			case time.Time:
+				t = s
+			case nil:
+				return NewNullColumnData(), nil
+			default:
+				return ColumnData{}, fmt.Errorf("value from Valuer is not comatible with timestamp: %v", s)
+			}
+		}
+		if err := checkTimestampRange(t); err != nil {
+			return ColumnData{}, fmt.Errorf("could not set %s: %w", c.Name, err)
+		}
+		return NewTimestampColumnData(t), nil
+	case Tbytes:
+		switch {
+		case fieldKind == reflect.Slice && fieldType.Type.Elem().Kind() == reflect.Uint8:
+			// a nil slice is null
+			if fieldValue.IsNil() {
+				return NewNullColumnData(), nil
+			}
+			return NewBytesColumnData(fieldValue.Bytes()), nil
+		case fieldKind == reflect.String:
+			return NewBytesColumnData([]byte(fieldValue.String())), nil
+		}
+		vv, err := fieldValuerValue(c, fieldValue, fieldType)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		switch s := vv.(type) {
+		case []byte:
+			return NewBytesColumnData(s), nil
+		case nil:
+			return NewNullColumnData(), nil
+		default:
+			return ColumnData{}, fmt.Errorf("value from Valuer is not comatible with bytes: %v", s)
+		}
+	}
+	return ColumnData{}, fmt.Errorf("undefined column %s type: %d", c.Name, c.Type)
+}
+
+func columnDataToField(c ColumnDescriptor, rc ColumnData, fieldValue reflect.Value, fieldType reflect.StructField) error {
+	fieldKind := fieldType.Type.Kind()
+	if reflect.PtrTo(fieldType.Type).Implements(_scannerInterface) {
+		scannableValue := fieldValue.Addr().Interface().(sql.Scanner)
+		if rc.IsNull() {
+			return scannableValue.Scan(nil)
+		}
+		switch c.Type {
+		case Tint:
+			return scannableValue.Scan(rc.Int())
+		case Tfloat64:
+			return scannableValue.Scan(rc.Float64())
+		case Tbool:
+			return scannableValue.Scan(rc.Bool())
+		case Ttimestamp:
+			return scannableValue.Scan(rc.Timestamp())
+		case Tbytes:
+			return scannableValue.Scan(append([]byte{}, rc.Buffer...))
+		}
+	}
+	if rc.IsNull() {
+		fieldValue.Set(reflect.Zero(fieldType.Type))
+		return nil
+	}
+	switch c.Type {
+	case Tint:
+		switch fieldKind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if fieldValue.OverflowInt(rc.Int()) {
+				return fmt.Errorf("could not set %s: %d overflows %s", c.Name, rc.Int(), fieldType.Type)
+			}
+			fieldValue.SetInt(rc.Int())
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			intVal := rc.Int()
+			if intVal < 0 {
+				return fmt.Errorf("could not set %s with negative value: %d", c.Name, intVal)
+			}
+			if fieldValue.OverflowUint(uint64(intVal)) {
+				return fmt.Errorf("could not set %s: %d overflows %s", c.Name, intVal, fieldType.Type)
+			}
+			fieldValue.SetUint(uint64(intVal))
+			return nil
+		}
+	case Tfloat64:
+		switch fieldKind {
+		case reflect.Float32, reflect.Float64:
+			fieldValue.SetFloat(rc.Float64())
+			return nil
+		}
+	case Tbool:
+		if fieldKind == reflect.Bool {
+			fieldValue.SetBool(rc.Bool())
+			return nil
+		}
+	case Ttimestamp:
+		switch {
+		case fieldType.Type == _timeType:
+			fieldValue.Set(reflect.ValueOf(rc.Timestamp()))
+			return nil
+		case fieldKind == reflect.Int64:
+			fieldValue.SetInt(rc.Int())
+			return nil
+		}
+	case Tbytes:
+		switch {
+		case fieldKind == reflect.Slice && fieldType.Type.Elem().Kind() == reflect.Uint8:
+			buf := make([]byte, len(rc.Buffer))
+			copy(buf, rc.Buffer)
+			fieldValue.SetBytes(buf)
+			return nil
+		case fieldKind == reflect.String:
+			fieldValue.SetString(string(rc.Buffer))
+			return nil
+		}
+	}
+	return fmt.Errorf("could not set %s with field kind: %s", c.Name, fieldKind.String())
+}
@@ -2,8 +2,10 @@ package tablepacked
 
 import (
 	"database/sql"
+	"math"
 	"strconv"
 	"testing"
+	"time"
 )
 
 var reflectTableTest = Table{
@@ -80,3 +82,145 @@ func equals(rt *reflectTest, row *RowData) bool {
 		int(row.Data[4].EncodedRawValue) != rt.TTInt ||
 		uint(row.Data[5].EncodedRawValue) != rt.TTUint)
 }
+
+var reflectTypedTableTest = Table{
+	Name: "typed",
+	Columns: []c{
+		{Name: "TTInt", Type: Tint},
+		{Name: "TTFloat", Type: Tfloat64},
+		{Name: "TTBool", Type: Tbool},
+		{Name: "TTTimestamp", Type: Ttimestamp},
+		{Name: "TTBytes", Type: Tbytes},
+		{Name: "TTNullFloat", Type: Tfloat64},
+	},
+}
+
+type reflectTypedTest struct {
+	TTInt       int64
+	TTFloat     float64
+	TTBool      bool
+	TTTimestamp time.Time
+	TTBytes     []byte
+	TTNullFloat sql.NullFloat64
+}
+
+func TestTypedColumnsRoundTrip(t *testing.T) {
+	rt := &reflectTypedTest{
+		TTInt:       -42,
+		TTFloat:     -3.25,
+		TTBool:      true,
+		TTTimestamp: time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC),
+		TTBytes:     []byte{0, 1, 255},
+		TTNullFloat: sql.NullFloat64{Valid: false},
+	}
+	row := &RowData{}
+	if err := StructToRow(rt, row, reflectTypedTableTest); err != nil {
+		t.Fatalf("fail struct to row:%s", err.Error())
+	}
+	if row.Data[0].Int() != -42 || row.Data[1].Float64() != -3.25 || !row.Data[2].Bool() || !row.Data[5].IsNull() {
+		t.Fatalf("row comparison pb: %v -> %v", rt, row.Data)
+	}
+
+	// go through the binary encoding
+	buffer := row.WriteToBuffer(nil)
+	decoded := &RowData{}
+	if err := ReadFromBuffer(buffer, decoded); err != nil {
+		t.Fatalf("fail to read buffer:%s", err.Error())
+	}
+
+	rtNew := &reflectTypedTest{TTNullFloat: sql.NullFloat64{Float64: 1, Valid: true}}
+	if err := RowToStruct(rtNew, decoded, reflectTypedTableTest); err != nil {
+		t.Fatalf("fail row to struct:%s", err.Error())
+	}
+	if rtNew.TTInt != rt.TTInt || rtNew.TTFloat != rt.TTFloat || rtNew.TTBool != rt.TTBool ||
+		!rtNew.TTTimestamp.Equal(rt.TTTimestamp) || string(rtNew.TTBytes) != string(rt.TTBytes) || rtNew.TTNullFloat.Valid {
+		t.Fatalf("struct comparison pb: %v -> %v", rt, rtNew)
+	}
+}
+
+func TestIntFullRange(t *testing.T) {
+	for _, v := range []int64{math.MinInt64, minVarintInt - 1, minVarintInt, -1, 0, maxVarintInt, maxVarintInt + 1, math.MaxInt64} {
+		rt := &reflectTypedTest{TTInt: v, TTTimestamp: time.Unix(0, v)}
+		row := &RowData{}
+		if err := StructToRow(rt, row, reflectTypedTableTest); err != nil {
+			t.Fatalf("%d: fail struct to row:%s", v, err.Error())
+		}
+		decoded := &RowData{}
+		if err := ReadFromBuffer(row.WriteToBuffer(nil), decoded); err != nil {
+			t.Fatalf("%d: fail to read buffer:%s", v, err.Error())
+		}
+		rtNew := &reflectTypedTest{}
+		if err := RowToStruct(rtNew, decoded, reflectTypedTableTest); err != nil {
+			t.Fatalf("%d: fail row to struct:%s", v, err.Error())
+		}
+		if rtNew.TTInt != v || rtNew.TTTimestamp.UnixNano() != v || decoded.Data[0].IsNull() {
+			t.Fatalf("%d: get %d %d", v, rtNew.TTInt, rtNew.TTTimestamp.UnixNano())
+		}
+	}
+
+	rt := &reflectTypedTest{TTTimestamp: time.Time{}}
+	if err := StructToRow(rt, &RowData{}, reflectTypedTableTest); err == nil {
+		t.Fatalf("timestamp out of the int64 nanoseconds should fail")
+	}
+	type unsigned struct {
+		TTInt uint64
+	}
+	if err := StructToRow(&unsigned{TTInt: math.MaxUint64}, &RowData{}, Table{Name: "unsigned", Columns: []c{{Name: "TTInt", Type: Tint}}}); err == nil {
+		t.Fatalf("uint out of the int64 range should fail")
+	}
+}
+
+func TestEmptyBytesIsNotNull(t *testing.T) {
+	for _, in := range [][]byte{{}, nil} {
+		rt := &reflectTypedTest{TTTimestamp: time.Unix(0, 0), TTBytes: in}
+		row := &RowData{}
+		if err := StructToRow(rt, row, reflectTypedTableTest); err != nil {
+			t.Fatalf("fail struct to row:%s", err.Error())
+		}
+		decoded := &RowData{}
+		if err := ReadFromBuffer(row.WriteToBuffer(nil), decoded); err != nil {
+			t.Fatalf("fail to read buffer:%s", err.Error())
+		}
+		if decoded.Data[4].IsNull() != (in == nil) {
+			t.Fatalf("%v: null is %v after decoding", in, decoded.Data[4].IsNull())
+		}
+		rtNew := &reflectTypedTest{TTBytes: []byte{1}}
+		if err := RowToStruct(rtNew, decoded, reflectTypedTableTest); err != nil {
+			t.Fatalf("fail row to struct:%s", err.Error())
+		}
+		if (rtNew.TTBytes == nil) != (in == nil) || len(rtNew.TTBytes) != 0 {
+			t.Fatalf("%v: read %v", in, rtNew.TTBytes)
+		}
+	}
+}
+
+func TestIntFieldOverflow(t *testing.T) {
+	type narrow struct {
+		TTInt  int8
+		TTUint uint16
+	}
+	table := Table{
+		Name:    "narrow",
+		Columns: []c{{Name: "TTInt", Type: Tint}, {Name: "TTUint", Type: Tint}},
+	}
+	rows := []struct {
+		i, u int64
+		ok   bool
+	}{
+		{-128, 65535, true},
+		{128, 0, false},
+		{-129, 0, false},
+		{0, 65536, false},
+	}
+	for _, r := range rows {
+		row := &RowData{Data: []ColumnData{NewIntColumnData(r.i), NewIntColumnData(r.u)}}
+		res := &narrow{}
+		err := RowToStruct(res, row, table)
+		if (err == nil) != r.ok {
+			t.Fatalf("%d %d: %v", r.i, r.u, err)
+		}
+		if r.ok && (int64(res.TTInt) != r.i || int64(res.TTUint) != r.u) {
+			t.Fatalf("bad values %+v", res)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package tablepacked
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// PredicateOp kind of comparison done by a ColumnPredicate
+type PredicateOp uint8
+
+const (
+	// PredicateEqual column value equals the predicate value
+	PredicateEqual PredicateOp = 0
+	// PredicateRange column value is between Min and Max (inclusive)
+	PredicateRange PredicateOp = 1
+)
+
+// ColumnPredicate filter applied on one column during a scan
+type ColumnPredicate struct {
+	ColumnIndex int
+	Op          PredicateOp
+	Value       ColumnData
+	Min         uint64
+	Max         uint64
+}
+
+// NewUintEqualPredicate column of type Tuint equals value
+func NewUintEqualPredicate(columnIndex int, value uint64) ColumnPredicate {
+	return ColumnPredicate{ColumnIndex: columnIndex, Op: PredicateEqual, Value: ColumnData{EncodedRawValue: value}}
+}
+
+// NewEnumEqualPredicate column of type Tenum equals the enum value index
+func NewEnumEqualPredicate(columnIndex int, enumIndex int) ColumnPredicate {
+	return ColumnPredicate{ColumnIndex: columnIndex, Op: PredicateEqual, Value: ColumnData{EncodedRawValue: uint64(enumIndex)}}
+}
+
+// NewStringEqualPredicate column of type Tstring equals value
+func NewStringEqualPredicate(columnIndex int, value string) ColumnPredicate {
+	return ColumnPredicate{ColumnIndex: columnIndex, Op: PredicateEqual, Value: ColumnData{EncodedRawValue: uint64(len(value)), Buffer: []byte(value)}}
+}
+
+// NewUintRangePredicate column of type Tuint is between min and max (inclusive)
+func NewUintRangePredicate(columnIndex int, min uint64, max uint64) ColumnPredicate {
+	return ColumnPredicate{ColumnIndex: columnIndex, Op: PredicateRange, Min: min, Max: max}
+}
+
+// Match test the predicate against a row
+func (p ColumnPredicate) Match(row *RowData) bool {
+	if p.ColumnIndex < 0 || p.ColumnIndex >= len(row.Data) {
+		return false
+	}
+	cd := row.Data[p.ColumnIndex]
+	switch p.Op {
+	case PredicateEqual:
+		if p.Value.Buffer != nil {
+			return cd.Buffer != nil && bytes.Equal(cd.Buffer, p.Value.Buffer)
+		}
+		return cd.Buffer == nil && cd.EncodedRawValue == p.Value.EncodedRawValue
+	case PredicateRange:
+		return cd.Buffer == nil && cd.EncodedRawValue >= p.Min && cd.EncodedRawValue <= p.Max
+	}
+	return false
+}
+
+// ScanOptions filter and paginate the rows returned by a scan
+type ScanOptions struct {
+	// Offset count of matching rows to skip
+	Offset int
+	// Limit max count of rows returned. 0 means no limit
+	Limit int
+	// Reverse iterate from the last row to the first one
+	Reverse bool
+	// Predicates all of them must match for a row to be returned
+	Predicates []ColumnPredicate
+	// Table if set, rows written with a previous version of the table are upgraded
+	// before the predicates are applied
+	Table *Table
+}
+
+func (o ScanOptions) match(row *RowData) bool {
+	for _, p := range o.Predicates {
+		if !p.Match(row) {
+			return false
+		}
+	}
+	return true
+}
+
+const scanReadAheadSize = 64 * 1024
+
+// frameReader read the file by chunks to walk the rows framing without loading
+// the whole file
+type frameReader struct {
+	r      io.ReaderAt
+	size   int64
+	buf    []byte
+	bufOff int64
+}
+
+func newFrameReader(r io.ReaderAt, size int64) *frameReader {
+	return &frameReader{
+		r:    r,
+		size: size,
+		buf:  make([]byte, 0, scanReadAheadSize),
+	}
+}
+
+// bytesAt return n bytes at offset. The slice is only valid until the next call.
+// A nil slice is returned if the file is too short.
+func (fr *frameReader) bytesAt(off int64, n int) ([]byte, error) {
+	if off+int64(n) > fr.size {
+		return nil, nil
+	}
+	if off >= fr.bufOff && off+int64(n) <= fr.bufOff+int64(len(fr.buf)) {
+		start := off - fr.bufOff
+		return fr.buf[start : start+int64(n)], nil
+	}
+	l := scanReadAheadSize
+	if n > l {
+		l = n
+	}
+	if off+int64(l) > fr.size {
+		l = int(fr.size - off)
+	}
+	if cap(fr.buf) < l {
+		fr.buf = make([]byte, l)
+	}
+	fr.buf = fr.buf[0:l]
+	rn, err := fr.r.ReadAt(fr.buf, off)
+	if err != nil && !(err == io.EOF && rn == l) {
+		fr.buf = fr.buf[0:0]
+		return nil, err
+	}
+	fr.bufOff = off
+	return fr.buf[0:n], nil
+}
+
+// frameAt read the frame starting at offset and check its checksum.
+// It returns the frame content and the offset of the next frame.
+func (fr *frameReader) frameAt(off int64, framing uint8) ([]byte, int64, error) {
+	lenBufferBytes, err := fr.bytesAt(off, 2)
+	if err != nil {
+		return nil, 0, err
+	}
+	if lenBufferBytes == nil {
+		return nil, 0, &ErrBadEndingCRC{SaneOffset: int(off), Offset: int(off)}
+	}
+	var lenBuffer [2]byte
+	copy(lenBuffer[:], lenBufferBytes)
+	contentLen := int(binary.BigEndian.Uint16(lenBuffer[:]))
+	frame, err := fr.bytesAt(off+2, contentLen+frameChecksumLen(framing))
+	if err != nil {
+		return nil, 0, err
+	}
+	if frame == nil || !frameChecksumOK(framing, lenBuffer[:], frame[0:contentLen], frame[contentLen:]) {
+		return nil, 0, &ErrBadEndingCRC{SaneOffset: int(off), Offset: int(off)}
+	}
+	return frame[0:contentLen], off + 2 + int64(len(frame)), nil
+}
+
+// frameState schema version and framing given by the meta frames read so far
+type frameState struct {
+	version uint32
+	framing uint8
+}
+
+// metaAt read the meta frame following the empty frame at offset.
+// It returns the updated state and the offset of the next frame.
+func (fr *frameReader) metaAt(off int64, next int64, state frameState) (frameState, int64, error) {
+	frame, next, err := fr.frameAt(next, state.framing)
+	if err != nil {
+		if _, ok := err.(*ErrBadEndingCRC); ok {
+			return state, 0, &ErrBadEndingCRC{SaneOffset: int(off), Offset: int(off)}
+		}
+		return state, 0, err
+	}
+	kind, value, err := readMetaFrame(frame)
+	if err != nil {
+		return state, 0, err
+	}
+	switch kind {
+	case metaKindSchemaVersion:
+		state.version = uint32(value)
+	case metaKindRowFraming:
+		state.framing = uint8(value)
+	}
+	return state, next, nil
+}
+
+type rowFrame struct {
+	off   int64
+	state frameState
+}
+
+// frameOffsets walk the framing without reading the rows content
+func (fr *frameReader) frameOffsets() ([]rowFrame, error) {
+	res := make([]rowFrame, 0)
+	var off int64 = 0
+	state := frameState{framing: rowFramingAdditiveCrc}
+	for off < fr.size {
+		lenBufferBytes, err := fr.bytesAt(off, 2)
+		if err != nil {
+			return res, err
+		}
+		if lenBufferBytes == nil {
+			return res, &ErrBadEndingCRC{SaneOffset: int(off), Offset: int(off), RowIndex: len(res)}
+		}
+		lenBuffer := binary.BigEndian.Uint16(lenBufferBytes)
+		next := off + int64(lenBuffer) + 2 + int64(frameChecksumLen(state.framing))
+		if next > fr.size {
+			return res, &ErrBadEndingCRC{SaneOffset: int(off), Offset: int(off), RowIndex: len(res)}
+		}
+		if lenBuffer == 0 {
+			state, next, err = fr.metaAt(off, next, state)
+			if err != nil {
+				if errCrc, ok := err.(*ErrBadEndingCRC); ok {
+					errCrc.RowIndex = len(res)
+				}
+				return res, err
+			}
+		} else {
+			res = append(res, rowFrame{off: off, state: state})
+		}
+		off = next
+	}
+	return res, nil
+}
+
+type rowCollector struct {
+	opts        ScanOptions
+	rowDataPool *sync.Pool
+	scratch     RowData
+	skipped     int
+	table       *TableData
+	upgrader    *rowUpgrader
+}
+
+// add return false when the limit is reached
+func (rc *rowCollector) add(frame []byte, version uint32) (bool, error) {
+	if len(rc.opts.Predicates) > 0 {
+		if err := ReadFromBuffer(frame, &rc.scratch); err != nil {
+			return false, err
+		}
+		if err := rc.upgrader.upgrade(&rc.scratch, version); err != nil {
+			return false, err
+		}
+		if !rc.opts.match(&rc.scratch) {
+			return true, nil
+		}
+	}
+	if rc.skipped < rc.opts.Offset {
+		rc.skipped++
+		return true, nil
+	}
+	// the row keep a reference to the buffer so it must outlive the read-ahead window
+	owned := make([]byte, len(frame))
+	copy(owned, frame)
+	rd := rc.rowDataPool.Get().(*RowData)
+	if err := ReadFromBuffer(owned, rd); err != nil {
+		return false, err
+	}
+	if err := rc.upgrader.upgrade(rd, version); err != nil {
+		return false, err
+	}
+	rc.table.Data = append(rc.table.Data, rd)
+	return rc.opts.Limit <= 0 || len(rc.table.Data) < rc.opts.Limit, nil
+}
+
+// ScanRowsFromReader walk the rows of a table packed file and only keep the ones matching
+// the options. On a corrupted file, the rows before the corruption are returned with an ErrBadEndingCRC.
+func ScanRowsFromReader(r io.ReaderAt, size int64, opts ScanOptions, rowDataPool *sync.Pool) (*TableData, error) {
+	fr := newFrameReader(r, size)
+	upgrader, err := newRowUpgrader(opts.Table)
+	if err != nil {
+		return &TableData{}, err
+	}
+	rc := &rowCollector{
+		opts:        opts,
+		rowDataPool: rowDataPool,
+		table:       &TableData{},
+		upgrader:    upgrader,
+	}
+
+	if !opts.Reverse {
+		var off int64 = 0
+		state := frameState{framing: rowFramingAdditiveCrc}
+		rowIndex := 0
+		for off < size {
+			frame, next, err := fr.frameAt(off, state.framing)
+			if err == nil && len(frame) == 0 {
+				state, next, err = fr.metaAt(off, next, state)
+				if err == nil {
+					off = next
+					continue
+				}
+			}
+			if err != nil {
+				if errCrc, ok := err.(*ErrBadEndingCRC); ok {
+					errCrc.RowIndex = rowIndex
+				}
+				return rc.table, err
+			}
+			rowIndex++
+			more, err := rc.add(frame, state.version)
+			if err != nil {
+				return rc.table, err
+			}
+			if !more {
+				break
+			}
+			off = next
+		}
+		return rc.table, nil
+	}
+
+	offsets, errOffsets := fr.frameOffsets()
+	for i := len(offsets) - 1; i >= 0; i-- {
+		frame, _, err := fr.frameAt(offsets[i].off, offsets[i].state.framing)
+		if err != nil {
+			if errCrc, ok := err.(*ErrBadEndingCRC); ok {
+				errCrc.RowIndex = i
+			}
+			return rc.table, err
+		}
+		more, err := rc.add(frame, offsets[i].state.version)
+		if err != nil {
+			return rc.table, err
+		}
+		if !more {
+			break
+		}
+	}
+	return rc.table, errOffsets
+}
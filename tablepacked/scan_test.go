@@ -0,0 +1,181 @@
+package tablepacked
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func scanTestRow(i int) *RowData {
+	s := fmt.Sprintf("user%d", i%3)
+	return &RowData{
+		Data: []ColumnData{
+			{EncodedRawValue: uint64(i)},
+			{EncodedRawValue: uint64(i % 2)},
+			{EncodedRawValue: uint64(len(s)), Buffer: []byte(s)},
+		},
+	}
+}
+
+func TestScanRows(t *testing.T) {
+
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
+	logger := zap.New(core).WithOptions()
+
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	bfo, err := InitDriver(*sc, logger, map[string]Table{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "scan")
+
+	const rowCount = 100
+	rows := make([]*RowData, 0, rowCount)
+	for i := 0; i < rowCount/2; i++ {
+		rows = append(rows, scanTestRow(i))
+	}
+	if err := bfo.AppendRowData(cf, rows); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// half of the rows on disk, the other half pending in the wal
+	if _, err := bfo.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	rows = rows[0:0]
+	for i := rowCount / 2; i < rowCount; i++ {
+		rows = append(rows, scanTestRow(i))
+	}
+	if err := bfo.AppendRowData(cf, rows); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	res, err := bfo.ScanRows(cf, ScanOptions{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != rowCount {
+		t.Fatalf("should have read %d but get %d", rowCount, res.Len())
+	}
+	for i := 0; i < res.Len(); i++ {
+		if res.Row(i).Data[0].EncodedRawValue != uint64(i) {
+			t.Fatalf("row %d has value %d", i, res.Row(i).Data[0].EncodedRawValue)
+		}
+	}
+
+	res, err = bfo.ScanRows(cf, ScanOptions{Reverse: true, Limit: 10})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != 10 {
+		t.Fatalf("should have read %d but get %d", 10, res.Len())
+	}
+	if res.Row(0).Data[0].EncodedRawValue != rowCount-1 || res.Row(9).Data[0].EncodedRawValue != rowCount-10 {
+		t.Fatalf("reverse order not respected")
+	}
+
+	res, err = bfo.ScanRows(cf, ScanOptions{
+		Offset: 2,
+		Limit:  3,
+		Predicates: []ColumnPredicate{
+			NewStringEqualPredicate(2, "user1"),
+			NewUintEqualPredicate(1, 0),
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// matching rows: 4, 10, 16, 22, 28 ...
+	if res.Len() != 3 {
+		t.Fatalf("should have read %d but get %d", 3, res.Len())
+	}
+	if res.Row(0).Data[0].EncodedRawValue != 16 || res.Row(2).Data[0].EncodedRawValue != 28 {
+		t.Fatalf("bad predicate result: %d %d", res.Row(0).Data[0].EncodedRawValue, res.Row(2).Data[0].EncodedRawValue)
+	}
+
+	res, err = bfo.ScanRows(cf, ScanOptions{
+		Reverse:    true,
+		Predicates: []ColumnPredicate{NewUintRangePredicate(0, 45, 54)},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != 10 {
+		t.Fatalf("should have read %d but get %d", 10, res.Len())
+	}
+	if res.Row(0).Data[0].EncodedRawValue != 54 || res.Row(9).Data[0].EncodedRawValue != 45 {
+		t.Fatalf("bad range result")
+	}
+
+	bfo.Close()
+}
+
+func TestScanRowsCrc(t *testing.T) {
+
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
+	logger := zap.New(core).WithOptions()
+
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	bfo, err := InitDriver(*sc, logger, map[string]Table{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "scan")
+
+	rows := []*RowData{scanTestRow(0), scanTestRow(1), scanTestRow(2)}
+	if err := bfo.AppendRowData(cf, rows); err != nil {
+		t.Fatalf("%v", err)
+	}
+	bfo.Close()
+
+	file, err := os.OpenFile(cf.PathToFile(*sc), os.O_RDWR, 0744)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	st, err := file.Stat()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := file.WriteAt([]byte{15}, st.Size()-1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.Close()
+
+	res, err := bfo.ScanRows(cf, ScanOptions{Reverse: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != 2 {
+		t.Fatalf("should have read %d but get %d", 2, res.Len())
+	}
+	if res.Row(0).Data[0].EncodedRawValue != 1 {
+		t.Fatalf("rows after the corruption should be discarded")
+	}
+}
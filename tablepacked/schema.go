@@ -0,0 +1,183 @@
+package tablepacked
+
+import (
+	"fmt"
+
+	"github.com/buger/jsonparser"
+)
+
+// TableVersion columns of a previous version of a table
+type TableVersion struct {
+	Version uint32
+	Columns []ColumnDescriptor
+}
+
+// meta frames are made of an empty frame followed by a frame describing the meta data.
+// A row can not be empty so an empty frame is never a row.
+const (
+	metaKindSchemaVersion uint64 = 1
+	metaKindRowFraming    uint64 = 2
+)
+
+func metaFrameBuffer(kind uint64, value uint64) []byte {
+	buffer := ColumnData{EncodedRawValue: kind}.AppendColumnData(nil)
+	buffer = ColumnData{EncodedRawValue: value}.AppendColumnData(buffer)
+	return buffer
+}
+
+func readMetaFrame(frame []byte) (kind uint64, value uint64, err error) {
+	var kindCol, valueCol ColumnData
+	n, err := readColumnData(frame, &kindCol)
+	if err != nil {
+		return 0, 0, err
+	}
+	if int(n) >= len(frame) {
+		return 0, 0, fmt.Errorf("meta frame without value")
+	}
+	_, err = readColumnData(frame[n:], &valueCol)
+	if err != nil {
+		return 0, 0, err
+	}
+	return kindCol.EncodedRawValue, valueCol.EncodedRawValue, nil
+}
+
+// columnsForVersion get the columns used to write a row with this version.
+// Rows written before any versioning are version 0: if the history does not contain it,
+// the current columns are used.
+func (t Table) columnsForVersion(version uint32) ([]ColumnDescriptor, error) {
+	if version == t.Version {
+		return t.Columns, nil
+	}
+	for _, v := range t.History {
+		if v.Version == version {
+			return v.Columns, nil
+		}
+	}
+	if version == 0 {
+		return t.Columns, nil
+	}
+	return nil, fmt.Errorf("table %s has no version %d", t.Name, version)
+}
+
+// rowUpgrader convert rows of previous versions to the current version of a table
+type rowUpgrader struct {
+	table    *Table
+	defaults []ColumnData
+	plans    map[uint32][]int // index of the source column for each current column, -1 for default
+}
+
+func newRowUpgrader(table *Table) (*rowUpgrader, error) {
+	if table == nil {
+		return nil, nil
+	}
+	defaults := make([]ColumnData, len(table.Columns))
+	for i, c := range table.Columns {
+		d, err := c.DefaultColumnData()
+		if err != nil {
+			return nil, fmt.Errorf("bad default value for column %s: %w", c.Name, err)
+		}
+		defaults[i] = d
+	}
+	return &rowUpgrader{
+		table:    table,
+		defaults: defaults,
+		plans:    make(map[uint32][]int),
+	}, nil
+}
+
+func (ru *rowUpgrader) plan(version uint32) ([]int, error) {
+	if p, exists := ru.plans[version]; exists {
+		return p, nil
+	}
+	columns, err := ru.table.columnsForVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]int, len(ru.table.Columns))
+	for i, c := range ru.table.Columns {
+		p[i] = -1
+		for io, oc := range columns {
+			if oc.Name == c.Name {
+				p[i] = io
+				break
+			}
+		}
+	}
+	ru.plans[version] = p
+	return p, nil
+}
+
+// upgrade the row in place. Unknown columns are dropped and new columns get their default value.
+func (ru *rowUpgrader) upgrade(row *RowData, version uint32) error {
+	if ru == nil {
+		return nil
+	}
+	p, err := ru.plan(version)
+	if err != nil {
+		return err
+	}
+	identity := len(row.Data) == len(p)
+	for i, src := range p {
+		if src != i {
+			identity = false
+			break
+		}
+	}
+	if identity {
+		return nil
+	}
+	res := make([]ColumnData, len(p))
+	for i, src := range p {
+		if src >= 0 && src < len(row.Data) {
+			res[i] = row.Data[src]
+		} else {
+			res[i] = ru.defaults[i]
+		}
+	}
+	row.Data = res
+	return nil
+}
+
+// DefaultColumnData value used for the column when a row written with a previous version
+// of the table is read. No default means null.
+func (c ColumnDescriptor) DefaultColumnData() (ColumnData, error) {
+	if len(c.Default) == 0 {
+		return NewNullColumnData(), nil
+	}
+	value, vt, _, err := jsonparser.Get(c.Default)
+	if err != nil {
+		return ColumnData{}, err
+	}
+	if vt == jsonparser.Null {
+		return NewNullColumnData(), nil
+	}
+	switch c.Type {
+	case Tuint:
+		v, err := jsonparser.ParseInt(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		if v < 0 {
+			return ColumnData{}, fmt.Errorf("negative default for uint column: %d", v)
+		}
+		return ColumnData{EncodedRawValue: uint64(v)}, nil
+	case Tenum:
+		sv, err := jsonparser.ParseString(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		for i, ev := range c.EnumValues {
+			if ev == sv {
+				return ColumnData{EncodedRawValue: uint64(i)}, nil
+			}
+		}
+		return ColumnData{}, fmt.Errorf("default '%s' is not an enum value", sv)
+	case Tstring:
+		sv, err := jsonparser.ParseString(value)
+		if err != nil {
+			return ColumnData{}, err
+		}
+		return ColumnData{EncodedRawValue: uint64(len(sv)), Buffer: []byte(sv)}, nil
+	}
+	return c.parseJSONValue(value, vt)
+}
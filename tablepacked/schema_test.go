@@ -0,0 +1,180 @@
+package tablepacked
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var schemaTableV1 = Table{
+	Name:    "schema",
+	Version: 1,
+	Columns: []ColumnDescriptor{
+		{Name: "ID", Type: Tuint},
+		{Name: "Label", Type: Tstring},
+		{Name: "Obsolete", Type: Tuint},
+	},
+}
+
+var schemaTableV2 = Table{
+	Name:    "schema",
+	Version: 2,
+	Columns: []ColumnDescriptor{
+		{Name: "Label", Type: Tstring},
+		{Name: "ID", Type: Tuint},
+		{Name: "Score", Type: Tint, Default: json.RawMessage("-5")},
+	},
+	History: []TableVersion{
+		{Version: 1, Columns: schemaTableV1.Columns},
+	},
+}
+
+func schemaTestLogger() *zap.Logger {
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
+	return zap.New(core).WithOptions()
+}
+
+func TestSchemaUpgradeOnRead(t *testing.T) {
+	logger := schemaTestLogger()
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "schema")
+
+	bfo, err := InitDriver(*sc, logger, map[string]Table{"schema": schemaTableV1})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = bfo.AppendRowData(cf, []*RowData{
+		{Data: []ColumnData{{EncodedRawValue: 1}, schemaString("one"), {EncodedRawValue: 11}}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	bfo.Close()
+
+	bfo, err = InitDriver(*sc, logger, map[string]Table{"schema": schemaTableV2})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = bfo.AppendRowData(cf, []*RowData{
+		{Data: []ColumnData{schemaString("two"), {EncodedRawValue: 2}, NewIntColumnData(7)}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	check := func(res TableDataSlice) {
+		if res.Len() != 2 {
+			t.Fatalf("should have read %d but get %d", 2, res.Len())
+		}
+		r := res.Row(0)
+		if len(r.Data) != 3 || string(r.Data[0].Buffer) != "one" || r.Data[1].EncodedRawValue != 1 || r.Data[2].Int() != -5 {
+			t.Fatalf("old row not upgraded: %v", r.Data)
+		}
+		r = res.Row(1)
+		if string(r.Data[0].Buffer) != "two" || r.Data[1].EncodedRawValue != 2 || r.Data[2].Int() != 7 {
+			t.Fatalf("new row altered: %v", r.Data)
+		}
+	}
+
+	res, err := bfo.ReadAllRowData(cf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	check(res)
+
+	res, err = bfo.ScanRows(cf, ScanOptions{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	check(res)
+
+	res, err = bfo.ScanRows(cf, ScanOptions{Reverse: true, Predicates: []ColumnPredicate{NewUintEqualPredicate(1, 1)}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Len() != 1 || string(res.Row(0).Data[0].Buffer) != "one" {
+		t.Fatalf("predicate should apply on the upgraded row")
+	}
+
+	bfo.Close()
+}
+
+func TestSqliteSchemaUpgrade(t *testing.T) {
+	logger := schemaTestLogger()
+	sc := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "schema")
+
+	archive := func(table Table, row *RowData) {
+		bfo, err := InitDriver(*sc, logger, map[string]Table{"schema": table})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := bfo.AppendRowData(cf, []*RowData{row}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := bfo.Archive(cf); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := bfo.Flush(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		time.Sleep(1 * time.Second)
+		bfo.Close()
+	}
+
+	archive(schemaTableV1, &RowData{Data: []ColumnData{{EncodedRawValue: 1}, schemaString("one"), {EncodedRawValue: 11}}})
+	archive(schemaTableV2, &RowData{Data: []ColumnData{schemaString("two"), {EncodedRawValue: 2}, NewIntColumnData(7)}})
+
+	db, err := sql.Open("sqlite3", SqliteDbPathForTableName(*sc, "schema"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT ID, Label, Score FROM schema ORDER BY ID")
+	if err != nil {
+		t.Fatalf("Error happened during select %s", err.Error())
+	}
+	defer rows.Close()
+
+	expectedScores := []sql.NullInt64{{}, {Int64: 7, Valid: true}}
+	i := 0
+	for rows.Next() {
+		var id int
+		var label string
+		var score sql.NullInt64
+		if err := rows.Scan(&id, &label, &score); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if i >= len(expectedScores) || id != i+1 || score != expectedScores[i] {
+			t.Fatalf("bad sqlite row %d: %d %s %v", i, id, label, score)
+		}
+		i++
+	}
+	if i != 2 {
+		t.Fatalf("should have %d sqlite rows but get %d", 2, i)
+	}
+}
+
+func schemaString(s string) ColumnData {
+	return ColumnData{EncodedRawValue: uint64(len(s)), Buffer: []byte(s)}
+}
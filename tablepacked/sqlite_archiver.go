@@ -20,6 +20,8 @@ type sqlite3Archiver struct {
 	logger              *zap.Logger
 	tableDescriptorRepo map[string]Table
 	rowDataPool         *sync.Pool
+	// sealer encrypts the values, nil without KeyProvider
+	sealer *sqliteSealer
 }
 
 // var instead of const for testing purpose
@@ -58,25 +60,30 @@ func (sa *sqlite3Archiver) openDbAndRegisterIt(fdb string, file config.Container
 	if shouldCreateTable {
 		sql := "CREATE TABLE " + file.TableName + "("
 		for ic, c := range descriptor.Columns {
-			sql += c.Name
-			switch c.Type {
-			case Tuint, Tenum:
-				sql += " INTEGER"
-			case Tstring:
-				sql += " TEXT"
-			default:
+			sqlType, err := sa.columnType(c)
+			if err != nil {
 				sa.logger.Error("unkown type", zap.Int("type", int(c.Type)))
 				return nil
 			}
+			sql += c.Name + " " + sqlType
 			if ic < len(descriptor.Columns)-1 {
 				sql += ", "
 			}
 		}
 		sql += ");"
+		if sa.sealer != nil {
+			sql = "BEGIN; CREATE TABLE " + sqliteEncryptionTable + "(version INTEGER); " + sql + " COMMIT;"
+		}
 		if _, err := db.Exec(sql); err != nil {
 			sa.logger.Error("could not create sqlite table", zap.String("sql", sql), zap.Error(err))
 			return nil
 		}
+	} else if err := checkSqliteEncryption(db, fdb, sa.sealer); err != nil {
+		sa.logger.Error("could not open sqlite file", zap.String("file", fdb), zap.Error(err))
+		return nil
+	} else if err := sa.addMissingColumns(db, file.TableName, descriptor); err != nil {
+		sa.logger.Error("could not upgrade sqlite table", zap.String("file", fdb), zap.Error(err))
+		return nil
 	}
 
 	sa.bdByTable[file.TableName] = db
@@ -84,6 +91,99 @@ func (sa *sqlite3Archiver) openDbAndRegisterIt(fdb string, file config.Container
 	return db
 }
 
+// addMissingColumns alter the sqlite table to add the columns of the descriptor it does not have yet.
+// Dropped columns are kept in sqlite and filled with null.
+func (sa *sqlite3Archiver) addMissingColumns(db *sql.DB, tableName string, descriptor Table) error {
+	rows, err := db.Query("PRAGMA table_info(" + tableName + ");")
+	if err != nil {
+		return err
+	}
+	existingColumns := map[string]bool{}
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notNull, pk int
+		var defaultValue interface{}
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existingColumns[name] = true
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range descriptor.Columns {
+		if existingColumns[c.Name] {
+			continue
+		}
+		sqlType, err := sa.columnType(c)
+		if err != nil {
+			return err
+		}
+		sql := "ALTER TABLE " + tableName + " ADD COLUMN " + c.Name + " " + sqlType + ";"
+		if _, err := db.Exec(sql); err != nil {
+			return fmt.Errorf("%s: %w", sql, err)
+		}
+		sa.logger.Info("sqlite column added", zap.String("table", tableName), zap.String("column", c.Name))
+	}
+	return nil
+}
+
+func sqliteColumnType(c ColumnDescriptor) (string, error) {
+	switch c.Type {
+	case Tuint, Tenum, Tint, Tbool, Ttimestamp:
+		return "INTEGER", nil
+	case Tstring:
+		return "TEXT", nil
+	case Tfloat64:
+		return "REAL", nil
+	case Tbytes:
+		return "BLOB", nil
+	}
+	return "", fmt.Errorf("unkown type: %d", c.Type)
+}
+
+// columnType sql type of a column, BLOB for all the columns of the encrypted files
+func (sa *sqlite3Archiver) columnType(c ColumnDescriptor) (string, error) {
+	sqlType, err := sqliteColumnType(c)
+	if err != nil || sa.sealer == nil {
+		return sqlType, err
+	}
+	return "BLOB", nil
+}
+
+// sqliteColumnValue convert a column to a sql value. Timestamps are stored as unix nanoseconds.
+func sqliteColumnValue(c ColumnDescriptor, cd ColumnData) (interface{}, error) {
+	switch c.Type {
+	case Tuint, Tenum:
+		return cd.EncodedRawValue, nil
+	case Tstring:
+		return string(cd.Buffer), nil
+	}
+	if cd.IsNull() {
+		return nil, nil
+	}
+	switch c.Type {
+	case Tint, Ttimestamp:
+		return cd.Int(), nil
+	case Tbool:
+		return cd.Bool(), nil
+	case Tfloat64:
+		return cd.Float64(), nil
+	case Tbytes:
+		if cd.Buffer == nil {
+			return []byte{}, nil
+		}
+		return cd.Buffer, nil
+	}
+	return nil, fmt.Errorf("unkown type: %d", c.Type)
+}
+
 func (sa *sqlite3Archiver) Close() {
 	for key, db := range sa.bdByTable {
 		err := db.Close()
@@ -91,13 +191,29 @@ func (sa *sqlite3Archiver) Close() {
 	}
 }
 
+// Do insert the rows of the archived file and remove it. The file is kept if the insertion fails.
 func (sa *sqlite3Archiver) Do(p string, file config.ContainerFile) {
+	if err := sa.insert(p, file); err != nil {
+		sa.logger.Error("could not insert archived file in sqlite", zap.String("path", p), zap.Error(err))
+		return
+	}
+	if err := sa.config.GetStorage().Remove(p); err != nil {
+		sa.logger.Error("could not delete archive file", zap.String("path", p), zap.Error(err))
+	}
+}
+
+// Send insert the rows of the archived file, as a sink of a wal.FanOut
+func (sa *sqlite3Archiver) Send(p string, file config.ContainerFile) error {
+	return sa.insert(p, file)
+}
+
+// insert the rows of the archived file in the sqlite file of its table
+func (sa *sqlite3Archiver) insert(p string, file config.ContainerFile) error {
 	var descriptor Table
 	var exist bool
 	descriptor, exist = sa.tableDescriptorRepo[file.TableName]
 	if !exist {
-		sa.logger.Error("could not found table descriptor", zap.String("table", file.TableName))
-		return
+		return fmt.Errorf("could not found table descriptor %s", file.TableName)
 	}
 	db, exist := sa.bdByTable[file.TableName]
 	fdb := SqliteDbPathForTableName(sa.config, file.TableName)
@@ -108,30 +224,29 @@ func (sa *sqlite3Archiver) Do(p string, file config.ContainerFile) {
 		}
 		db = sa.openDbAndRegisterIt(fdb, file, descriptor, shouldCreateTable)
 		if db == nil {
-			return
+			return fmt.Errorf("could not open sqlite file %s", fdb)
 		}
 	}
 
-	f, err := os.Open(p)
+	store := sa.config.GetStorage()
+	f, err := store.OpenFile(p, false)
 	if err != nil {
-		sa.logger.Error("could not open file", zap.String("path", p), zap.Error(err))
-		return
+		return fmt.Errorf("could not open file: %w", err)
 	}
 	buffer := &wutils.Buffer{}
 	err = fileop.GetFileBufferFromFile(f, buffer)
 	if err != nil {
-		sa.logger.Error("could not get file buffer from file", zap.String("path", p), zap.Error(err))
-		return
+		f.Close()
+		return fmt.Errorf("could not get file buffer from file: %w", err)
 	}
 	buffer.ResetRead()
 
 	err = f.Close()
 	if err != nil {
-		sa.logger.Error("could not close file", zap.String("path", p), zap.Error(err))
-		return
+		return fmt.Errorf("could not close file: %w", err)
 	}
 
-	tableData, err := ReadAllRowDataFromFileBuffer(buffer, sa.rowDataPool)
+	tableData, err := ReadAllRowDataFromFileBufferForTable(buffer, sa.rowDataPool, descriptor)
 	if err != nil {
 		if _, ok := err.(*ErrBadEndingCRC); !ok {
 			sa.logger.Error("could not parse file", zap.String("path", p), zap.Error(err))
@@ -146,37 +261,39 @@ func (sa *sqlite3Archiver) Do(p string, file config.ContainerFile) {
 	err = maxRowIDRow.Scan(&maxRowID)
 	if err != nil {
 		if err != sql.ErrNoRows {
-			sa.logger.Error("could not get max row id", zap.String("sql", maxRowIDSQL), zap.Error(err))
-			return
+			return fmt.Errorf("could not get max row id: %w", err)
 		}
 	}
 
 	if maxRowID >= maxSqliteRowPerFile {
 		delete(sa.bdByTable, file.TableName)
 		sa.logger.Info("archive sqlite file because limit row has been reached", zap.Int("limit", maxSqliteRowPerFile), zap.Int("max-row-id", maxRowID))
+		// without reader, the close merges the sqlite wal in the file before the rename
+		rollLock := sqliteRollLock(fdb)
+		rollLock.Lock()
 		err = db.Close()
 		if err != nil {
-			sa.logger.Error("could not close db", zap.String("table-name", file.TableName))
-			return
+			rollLock.Unlock()
+			return fmt.Errorf("could not close db of table %s: %w", file.TableName, err)
 		}
 		newPath := fmt.Sprintf("%s-%d.bak", fdb, time.Now().Unix())
 		err = os.Rename(fdb, newPath)
+		rollLock.Unlock()
 		if err != nil {
-			sa.logger.Error("could not rename db", zap.String("from", fdb), zap.String("to", newPath))
-			return
+			return fmt.Errorf("could not rename db %s to %s: %w", fdb, newPath, err)
 		}
 
 		db = sa.openDbAndRegisterIt(fdb, file, descriptor, true)
 		if db == nil {
-			return
+			return fmt.Errorf("could not open sqlite file %s", fdb)
 		}
 	}
 
 	if len(tableData.Data) > 0 {
+		insertStart := time.Now()
 		tx, err := db.Begin()
 		if err != nil {
-			sa.logger.Error("could not create transaction for sqlite archiver", zap.Error(err))
-			return
+			return fmt.Errorf("could not create transaction for sqlite archiver: %w", err)
 		}
 		const batchInsertRow = 100
 		curRow := 0
@@ -202,18 +319,21 @@ func (sa *sqlite3Archiver) Do(p string, file config.ContainerFile) {
 			for rDataI, rData := range thisRows {
 				sql += "("
 				for ic, c := range descriptor.Columns {
-					if ic < len(rData.Data) {
-						switch c.Type {
-						case Tuint, Tenum:
-							sql += "?"
-							values = append(values, rData.Data[ic].EncodedRawValue)
-						case Tstring:
-							sql += "?"
-							values = append(values, string(rData.Data[ic].Buffer))
-						default:
-							sa.logger.Error("unkown type", zap.Int("type", int(c.Type)))
-							return
+					if ic < len(rData.Data) || sa.sealer != nil {
+						var v interface{}
+						var err error
+						if ic < len(rData.Data) {
+							v, err = sqliteColumnValue(c, rData.Data[ic])
 						}
+						if err == nil && sa.sealer != nil {
+							v, err = sa.sealer.seal(v, file.TableName, c.Name)
+						}
+						if err != nil {
+							tx.Rollback()
+							return err
+						}
+						sql += "?"
+						values = append(values, v)
 					} else {
 						sql += "null"
 					}
@@ -228,17 +348,18 @@ func (sa *sqlite3Archiver) Do(p string, file config.ContainerFile) {
 			}
 			_, err = tx.Exec(sql, values...)
 			if err != nil {
-				sa.logger.Error("could not insert data", zap.String("sql", sql), zap.Error(err))
-				return
+				tx.Rollback()
+				return fmt.Errorf("could not insert data: %w", err)
 			}
 
 			curRow += batchInsertRow
 		}
 		err = tx.Commit()
 		if err != nil {
-			sa.logger.Error("could not commit transaction for sqlite archiver", zap.Error(err))
-			return
+			return fmt.Errorf("could not commit transaction for sqlite archiver: %w", err)
 		}
+		sqliteInsertDurationMetric.WithLabelValues(file.TableName).Observe(time.Since(insertStart).Seconds())
+		sqliteInsertedRowsMetric.WithLabelValues(file.TableName).Add(float64(len(tableData.Data)))
 	}
 
 	for _, r := range tableData.Data {
@@ -246,9 +367,5 @@ func (sa *sqlite3Archiver) Do(p string, file config.ContainerFile) {
 		sa.rowDataPool.Put(r)
 	}
 
-	err = os.Remove(p)
-	if err != nil {
-		sa.logger.Error("could not delete archive file", zap.String("path", p), zap.Error(err))
-		return
-	}
+	return nil
 }
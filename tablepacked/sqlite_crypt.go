@@ -0,0 +1,401 @@
+package tablepacked
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/chamot1111/waldb/crypt"
+)
+
+// The sqlite files of a config with a KeyProvider are encrypted per value: each column value is sealed by
+// crypt.Seal with the table and column names as additional data, and stored as a BLOB after the id of its
+// key. The table and column names and the row count stay in plaintext. As sqlite can not compare the
+// sealed values, the predicates, the order and the limit of QueryArchive are applied to the opened rows.
+// An encrypted file has the sqliteEncryptionTable table: a plaintext file is rejected with a KeyProvider,
+// and must be encrypted by EncryptSqliteFiles.
+const sqliteEncryptionTable = "waldb_encryption"
+
+// ErrSqliteNotEncrypted the sqlite file has been written before the encryption was enabled, see
+// EncryptSqliteFiles
+var ErrSqliteNotEncrypted = errors.New("sqlite file is not encrypted")
+
+// type of the sealed sql values
+const (
+	sqliteSealedNull = iota
+	sqliteSealedInt
+	sqliteSealedFloat
+	sqliteSealedText
+	sqliteSealedBlob
+)
+
+// sqliteSealer seal and open the sql values of the encrypted sqlite files
+type sqliteSealer struct {
+	keys  crypt.KeyProvider
+	mutex sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+// newSqliteSealer nil without keys: the sqlite files are not encrypted
+func newSqliteSealer(keys crypt.KeyProvider) *sqliteSealer {
+	if keys == nil {
+		return nil
+	}
+	return &sqliteSealer{keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+func (s *sqliteSealer) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if aead, exists := s.aeads[id]; exists {
+		return aead, nil
+	}
+	aead, err := crypt.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	s.aeads[id] = aead
+	return aead, nil
+}
+
+func sqliteSealedAdditionalData(table string, column string) []byte {
+	return []byte(table + "." + column)
+}
+
+// seal a value of sqliteColumnValue with the current key
+func (s *sqliteSealer) seal(v interface{}, table string, column string) ([]byte, error) {
+	plaintext, err := encodeSqliteValue(v)
+	if err != nil {
+		return nil, err
+	}
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 4, 4+crypt.Overhead+len(plaintext))
+	binary.BigEndian.PutUint32(res, id)
+	return crypt.Seal(aead, res, plaintext, sqliteSealedAdditionalData(table, column))
+}
+
+// open a value read from an encrypted sqlite file. Null is the value of the rows inserted before the
+// column was added.
+func (s *sqliteSealer) open(v interface{}, table string, column string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	sealed, ok := v.([]byte)
+	if !ok || len(sealed) < 4 {
+		return nil, fmt.Errorf("column %s: sealed value expected, get %T", column, v)
+	}
+	id := binary.BigEndian.Uint32(sealed)
+	key, err := s.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := crypt.Open(aead, nil, sealed[4:], sqliteSealedAdditionalData(table, column))
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", column, err)
+	}
+	return decodeSqliteValue(plaintext)
+}
+
+// normalizeSqliteValue value as read back from sqlite
+func normalizeSqliteValue(v interface{}) interface{} {
+	switch s := v.(type) {
+	case uint64:
+		return int64(s)
+	case bool:
+		if s {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return v
+}
+
+func encodeSqliteValue(v interface{}) ([]byte, error) {
+	switch s := normalizeSqliteValue(v).(type) {
+	case nil:
+		return []byte{sqliteSealedNull}, nil
+	case int64:
+		res := make([]byte, 9)
+		res[0] = sqliteSealedInt
+		binary.BigEndian.PutUint64(res[1:], uint64(s))
+		return res, nil
+	case float64:
+		res := make([]byte, 9)
+		res[0] = sqliteSealedFloat
+		binary.BigEndian.PutUint64(res[1:], math.Float64bits(s))
+		return res, nil
+	case string:
+		return append([]byte{sqliteSealedText}, s...), nil
+	case []byte:
+		return append([]byte{sqliteSealedBlob}, s...), nil
+	}
+	return nil, fmt.Errorf("could not seal sql value of type %T", v)
+}
+
+func decodeSqliteValue(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty sealed value")
+	}
+	switch b[0] {
+	case sqliteSealedNull:
+		return nil, nil
+	case sqliteSealedInt, sqliteSealedFloat:
+		if len(b) != 9 {
+			return nil, fmt.Errorf("bad sealed number length %d", len(b))
+		}
+		u := binary.BigEndian.Uint64(b[1:])
+		if b[0] == sqliteSealedFloat {
+			return math.Float64frombits(u), nil
+		}
+		return int64(u), nil
+	case sqliteSealedText:
+		return string(b[1:]), nil
+	case sqliteSealedBlob:
+		return b[1:], nil
+	}
+	return nil, fmt.Errorf("unknown sealed value type %d", b[0])
+}
+
+// sqliteValueMatch match an opened value like the where clause of queryArchiveFile
+func sqliteValueMatch(c ColumnDescriptor, p ColumnPredicate, v interface{}) (bool, error) {
+	switch p.Op {
+	case PredicateEqual:
+		pv, err := sqliteColumnValue(c, p.Value)
+		if err != nil {
+			return false, err
+		}
+		switch s := normalizeSqliteValue(pv).(type) {
+		case nil:
+			return v == nil, nil
+		case []byte:
+			b, ok := v.([]byte)
+			return ok && bytes.Equal(b, s), nil
+		default:
+			return v == s, nil
+		}
+	case PredicateRange:
+		i, ok := v.(int64)
+		return ok && i >= int64(p.Min) && i <= int64(p.Max), nil
+	}
+	return false, fmt.Errorf("unknown predicate op %d", p.Op)
+}
+
+// sqliteEncrypted the sqlite file has the sqliteEncryptionTable table
+func sqliteEncrypted(db *sql.DB) (bool, error) {
+	var name string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", sqliteEncryptionTable).Scan(&name)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkSqliteEncryption the sqlite file is encrypted if and only if there is a sealer
+func checkSqliteEncryption(db *sql.DB, fdb string, sealer *sqliteSealer) error {
+	encrypted, err := sqliteEncrypted(db)
+	if err != nil {
+		return err
+	}
+	if encrypted && sealer == nil {
+		return fmt.Errorf("sqlite file %s is encrypted and there is no KeyProvider", fdb)
+	}
+	if !encrypted && sealer != nil {
+		return fmt.Errorf("%s: %w", fdb, ErrSqliteNotEncrypted)
+	}
+	return nil
+}
+
+// EncryptSqliteFiles encrypt with the current key of keys the plaintext sqlite files of folder, the
+// current and the rolled ones, written before the encryption was enabled. The database must be stopped.
+// A file is encrypted in <path>.tmp then renamed, so an interrupted migration can be run again. It
+// returns the paths of the encrypted files.
+func EncryptSqliteFiles(folder string, keys crypt.KeyProvider) ([]string, error) {
+	res := make([]string, 0)
+	if folder == "" {
+		return res, nil
+	}
+	entries, err := ioutil.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	sealer := newSqliteSealer(keys)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, ".db") || strings.Contains(name, ".db-") && strings.HasSuffix(name, ".bak")) {
+			continue
+		}
+		fdb := path.Join(folder, name)
+		encrypted, err := encryptSqliteFile(fdb, sealer)
+		if err != nil {
+			return res, fmt.Errorf("could not encrypt %s: %w", fdb, err)
+		}
+		if encrypted {
+			res = append(res, fdb)
+		}
+	}
+	return res, nil
+}
+
+// encryptSqliteFile copy the tables of a plaintext sqlite file with their values sealed
+func encryptSqliteFile(fdb string, sealer *sqliteSealer) (bool, error) {
+	src, err := sql.Open("sqlite3", fdb)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	if encrypted, err := sqliteEncrypted(src); err != nil || encrypted {
+		return false, err
+	}
+	// the write-ahead log of the plaintext file is not valid for the encrypted one
+	if _, err := src.Exec("PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		return false, err
+	}
+
+	tables := make([]string, 0)
+	rows, err := src.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	tmpPath := fdb + ".tmp"
+	os.Remove(tmpPath)
+	dst, err := sql.Open("sqlite3", tmpPath)
+	if err != nil {
+		return false, err
+	}
+	defer dst.Close()
+	tx, err := dst.Begin()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("CREATE TABLE " + sqliteEncryptionTable + "(version INTEGER);"); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	for _, table := range tables {
+		if err := encryptSqliteTable(src, tx, table, sealer); err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	if err := dst.Close(); err != nil {
+		return false, err
+	}
+	if err := src.Close(); err != nil {
+		return false, err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(fdb + suffix); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return true, os.Rename(tmpPath, fdb)
+}
+
+func encryptSqliteTable(src *sql.DB, dst *sql.Tx, table string, sealer *sqliteSealer) error {
+	existing, err := sqliteTableColumnNames(src, table)
+	if err != nil {
+		return err
+	}
+	create := "CREATE TABLE " + table + "("
+	insert := "INSERT INTO " + table + "(rowid"
+	for i, name := range existing {
+		if i > 0 {
+			create += ", "
+		}
+		create += name + " BLOB"
+		insert += ", " + name
+	}
+	create += ");"
+	insert += ") VALUES (?" + strings.Repeat(", ?", len(existing)) + ");"
+	if _, err := dst.Exec(create); err != nil {
+		return err
+	}
+
+	rows, err := src.Query("SELECT rowid, " + strings.Join(existing, ", ") + " FROM " + table + " ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	values := make([]interface{}, len(existing)+1)
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, name := range existing {
+			if values[i+1], err = sealer.seal(values[i+1], table, name); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Exec(insert, values...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// openSqliteRow open in place the selected values of a row of an encrypted file and match them with
+// the predicates
+func openSqliteRow(sealer *sqliteSealer, table string, descriptor Table, selected []int, filter []ColumnPredicate, values []interface{}) (bool, error) {
+	for i, ci := range selected {
+		v, err := sealer.open(values[i], table, descriptor.Columns[ci].Name)
+		if err != nil {
+			return false, err
+		}
+		values[i] = v
+	}
+	for _, p := range filter {
+		for i, ci := range selected {
+			if ci != p.ColumnIndex {
+				continue
+			}
+			match, err := sqliteValueMatch(descriptor.Columns[ci], p, values[i])
+			if err != nil || !match {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,415 @@
+package tablepacked
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ArchiveOrder order of the rows returned by QueryArchive. An empty column keeps the archiving order.
+type ArchiveOrder struct {
+	Column string
+	Desc   bool
+}
+
+// sqliteDbFiles current sqlite file of the table and the files rolled after maxSqliteRowPerFile rows,
+// the oldest first
+func sqliteDbFiles(fdb string) ([]string, error) {
+	rolled, err := filepath.Glob(fdb + "-*.bak")
+	if err != nil {
+		return nil, err
+	}
+	rolledAt := func(p string) int64 {
+		v, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(p, fdb+"-"), ".bak"), 10, 64)
+		return v
+	}
+	sort.Slice(rolled, func(i, j int) bool { return rolledAt(rolled[i]) < rolledAt(rolled[j]) })
+	if _, err := os.Stat(fdb); err == nil {
+		rolled = append(rolled, fdb)
+	}
+	return rolled, nil
+}
+
+// sqliteRollLocks *sync.RWMutex by current sqlite file, see sqliteRollLock
+var sqliteRollLocks sync.Map
+
+// sqliteRollLock lock of the roll of the current sqlite file fdb by the archiver, held for read by
+// QueryArchive
+func sqliteRollLock(fdb string) *sync.RWMutex {
+	l, _ := sqliteRollLocks.LoadOrStore(fdb, &sync.RWMutex{})
+	return l.(*sync.RWMutex)
+}
+
+// QueryArchive read the rows of table archived in sqlite, from the current file and the rolled ones.
+// The predicates use the column indexes of the table descriptor. limit 0 means no limit.
+// The rows are released with FreeTable.
+func (d *Driver) QueryArchive(table string, filter []ColumnPredicate, order ArchiveOrder, limit int) (TableDataSlice, error) {
+	descriptor, exists := d.tableDescriptorRepo[table]
+	if !exists {
+		return TableDataSlice{}, fmt.Errorf("unknown table %s", table)
+	}
+	orderIndex := -1
+	if order.Column != "" {
+		for i, c := range descriptor.Columns {
+			if c.Name == order.Column {
+				orderIndex = i
+			}
+		}
+		if orderIndex < 0 {
+			return TableDataSlice{}, fmt.Errorf("unknown order column %s", order.Column)
+		}
+	}
+	for _, p := range filter {
+		if p.ColumnIndex < 0 || p.ColumnIndex >= len(descriptor.Columns) {
+			return TableDataSlice{}, fmt.Errorf("bad predicate column index %d", p.ColumnIndex)
+		}
+	}
+
+	res := &TableData{}
+	if err := d.queryArchiveFiles(table, descriptor, filter, order, limit, res); err != nil {
+		d.putRows(res.Data)
+		return TableDataSlice{}, err
+	}
+
+	if orderIndex >= 0 {
+		c := descriptor.Columns[orderIndex]
+		sort.SliceStable(res.Data, func(i, j int) bool {
+			cmp := compareColumnData(c, res.Data[i].Data[orderIndex], res.Data[j].Data[orderIndex])
+			if order.Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+	if limit > 0 && len(res.Data) > limit {
+		d.putRows(res.Data[limit:])
+		res.Data = res.Data[0:limit]
+	}
+	return InitTableDataSlice(res), nil
+}
+
+// queryArchiveFiles query the rolled sqlite files of table, the oldest first, then the current one. The
+// archiver does not roll the current file meanwhile: in WAL journal mode its last rows can be in the
+// sqlite wal, merged in the file only when its last connection is closed.
+func (d *Driver) queryArchiveFiles(table string, descriptor Table, filter []ColumnPredicate, order ArchiveOrder, limit int, res *TableData) error {
+	fdb := SqliteDbPathForTableName(d.conf, table)
+	rollLock := sqliteRollLock(fdb)
+	rollLock.RLock()
+	defer rollLock.RUnlock()
+
+	files, err := sqliteDbFiles(fdb)
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		if order.Column == "" && limit > 0 && len(res.Data) >= limit {
+			break
+		}
+		if err := d.queryArchiveFile(p, table, descriptor, filter, order, limit, res); err != nil {
+			return fmt.Errorf("could not query %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) putRows(rows []*RowData) {
+	for _, r := range rows {
+		r.Data = r.Data[0:0]
+		d.rowDataPool.Put(r)
+	}
+}
+
+// QueryArchiveStructs same as QueryArchive but fill dst, a pointer to a slice of structs, with RowToStruct
+func (d *Driver) QueryArchiveStructs(dst interface{}, table string, filter []ColumnPredicate, order ArchiveOrder, limit int) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice || v.Elem().Type().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("destination must be a pointer to a slice of structs")
+	}
+	t, err := d.QueryArchive(table, filter, order, limit)
+	if err != nil {
+		return err
+	}
+	defer d.FreeTable(t)
+	defer t.Release()
+	slice := v.Elem()
+	descriptor := d.tableDescriptorRepo[table]
+	for _, r := range t.AllRows() {
+		elem := reflect.New(slice.Type().Elem())
+		if err := RowToStruct(elem.Interface(), r, descriptor); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	v.Elem().Set(slice)
+	return nil
+}
+
+// queryArchiveFile append to res the rows of a sqlite file. The columns added to the table after
+// the file has been rolled get their default value.
+func (d *Driver) queryArchiveFile(fdb string, table string, descriptor Table, filter []ColumnPredicate, order ArchiveOrder, limit int, res *TableData) error {
+	db, err := sql.Open("sqlite3", "file:"+fdb+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	existing, err := sqliteTableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	if err := checkSqliteEncryption(db, fdb, d.sqliteSealer); err != nil {
+		return err
+	}
+	sealer := d.sqliteSealer
+
+	defaults := make([]ColumnData, len(descriptor.Columns))
+	selected := make([]int, 0, len(descriptor.Columns))
+	query := "SELECT "
+	for i, c := range descriptor.Columns {
+		if !existing[c.Name] {
+			if defaults[i], err = c.DefaultColumnData(); err != nil {
+				return fmt.Errorf("bad default value for column %s: %w", c.Name, err)
+			}
+			continue
+		}
+		if len(selected) > 0 {
+			query += ", "
+		}
+		query += c.Name
+		selected = append(selected, i)
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	query += " FROM " + table
+
+	where := make([]string, 0, len(filter))
+	args := make([]interface{}, 0, len(filter))
+	// the predicates applied to the opened values of an encrypted file
+	sealedFilter := make([]ColumnPredicate, 0)
+	for _, p := range filter {
+		c := descriptor.Columns[p.ColumnIndex]
+		if !existing[c.Name] {
+			// the column has the default value in all the rows of this file
+			row := &RowData{Data: defaults}
+			if !p.Match(row) {
+				return nil
+			}
+			continue
+		}
+		if sealer != nil {
+			sealedFilter = append(sealedFilter, p)
+			continue
+		}
+		switch p.Op {
+		case PredicateEqual:
+			v, err := sqliteColumnValue(c, p.Value)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				where = append(where, c.Name+" IS NULL")
+			} else {
+				where = append(where, c.Name+" = ?")
+				args = append(args, v)
+			}
+		case PredicateRange:
+			where = append(where, c.Name+" BETWEEN ? AND ?")
+			args = append(args, int64(p.Min), int64(p.Max))
+		default:
+			return fmt.Errorf("unknown predicate op %d", p.Op)
+		}
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if order.Column != "" && existing[order.Column] && sealer == nil {
+		query += " ORDER BY " + order.Column
+		if order.Desc {
+			query += " DESC"
+		}
+		query += ", rowid"
+	} else {
+		query += " ORDER BY rowid"
+	}
+	// the rows of an encrypted file are ordered by QueryArchive
+	sealedLimit := 0
+	if limit > 0 && sealer != nil && order.Column == "" {
+		sealedLimit = limit
+	} else if limit > 0 && sealer == nil {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", query, err)
+	}
+	defer rows.Close()
+	values := make([]interface{}, len(selected))
+	dest := make([]interface{}, len(selected))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	added := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if sealer != nil {
+			match, err := openSqliteRow(sealer, table, descriptor, selected, sealedFilter, values)
+			if err != nil {
+				return err
+			}
+			if !match {
+				continue
+			}
+		}
+		rd := d.rowDataPool.Get().(*RowData)
+		rd.Data = append(rd.Data[0:0], defaults...)
+		for i, ci := range selected {
+			cd, err := sqliteValueColumnData(descriptor.Columns[ci], values[i])
+			if err != nil {
+				d.putRows([]*RowData{rd})
+				return err
+			}
+			rd.Data[ci] = cd
+		}
+		res.Data = append(res.Data, rd)
+		added++
+		if sealedLimit > 0 && added >= sealedLimit {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// sqliteTableColumns names of the columns of a sqlite table, empty if the table does not exist
+func sqliteTableColumns(db *sql.DB, tableName string) (map[string]bool, error) {
+	names, err := sqliteTableColumnNames(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]bool{}
+	for _, name := range names {
+		res[name] = true
+	}
+	return res, nil
+}
+
+// sqliteTableColumnNames names of the columns of a sqlite table in their order
+func sqliteTableColumnNames(db *sql.DB, tableName string) ([]string, error) {
+	rows, err := db.Query("PRAGMA table_info(" + tableName + ");")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]string, 0)
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notNull, pk int
+		var defaultValue interface{}
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
+
+// sqliteValueColumnData convert a sql value written by sqliteColumnValue back to a column
+func sqliteValueColumnData(c ColumnDescriptor, v interface{}) (ColumnData, error) {
+	if v == nil {
+		return NewNullColumnData(), nil
+	}
+	switch c.Type {
+	case Tuint, Tenum, Tint, Tbool, Ttimestamp:
+		i, ok := v.(int64)
+		if !ok {
+			return ColumnData{}, fmt.Errorf("column %s: integer expected, get %T", c.Name, v)
+		}
+		switch c.Type {
+		case Tuint, Tenum:
+			return ColumnData{EncodedRawValue: uint64(i)}, nil
+		case Tbool:
+			return NewBoolColumnData(i != 0), nil
+		}
+		return NewIntColumnData(i), nil
+	case Tfloat64:
+		switch f := v.(type) {
+		case float64:
+			return NewFloat64ColumnData(f), nil
+		case int64:
+			return NewFloat64ColumnData(float64(f)), nil
+		}
+		return ColumnData{}, fmt.Errorf("column %s: real expected, get %T", c.Name, v)
+	case Tstring, Tbytes:
+		var b []byte
+		switch s := v.(type) {
+		case string:
+			b = []byte(s)
+		case []byte:
+			b = append([]byte(nil), s...)
+		default:
+			return ColumnData{}, fmt.Errorf("column %s: text expected, get %T", c.Name, v)
+		}
+		if c.Type == Tbytes {
+			return NewBytesColumnData(b), nil
+		}
+		return ColumnData{EncodedRawValue: uint64(len(b)), Buffer: b}, nil
+	}
+	return ColumnData{}, fmt.Errorf("unkown type: %d", c.Type)
+}
+
+// compareColumnData order two values of a column. Null is lower than any value.
+func compareColumnData(c ColumnDescriptor, a, b ColumnData) int {
+	an, bn := a.IsNull() && c.Type != Tuint && c.Type != Tenum, b.IsNull() && c.Type != Tuint && c.Type != Tenum
+	if an || bn {
+		switch {
+		case an && bn:
+			return 0
+		case an:
+			return -1
+		}
+		return 1
+	}
+	switch c.Type {
+	case Tint, Ttimestamp:
+		ai, bi := a.Int(), b.Int()
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	case Tfloat64:
+		af, bf := a.Float64(), b.Float64()
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	case Tstring, Tbytes:
+		return bytes.Compare(a.Buffer, b.Buffer)
+	}
+	switch {
+	case a.EncodedRawValue < b.EncodedRawValue:
+		return -1
+	case a.EncodedRawValue > b.EncodedRawValue:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+package tablepacked
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"go.uber.org/zap"
+)
+
+var queryTable = Table{
+	Name: "query",
+	Columns: []ColumnDescriptor{
+		{Name: "ID", Type: Tuint},
+		{Name: "Label", Type: Tstring},
+		{Name: "Score", Type: Tint},
+	},
+}
+
+type queryRow struct {
+	ID    uint64
+	Label string
+	Score int64
+}
+
+// waitArchivedRows wait for the archiver to insert count rows in sqlite
+func waitArchivedRows(t *testing.T, driver *Driver, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows, err := driver.QueryArchive("query", nil, ArchiveOrder{}, 0)
+		n := rows.Len()
+		if err == nil {
+			rows.Release()
+			driver.FreeTable(rows)
+		}
+		if err == nil && n == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("archived rows: %d, expected %d: %v", n, count, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestQueryArchive(t *testing.T) {
+	testQueryArchive(t, config.InitDefaultTestConfig())
+}
+
+func TestQueryArchiveEncrypted(t *testing.T) {
+	sc := config.InitDefaultTestConfig()
+	sc.KeyProvider = testKeyRing(t)
+	testQueryArchive(t, sc)
+
+	files, err := sqliteDbFiles(SqliteDbPathForTableName(*sc, "query"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("should have a rolled and a current sqlite file: %v %v", files, err)
+	}
+	for _, fdb := range files {
+		raw, err := ioutil.ReadFile(fdb)
+		if err != nil || bytes.Contains(raw, []byte("label")) {
+			t.Fatalf("the values of %s should be encrypted: %v", fdb, err)
+		}
+	}
+
+	sc.KeyProvider = nil
+	driver, err := InitDriver(*sc, zap.NewNop(), map[string]Table{"query": queryTable})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+	if _, err := driver.QueryArchive("query", nil, ArchiveOrder{}, 0); err == nil {
+		t.Fatalf("query of encrypted files without KeyProvider should fail")
+	}
+}
+
+func TestEncryptSqliteFiles(t *testing.T) {
+	sc := config.InitDefaultTestConfig()
+	testQueryArchive(t, sc)
+
+	keys := testKeyRing(t)
+	sc.KeyProvider = keys
+	driver, err := InitDriver(*sc, zap.NewNop(), map[string]Table{"query": queryTable})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+	if _, err := driver.QueryArchive("query", nil, ArchiveOrder{}, 0); !errors.Is(err, ErrSqliteNotEncrypted) {
+		t.Fatalf("plaintext files should be rejected with a KeyProvider: %v", err)
+	}
+
+	encrypted, err := EncryptSqliteFiles(sc.SqliteFolder, keys)
+	if err != nil || len(encrypted) != 2 {
+		t.Fatalf("the current and the rolled files should be encrypted: %v %v", encrypted, err)
+	}
+	var res []queryRow
+	if err := driver.QueryArchiveStructs(&res, "query", []ColumnPredicate{NewStringEqualPredicate(1, "label")}, ArchiveOrder{}, 0); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(res) != 8 || res[7].ID != 7 || res[7].Score != 9 {
+		t.Fatalf("bad rows after encryption %+v", res)
+	}
+	if encrypted, err := EncryptSqliteFiles(sc.SqliteFolder, keys); err != nil || len(encrypted) != 0 {
+		t.Fatalf("encrypted files should be skipped: %v %v", encrypted, err)
+	}
+}
+
+func testKeyRing(t *testing.T) *crypt.KeyRing {
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testQueryArchive(t *testing.T, sc *config.Config) {
+	defer func(v int) { maxSqliteRowPerFile = v }(maxSqliteRowPerFile)
+	maxSqliteRowPerFile = 3
+	logger := zap.NewNop()
+
+	os.RemoveAll("data-test")
+
+	driver, err := InitDriver(*sc, logger, map[string]Table{"query": queryTable})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer driver.Close()
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "query")
+	id := 0
+	for batch := 0; batch < 2; batch++ {
+		rows := make([]*RowData, 0)
+		for i := 0; i < 4; i++ {
+			rows = append(rows, &RowData{Data: []ColumnData{
+				{EncodedRawValue: uint64(id)},
+				{EncodedRawValue: 5, Buffer: []byte("label")},
+				NewIntColumnData(int64((id * 7) % 10)),
+			}})
+			id++
+		}
+		if err := driver.AppendRowData(cf, rows); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := driver.Archive(cf); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := driver.Flush(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		// the second batch rolls the sqlite file
+		waitArchivedRows(t, driver, id)
+	}
+	files, err := sqliteDbFiles(SqliteDbPathForTableName(*sc, "query"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("should have a rolled and a current sqlite file: %v %v", files, err)
+	}
+
+	all, err := driver.QueryArchive("query", nil, ArchiveOrder{}, 0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i, r := range all.AllRows() {
+		if r.Data[0].EncodedRawValue != uint64(i) || string(r.Data[1].Buffer) != "label" || r.Data[2].Int() != int64((i*7)%10) {
+			t.Fatalf("bad row %d: %+v", i, r.Data)
+		}
+	}
+	all.Release()
+	driver.FreeTable(all)
+
+	var res []queryRow
+	filter := []ColumnPredicate{NewUintRangePredicate(0, 2, 6)}
+	if err := driver.QueryArchiveStructs(&res, "query", filter, ArchiveOrder{Column: "Score", Desc: true}, 3); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// scores of the ids 2 to 6: 4, 1, 8, 5, 2
+	expected := []queryRow{{4, "label", 8}, {5, "label", 5}, {2, "label", 4}}
+	if len(res) != len(expected) {
+		t.Fatalf("bad result %+v", res)
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Fatalf("bad result %+v, expected %+v", res, expected)
+		}
+	}
+
+	res = res[0:0]
+	if err := driver.QueryArchiveStructs(&res, "query", []ColumnPredicate{NewUintEqualPredicate(0, 7)}, ArchiveOrder{}, 0); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(res) != 1 || res[0].ID != 7 {
+		t.Fatalf("bad result %+v", res)
+	}
+}
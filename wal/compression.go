@@ -0,0 +1,100 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/golang/snappy"
+)
+
+// cmdCompression compression of the data of a command, written in the commands from the wal version 4
+type cmdCompression uint8
+
+const (
+	compressionNone   cmdCompression = 0
+	compressionSnappy cmdCompression = 1
+	compressionFlate  cmdCompression = 2
+)
+
+// compressionFromConfig compression of the config, none if unknown
+func compressionFromConfig(name string) cmdCompression {
+	switch name {
+	case config.WALCompressionSnappy:
+		return compressionSnappy
+	case config.WALCompressionFlate:
+		return compressionFlate
+	}
+	return compressionNone
+}
+
+// compress the data. The flate stream is prefixed by the uvarint of the raw length.
+func (c cmdCompression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case compressionNone:
+		return data, nil
+	case compressionSnappy:
+		return snappy.Encode(make([]byte, 0, snappy.MaxEncodedLen(len(data))), data), nil
+	case compressionFlate:
+		var out bytes.Buffer
+		var lenBuf [binary.MaxVarintLen64]byte
+		out.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(data)))])
+		w, err := flate.NewWriter(&out, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown command compression: %d", c)
+}
+
+func (c cmdCompression) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case compressionNone:
+		return data, nil
+	case compressionSnappy:
+		// the decoded length is checked before snappy allocates it
+		rawLen, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if rawLen > maxCompressedCmdDataLen {
+			return nil, fmt.Errorf("snappy raw length %d is more than %d", rawLen, maxCompressedCmdDataLen)
+		}
+		return snappy.Decode(nil, data)
+	case compressionFlate:
+		rawLen, n := binary.Uvarint(data)
+		if n <= 0 || rawLen > maxCompressedCmdDataLen {
+			return nil, fmt.Errorf("bad flate raw length")
+		}
+		r := flate.NewReader(bytes.NewReader(data[n:]))
+		defer r.Close()
+		// the buffer only grows with the bytes decompressed
+		var raw bytes.Buffer
+		if _, err := io.CopyN(&raw, r, int64(rawLen)); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		var extra [1]byte
+		if n, _ := r.Read(extra[:]); n != 0 {
+			return nil, fmt.Errorf("flate data longer than its raw length")
+		}
+		return raw.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown command compression: %d", c)
+}
+
+// maxCompressedCmdDataLen bound of the raw length of a compressed command data, four times the default
+// MaxWALFileSize. Larger data are written raw so a corrupted length can not allocate more on read.
+const maxCompressedCmdDataLen = 64 << 20
@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wutils"
+	"go.uber.org/zap"
+)
+
+// crashTestConfig config with all the folders in root
+func crashTestConfig(root string) config.Config {
+	conf := config.InitDefaultTestConfig()
+	conf.ShardCount = 2
+	conf.WALFolder = root
+	conf.ActiveFolder = path.Join(root, "active")
+	conf.ArchiveFolder = path.Join(root, "archive")
+	conf.WalArchiveFolder = path.Join(root, "wal-archive")
+	conf.DeadLetterFolder = path.Join(root, "dead-letter")
+	conf.WALDurability = config.WALDurabilitySync
+	conf.MaxWALFileSize = 300
+	conf.DisableResumeArchiving = true
+	return *conf
+}
+
+// copyFolder copy the files of src in dst, as left on the disk by a killed process
+func copyFolder(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(path.Join(dst, rel), 0744)
+		}
+		return wutils.CopyFile(p, path.Join(dst, rel))
+	})
+}
+
+// crashExpectation valid contents of a container file after the crash
+type crashExpectation struct {
+	acked []byte
+	// pending operation not acknowledged when the process has been killed
+	pendingWrite   []byte
+	pendingArchive bool
+}
+
+func (e *crashExpectation) valid(content []byte) bool {
+	if bytes.Equal(content, e.acked) {
+		return true
+	}
+	if e.pendingWrite != nil && bytes.Equal(content, append(append([]byte(nil), e.acked...), e.pendingWrite...)) {
+		return true
+	}
+	return e.pendingArchive && len(content) == 0
+}
+
+// maxFaultAfter bound of the calls before the fault, by point, for the workload of TestCrashRecovery
+var maxFaultAfter = map[storage.FaultPoint]int{
+	storage.FaultWALSync:       150,
+	storage.FaultHeaderWrite:   60,
+	storage.FaultWALMove:       15,
+	storage.FaultArchiveRename: 6,
+}
+
+// TestCrashRecovery kill the process at a random fault point, restart from the files left on the disk
+// and check the acknowledged writes are intact and the size headers match the active files.
+func TestCrashRecovery(t *testing.T) {
+	logger := zap.NewNop()
+	const runCount = 24
+	for seed := int64(0); seed < runCount; seed++ {
+		os.RemoveAll("data-test")
+		rng := rand.New(rand.NewSource(seed))
+		point := storage.FaultPoints[rng.Intn(len(storage.FaultPoints))]
+		fault := storage.Fault{Point: point, After: rng.Intn(maxFaultAfter[point]), Crash: true}
+		if point == storage.FaultHeaderWrite {
+			fault.ShortWrite = rng.Intn(8)
+		}
+
+		conf := crashTestConfig("data-test/run")
+		image := crashTestConfig("data-test/image")
+		faults := storage.NewFaultInjector(fault)
+		faults.OnCrash = func() {
+			if err := copyFolder(conf.WALFolder, image.WALFolder); err != nil {
+				t.Errorf("seed %d: could not copy the files at crash: %v", seed, err)
+			}
+		}
+		conf.Faults = faults
+
+		expectations := runCrashWorkload(t, seed, rng, conf, logger)
+		if !faults.Crashed() {
+			faults.OnCrash()
+		}
+		checkCrashImage(t, seed, fault, image, expectations, logger)
+	}
+}
+
+func runCrashWorkload(t *testing.T, seed int64, rng *rand.Rand, conf config.Config, logger *zap.Logger) map[string]*crashExpectation {
+	shardWal, err := InitShardWAL(conf, logger, nil)
+	if err != nil {
+		t.Fatalf("seed %d: %v", seed, err)
+	}
+	cfs := []config.ContainerFile{
+		config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		config.NewContainerFileWTableName("app1", "b1", "sb0", "inter"),
+		config.NewContainerFileWTableName("app2", "b2", "sb1", "inter"),
+		config.NewContainerFileWTableName("app2", "b3", "sb1", "inter"),
+	}
+	expectations := make(map[string]*crashExpectation)
+	for _, cf := range cfs {
+		expectations[cf.Key()] = &crashExpectation{}
+	}
+
+	for i := 0; i < 300 && !conf.Faults.Crashed(); i++ {
+		cf := cfs[rng.Intn(len(cfs))]
+		e := expectations[cf.Key()]
+		si := cf.ShardIndex(uint32(conf.ShardCount))
+		op := rng.Intn(100)
+		if op < 10 {
+			if _, err := shardWal.FlushShardIndex(si); err != nil && !conf.Faults.Crashed() {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+			continue
+		}
+
+		var data []byte
+		shardWal.LockShardIndex(si)
+		w := shardWal.GetWalForShardIndex(si)
+		if op < 15 {
+			e.pendingArchive = true
+			err = w.Archive(cf)
+		} else {
+			data = make([]byte, 1+rng.Intn(40))
+			rng.Read(data)
+			e.pendingWrite = data
+			err = w.AppendWrite(cf, data)
+		}
+		seq := w.MutationSeq()
+		shardWal.UnlockShardIndex(si)
+		if err == nil {
+			err = shardWal.WaitDurable(si, seq)
+		}
+		if err != nil {
+			if !conf.Faults.Crashed() {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+			break
+		}
+		if data == nil {
+			e.acked = nil
+		} else {
+			e.acked = append(e.acked, data...)
+		}
+		e.pendingArchive = false
+		e.pendingWrite = nil
+	}
+	return expectations
+}
+
+func checkCrashImage(t *testing.T, seed int64, fault storage.Fault, image config.Config, expectations map[string]*crashExpectation, logger *zap.Logger) {
+	shardWal, err := InitShardWAL(image, logger, nil)
+	if err != nil {
+		t.Fatalf("seed %d, fault %+v: restart failed: %v", seed, fault, err)
+	}
+	for key, e := range expectations {
+		cf, err := config.ParseContainerFileKey(key)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		si := cf.ShardIndex(uint32(image.ShardCount))
+		shardWal.LockShardIndex(si)
+		fileBuf := &wutils.Buffer{}
+		err = shardWal.GetWalForShardIndex(si).GetFileBuffer(*cf, fileBuf)
+		shardWal.UnlockShardIndex(si)
+		if err != nil {
+			t.Fatalf("seed %d, fault %+v: %v", seed, fault, err)
+		}
+		if !e.valid(fileBuf.Bytes()) {
+			t.Fatalf("seed %d, fault %+v: bad content for %s after restart: %v, acknowledged %v", seed, fault, key, fileBuf.Bytes(), e.acked)
+		}
+	}
+	if errs := shardWal.CloseAll(); errs.Err() != nil {
+		t.Fatalf("seed %d, fault %+v: %v", seed, fault, errs.Err())
+	}
+
+	err = filepath.Walk(image.ActiveFolder, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Size() == 0 {
+			return err
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if len(content) < 8 || binary.BigEndian.Uint64(content) != uint64(len(content)) {
+			t.Fatalf("seed %d, fault %+v: header of %s disagrees with its size %d", seed, fault, p, len(content))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("seed %d: %v", seed, err)
+	}
+}
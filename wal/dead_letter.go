@@ -0,0 +1,306 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+// A dead letter is the pair of files <id>.bin, a wal file holding the dropped commands, and <id>.json,
+// the description of the commands with their last error. Both are in DeadLetterFolder of the storage of
+// the config. The wal file is written first: a dead letter without description is still listed, without
+// the errors.
+const deadLetterFilePrefix = "dl-"
+
+// ErrDeadLetterNotFound no dead letter with this id
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetterCommand command dropped after the max retry count
+type DeadLetterCommand struct {
+	Key        string
+	Op         string
+	Offset     uint64
+	FileSize   uint64
+	DataSize   int
+	RetryCount uint8
+	// Error last error while applying the command
+	Error string
+	// Data written by a write command
+	Data []byte `json:"-"`
+}
+
+// DeadLetter commands of a shard dropped by a checkpoint
+type DeadLetter struct {
+	ID         string
+	ShardIndex uint64
+	WalIndex   uint64
+	CreatedAt  time.Time
+	Commands   []DeadLetterCommand
+}
+
+func deadLetterID(walIndex uint64, shardIndex int) string {
+	return fmt.Sprintf(deadLetterFilePrefix+"%012d-s%05d", walIndex, shardIndex)
+}
+
+func deadLetterPaths(folder, id string) (string, string) {
+	return path.Join(folder, id+".bin"), path.Join(folder, id+".json")
+}
+
+// deadLetter save the commands dropped after the max retry count with their last error
+func (w *WAL) deadLetter(cmds []*walCmd) {
+	if len(cmds) == 0 {
+		return
+	}
+	retriesDroppedMetric.WithLabelValues(shardLabel(w.shardIndex)).Add(float64(len(cmds)))
+	if w.config.DeadLetterFolder == "" {
+		w.logger.Error("commands dropped after the max retry count", zap.Int("count", len(cmds)), zap.Int("shard", w.shardIndex))
+		return
+	}
+	errs := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		errs[i] = w.opErrors[cmd.operationIndex]
+	}
+	id, err := writeDeadLetter(w.config, w.walFile.walIndex, w.shardIndex, cmds, errs)
+	if err != nil {
+		w.logger.Error("could not write dead letter: commands dropped", zap.Int("count", len(cmds)), zap.Int("shard", w.shardIndex), zap.Error(err))
+		return
+	}
+	w.logger.Warn("commands moved to the dead letter folder", zap.String("id", id), zap.Int("count", len(cmds)))
+}
+
+// writeDeadLetter write the commands and their errors in a new dead letter of the config. They are
+// encrypted by the storage of the config if it has a KeyProvider.
+func writeDeadLetter(conf config.Config, walIndex uint64, shardIndex int, cmds []*walCmd, errs []string) (string, error) {
+	store := conf.GetStorage()
+	id := deadLetterID(walIndex, shardIndex)
+	for i := 1; ; i++ {
+		binPath, _ := deadLetterPaths(conf.DeadLetterFolder, id)
+		_, err := store.Stat(binPath)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		id = fmt.Sprintf("%s-%d", deadLetterID(walIndex, shardIndex), i)
+	}
+
+	wf := initFile(int(walIndex), shardIndex, conf.ShardCount)
+	dl := DeadLetter{
+		ID:         id,
+		ShardIndex: uint64(shardIndex),
+		WalIndex:   walIndex,
+		CreatedAt:  time.Unix(int64(wf.unixCreationTime), 0).UTC(),
+		Commands:   make([]DeadLetterCommand, 0, len(cmds)),
+	}
+	for i, cmd := range cmds {
+		cmdCopy := *cmd
+		cmdCopy.operationIndex = uint32(i)
+		wf.addCmd(&cmdCopy)
+		dlCmd := deadLetterCommand(&cmdCopy)
+		dlCmd.Error = errs[i]
+		dl.Commands = append(dl.Commands, dlCmd)
+	}
+
+	binPath, jsonPath := deadLetterPaths(conf.DeadLetterFolder, id)
+	var bin bytes.Buffer
+	buffer := bufio.NewWriter(&bin)
+	if err := wf.writeHeader(buffer); err != nil {
+		return "", err
+	}
+	if err := wf.writeAllCmdToFile(buffer); err != nil {
+		return "", err
+	}
+	if err := buffer.Flush(); err != nil {
+		return "", err
+	}
+	if err := storage.WriteFile(store, binPath, bin.Bytes()); err != nil {
+		return "", err
+	}
+	content, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return id, storage.WriteFile(store, jsonPath, content)
+}
+
+func deadLetterCommand(cmd *walCmd) DeadLetterCommand {
+	res := DeadLetterCommand{
+		Key:        cmd.cf.Key(),
+		Op:         cmdKindLabel(cmd.cmd),
+		Offset:     cmd.writeOffset,
+		FileSize:   cmd.fileSize,
+		RetryCount: cmd.retryCount,
+	}
+	if cmd.buffer != nil {
+		cmd.buffer.ResetRead()
+		res.Data = cmd.buffer.Bytes()
+		res.DataSize = len(res.Data)
+	}
+	return res
+}
+
+// ListDeadLetters dead letters of the config, ordered by id
+func ListDeadLetters(conf config.Config) ([]DeadLetter, error) {
+	if conf.DeadLetterFolder == "" {
+		return []DeadLetter{}, nil
+	}
+	paths, err := conf.GetStorage().List(conf.DeadLetterFolder)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]DeadLetter, 0)
+	for _, p := range paths {
+		name := path.Base(p)
+		if path.Dir(p) != path.Clean(conf.DeadLetterFolder) || !strings.HasPrefix(name, deadLetterFilePrefix) || !strings.HasSuffix(name, ".bin") {
+			continue
+		}
+		dl, err := ReadDeadLetter(conf, strings.TrimSuffix(name, ".bin"))
+		if err != nil {
+			return res, err
+		}
+		res = append(res, dl)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// ReadDeadLetter read the commands of a dead letter of the config with their data
+func ReadDeadLetter(conf config.Config, id string) (DeadLetter, error) {
+	dl, wf, err := readDeadLetter(conf, id)
+	if err != nil {
+		return dl, err
+	}
+	errs := make([]string, len(wf.cmdsOrder))
+	for i := range dl.Commands {
+		if i < len(errs) {
+			errs[i] = dl.Commands[i].Error
+		}
+	}
+	dl.Commands = make([]DeadLetterCommand, 0, len(wf.cmdsOrder))
+	for i, cmd := range wf.cmdsOrder {
+		dlCmd := deadLetterCommand(cmd)
+		dlCmd.Error = errs[i]
+		dl.Commands = append(dl.Commands, dlCmd)
+	}
+	return dl, nil
+}
+
+// readDeadLetter the commands of the dead letters written before they went through the storage are
+// encrypted by the wal file itself
+func readDeadLetter(conf config.Config, id string) (DeadLetter, *File, error) {
+	dl := DeadLetter{ID: id}
+	if strings.ContainsAny(id, `/\`) {
+		return dl, nil, fmt.Errorf("bad dead letter id %s", id)
+	}
+	store := conf.GetStorage()
+	binPath, jsonPath := deadLetterPaths(conf.DeadLetterFolder, id)
+	wf, err := readFileFromStorage(store, binPath, conf.KeyProvider)
+	if os.IsNotExist(err) {
+		return dl, nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	if err != nil {
+		return dl, nil, err
+	}
+	content, err := storage.ReadFile(store, jsonPath)
+	if err == nil {
+		if err := json.Unmarshal(content, &dl); err != nil {
+			return dl, nil, fmt.Errorf("bad dead letter description %s: %w", jsonPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return dl, nil, err
+	}
+	dl.ID = id
+	dl.ShardIndex = wf.shardIndex
+	dl.WalIndex = wf.walIndex
+	if dl.CreatedAt.IsZero() {
+		dl.CreatedAt = time.Unix(int64(wf.unixCreationTime), 0).UTC()
+	}
+	return dl, wf, nil
+}
+
+// DiscardDeadLetter remove a dead letter of the config
+func DiscardDeadLetter(conf config.Config, id string) error {
+	if strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("bad dead letter id %s", id)
+	}
+	store := conf.GetStorage()
+	binPath, jsonPath := deadLetterPaths(conf.DeadLetterFolder, id)
+	if err := store.Remove(jsonPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := store.Remove(binPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// ColdReplayDeadLetter replay a dead letter of the configured folder on the files of a stopped database,
+// with the same semantics as File.ColdReplay, then discard it
+func ColdReplayDeadLetter(conf config.Config, id string) error {
+	_, wf, err := readDeadLetter(conf, id)
+	if err != nil {
+		return err
+	}
+	if errs := wf.ColdReplayOn(conf.GetStorage(), conf.GetLayout(), conf.ActiveFolder, conf.ArchiveFolder); errs.Err() != nil {
+		return errs.Err()
+	}
+	return DiscardDeadLetter(conf, id)
+}
+
+// ReplayDeadLetter append the commands of a dead letter of the configured folder to the wal, flush the
+// shards and discard the dead letter. onReplay, if not nil, is called with the shard lock held before the
+// commands of a container file are appended. On error the dead letter is kept.
+func (swa *ShardWAL) ReplayDeadLetter(id string, onReplay func(shardIndex uint32, cf config.ContainerFile)) error {
+	_, wf, err := readDeadLetter(swa.config, id)
+	if err != nil {
+		return err
+	}
+	shards := make(map[uint32]bool)
+	for _, cmd := range wf.cmdsOrder {
+		si := swa.ShardIndex(cmd.cf)
+		shards[si] = true
+		swa.LockShardIndex(si)
+		if onReplay != nil {
+			onReplay(si, cmd.cf)
+		}
+		err := swa.GetWalForShardIndex(si).replayCmd(cmd)
+		swa.UnlockShardIndex(si)
+		if err != nil {
+			return fmt.Errorf("replay of dead letter %s: %w", id, err)
+		}
+	}
+	for si := range shards {
+		if _, err := swa.FlushShardIndex(si); err != nil {
+			return err
+		}
+	}
+	return DiscardDeadLetter(swa.config, id)
+}
+
+func (w *WAL) replayCmd(cmd *walCmd) error {
+	switch cmd.cmd {
+	case writeCmd:
+		cmd.buffer.ResetRead()
+		return w.Write(cmd.cf, int64(cmd.writeOffset), int64(cmd.fileSize), cmd.buffer.Bytes())
+	case truncateCmd:
+		return w.Truncate(cmd.cf, int64(cmd.writeOffset))
+	case archiveCmd:
+		return w.Archive(cmd.cf)
+	}
+	return fmt.Errorf("unknown command %d", cmd.cmd)
+}
@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wutils"
+	"go.uber.org/zap"
+)
+
+func TestDeadLetter(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+	conf.ShardCount = 1
+
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	failing := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	other := config.NewContainerFileWTableName("app1", "b1", "sb0", "inter")
+	// a folder in place of the active file makes the writes fail
+	if err := os.MkdirAll(failing.PathToFile(*conf), 0744); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	w := shardWal.GetWalForShardIndex(0)
+	if err := w.Write(failing, 0, 2, []byte{1, 2}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i <= maxRetryCount; i++ {
+		// the retries are applied with the next wal file
+		if err := w.AppendWrite(other, []byte{byte(i)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if n, _ := shardWal.FlushShardIndex(0); n != 1 {
+			t.Fatalf("the write should fail, get %d errors", n)
+		}
+	}
+
+	dls, err := ListDeadLetters(*conf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(dls) != 1 || len(dls[0].Commands) != 1 {
+		t.Fatalf("should have one dead letter with one command: %+v", dls)
+	}
+	cmd := dls[0].Commands[0]
+	if cmd.Key != failing.Key() || cmd.Op != "write" || cmd.Error == "" || cmd.RetryCount != maxRetryCount || !bytes.Equal(cmd.Data, []byte{1, 2}) {
+		t.Fatalf("bad dead letter command %+v", cmd)
+	}
+	if len(w.walFile.cmdsOrder) != 0 {
+		t.Fatalf("the dropped command should not be retried")
+	}
+
+	os.RemoveAll(failing.PathToFile(*conf))
+	if err := shardWal.ReplayDeadLetter(dls[0].ID, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := ioutil.ReadFile(failing.PathToFile(*conf))
+	if err != nil || !bytes.HasSuffix(content, []byte{1, 2}) {
+		t.Fatalf("bad content after replay %v %v", content, err)
+	}
+	if dls, _ := ListDeadLetters(*conf); len(dls) != 0 {
+		t.Fatalf("replayed dead letter should be discarded")
+	}
+
+	// a failed write still waiting for a retry is saved at close
+	failing2 := config.NewContainerFileWTableName("app1", "b2", "sb0", "inter")
+	if err := os.MkdirAll(failing2.PathToFile(*conf), 0744); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := w.Write(failing2, 0, 1, []byte{3}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if errs := shardWal.CloseAll(); errs.Err() != nil {
+		t.Fatalf("%v", errs.Err())
+	}
+	dls, err = ListDeadLetters(*conf)
+	if err != nil || len(dls) != 1 || dls[0].Commands[0].Key != failing2.Key() {
+		t.Fatalf("pending retry should be saved at close: %+v %v", dls, err)
+	}
+
+	os.RemoveAll(failing2.PathToFile(*conf))
+	if err := ColdReplayDeadLetter(*conf, dls[0].ID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err = ioutil.ReadFile(failing2.PathToFile(*conf))
+	if err != nil || !bytes.HasSuffix(content, []byte{3}) {
+		t.Fatalf("bad content after cold replay %v %v", content, err)
+	}
+	if err := DiscardDeadLetter(*conf, dls[0].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("discard of a replayed dead letter should fail: %v", err)
+	}
+}
+
+func TestDeadLetterStorage(t *testing.T) {
+	conf := config.InitDefaultTestConfig()
+	mem := storage.NewMemory()
+	conf.Storage = mem
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	conf.KeyProvider = keys
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	cmds := []*walCmd{{cf: cf, cmd: writeCmd, buffer: wutils.NewBuffer([]byte("secret")), fileSize: 6}}
+	id, err := writeDeadLetter(*conf, 3, 0, cmds, []string{"failed"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(conf.DeadLetterFolder); !os.IsNotExist(err) {
+		t.Fatalf("the dead letter should be written in the storage: %v", err)
+	}
+	paths, err := mem.List(conf.DeadLetterFolder)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("bad dead letter files %v %v", paths, err)
+	}
+	for _, p := range paths {
+		raw, err := storage.ReadFile(mem, p)
+		if err != nil || bytes.Contains(raw, []byte("secret")) || bytes.Contains(raw, []byte("failed")) {
+			t.Fatalf("%s should be encrypted: %v", p, err)
+		}
+	}
+
+	dls, err := ListDeadLetters(*conf)
+	if err != nil || len(dls) != 1 || dls[0].ID != id || dls[0].Commands[0].Error != "failed" || string(dls[0].Commands[0].Data) != "secret" {
+		t.Fatalf("bad dead letters %+v %v", dls, err)
+	}
+	if err := DiscardDeadLetter(*conf, id); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if dls, err := ListDeadLetters(*conf); err != nil || len(dls) != 0 {
+		t.Fatalf("discarded dead letter should not be listed %+v %v", dls, err)
+	}
+}
@@ -0,0 +1,166 @@
+package wal
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+// ArchivedFileSink receive the archived files from a FanOut. It must not remove the archived file:
+// it is removed once all the sinks have acknowledged it by returning nil.
+type ArchivedFileSink interface {
+	Send(path string, file config.ContainerFile) error
+	Close()
+}
+
+// ArchivedFileSinkFunc sink calling a function, for example a webhook
+type ArchivedFileSinkFunc func(path string, file config.ContainerFile) error
+
+// Send call f
+func (f ArchivedFileSinkFunc) Send(path string, file config.ContainerFile) error {
+	return f(path, file)
+}
+
+// Close do nothing
+func (f ArchivedFileSinkFunc) Close() {}
+
+// RetryPolicy retries of a sink failing to receive an archived file. Attempt n waits
+// Backoff * 2^(n-2), at most MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts attempts before giving up, at least 1
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// FanOutSink sink of a FanOut with its retry policy
+type FanOutSink struct {
+	// Name identify the acknowledgements of the sink: it must be unique and stable across restarts
+	Name  string
+	Sink  ArchivedFileSink
+	Retry RetryPolicy
+}
+
+// FanOut archived file functer sending each archived file to several sinks. The sinks acknowledging a
+// file are saved in ArchiveAcksFolder of the storage: a file a sink has failed to receive after its
+// retries is kept and sent again at the next start, to the sinks that have not acknowledged it only.
+// Without ArchiveAcksFolder a kept file is sent again to all the sinks.
+type FanOut struct {
+	sinks      []FanOutSink
+	storage    storage.Storage
+	acksFolder string
+	logger     *zap.Logger
+	sleep      func(time.Duration)
+}
+
+// NewFanOut init a fan out to sinks
+func NewFanOut(conf config.Config, logger *zap.Logger, sinks ...FanOutSink) *FanOut {
+	return &FanOut{
+		sinks:      sinks,
+		storage:    conf.GetStorage(),
+		acksFolder: conf.ArchiveAcksFolder,
+		logger:     logger,
+		sleep:      time.Sleep,
+	}
+}
+
+// acksPath the base name of an archived file is unique: it holds its shard, wal and operation indexes
+func (fo *FanOut) acksPath(p string) string {
+	return path.Join(fo.acksFolder, path.Base(p)+".json")
+}
+
+func (fo *FanOut) readAcks(p string) map[string]bool {
+	acks := make(map[string]bool)
+	if fo.acksFolder == "" {
+		return acks
+	}
+	content, err := storage.ReadFile(fo.storage, fo.acksPath(p))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fo.logger.Warn("could not read the acknowledgements of archived file", zap.String("path", p), zap.Error(err))
+		}
+		return acks
+	}
+	if err := json.Unmarshal(content, &acks); err != nil {
+		fo.logger.Warn("bad acknowledgements of archived file", zap.String("path", p), zap.Error(err))
+	}
+	return acks
+}
+
+func (fo *FanOut) writeAcks(p string, acks map[string]bool) error {
+	if fo.acksFolder == "" {
+		return nil
+	}
+	content, err := json.Marshal(acks)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(fo.storage, fo.acksPath(p), content)
+}
+
+// send the file to a sink with its retry policy
+func (fo *FanOut) send(s FanOutSink, p string, file config.ContainerFile) error {
+	backoff := s.Retry.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = s.Sink.Send(p, file); err == nil {
+			return nil
+		}
+		archivedFileSinkErrorsMetric.WithLabelValues(s.Name).Inc()
+		if attempt >= s.Retry.MaxAttempts {
+			return err
+		}
+		fo.logger.Warn("archived file sink failed, retrying", zap.String("sink", s.Name), zap.String("path", p), zap.Int("attempt", attempt), zap.Error(err))
+		fo.sleep(backoff)
+		backoff *= 2
+		if s.Retry.MaxBackoff > 0 && backoff > s.Retry.MaxBackoff {
+			backoff = s.Retry.MaxBackoff
+		}
+	}
+}
+
+// Do send the archived file to the sinks that have not acknowledged it yet and remove it once all of
+// them have
+func (fo *FanOut) Do(p string, file config.ContainerFile) {
+	acks := fo.readAcks(p)
+	acked := true
+	for _, s := range fo.sinks {
+		if acks[s.Name] {
+			continue
+		}
+		if err := fo.send(s, p, file); err != nil {
+			fo.logger.Error("archived file sink failed: the file is kept", zap.String("sink", s.Name), zap.String("path", p), zap.Error(err))
+			acked = false
+			continue
+		}
+		acks[s.Name] = true
+		if err := fo.writeAcks(p, acks); err != nil {
+			fo.logger.Error("could not save the acknowledgements of archived file", zap.String("path", p), zap.Error(err))
+		}
+	}
+	if !acked {
+		return
+	}
+	if err := fo.storage.Remove(p); err != nil {
+		fo.logger.Error("could not delete archive file", zap.String("path", p), zap.Error(err))
+		return
+	}
+	if fo.acksFolder == "" {
+		return
+	}
+	if err := fo.storage.Remove(fo.acksPath(p)); err != nil && !os.IsNotExist(err) {
+		fo.logger.Warn("could not delete the acknowledgements of archived file", zap.String("path", p), zap.Error(err))
+	}
+}
+
+// Close close all the sinks
+func (fo *FanOut) Close() {
+	for _, s := range fo.sinks {
+		s.Sink.Close()
+	}
+}
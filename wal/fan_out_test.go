@@ -0,0 +1,149 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+func TestFanOut(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	p := path.Join(conf.ArchiveFolder, "b0_sb0_inter:0:1:2")
+	if err := os.MkdirAll(conf.ArchiveFolder, 0744); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(p, []byte{1}, 0744); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	okCalls, failCalls := 0, 0
+	failing := true
+	fo := NewFanOut(*conf, logger,
+		FanOutSink{Name: "ok", Sink: ArchivedFileSinkFunc(func(sp string, file config.ContainerFile) error {
+			if sp != p || file != cf {
+				t.Fatalf("bad archived file %s %v", sp, file)
+			}
+			okCalls++
+			return nil
+		}), Retry: RetryPolicy{MaxAttempts: 1}},
+		FanOutSink{Name: "webhook", Sink: ArchivedFileSinkFunc(func(sp string, file config.ContainerFile) error {
+			failCalls++
+			if failing {
+				return errors.New("unavailable")
+			}
+			return nil
+		}), Retry: RetryPolicy{MaxAttempts: 4, Backoff: time.Second, MaxBackoff: 3 * time.Second}},
+	)
+	sleeps := make([]time.Duration, 0)
+	fo.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	fo.Do(p, cf)
+	if okCalls != 1 || failCalls != 4 {
+		t.Fatalf("bad sink calls %d %d", okCalls, failCalls)
+	}
+	if len(sleeps) != 3 || sleeps[0] != time.Second || sleeps[1] != 2*time.Second || sleeps[2] != 3*time.Second {
+		t.Fatalf("bad backoff %v", sleeps)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Fatalf("archived file should be kept until all the sinks acknowledge it: %v", err)
+	}
+
+	// a new fan out, as after a restart, only sends to the sink that has not acknowledged the file
+	failing = false
+	fo = NewFanOut(*conf, logger, fo.sinks...)
+	fo.Do(p, cf)
+	if okCalls != 1 || failCalls != 5 {
+		t.Fatalf("bad sink calls after restart %d %d", okCalls, failCalls)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("archived file should be removed: %v", err)
+	}
+	if _, err := os.Stat(fo.acksPath(p)); !os.IsNotExist(err) {
+		t.Fatalf("acknowledgements should be removed: %v", err)
+	}
+
+	// without acknowledgements folder a kept file is sent again to all the sinks
+	conf.ArchiveAcksFolder = ""
+	if err := ioutil.WriteFile(p, []byte{1}, 0744); err != nil {
+		t.Fatalf("%v", err)
+	}
+	failing = true
+	fo = NewFanOut(*conf, logger, fo.sinks...)
+	fo.sleep = func(d time.Duration) {}
+	fo.Do(p, cf)
+	failing = false
+	fo.Do(p, cf)
+	if okCalls != 3 || failCalls != 10 {
+		t.Fatalf("bad sink calls without acknowledgements %d %d", okCalls, failCalls)
+	}
+	files, _ := ioutil.ReadDir(".")
+	for _, f := range files {
+		if path.Ext(f.Name()) == ".json" {
+			t.Fatalf("acknowledgements should not be written: %s", f.Name())
+		}
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("archived file should be removed: %v", err)
+	}
+}
+
+func TestFanOutStorage(t *testing.T) {
+	conf := config.InitDefaultTestConfig()
+	mem := storage.NewMemory()
+	conf.Storage = mem
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	conf.KeyProvider = keys
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	p := path.Join(conf.ArchiveFolder, "b0_sb0_inter:0:1:2")
+	if err := storage.WriteFile(conf.GetStorage(), p, []byte{1}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	failing := true
+	fo := NewFanOut(*conf, zap.NewNop(),
+		FanOutSink{Name: "ok", Sink: ArchivedFileSinkFunc(func(sp string, file config.ContainerFile) error { return nil }), Retry: RetryPolicy{MaxAttempts: 1}},
+		FanOutSink{Name: "webhook", Sink: ArchivedFileSinkFunc(func(sp string, file config.ContainerFile) error {
+			if failing {
+				return errors.New("unavailable")
+			}
+			return nil
+		}), Retry: RetryPolicy{MaxAttempts: 1}},
+	)
+	fo.Do(p, cf)
+
+	if _, err := os.Stat(conf.ArchiveAcksFolder); !os.IsNotExist(err) {
+		t.Fatalf("the acknowledgements should be written in the storage: %v", err)
+	}
+	raw, err := storage.ReadFile(mem, fo.acksPath(p))
+	if err != nil || bytes.Contains(raw, []byte("ok")) {
+		t.Fatalf("the acknowledgements should be encrypted: %v", err)
+	}
+	if acks := fo.readAcks(p); !acks["ok"] || acks["webhook"] {
+		t.Fatalf("bad acknowledgements %v", acks)
+	}
+
+	failing = false
+	fo.Do(p, cf)
+	if _, err := mem.Stat(fo.acksPath(p)); !os.IsNotExist(err) {
+		t.Fatalf("acknowledgements should be removed: %v", err)
+	}
+}
@@ -2,16 +2,22 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"path"
 	"time"
 
 	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
 	"github.com/chamot1111/waldb/fileop"
+	"github.com/chamot1111/waldb/storage"
 	"github.com/chamot1111/waldb/wutils"
 )
 
@@ -23,9 +29,121 @@ const (
 	truncateCmd cmdKind = iota
 )
 
-const successOperationCount = 40000 * 8
+// successOperationHeaderLen size of the success operation bitmap in the header of the
+// wal versions writing it in the header
+const successOperationHeaderLen = 40000
 
-const curWalVersion = 1
+// maxOperationCount operation indexes are stored on 32 bits
+const maxOperationCount = math.MaxInt32
+
+const (
+	// commands end with an 8-bit additive checksum
+	walVersionAdditiveCrc = 1
+	// commands end with a CRC32C (Castagnoli) checksum
+	walVersionCrc32c = 2
+	// the success operation bitmap is written in a footer after the commands, with any size
+	walVersionSuccessFooter = 3
+	// a byte after the command kind tells the compression of the data
+	walVersionCompression = 4
+	// the header ends with the id of the key of the encrypted commands, 0 if not encrypted
+	walVersionEncryption = 5
+)
+
+const curWalVersion = walVersionEncryption
+
+// walCodec encode and decode the commands of a wal file version.
+// The header layout is shared by all the versions.
+type walCodec interface {
+	version() uint8
+	writeCmd(buffer *bufio.Writer, cmd *walCmd) (int, error)
+	readCmd(reader *bufio.Reader, curIndex int) (*walCmd, error)
+	// successOperationInHeader the success operation bitmap has a fixed size and is written in the header.
+	// Otherwise it is written in a footer at checkpoint.
+	successOperationInHeader() bool
+}
+
+// checksumCodec the commands of the versions 1, 2 and 3 only differ by their checksum. The version 4 adds
+// the compression of the data. The encryption of the version 5 is done by the File around the codec.
+type checksumCodec struct {
+	v uint8
+	// compression of the written data of at least minCompressSize bytes, from the version 4
+	compression     cmdCompression
+	minCompressSize int
+}
+
+func (c checksumCodec) version() uint8 { return c.v }
+
+func (c checksumCodec) successOperationInHeader() bool { return c.v < walVersionSuccessFooter }
+
+var walCodecs = map[uint8]walCodec{
+	walVersionAdditiveCrc:   checksumCodec{v: walVersionAdditiveCrc},
+	walVersionCrc32c:        checksumCodec{v: walVersionCrc32c},
+	walVersionSuccessFooter: checksumCodec{v: walVersionSuccessFooter},
+	walVersionCompression:   checksumCodec{v: walVersionCompression},
+	walVersionEncryption:    checksumCodec{v: walVersionEncryption},
+}
+
+// codecForConfig codec of the current version writing the data with the compression of the config
+func codecForConfig(c config.Config) walCodec {
+	return checksumCodec{
+		v:               curWalVersion,
+		compression:     compressionFromConfig(c.WALCompression),
+		minCompressSize: c.WALCompressionMinSize,
+	}
+}
+
+func codecForVersion(version uint8) (walCodec, error) {
+	codec, exists := walCodecs[version]
+	if !exists {
+		return nil, fmt.Errorf("try to open a wal file version: %d (supported versions: %d to %d)", version, walVersionAdditiveCrc, curWalVersion)
+	}
+	return codec, nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// cmdChecksum checksum of a command for a wal file version
+type cmdChecksum struct {
+	version uint8
+	sum8    uint8
+	sum32   uint32
+}
+
+func newCmdChecksum(version uint8) cmdChecksum {
+	return cmdChecksum{version: version, sum8: 128}
+}
+
+func (c *cmdChecksum) update(b []byte) {
+	if c.version == walVersionAdditiveCrc {
+		for _, v := range b {
+			c.sum8 += v
+		}
+		return
+	}
+	c.sum32 = crc32.Update(c.sum32, crc32cTable, b)
+}
+
+func (c *cmdChecksum) updateByte(b byte) {
+	var buf = [1]byte{b}
+	c.update(buf[:])
+}
+
+// bytes encoded checksum written at the end of the command
+func (c *cmdChecksum) bytes() []byte {
+	if c.version == walVersionAdditiveCrc {
+		return []byte{c.sum8}
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], c.sum32)
+	return b[:]
+}
+
+func checksumLen(version uint8) int {
+	if version == walVersionAdditiveCrc {
+		return 1
+	}
+	return 4
+}
 
 type walCmd struct {
 	cf             config.ContainerFile
@@ -46,17 +164,28 @@ type File struct {
 	shardCount       uint64
 	unixCreationTime uint64
 	successOperation []byte
+	// codec used to read and write the commands
+	codec walCodec
+	// keyID key of the encrypted commands, 0 if not encrypted
+	keyID uint32
+	aead  cipher.AEAD
+}
+
+// Version of the file format
+func (wf *File) Version() uint8 {
+	return wf.codec.version()
 }
 
 func initFile(walIndex, shardIndex, shardCount int) *File {
 	return &File{
 		cmdsPerFile:      make(map[string][]*walCmd),
 		cmdsOrder:        make([]*walCmd, 0),
-		successOperation: make([]byte, successOperationCount/8),
+		successOperation: make([]byte, 0),
 		unixCreationTime: uint64(time.Now().Unix()),
 		walIndex:         uint64(walIndex),
 		shardIndex:       uint64(shardIndex),
 		shardCount:       uint64(shardCount),
+		codec:            walCodecs[curWalVersion],
 	}
 }
 
@@ -64,8 +193,9 @@ func initFileForRead() *File {
 	return &File{
 		cmdsPerFile:      make(map[string][]*walCmd),
 		cmdsOrder:        make([]*walCmd, 0),
-		successOperation: make([]byte, successOperationCount/8),
+		successOperation: make([]byte, 0),
 		unixCreationTime: uint64(time.Now().Unix()),
+		codec:            walCodecs[curWalVersion],
 	}
 }
 
@@ -78,10 +208,16 @@ func (wf *File) addCmd(cmd *walCmd) {
 	wf.cmdsPerFile[key] = append(wf.cmdsPerFile[key], cmd)
 }
 
-// SetSuccessOperation set success operation value
+// SetSuccessOperation set success operation value. The bitmap grows as needed.
 func (wf *File) setSuccessOperation(operationIndex int, value bool) {
 	byteIndex := operationIndex / 8
 	bitIndex := operationIndex % 8
+	if byteIndex >= len(wf.successOperation) {
+		if !value {
+			return
+		}
+		wf.successOperation = append(wf.successOperation, make([]byte, byteIndex+1-len(wf.successOperation))...)
+	}
 	b := wf.successOperation[byteIndex]
 	if value {
 		b = b | 1<<bitIndex
@@ -95,26 +231,87 @@ func (wf *File) setSuccessOperation(operationIndex int, value bool) {
 func (wf *File) getSuccessOperation(operationIndex int) bool {
 	byteIndex := operationIndex / 8
 	bitIndex := operationIndex % 8
-	if byteIndex > len(wf.successOperation) {
-		panic("getSuccessOperation: out of bound index")
+	if byteIndex >= len(wf.successOperation) {
+		return false
 	}
 	b := wf.successOperation[byteIndex]
 	return (b & (1 << bitIndex)) != 0
 }
 
+// headerSuccessOperation bitmap with the size reserved in the header
+func (wf *File) headerSuccessOperation() ([]byte, error) {
+	if len(wf.successOperation) > successOperationHeaderLen {
+		return nil, fmt.Errorf("wal version %d can not track more than %d operations", wf.codec.version(), successOperationHeaderLen*8)
+	}
+	res := make([]byte, successOperationHeaderLen)
+	copy(res, wf.successOperation)
+	return res, nil
+}
+
+// syncSuccessOperation write the success operation bitmap. Without bitmap in the header,
+// it is written in a footer after the commands: the file offset must be at the end of the commands.
 func (wf *File) syncSuccessOperation(file *os.File) error {
-	const headerCurWalVersionLen = 1
-	const headerWalIndexLen = 8
-	const headerUnixCreationTimeLen = 8
-	const headerShardCountLen = 8
-	const headerShardIndexLen = 8
-	_, err := file.WriteAt(wf.successOperation, offsetSuccessOperationBytes)
+	if !wf.codec.successOperationInHeader() {
+		if _, err := file.Write(successOperationFooter(wf.successOperation)); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+	successOperation, err := wf.headerSuccessOperation()
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(successOperation, offsetSuccessOperationBytes)
 	if err != nil {
 		return err
 	}
 	return file.Sync()
 }
 
+// footer: [success operation bitmap][uint32 crc32c of the bitmap][uint64 bitmap len][magic]
+var successOperationFooterMagic = [4]byte{'W', 'S', 'O', 'F'}
+
+const successOperationFooterTrailerLen = 4 + 8 + len(successOperationFooterMagic)
+
+func successOperationFooter(successOperation []byte) []byte {
+	res := make([]byte, 0, len(successOperation)+successOperationFooterTrailerLen)
+	res = append(res, successOperation...)
+	var trailer [successOperationFooterTrailerLen]byte
+	binary.BigEndian.PutUint32(trailer[0:4], crc32.Checksum(successOperation, crc32cTable))
+	binary.BigEndian.PutUint64(trailer[4:12], uint64(len(successOperation)))
+	copy(trailer[12:], successOperationFooterMagic[:])
+	return append(res, trailer[:]...)
+}
+
+// readSuccessOperationFooter read the footer of a file of size fileSize. It returns the bitmap and the
+// offset of the end of the commands. A file without footer has been written without being applied:
+// its bitmap is empty. A footer with a bad checksum gives an empty bitmap too.
+func readSuccessOperationFooter(file io.ReaderAt, fileSize int64) ([]byte, int64, error) {
+	if fileSize < offsetSuccessOperationBytes+int64(successOperationFooterTrailerLen) {
+		return []byte{}, fileSize, nil
+	}
+	var trailer [successOperationFooterTrailerLen]byte
+	if _, err := file.ReadAt(trailer[:], fileSize-int64(len(trailer))); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(trailer[12:], successOperationFooterMagic[:]) {
+		return []byte{}, fileSize, nil
+	}
+	bitmapLen := binary.BigEndian.Uint64(trailer[4:12])
+	if bitmapLen > uint64(fileSize-offsetSuccessOperationBytes-int64(len(trailer))) {
+		return []byte{}, fileSize, nil
+	}
+	cmdsEnd := fileSize - int64(len(trailer)) - int64(bitmapLen)
+	successOperation := make([]byte, bitmapLen)
+	if _, err := file.ReadAt(successOperation, cmdsEnd); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(successOperation, crc32cTable) != binary.BigEndian.Uint32(trailer[0:4]) {
+		return []byte{}, cmdsEnd, nil
+	}
+	return successOperation, cmdsEnd, nil
+}
+
 func (wf *File) reset() {
 	wf.resetWithNewElems(make(map[string][]*walCmd), wf.cmdsOrder[0:0], wf.walIndex)
 }
@@ -126,6 +323,7 @@ func (wf *File) resetWithNewElems(perFile map[string][]*walCmd, cmdsOrder []*wal
 	for i := range wf.successOperation {
 		wf.successOperation[i] = 0
 	}
+	wf.successOperation = wf.successOperation[0:0]
 }
 
 func (wf *File) writeAllCmdToFile(buffer *bufio.Writer) error {
@@ -145,10 +343,11 @@ const headerShardCountLen = 8
 const headerShardIndexLen = 8
 const offsetSuccessOperationBytes = headerCurWalVersionLen + headerWalIndexLen + headerUnixCreationTimeLen + headerShardCountLen + headerShardIndexLen
 
-func (wf *File) writeHeader(buffer *bufio.Writer) error {
-	wf.unixCreationTime = uint64(time.Now().Unix())
+// headerKeyIDLen size of the key id ending the header from the version 5
+const headerKeyIDLen = 4
 
-	err := buffer.WriteByte(curWalVersion)
+func (wf *File) writeHeader(buffer *bufio.Writer) error {
+	err := buffer.WriteByte(wf.codec.version())
 	if err != nil {
 		return err
 	}
@@ -173,10 +372,74 @@ func (wf *File) writeHeader(buffer *bufio.Writer) error {
 		return err
 	}
 
-	_, err = buffer.Write(wf.successOperation)
+	if wf.codec.version() >= walVersionEncryption {
+		var keyID [headerKeyIDLen]byte
+		binary.BigEndian.PutUint32(keyID[:], wf.keyID)
+		if _, err := buffer.Write(keyID[:]); err != nil {
+			return err
+		}
+	}
+
+	if !wf.codec.successOperationInHeader() {
+		return nil
+	}
+	successOperation, err := wf.headerSuccessOperation()
+	if err != nil {
+		return err
+	}
+	_, err = buffer.Write(successOperation)
 	return err
 }
 
+// encryptWith encrypt the next written commands with the current key of keys, in plaintext if nil.
+// It must be called before writing the header.
+func (wf *File) encryptWith(keys crypt.KeyProvider) error {
+	wf.keyID = 0
+	wf.aead = nil
+	if keys == nil {
+		return nil
+	}
+	keyID, key, err := keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	aead, err := crypt.NewAEAD(key)
+	if err != nil {
+		return err
+	}
+	wf.keyID = keyID
+	wf.aead = aead
+	return nil
+}
+
+// decryptWith set the key of the commands read after the header
+func (wf *File) decryptWith(keys crypt.KeyProvider) error {
+	if wf.keyID == 0 {
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf("wal file encrypted with the key %d: no key provider", wf.keyID)
+	}
+	key, err := keys.Key(wf.keyID)
+	if err != nil {
+		return err
+	}
+	wf.aead, err = crypt.NewAEAD(key)
+	return err
+}
+
+// additionalData header fields authenticated with each encrypted command: the commands can not be
+// moved to another wal file
+func (wf *File) additionalData() []byte {
+	var ad [4*8 + 4]byte
+	binary.BigEndian.PutUint64(ad[0:], wf.walIndex)
+	binary.BigEndian.PutUint64(ad[8:], wf.unixCreationTime)
+	binary.BigEndian.PutUint64(ad[16:], wf.shardCount)
+	binary.BigEndian.PutUint64(ad[24:], wf.shardIndex)
+	binary.BigEndian.PutUint32(ad[32:], wf.keyID)
+	return ad[:]
+}
+
 func (wf *File) readHeader(reader *bufio.Reader) error {
 	fileVersion, err := reader.ReadByte() // wal version
 	if err == io.EOF {
@@ -186,9 +449,11 @@ func (wf *File) readHeader(reader *bufio.Reader) error {
 		return err
 	}
 
-	if int(fileVersion) != curWalVersion {
-		return fmt.Errorf("try to open a wal file version: %d", curWalVersion)
+	codec, err := codecForVersion(fileVersion)
+	if err != nil {
+		return err
 	}
+	wf.codec = codec
 
 	walIndex, err := readUint64(reader)
 	if err != nil {
@@ -214,14 +479,86 @@ func (wf *File) readHeader(reader *bufio.Reader) error {
 	}
 	wf.shardIndex = shardIndex
 
+	wf.keyID = 0
+	if codec.version() >= walVersionEncryption {
+		var keyID [headerKeyIDLen]byte
+		if _, err := io.ReadFull(reader, keyID[:]); err != nil {
+			return err
+		}
+		wf.keyID = binary.BigEndian.Uint32(keyID[:])
+	}
+
+	if !codec.successOperationInHeader() {
+		return nil
+	}
+	wf.successOperation = make([]byte, successOperationHeaderLen)
 	_, err = io.ReadFull(reader, wf.successOperation)
 
 	return err
 }
 
+// writeCmdToFile write a command. An encrypted command is [uint32 sealed len][command sealed by crypt.Seal].
 func (wf *File) writeCmdToFile(buffer *bufio.Writer, cmd *walCmd) (int, error) {
+	if wf.aead == nil {
+		return wf.codec.writeCmd(buffer, cmd)
+	}
+	var plain bytes.Buffer
+	plainWriter := bufio.NewWriter(&plain)
+	if _, err := wf.codec.writeCmd(plainWriter, cmd); err != nil {
+		return 0, err
+	}
+	if err := plainWriter.Flush(); err != nil {
+		return 0, err
+	}
+	sealed, err := crypt.Seal(wf.aead, nil, plain.Bytes(), wf.additionalData())
+	if err != nil {
+		return 0, err
+	}
+	var lenBuffer [4]byte
+	binary.BigEndian.PutUint32(lenBuffer[:], uint32(len(sealed)))
+	if _, err := buffer.Write(lenBuffer[:]); err != nil {
+		return 0, err
+	}
+	if _, err := buffer.Write(sealed); err != nil {
+		return 0, err
+	}
+	return len(lenBuffer) + len(sealed), nil
+}
+
+func (wf *File) readCmd(reader *bufio.Reader, curIndex int) (*walCmd, error) {
+	if wf.aead == nil {
+		return wf.codec.readCmd(reader, curIndex)
+	}
+	var lenBuffer [4]byte
+	if _, err := io.ReadFull(reader, lenBuffer[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedWalFileCommand
+		}
+		return nil, err
+	}
+	// the length may be corrupted: the buffer only grows with the bytes read
+	var sealed bytes.Buffer
+	sealedLen := int64(binary.BigEndian.Uint32(lenBuffer[:]))
+	if n, err := io.CopyN(&sealed, reader, sealedLen); n < sealedLen {
+		if err == io.EOF {
+			return nil, ErrTruncatedWalFileCommand
+		}
+		return nil, err
+	}
+	plain, err := crypt.Open(wf.aead, nil, sealed.Bytes(), wf.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadWalFileCrcCommand, err.Error())
+	}
+	cmd, err := wf.codec.readCmd(bufio.NewReader(bytes.NewReader(plain)), curIndex)
+	if err == io.EOF {
+		return nil, ErrTruncatedWalFileCommand
+	}
+	return cmd, err
+}
+
+func (c checksumCodec) writeCmd(buffer *bufio.Writer, cmd *walCmd) (int, error) {
 	n := 0
-	var crc uint8 = 128
+	crc := newCmdChecksum(c.v)
 	key := cmd.cf.Key()
 	if len(key) > 255 {
 		return 0, fmt.Errorf("key is more than 255 chars: %s", key)
@@ -229,47 +566,61 @@ func (wf *File) writeCmdToFile(buffer *bufio.Writer, cmd *walCmd) (int, error) {
 	if err := buffer.WriteByte(byte(len(key))); err != nil {
 		return 0, err
 	}
-	crc += byte(len(key))
+	crc.updateByte(byte(len(key)))
 	n = n + 1
 	if _, err := buffer.WriteString(key); err != nil {
 		return 0, err
 	}
-	for _, v := range []byte(key) {
-		crc += v
-	}
+	crc.update([]byte(key))
 	n = n + len(key)
 	if err := buffer.WriteByte(byte(cmd.cmd)); err != nil {
 		return 0, err
 	}
-	crc += byte(cmd.cmd)
+	crc.updateByte(byte(cmd.cmd))
 	n = n + 1
-	var lenBuffer [8]byte
+
+	var data []byte
 	if cmd.buffer != nil {
-		binary.BigEndian.PutUint64(lenBuffer[:], uint64(cmd.buffer.Len()))
-	} else {
-		binary.BigEndian.PutUint64(lenBuffer[:], 0)
+		cmd.buffer.ResetRead()
+		data = cmd.buffer.Bytes()
 	}
+	if c.v >= walVersionCompression {
+		compression := compressionNone
+		if c.compression != compressionNone && len(data) > 0 && len(data) >= c.minCompressSize &&
+			len(data) <= maxCompressedCmdDataLen {
+			compressed, err := c.compression.compress(data)
+			if err != nil {
+				return 0, err
+			}
+			// incompressible data is kept raw
+			if len(compressed) < len(data) {
+				compression = c.compression
+				data = compressed
+			}
+		}
+		if err := buffer.WriteByte(byte(compression)); err != nil {
+			return 0, err
+		}
+		crc.updateByte(byte(compression))
+		n = n + 1
+	}
+
+	var lenBuffer [8]byte
+	binary.BigEndian.PutUint64(lenBuffer[:], uint64(len(data)))
 
 	if _, err := buffer.Write(lenBuffer[:]); err != nil {
 		return 0, err
 	}
 	n = n + 8
 
-	for _, v := range lenBuffer {
-		crc += v
-	}
+	crc.update(lenBuffer[:])
 
-	if cmd.buffer != nil {
-		cmd.buffer.ResetRead()
-		n = n + cmd.buffer.Len() // must be call before write
-		if _, err := buffer.Write(cmd.buffer.Bytes()); err != nil {
-			cmd.buffer.ResetRead()
+	if len(data) > 0 {
+		n = n + len(data)
+		if _, err := buffer.Write(data); err != nil {
 			return 0, err
 		}
-		cmd.buffer.ResetRead()
-		for _, v := range cmd.buffer.Bytes() {
-			crc += v
-		}
+		crc.update(data)
 	}
 
 	var offset [8]byte
@@ -279,9 +630,7 @@ func (wf *File) writeCmdToFile(buffer *bufio.Writer, cmd *walCmd) (int, error) {
 	}
 	n = n + 8
 
-	for _, v := range offset {
-		crc += v
-	}
+	crc.update(offset[:])
 
 	var fileSize [8]byte
 	binary.BigEndian.PutUint64(fileSize[:], uint64(cmd.fileSize))
@@ -290,46 +639,102 @@ func (wf *File) writeCmdToFile(buffer *bufio.Writer, cmd *walCmd) (int, error) {
 	}
 	n = n + 8
 
-	for _, v := range fileSize {
-		crc += v
-	}
+	crc.update(fileSize[:])
 
 	if err := buffer.WriteByte(byte(cmd.retryCount)); err != nil {
 		return 0, err
 	}
 	n = n + 1
 
-	crc += byte(cmd.retryCount)
+	crc.updateByte(byte(cmd.retryCount))
 
-	if err := buffer.WriteByte(byte(crc)); err != nil {
+	crcBytes := crc.bytes()
+	if _, err := buffer.Write(crcBytes); err != nil {
 		return 0, err
 	}
-	n = n + 1
+	n = n + len(crcBytes)
 
 	return n, nil
 }
 
-// ReadFileFromPath read a wal file from a specific path
-func ReadFileFromPath(path string) (*File, error) {
-	var err error
-	res := initFileForRead()
+// countingReader count the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
 
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// ReadFileFromPath read a wal file from a specific path, the encrypted commands with the keys of keys.
+// The commands before a corrupted one are returned with an *ErrCorruptedCommand.
+func ReadFileFromPath(path string, keys crypt.KeyProvider) (*File, error) {
 	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readFile(file, st.Size(), path, keys)
+}
+
+// readFileFromStorage read a wal file of a storage, see ReadFileFromPath
+func readFileFromStorage(store storage.Storage, path string, keys crypt.KeyProvider) (*File, error) {
+	file, err := store.OpenFile(path, false)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
+
+	size, err := file.Size()
 	if err != nil {
 		return nil, err
 	}
+	return readFile(file, size, path, keys)
+}
+
+// readFile read the wal file of size bytes of file, path is only used in the errors
+func readFile(file io.ReaderAt, size int64, path string, keys crypt.KeyProvider) (*File, error) {
+	var err error
+	res := initFileForRead()
 
-	reader := bufio.NewReader(file)
+	cmdsEnd := size
+	var successOperation []byte
+	var versionBuf [1]byte
+	if n, _ := file.ReadAt(versionBuf[:], 0); n == 1 {
+		if codec, err := codecForVersion(versionBuf[0]); err == nil && !codec.successOperationInHeader() {
+			successOperation, cmdsEnd, err = readSuccessOperationFooter(file, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	counter := &countingReader{r: io.NewSectionReader(file, 0, cmdsEnd)}
+	reader := bufio.NewReader(counter)
 
 	err = res.readHeader(reader)
 	if err != nil {
 		return nil, err
 	}
+	if successOperation != nil {
+		res.successOperation = successOperation
+	}
+	if err := res.decryptWith(keys); err != nil {
+		return nil, err
+	}
 	curIndex := 0
 	for true {
 		var cmd *walCmd
-		cmd, err = readCmdFromReader(reader, curIndex)
+		cmdOffset := counter.n - int64(reader.Buffered())
+		cmd, err = res.readCmd(reader, curIndex)
 		if cmd != nil {
 			res.cmdsOrder = append(res.cmdsOrder, cmd)
 			key := cmd.cf.Key()
@@ -340,6 +745,14 @@ func ReadFileFromPath(path string) (*File, error) {
 			curIndex++
 		}
 		if err != nil {
+			if err != io.EOF {
+				err = &ErrCorruptedCommand{
+					Path:         path,
+					CommandIndex: curIndex,
+					Offset:       cmdOffset,
+					Err:          err,
+				}
+			}
 			break
 		}
 	}
@@ -353,93 +766,139 @@ func ReadFileFromPath(path string) (*File, error) {
 // ErrBadWalFileCrcCommand means a command has a bad CRC and will be discarded
 var ErrBadWalFileCrcCommand = errors.New("bad CRC for command")
 
-func readCmdFromReader(reader *bufio.Reader, curIndex int) (*walCmd, error) {
-	var crc uint8 = 128
+// ErrTruncatedWalFileCommand means the file ends in the middle of a command
+var ErrTruncatedWalFileCommand = errors.New("truncated command")
+
+// ErrCorruptedCommand a command of a wal file could not be read. The commands after it are discarded.
+type ErrCorruptedCommand struct {
+	Path string
+	// CommandIndex index of the command in the file
+	CommandIndex int
+	// Offset of the command in the file
+	Offset int64
+	Err    error
+}
+
+func (e *ErrCorruptedCommand) Error() string {
+	return fmt.Sprintf("wal file %s: command %d at offset %d: %s", e.Path, e.CommandIndex, e.Offset, e.Err.Error())
+}
+
+func (e *ErrCorruptedCommand) Unwrap() error { return e.Err }
+
+// isCorruptedCommandErr the command has been partially written or altered
+func isCorruptedCommandErr(err error) bool {
+	return errors.Is(err, ErrBadWalFileCrcCommand) || errors.Is(err, ErrTruncatedWalFileCommand)
+}
+
+func (c checksumCodec) readCmd(reader *bufio.Reader, curIndex int) (*walCmd, error) {
+	crc := newCmdChecksum(c.v)
 	lenKey, err := reader.ReadByte()
 	if err != nil {
 		return nil, err
 	}
 
-	crc += lenKey
+	// the file may only end between two commands
+	readFull := func(b []byte) error {
+		_, err := io.ReadFull(reader, b)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncatedWalFileCommand
+		}
+		return err
+	}
+
+	crc.updateByte(lenKey)
 
 	var bKeyBuf [255]byte
 	keyBuf := bKeyBuf[0:lenKey]
-	_, err = reader.Read(keyBuf)
-	if err != nil {
+	if err := readFull(keyBuf); err != nil {
 		return nil, err
 	}
 
-	for _, v := range keyBuf {
-		crc += v
-	}
+	crc.update(keyBuf)
 
-	cf, err := config.ParseContainerFileKey(string(keyBuf))
-	if err != nil {
+	var bCmd [1]byte
+	if err := readFull(bCmd[:]); err != nil {
 		return nil, err
 	}
+	cmd := bCmd[0]
+	crc.updateByte(cmd)
 
-	cmd, err := reader.ReadByte()
-	if err != nil {
-		return nil, err
+	compression := compressionNone
+	if c.v >= walVersionCompression {
+		var bCompression [1]byte
+		if err := readFull(bCompression[:]); err != nil {
+			return nil, err
+		}
+		compression = cmdCompression(bCompression[0])
+		crc.updateByte(bCompression[0])
 	}
-	crc += cmd
 
 	var bLenBufferBuf [8]byte
-	_, err = reader.Read(bLenBufferBuf[:])
-	if err != nil {
+	if err := readFull(bLenBufferBuf[:]); err != nil {
 		return nil, err
 	}
 	lenBuffer := binary.BigEndian.Uint64(bLenBufferBuf[:])
-	for _, v := range bLenBufferBuf {
-		crc += v
-	}
+	crc.update(bLenBufferBuf[:])
 
 	var dataBuffer *wutils.Buffer
 	if lenBuffer > 0 {
-		dataBuffer = &wutils.Buffer{}
-		dataBuffer.GrowAndKeepSpace(int(lenBuffer))
-		_, err = reader.Read(dataBuffer.Bytes())
-		if err != nil {
-			return nil, err
+		// the length may be corrupted: the buffer only grows with the bytes read
+		if lenBuffer > math.MaxInt64 {
+			return nil, ErrTruncatedWalFileCommand
 		}
-		for _, v := range dataBuffer.Bytes() {
-			crc += v
+		var data bytes.Buffer
+		if n, err := io.CopyN(&data, reader, int64(lenBuffer)); n < int64(lenBuffer) {
+			if err == io.EOF {
+				return nil, ErrTruncatedWalFileCommand
+			}
+			return nil, err
 		}
+		dataBuffer = wutils.NewBuffer(data.Bytes())
+		crc.update(dataBuffer.Bytes())
 	}
 
 	var bOffset [8]byte
-	_, err = reader.Read(bOffset[:])
-	if err != nil {
+	if err := readFull(bOffset[:]); err != nil {
 		return nil, err
 	}
 
 	offset := binary.BigEndian.Uint64(bOffset[:])
-	for _, v := range bOffset {
-		crc += v
-	}
+	crc.update(bOffset[:])
 
 	var bFileSize [8]byte
-	_, err = reader.Read(bFileSize[:])
-	if err != nil {
+	if err := readFull(bFileSize[:]); err != nil {
 		return nil, err
 	}
-	for _, v := range bFileSize {
-		crc += v
+	crc.update(bFileSize[:])
+
+	var bRetryCount [1]byte
+	if err := readFull(bRetryCount[:]); err != nil {
+		return nil, err
 	}
+	retryCount := bRetryCount[0]
+	crc.updateByte(retryCount)
 
-	retryCount, err := reader.ReadByte()
-	if err != nil {
+	var bReadCrc [4]byte
+	readCrc := bReadCrc[0:checksumLen(c.v)]
+	if err := readFull(readCrc); err != nil {
 		return nil, err
 	}
-	crc += retryCount
 
-	readCrd, err := reader.ReadByte()
+	if !bytes.Equal(crc.bytes(), readCrc) {
+		return nil, ErrBadWalFileCrcCommand
+	}
+
+	cf, err := config.ParseContainerFileKey(string(keyBuf))
 	if err != nil {
 		return nil, err
 	}
 
-	if crc != readCrd {
-		return nil, ErrBadWalFileCrcCommand
+	if dataBuffer != nil && compression != compressionNone {
+		raw, err := compression.decompress(dataBuffer.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress the command data: %w", err)
+		}
+		dataBuffer = wutils.NewBuffer(raw)
 	}
 
 	fileSize := binary.BigEndian.Uint64(bFileSize[:])
@@ -455,8 +914,68 @@ func readCmdFromReader(reader *bufio.Reader, curIndex int) (*walCmd, error) {
 
 }
 
-// ColdReplay will replay all the cmds of the wal file
+// UpgradeFile rewrite a wal file with the current version, encrypted with the current key of keys if not
+// nil. The header and the commands are kept as is. It returns false if the file already has the current
+// version and is encrypted or keys is nil. A file with corrupted commands is not upgraded.
+func UpgradeFile(p string, keys crypt.KeyProvider) (bool, error) {
+	wf, err := ReadFileFromPath(p, keys)
+	if err != nil {
+		return false, err
+	}
+	if wf.Version() == curWalVersion && (wf.keyID != 0 || keys == nil) {
+		return false, nil
+	}
+	wf.codec = walCodecs[curWalVersion]
+	if wf.keyID == 0 {
+		if err := wf.encryptWith(keys); err != nil {
+			return false, err
+		}
+	}
+
+	// the temporary file must not look like an archived wal file
+	tmpPath := path.Join(path.Dir(p), "upgrade-"+path.Base(p))
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	if err != nil {
+		return false, err
+	}
+	writer := bufio.NewWriter(file)
+	err = wf.writeHeader(writer)
+	if err == nil {
+		err = wf.writeAllCmdToFile(writer)
+	}
+	if err == nil && !wf.codec.successOperationInHeader() {
+		_, err = writer.Write(successOperationFooter(wf.successOperation))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err := os.Rename(tmpPath, p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ColdReplay will replay all the cmds of the wal file on the local disk with the default layout
 func (wf *File) ColdReplay(activeFolder, archiveFolder string) wutils.ErrorList {
+	return wf.ColdReplayOn(storage.Local{}, nil, activeFolder, archiveFolder)
+}
+
+// ColdReplayOn will replay all the cmds of the wal file on the files of store with the layout, the
+// default one if nil
+func (wf *File) ColdReplayOn(store storage.Storage, layout config.Layout, activeFolder, archiveFolder string) wutils.ErrorList {
+	if layout == nil {
+		layout = config.DefaultLayout
+	}
 	errors := wutils.ErrorList{}
 	for key, perFile := range wf.cmdsPerFile {
 		cf, err := config.ParseContainerFileKey(key)
@@ -464,12 +983,8 @@ func (wf *File) ColdReplay(activeFolder, archiveFolder string) wutils.ErrorList
 			errors.Add(err)
 			break
 		}
-		filePath := cf.PathToFileFromFolder(activeFolder)
-		if err := os.MkdirAll(path.Dir(filePath), 0744); err != nil {
-			errors.Add(err)
-			return errors
-		}
-		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0744)
+		filePath := cf.PathInLayout(layout, activeFolder)
+		file, err := store.OpenFile(filePath, true)
 		if err != nil {
 			errors.Add(err)
 			break
@@ -490,8 +1005,8 @@ func (wf *File) ColdReplay(activeFolder, archiveFolder string) wutils.ErrorList
 					break
 				}
 			case archiveCmd:
-				archiveFileName := cf.ArchivePath(archiveFolder, int(wf.shardIndex), int(wf.walIndex), int(cmd.operationIndex))
-				deletedFile, err := fileop.ArchiveAtomicOp(file, cf.PathToFileFromFolder(activeFolder), archiveFileName, len(perFile)-1 == iCmd, archiveFolder == "")
+				archiveFileName := cf.ArchivePathInLayout(layout, archiveFolder, int(wf.shardIndex), int(wf.walIndex), int(cmd.operationIndex))
+				deletedFile, err := fileop.ArchiveAtomicOp(store, file, filePath, archiveFileName, len(perFile)-1 == iCmd, archiveFolder == "")
 				if err != nil {
 					errors.Add(err)
 					break
@@ -501,6 +1016,9 @@ func (wf *File) ColdReplay(activeFolder, archiveFolder string) wutils.ErrorList
 				}
 			}
 		}
+		if file != nil {
+			errors.Add(file.Close())
+		}
 	}
 	return errors
 }
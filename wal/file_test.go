@@ -2,11 +2,18 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
 	"github.com/chamot1111/waldb/wutils"
 )
 
@@ -67,7 +74,7 @@ func TestSaveAndReload(t *testing.T) {
 	f.Close()
 	f = nil
 
-	wf2, err := ReadFileFromPath("test-wal.bin")
+	wf2, err := ReadFileFromPath("test-wal.bin", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,3 +132,375 @@ func bufferAreEquals(b1, b2 *wutils.Buffer) error {
 	}
 	return nil
 }
+
+func writeTestWalFile(t *testing.T, wf *File, p string) []int {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	if err := wf.writeHeader(writer); err != nil {
+		t.Fatal(err)
+	}
+	cmdLens := make([]int, 0)
+	for _, cmd := range wf.cmdsOrder {
+		n, err := wf.writeCmdToFile(writer, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmdLens = append(cmdLens, n)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return cmdLens
+}
+
+func TestCorruptedCommand(t *testing.T) {
+	defer os.Remove("test-wal.bin")
+	for _, version := range []uint8{walVersionAdditiveCrc, walVersionCrc32c, walVersionSuccessFooter, walVersionCompression, walVersionEncryption} {
+		wf := initFile(0, 0, 1)
+		wf.codec = walCodecs[version]
+		for _, content := range []string{"hello", "world", "again"} {
+			wf.addCmd(&walCmd{
+				cf:       config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+				cmd:      writeCmd,
+				buffer:   wutils.NewBuffer([]byte(content)),
+				fileSize: 5,
+			})
+		}
+		cmdLens := writeTestWalFile(t, wf, "test-wal.bin")
+
+		wf2, err := ReadFileFromPath("test-wal.bin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := walFileEquals(wf, wf2); err != nil {
+			t.Fatal(err)
+		}
+
+		// swap two bytes of the second command content: "world" => "wrold"
+		cmdOffset := int64(offsetSuccessOperationBytes + cmdLens[0])
+		if wf.codec.successOperationInHeader() {
+			cmdOffset += successOperationHeaderLen
+		}
+		if version >= walVersionEncryption {
+			cmdOffset += headerKeyIDLen
+		}
+		contentOffset := cmdOffset + int64(1+len(wf.cmdsOrder[1].cf.Key())+1+8)
+		if version >= walVersionCompression {
+			contentOffset++
+		}
+		f, err := os.OpenFile("test-wal.bin", os.O_RDWR, 0744)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte("ro"), contentOffset+1); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		wf2, err = ReadFileFromPath("test-wal.bin", nil)
+		if version == walVersionAdditiveCrc {
+			// the additive checksum can not detect a byte swap
+			if err != nil {
+				t.Fatalf("version %d: %v", version, err)
+			}
+			continue
+		}
+		errCmd, ok := err.(*ErrCorruptedCommand)
+		if !ok {
+			t.Fatalf("version %d: should get a corrupted command error: %v", version, err)
+		}
+		if errCmd.CommandIndex != 1 || errCmd.Offset != cmdOffset || !isCorruptedCommandErr(err) {
+			t.Fatalf("version %d: bad corrupted command error: %v", version, err)
+		}
+		if len(wf2.cmdsOrder) != 1 {
+			t.Fatalf("version %d: only the first command should be read", version)
+		}
+
+		// a partially written command
+		if err := os.Truncate("test-wal.bin", cmdOffset+3); err != nil {
+			t.Fatal(err)
+		}
+		_, err = ReadFileFromPath("test-wal.bin", nil)
+		if !errors.Is(err, ErrTruncatedWalFileCommand) {
+			t.Fatalf("version %d: should get a truncated command error: %v", version, err)
+		}
+	}
+}
+
+func TestCompressedCommands(t *testing.T) {
+	defer os.Remove("test-wal.bin")
+	r := rand.New(rand.NewSource(1))
+	incompressible := make([]byte, 1000)
+	r.Read(incompressible)
+	contents := [][]byte{
+		bytes.Repeat([]byte(`{"id":1,"name":"waldb"}`+"\n"), 200),
+		[]byte("hello"),
+		incompressible,
+		nil,
+	}
+	var rawSize int64
+	for _, compression := range []string{config.WALCompressionNone, config.WALCompressionSnappy, config.WALCompressionFlate} {
+		conf := config.InitDefaultTestConfig()
+		conf.WALCompression = compression
+		wf := initFile(0, 0, 1)
+		wf.codec = codecForConfig(*conf)
+		for _, content := range contents {
+			cmd := &walCmd{
+				cf:  config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+				cmd: writeCmd,
+			}
+			if content != nil {
+				cmd.buffer = wutils.NewBuffer(content)
+				cmd.fileSize = uint64(len(content))
+			}
+			wf.addCmd(cmd)
+		}
+		writeTestWalFile(t, wf, "test-wal.bin")
+
+		wf2, err := ReadFileFromPath("test-wal.bin", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if err := walFileEquals(wf, wf2); err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		st, err := os.Stat("test-wal.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression == config.WALCompressionNone {
+			rawSize = st.Size()
+		} else if st.Size() > rawSize-int64(len(contents[0]))/2 {
+			t.Fatalf("%s: the first command should be compressed: %d bytes, %d raw", compression, st.Size(), rawSize)
+		}
+	}
+}
+
+func TestDecompressCorruptedLength(t *testing.T) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	hugeLen := lenBuf[:binary.PutUvarint(lenBuf[:], 0xffffffff)]
+	for _, compression := range []cmdCompression{compressionSnappy, compressionFlate} {
+		// a few bytes announcing 4 GiB of raw data
+		data := append(append([]byte{}, hugeLen...), 0x00, 'a')
+		if _, err := compression.decompress(data); err == nil {
+			t.Fatalf("compression %d: a raw length above the bound should be rejected", compression)
+		}
+	}
+
+	// the data above the bound are written raw
+	big := bytes.Repeat([]byte{'a'}, maxCompressedCmdDataLen+1)
+	conf := config.InitDefaultTestConfig()
+	conf.WALCompression = config.WALCompressionFlate
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	cmd := &walCmd{
+		cf:       config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		cmd:      writeCmd,
+		buffer:   wutils.NewBuffer(big),
+		fileSize: uint64(len(big)),
+	}
+	if _, err := codecForConfig(*conf).writeCmd(w, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() <= len(big) {
+		t.Fatalf("the data above the bound should not be compressed: %d bytes", out.Len())
+	}
+}
+
+func TestEncryptedCommands(t *testing.T) {
+	defer os.Remove("test-wal.bin")
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	conf := config.InitDefaultTestConfig()
+	conf.WALCompression = config.WALCompressionSnappy
+	wf := initFile(0, 0, 1)
+	wf.codec = codecForConfig(*conf)
+	if err := wf.encryptWith(keys); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"secret", strings.Repeat("compressed secret ", 100), "last secret"} {
+		wf.addCmd(&walCmd{
+			cf:       config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+			cmd:      writeCmd,
+			buffer:   wutils.NewBuffer([]byte(content)),
+			fileSize: uint64(len(content)),
+		})
+	}
+	cmdLens := writeTestWalFile(t, wf, "test-wal.bin")
+
+	raw, err := ioutil.ReadFile("test-wal.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret")) || bytes.Contains(raw, []byte("app1")) {
+		t.Fatalf("the commands should be encrypted")
+	}
+	wf2, err := ReadFileFromPath("test-wal.bin", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := walFileEquals(wf, wf2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFileFromPath("test-wal.bin", nil); err == nil {
+		t.Fatalf("an encrypted wal file should not be read without keys")
+	}
+
+	// an altered last command
+	raw[len(raw)-1] ^= 1
+	if err := ioutil.WriteFile("test-wal.bin", raw, 0744); err != nil {
+		t.Fatal(err)
+	}
+	wf2, err = ReadFileFromPath("test-wal.bin", keys)
+	errCmd, ok := err.(*ErrCorruptedCommand)
+	if !ok || errCmd.CommandIndex != 2 || !isCorruptedCommandErr(err) || len(wf2.cmdsOrder) != 2 {
+		t.Fatalf("should get a corrupted command error: %v", err)
+	}
+
+	// a partially written command
+	if err := os.Truncate("test-wal.bin", int64(len(raw)-cmdLens[2]/2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFileFromPath("test-wal.bin", keys); !errors.Is(err, ErrTruncatedWalFileCommand) {
+		t.Fatalf("should get a truncated command error: %v", err)
+	}
+
+	// a plaintext wal file encrypted by an upgrade
+	wf.encryptWith(nil)
+	writeTestWalFile(t, wf, "test-wal.bin")
+	if upgraded, err := UpgradeFile("test-wal.bin", keys); err != nil || !upgraded {
+		t.Fatalf("plaintext wal file should be upgraded: %v", err)
+	}
+	if wf2, err = ReadFileFromPath("test-wal.bin", keys); err != nil || wf2.keyID != 1 {
+		t.Fatalf("upgraded wal file should be encrypted: %v", err)
+	}
+	if err := walFileEquals(wf, wf2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeFile(t *testing.T) {
+	defer os.Remove("test-wal.bin")
+	wf := initFile(3, 0, 1)
+	wf.codec = walCodecs[walVersionAdditiveCrc]
+	wf.addCmd(&walCmd{
+		cf:       config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		cmd:      writeCmd,
+		buffer:   wutils.NewBuffer([]byte("hello")),
+		fileSize: 5,
+	})
+	wf.addCmd(&walCmd{
+		cf:  config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		cmd: archiveCmd,
+	})
+	wf.setSuccessOperation(0, true)
+	writeTestWalFile(t, wf, "test-wal.bin")
+
+	upgraded, err := UpgradeFile("test-wal.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upgraded {
+		t.Fatalf("file should have been upgraded")
+	}
+
+	wf2, err := ReadFileFromPath("test-wal.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wf2.Version() != curWalVersion {
+		t.Fatalf("bad version after upgrade: %d", wf2.Version())
+	}
+	if err := walFileEquals(wf, wf2); err != nil {
+		t.Fatal(err)
+	}
+	if wf2.walIndex != 3 || wf2.unixCreationTime != wf.unixCreationTime || !wf2.getSuccessOperation(0) || wf2.getSuccessOperation(1) {
+		t.Fatalf("header should be kept")
+	}
+
+	upgraded, err = UpgradeFile("test-wal.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded {
+		t.Fatalf("file already has the current version")
+	}
+}
+
+func TestReadUnknownVersion(t *testing.T) {
+	defer os.Remove("test-wal.bin")
+	if err := ioutil.WriteFile("test-wal.bin", []byte{curWalVersion + 1}, 0744); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ReadFileFromPath("test-wal.bin", nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("version: %d", curWalVersion+1)) {
+		t.Fatalf("error should give the version found: %v", err)
+	}
+}
+
+func TestSuccessOperationFooter(t *testing.T) {
+	defer os.Remove("test-wal.bin")
+	wf := initFile(0, 0, 1)
+	wf.addCmd(&walCmd{
+		cf:       config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		cmd:      writeCmd,
+		buffer:   wutils.NewBuffer([]byte("hello")),
+		fileSize: 5,
+	})
+	// far above the 320k operations of the header bitmap
+	const bigOperationIndex = 1000000
+	wf.setSuccessOperation(0, true)
+	wf.setSuccessOperation(bigOperationIndex, true)
+
+	f, err := os.OpenFile("test-wal.bin", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := bufio.NewWriter(f)
+	if err := wf.writeHeader(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.writeAllCmdToFile(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// not applied yet: no footer
+	wf2, err := ReadFileFromPath("test-wal.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wf2.cmdsOrder) != 1 || wf2.getSuccessOperation(0) {
+		t.Fatalf("a wal without footer has no success operation")
+	}
+
+	if err := wf.syncSuccessOperation(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	wf2, err = ReadFileFromPath("test-wal.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := walFileEquals(wf, wf2); err != nil {
+		t.Fatal(err)
+	}
+	if !wf2.getSuccessOperation(0) || !wf2.getSuccessOperation(bigOperationIndex) || wf2.getSuccessOperation(bigOperationIndex-1) {
+		t.Fatalf("bad success operations read from the footer")
+	}
+	if wf2.getSuccessOperation(100 * bigOperationIndex) {
+		t.Fatalf("operation out of the bitmap should not be successful")
+	}
+}
@@ -0,0 +1,53 @@
+package wal
+
+import (
+	"strconv"
+
+	"github.com/chamot1111/waldb/metrics"
+)
+
+// Checkpoint triggers
+const (
+	checkpointTriggerSoft     = "soft"
+	checkpointTriggerTime     = "time"
+	checkpointTriggerHard     = "hard"
+	checkpointTriggerFlush    = "flush"
+	checkpointTriggerRecovery = "recovery"
+)
+
+var (
+	walBytesMetric = metrics.Default.NewCounterVec("waldb_wal_bytes_total",
+		"Bytes of commands written to the wal files.", "shard")
+	walCommandsMetric = metrics.Default.NewCounterVec("waldb_wal_commands_total",
+		"Commands appended to the wal.", "shard", "kind")
+	checkpointDurationMetric = metrics.Default.NewHistogramVec("waldb_checkpoint_duration_seconds",
+		"Duration of the checkpoints by trigger.", nil, "trigger")
+	applyFailedOpsMetric = metrics.Default.NewCounterVec("waldb_apply_failed_ops_total",
+		"Operations failed while applying a wal file.", "shard")
+	retriesDroppedMetric = metrics.Default.NewCounterVec("waldb_wal_retries_dropped_total",
+		"Failed operations dropped after the max retry count, saved in the dead letter folder when configured.", "shard")
+	archivedFileQueueMetric = metrics.Default.NewGauge("waldb_archived_file_queue_depth",
+		"Archived files waiting for the archived file functer.")
+	archivedFileSinkErrorsMetric = metrics.Default.NewCounterVec("waldb_archived_file_sink_errors_total",
+		"Failed attempts of the fan out sinks to process an archived file.", "sink")
+	replicatorLagMetric = metrics.Default.NewGauge("waldb_replicator_lag_seconds",
+		"Age of the last archived wal file processed by the replicator.")
+	replicatorQueueMetric = metrics.Default.NewGauge("waldb_replicator_queue_depth",
+		"Archived wal files waiting for the replicator.")
+)
+
+func cmdKindLabel(kind cmdKind) string {
+	switch kind {
+	case writeCmd:
+		return "write"
+	case truncateCmd:
+		return "truncate"
+	case archiveCmd:
+		return "archive"
+	}
+	return "unknown"
+}
+
+func shardLabel(shardIndex int) string {
+	return strconv.Itoa(shardIndex)
+}
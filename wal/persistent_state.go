@@ -20,12 +20,16 @@ type PersistentState struct {
 
 // Save state to file
 func (p *PersistentState) Save() error {
-	var buffer [8]byte
-	binary.BigEndian.PutUint64(buffer[:], p.WalIndex)
-	_, err := p.file.WriteAt(buffer[:], 0)
+	_, err := p.file.WriteAt(persistentStateBuffer(p.WalIndex), 0)
 	return err
 }
 
+func persistentStateBuffer(walIndex uint64) []byte {
+	var buffer [8]byte
+	binary.BigEndian.PutUint64(buffer[:], walIndex)
+	return buffer[:]
+}
+
 // InitPersistentFileFromDisk restore from file
 func InitPersistentFileFromDisk(config config.Config, shardIndex int) (*PersistentState, error) {
 	file, err := os.OpenFile(persistentStatePath(config, shardIndex), os.O_CREATE|os.O_RDWR, 0744)
@@ -0,0 +1,850 @@
+package wal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+// Replication protocol. The follower opens the connection and sends ["WDBR"][u8 protocol version]
+// [nonce]. The leader answers ["WDBR"][u8 protocol version][nonce][mac of the follower nonce]. The
+// follower checks the mac and sends its hello [u16 len][name][u32 shard count][u64 next wal index
+// wanted per shard][mac of the leader nonce and the hello]. The macs are HMAC-SHA256 keyed by
+// ReplicationSecret, so each side proves it knows the secret. There is no TLS: the wal files are sent
+// as they are on the disk, encrypted only with a KeyProvider.
+// The leader then streams frames [u8 frame type][payload]:
+//   - file: [u32 shard index][u64 wal index][u64 len][wal file content][mac of the frame]
+//   - heartbeat: no payload, sent when there is no new wal file
+//   - error: [u32 len][message], the leader closes the connection after it
+//   - missing: [u32 shard index][u64 wal index], the wal file is no longer retained: the follower
+//     must be resynced from a snapshot. The leader closes the connection after it.
+//
+// The follower acknowledges each applied wal file with [u32 shard index][u64 next wal index][mac of
+// the ack]. The frame macs are keyed by a session key derived from the secret and both nonces.
+const (
+	replicationProtocolVersion uint8 = 2
+
+	replicationFrameFile      uint8 = 1
+	replicationFrameHeartbeat uint8 = 2
+	replicationFrameError     uint8 = 3
+	replicationFrameMissing   uint8 = 4
+
+	replicationNonceSize = 32
+	replicationMACSize   = sha256.Size
+)
+
+const (
+	replicationLeaderRole   = "leader"
+	replicationFollowerRole = "follower"
+	replicationSessionRole  = "session"
+)
+
+var replicationMagic = [4]byte{'W', 'D', 'B', 'R'}
+
+const (
+	replicationPollInterval      = 100 * time.Millisecond
+	replicationHeartbeatInterval = 1 * time.Second
+	// replicationReadTimeout a follower without frame for this duration reconnects
+	replicationReadTimeout = 5 * replicationHeartbeatInterval
+	replicationRetryDelay  = 1 * time.Second
+	replicationMaxFileSize = 1 << 32
+)
+
+const replicationFollowerStateFilename = "replication-follower-state.bin"
+
+// ErrReplicationProtocol the peer does not speak the replication protocol
+var ErrReplicationProtocol = errors.New("bad replication protocol")
+
+// ErrReplicationAuth the peer does not know the replication secret
+var ErrReplicationAuth = errors.New("replication authentication failed")
+
+// ReplicationLeader serve the archived wal files of WalArchiveFolder to the followers over tcp.
+// The position of each follower is saved in a ReplicationSlot: the Replicator keeps the files until
+// all the followers have applied them, see Replicator.SetRetention.
+type ReplicationLeader struct {
+	walArchiveFolder string
+	shardCount       int
+	secret           []byte
+	logger           *zap.Logger
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	stop     chan struct{}
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+	// headers wal index and shard index of the archived files still in the folder
+	headers map[string]archivedWalFile
+	// followers names of the connected followers
+	followers map[string]bool
+}
+
+// InitReplicationLeader init a replication leader
+func InitReplicationLeader(conf config.Config, logger *zap.Logger) *ReplicationLeader {
+	return &ReplicationLeader{
+		walArchiveFolder: conf.WalArchiveFolder,
+		shardCount:       conf.ShardCount,
+		secret:           []byte(conf.ReplicationSecret),
+		logger:           logger,
+		stop:             make(chan struct{}),
+		conns:            make(map[net.Conn]struct{}),
+		headers:          make(map[string]archivedWalFile),
+		followers:        make(map[string]bool),
+	}
+}
+
+// Listen start to accept followers on addr
+func (l *ReplicationLeader) Listen(addr string) error {
+	if l.walArchiveFolder == "" {
+		return fmt.Errorf("replication leader needs a wal archive folder")
+	}
+	if len(l.secret) == 0 {
+		l.logger.Warn("ReplicationLeader: no replication secret, the followers are not authenticated")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+	l.wg.Add(1)
+	go l.acceptLoop()
+	return nil
+}
+
+// Addr address the leader listens on
+func (l *ReplicationLeader) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stop accepting followers and close the connections
+func (l *ReplicationLeader) Close() error {
+	close(l.stop)
+	err := l.listener.Close()
+	l.mutex.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mutex.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *ReplicationLeader) acceptLoop() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+			l.logger.Error("ReplicationLeader: accept failed", zap.Error(err))
+			time.Sleep(replicationPollInterval)
+			continue
+		}
+		l.mutex.Lock()
+		l.conns[conn] = struct{}{}
+		l.mutex.Unlock()
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			err := l.serve(conn)
+			select {
+			case <-l.stop:
+			default:
+				if err != nil {
+					l.logger.Info("ReplicationLeader: follower disconnected", zap.String("follower", conn.RemoteAddr().String()), zap.Error(err))
+				}
+			}
+			l.mutex.Lock()
+			delete(l.conns, conn)
+			l.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (l *ReplicationLeader) serve(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(replicationReadTimeout))
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	followerNonce, _, err := readReplicationGreeting(reader, false)
+	if err != nil {
+		return err
+	}
+	nonce, err := replicationNonce()
+	if err != nil {
+		return err
+	}
+	if err := writeReplicationGreeting(writer, nonce, replicationMAC(l.secret, []byte(replicationLeaderRole), followerNonce)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	name, next, err := readReplicationHello(reader, l.secret, nonce)
+	if err != nil {
+		if errors.Is(err, ErrReplicationAuth) {
+			writeReplicationError(writer, err.Error())
+			writer.Flush()
+		}
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if len(next) != l.shardCount {
+		msg := fmt.Sprintf("follower has %d shards, leader has %d", len(next), l.shardCount)
+		writeReplicationError(writer, msg)
+		writer.Flush()
+		return errors.New(msg)
+	}
+	slot, err := l.openSlot(name, next)
+	if err != nil {
+		writeReplicationError(writer, err.Error())
+		writer.Flush()
+		return err
+	}
+	defer l.closeSlot(name, slot)
+	session := replicationMAC(l.secret, []byte(replicationSessionRole), followerNonce, nonce)
+	acks := make(chan error, 1)
+	go func() {
+		acks <- l.readAcks(reader, session, slot)
+	}()
+	defer func() {
+		conn.Close()
+		<-acks
+	}()
+	l.logger.Info("ReplicationLeader: follower connected", zap.String("follower", name), zap.String("addr", conn.RemoteAddr().String()))
+
+	lastSent := time.Now()
+	for {
+		files, err := l.pendingFiles(next)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if next[f.shardIndex] > 0 && f.walIndex > next[f.shardIndex] {
+				// the files before have been deleted before the follower got them
+				writeReplicationMissing(writer, uint32(f.shardIndex), next[f.shardIndex])
+				writer.Flush()
+				return fmt.Errorf("%w: follower %s, shard %d wal index %d", ErrMissingWalFile, name, f.shardIndex, next[f.shardIndex])
+			}
+			content, err := ioutil.ReadFile(f.path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := writeReplicationFile(writer, session, f, content); err != nil {
+				return err
+			}
+			next[f.shardIndex] = f.walIndex + 1
+		}
+		if len(files) == 0 && time.Since(lastSent) >= replicationHeartbeatInterval {
+			if err := writer.WriteByte(replicationFrameHeartbeat); err != nil {
+				return err
+			}
+		}
+		if writer.Buffered() > 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			lastSent = time.Now()
+		}
+
+		select {
+		case <-l.stop:
+			return nil
+		case err := <-acks:
+			acks <- err
+			return err
+		case <-time.After(replicationPollInterval):
+		}
+	}
+}
+
+// openSlot open the slot of a follower, created at its first connection, with the positions of its hello
+func (l *ReplicationLeader) openSlot(name string, next []uint64) (*walPositions, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.followers[name] {
+		return nil, fmt.Errorf("follower %s is already connected", name)
+	}
+	slot, err := openWalPositions(replicationSlotPath(l.walArchiveFolder, name), l.shardCount)
+	if err != nil {
+		return nil, err
+	}
+	for shardIndex, walIndex := range next {
+		if err := slot.set(uint64(shardIndex), walIndex); err != nil {
+			slot.close()
+			return nil, err
+		}
+	}
+	l.followers[name] = true
+	return slot, nil
+}
+
+func (l *ReplicationLeader) closeSlot(name string, slot *walPositions) {
+	slot.close()
+	l.mutex.Lock()
+	delete(l.followers, name)
+	l.mutex.Unlock()
+}
+
+// readAcks save in the slot the wal files acknowledged by the follower until the connection is closed
+func (l *ReplicationLeader) readAcks(reader *bufio.Reader, session []byte, slot *walPositions) error {
+	for {
+		shardIndex, next, err := readReplicationAck(reader, session)
+		if err != nil {
+			return err
+		}
+		if int(shardIndex) >= l.shardCount {
+			return fmt.Errorf("%w: shard %d out of range", ErrReplicationProtocol, shardIndex)
+		}
+		if err := slot.set(uint64(shardIndex), next); err != nil {
+			return err
+		}
+	}
+}
+
+// pendingFiles archived wal files a follower does not have yet, ordered by wal index
+func (l *ReplicationLeader) pendingFiles(next []uint64) ([]archivedWalFile, error) {
+	paths, err := ArchivedWALFiles(l.walArchiveFolder)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]archivedWalFile, 0)
+	for _, p := range paths {
+		f, ok := l.fileHeader(p)
+		if !ok || f.shardIndex >= uint64(len(next)) || f.walIndex < next[f.shardIndex] {
+			continue
+		}
+		res = append(res, f)
+	}
+	l.evictHeaders(paths)
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].walIndex != res[j].walIndex {
+			return res[i].walIndex < res[j].walIndex
+		}
+		return res[i].shardIndex < res[j].shardIndex
+	})
+	return res, nil
+}
+
+// evictHeaders forget the headers of the files deleted from the folder
+func (l *ReplicationLeader) evictHeaders(paths []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	exists := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		exists[p] = true
+	}
+	for p := range l.headers {
+		if !exists[p] {
+			delete(l.headers, p)
+		}
+	}
+}
+
+func (l *ReplicationLeader) fileHeader(p string) (archivedWalFile, bool) {
+	l.mutex.Lock()
+	f, exists := l.headers[p]
+	l.mutex.Unlock()
+	if exists {
+		return f, true
+	}
+
+	f, err := readArchivedWalFileHeader(p)
+	if err != nil {
+		if err != io.ErrUnexpectedEOF && !os.IsNotExist(err) {
+			l.logger.Error("ReplicationLeader: could not read wal file header", zap.String("path", p), zap.Error(err))
+		}
+		return f, false
+	}
+	l.mutex.Lock()
+	l.headers[p] = f
+	l.mutex.Unlock()
+	return f, true
+}
+
+// ReplicationFollower receive the archived wal files of a leader and replay them
+// in ReplicationActiveFolder and ReplicationArchiveFolder with the same semantics as File.ColdReplay.
+// The next wal index wanted per shard is saved in WALFolder to resume after a disconnect or a restart.
+// A follower missing wal files no longer retained by the leader stops: it must be resynced by copying
+// a snapshot of the leader in its folders and removing its state file.
+type ReplicationFollower struct {
+	leaderAddr    string
+	name          string
+	secret        []byte
+	activeFolder  string
+	archiveFolder string
+	walFolder     string
+	storage       storage.Storage
+	layout        config.Layout
+	keys          crypt.KeyProvider
+	logger        *zap.Logger
+
+	shardCount int
+	mutex      sync.Mutex
+	positions  *walPositions
+	conn       net.Conn
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// InitReplicationFollower init a follower of conf.ReplicationFollowOf
+func InitReplicationFollower(conf config.Config, logger *zap.Logger) (*ReplicationFollower, error) {
+	if conf.ReplicationFollowOf == "" {
+		return nil, fmt.Errorf("replication follower needs the leader address")
+	}
+	if conf.ReplicationActiveFolder == "" {
+		return nil, fmt.Errorf("replication follower needs a replication active folder")
+	}
+	name := conf.ReplicationFollowerName
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		name = hostname
+	}
+	if err := checkReplicationFollowerName(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(conf.WALFolder, 0744); err != nil {
+		return nil, err
+	}
+	positions, err := openWalPositions(path.Join(conf.WALFolder, replicationFollowerStateFilename), conf.ShardCount)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplicationFollower{
+		leaderAddr:    conf.ReplicationFollowOf,
+		name:          name,
+		secret:        []byte(conf.ReplicationSecret),
+		activeFolder:  conf.ReplicationActiveFolder,
+		archiveFolder: conf.ReplicationArchiveFolder,
+		walFolder:     conf.WALFolder,
+		storage:       conf.GetStorage(),
+		layout:        conf.GetLayout(),
+		keys:          conf.KeyProvider,
+		logger:        logger,
+		shardCount:    conf.ShardCount,
+		positions:     positions,
+		stop:          make(chan struct{}),
+	}, nil
+}
+
+// Position next wal index wanted for the shard
+func (f *ReplicationFollower) Position(shardIndex int) uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.positions.get(uint64(shardIndex))
+}
+
+// Start follow the leader in background, reconnecting after a failure
+func (f *ReplicationFollower) Start() {
+	f.wg.Add(1)
+	go f.loop()
+}
+
+// Stop disconnect from the leader and wait for the wal file being applied
+func (f *ReplicationFollower) Stop() error {
+	close(f.stop)
+	f.mutex.Lock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mutex.Unlock()
+	f.wg.Wait()
+	return f.positions.close()
+}
+
+func (f *ReplicationFollower) stopped() bool {
+	select {
+	case <-f.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *ReplicationFollower) loop() {
+	defer f.wg.Done()
+	for !f.stopped() {
+		err := f.follow()
+		if f.stopped() {
+			break
+		}
+		if errors.Is(err, ErrMissingWalFile) {
+			f.logger.Error("ReplicationFollower: wal files are missing, resync the follower from a snapshot", zap.String("leader", f.leaderAddr), zap.Error(err))
+			break
+		}
+		f.logger.Info("ReplicationFollower: connection to leader lost, retry", zap.String("leader", f.leaderAddr), zap.Error(err))
+		select {
+		case <-f.stop:
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+	f.logger.Info("ReplicationFollower: stop")
+}
+
+func (f *ReplicationFollower) follow() error {
+	conn, err := net.DialTimeout("tcp", f.leaderAddr, replicationReadTimeout)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	if f.stopped() {
+		f.mutex.Unlock()
+		conn.Close()
+		return nil
+	}
+	f.conn = conn
+	next := make([]uint64, f.shardCount)
+	for i := range next {
+		next[i] = f.positions.get(uint64(i))
+	}
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.conn = nil
+		f.mutex.Unlock()
+		conn.Close()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(replicationReadTimeout))
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	nonce, err := replicationNonce()
+	if err != nil {
+		return err
+	}
+	if err := writeReplicationGreeting(writer, nonce, nil); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	leaderNonce, mac, err := readReplicationGreeting(reader, true)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, replicationMAC(f.secret, []byte(replicationLeaderRole), nonce)) {
+		return fmt.Errorf("%w: leader %s", ErrReplicationAuth, f.leaderAddr)
+	}
+	if err := writeReplicationHello(writer, f.secret, leaderNonce, f.name, next); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	session := replicationMAC(f.secret, []byte(replicationSessionRole), nonce, leaderNonce)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationReadTimeout))
+		frameType, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch frameType {
+		case replicationFrameHeartbeat:
+		case replicationFrameError:
+			msg, err := readReplicationString(reader)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("leader error: %s", msg)
+		case replicationFrameMissing:
+			var b [12]byte
+			if _, err := io.ReadFull(reader, b[:]); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: shard %d wal index %d is no longer retained by the leader", ErrMissingWalFile, binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint64(b[4:12]))
+		case replicationFrameFile:
+			shardIndex, walIndex, content, err := readReplicationFile(reader, session)
+			if err != nil {
+				return err
+			}
+			if err := f.apply(shardIndex, walIndex, content); err != nil {
+				return err
+			}
+			if err := writeReplicationAck(writer, session, shardIndex, f.Position(int(shardIndex))); err != nil {
+				return err
+			}
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown frame type %d", ErrReplicationProtocol, frameType)
+		}
+	}
+}
+
+// apply replay a wal file received from the leader and save the new position. The wal index must follow
+// the last applied one, any wal index is accepted for the first file of a shard. On error the position
+// is kept: the file is sent again after the reconnection.
+func (f *ReplicationFollower) apply(shardIndex uint32, walIndex uint64, content []byte) error {
+	if int(shardIndex) >= f.shardCount {
+		return fmt.Errorf("%w: shard %d out of range", ErrReplicationProtocol, shardIndex)
+	}
+	position := f.Position(int(shardIndex))
+	if walIndex < position {
+		return nil
+	}
+	if position > 0 && walIndex != position {
+		return fmt.Errorf("%w: shard %d wal index %d, received %d", ErrMissingWalFile, shardIndex, position, walIndex)
+	}
+
+	tmpPath := path.Join(f.walFolder, fmt.Sprintf("replication-%05d.tmp", shardIndex))
+	if err := ioutil.WriteFile(tmpPath, content, 0744); err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	walFile, err := ReadFileFromPath(tmpPath, f.keys)
+	if err != nil {
+		return err
+	}
+	if walFile.shardIndex != uint64(shardIndex) || walFile.walIndex != walIndex {
+		return fmt.Errorf("%w: wal file header does not match shard %d wal index %d", ErrReplicationProtocol, shardIndex, walIndex)
+	}
+
+	errs := walFile.ColdReplayOn(f.storage, f.layout, f.activeFolder, f.archiveFolder)
+	if errs.Err() != nil {
+		return fmt.Errorf("cold replay of shard %d wal index %d: %w", shardIndex, walIndex, errs.Err())
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.positions.set(uint64(shardIndex), walIndex+1)
+}
+
+func replicationNonce() ([]byte, error) {
+	nonce := make([]byte, replicationNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// replicationMAC HMAC-SHA256 of the parts keyed by key
+func replicationMAC(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// writeReplicationGreeting write the first message of a side, mac is nil for the follower
+func writeReplicationGreeting(writer *bufio.Writer, nonce []byte, mac []byte) error {
+	if _, err := writer.Write(replicationMagic[:]); err != nil {
+		return err
+	}
+	if err := writer.WriteByte(replicationProtocolVersion); err != nil {
+		return err
+	}
+	if _, err := writer.Write(nonce); err != nil {
+		return err
+	}
+	_, err := writer.Write(mac)
+	return err
+}
+
+func readReplicationGreeting(reader *bufio.Reader, withMAC bool) (nonce []byte, mac []byte, err error) {
+	var head [5]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return nil, nil, err
+	}
+	if string(head[:4]) != string(replicationMagic[:]) {
+		return nil, nil, ErrReplicationProtocol
+	}
+	if head[4] != replicationProtocolVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrReplicationProtocol, head[4])
+	}
+	size := replicationNonceSize
+	if withMAC {
+		size += replicationMACSize
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return nil, nil, err
+	}
+	return content[:replicationNonceSize], content[replicationNonceSize:], nil
+}
+
+func writeReplicationHello(writer *bufio.Writer, secret []byte, leaderNonce []byte, name string, next []uint64) error {
+	hello := make([]byte, 2+len(name)+4+8*len(next))
+	binary.BigEndian.PutUint16(hello, uint16(len(name)))
+	copy(hello[2:], name)
+	offset := 2 + len(name)
+	binary.BigEndian.PutUint32(hello[offset:], uint32(len(next)))
+	for i, walIndex := range next {
+		binary.BigEndian.PutUint64(hello[offset+4+8*i:], walIndex)
+	}
+	if _, err := writer.Write(hello); err != nil {
+		return err
+	}
+	_, err := writer.Write(replicationMAC(secret, []byte(replicationFollowerRole), leaderNonce, hello))
+	return err
+}
+
+func readReplicationHello(reader *bufio.Reader, secret []byte, leaderNonce []byte) (string, []uint64, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(reader, b[:2]); err != nil {
+		return "", nil, err
+	}
+	nameLen := int(binary.BigEndian.Uint16(b[:2]))
+	if nameLen > maxReplicationNameLen {
+		return "", nil, fmt.Errorf("%w: follower name too long %d", ErrReplicationProtocol, nameLen)
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(reader, name); err != nil {
+		return "", nil, err
+	}
+	if _, err := io.ReadFull(reader, b[:]); err != nil {
+		return "", nil, err
+	}
+	shardCount := binary.BigEndian.Uint32(b[:])
+	if shardCount > 1<<16 {
+		return "", nil, fmt.Errorf("%w: too many shards %d", ErrReplicationProtocol, shardCount)
+	}
+	hello := make([]byte, 2+nameLen+4+8*int(shardCount))
+	binary.BigEndian.PutUint16(hello, uint16(nameLen))
+	copy(hello[2:], name)
+	copy(hello[2+nameLen:], b[:])
+	if _, err := io.ReadFull(reader, hello[2+nameLen+4:]); err != nil {
+		return "", nil, err
+	}
+	mac := make([]byte, replicationMACSize)
+	if _, err := io.ReadFull(reader, mac); err != nil {
+		return "", nil, err
+	}
+	if !hmac.Equal(mac, replicationMAC(secret, []byte(replicationFollowerRole), leaderNonce, hello)) {
+		return "", nil, ErrReplicationAuth
+	}
+	if err := checkReplicationFollowerName(string(name)); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrReplicationProtocol, err)
+	}
+	next := make([]uint64, shardCount)
+	for i := range next {
+		next[i] = binary.BigEndian.Uint64(hello[2+nameLen+4+8*i:])
+	}
+	return string(name), next, nil
+}
+
+func writeReplicationFile(writer *bufio.Writer, session []byte, f archivedWalFile, content []byte) error {
+	var head [21]byte
+	head[0] = replicationFrameFile
+	binary.BigEndian.PutUint32(head[1:5], uint32(f.shardIndex))
+	binary.BigEndian.PutUint64(head[5:13], f.walIndex)
+	binary.BigEndian.PutUint64(head[13:21], uint64(len(content)))
+	if _, err := writer.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(content); err != nil {
+		return err
+	}
+	_, err := writer.Write(replicationMAC(session, head[1:], content))
+	return err
+}
+
+func readReplicationFile(reader *bufio.Reader, session []byte) (uint32, uint64, []byte, error) {
+	var head [20]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	shardIndex := binary.BigEndian.Uint32(head[0:4])
+	walIndex := binary.BigEndian.Uint64(head[4:12])
+	size := binary.BigEndian.Uint64(head[12:20])
+	if size > replicationMaxFileSize {
+		return 0, 0, nil, fmt.Errorf("%w: wal file too big %d", ErrReplicationProtocol, size)
+	}
+	content := make([]byte, size+replicationMACSize)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return 0, 0, nil, err
+	}
+	mac := content[size:]
+	content = content[:size]
+	if !hmac.Equal(mac, replicationMAC(session, head[:], content)) {
+		return 0, 0, nil, fmt.Errorf("%w: bad mac for shard %d wal index %d", ErrReplicationProtocol, shardIndex, walIndex)
+	}
+	return shardIndex, walIndex, content, nil
+}
+
+func writeReplicationAck(writer *bufio.Writer, session []byte, shardIndex uint32, next uint64) error {
+	var ack [12]byte
+	binary.BigEndian.PutUint32(ack[0:4], shardIndex)
+	binary.BigEndian.PutUint64(ack[4:12], next)
+	if _, err := writer.Write(ack[:]); err != nil {
+		return err
+	}
+	_, err := writer.Write(replicationMAC(session, ack[:]))
+	return err
+}
+
+func readReplicationAck(reader *bufio.Reader, session []byte) (uint32, uint64, error) {
+	var ack [12 + replicationMACSize]byte
+	if _, err := io.ReadFull(reader, ack[:]); err != nil {
+		return 0, 0, err
+	}
+	if !hmac.Equal(ack[12:], replicationMAC(session, ack[:12])) {
+		return 0, 0, fmt.Errorf("%w: bad mac of ack", ErrReplicationProtocol)
+	}
+	return binary.BigEndian.Uint32(ack[0:4]), binary.BigEndian.Uint64(ack[4:12]), nil
+}
+
+func writeReplicationMissing(writer *bufio.Writer, shardIndex uint32, walIndex uint64) error {
+	var frame [13]byte
+	frame[0] = replicationFrameMissing
+	binary.BigEndian.PutUint32(frame[1:5], shardIndex)
+	binary.BigEndian.PutUint64(frame[5:13], walIndex)
+	_, err := writer.Write(frame[:])
+	return err
+}
+
+func writeReplicationError(writer *bufio.Writer, msg string) error {
+	if err := writer.WriteByte(replicationFrameError); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(msg)))
+	if _, err := writer.Write(b[:]); err != nil {
+		return err
+	}
+	_, err := writer.WriteString(msg)
+	return err
+}
+
+func readReplicationString(reader *bufio.Reader) (string, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(reader, b[:]); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(b[:])
+	if size > 1<<16 {
+		return "", ErrReplicationProtocol
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
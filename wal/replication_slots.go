@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	replicationSlotPrefix = "replication-slot-"
+	replicationSlotSuffix = ".bin"
+	maxReplicationNameLen = 64
+)
+
+// ReplicationSlot next wal index per shard applied by a replication follower, saved by the leader in
+// the wal archive folder. The archived wal files from these indexes are kept for the follower.
+type ReplicationSlot struct {
+	Name string
+	Next []uint64
+}
+
+func replicationSlotPath(walArchiveFolder, name string) string {
+	return path.Join(walArchiveFolder, replicationSlotPrefix+name+replicationSlotSuffix)
+}
+
+// checkReplicationFollowerName a follower name is used in a file name: letters, digits, '.', '_'
+// and '-' only, not starting with '.'
+func checkReplicationFollowerName(name string) error {
+	if name == "" || len(name) > maxReplicationNameLen || name[0] == '.' {
+		return fmt.Errorf("bad replication follower name %q", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return fmt.Errorf("bad replication follower name %q", name)
+		}
+	}
+	return nil
+}
+
+// ReplicationSlots slots of the followers of the wal archive folder, ordered by name
+func ReplicationSlots(walArchiveFolder string) ([]ReplicationSlot, error) {
+	files, err := ioutil.ReadDir(walArchiveFolder)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ReplicationSlot, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, replicationSlotPrefix) || !strings.HasSuffix(name, replicationSlotSuffix) {
+			continue
+		}
+		positions, err := openWalPositions(path.Join(walArchiveFolder, name), 0)
+		if err != nil {
+			return res, err
+		}
+		positions.close()
+		res = append(res, ReplicationSlot{
+			Name: strings.TrimSuffix(strings.TrimPrefix(name, replicationSlotPrefix), replicationSlotSuffix),
+			Next: positions.next,
+		})
+	}
+	return res, nil
+}
+
+// DropReplicationSlot forget a follower no longer used: the wal files are no longer kept for it. It
+// must be resynced from a snapshot to follow again.
+func DropReplicationSlot(walArchiveFolder, name string) error {
+	if err := checkReplicationFollowerName(name); err != nil {
+		return err
+	}
+	return os.Remove(replicationSlotPath(walArchiveFolder, name))
+}
+
+// holdForReplicationSlots lower the next wal index per shard of positions to the ones of the slots
+func holdForReplicationSlots(positions map[uint64]uint64, slots []ReplicationSlot) {
+	for shardIndex, next := range positions {
+		for _, slot := range slots {
+			slotNext := uint64(0)
+			if shardIndex < uint64(len(slot.Next)) {
+				slotNext = slot.Next[shardIndex]
+			}
+			if slotNext < next {
+				next = slotNext
+			}
+		}
+		positions[shardIndex] = next
+	}
+}
@@ -0,0 +1,294 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestReplicationLeaderFollower(t *testing.T) {
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
+	logger := zap.New(core).WithOptions()
+
+	conf := config.InitDefaultTestConfig()
+	conf.ReplicationSecret = "secret"
+
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	appendAndFlush := func(b ...byte) {
+		shardWal.LockShardIndex(si)
+		err := shardWal.GetWalForShardIndex(si).AppendWrite(cf, b)
+		shardWal.UnlockShardIndex(si)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := shardWal.FlushShardIndex(si); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	leader := InitReplicationLeader(*conf, logger)
+	if err := leader.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer leader.Close()
+
+	followerConf := *conf
+	followerConf.WALFolder = "data-test/follower"
+	followerConf.ReplicationActiveFolder = "data-test/follower/active"
+	followerConf.ReplicationArchiveFolder = "data-test/follower/archive"
+	followerConf.ReplicationFollowOf = leader.Addr().String()
+
+	waitContent := func(expected []byte) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			content, _ := ioutil.ReadFile(cf.PathToFileFromFolder(followerConf.ReplicationActiveFolder))
+			// the replayed file starts with the header of the atomic operations
+			if bytes.HasSuffix(content, expected) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("follower content %v, expected %v", content, expected)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	appendAndFlush(1, 2, 3)
+
+	follower, err := InitReplicationFollower(followerConf, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	follower.Start()
+	waitContent([]byte{1, 2, 3})
+	position := follower.Position(int(si))
+	if position == 0 {
+		t.Fatalf("position should have moved")
+	}
+	if err := follower.Stop(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// written while the follower is disconnected
+	appendAndFlush(4, 5)
+	appendAndFlush(6)
+
+	follower, err = InitReplicationFollower(followerConf, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if follower.Position(int(si)) != position {
+		t.Fatalf("position should be restored: %d, expected %d", follower.Position(int(si)), position)
+	}
+	follower.Start()
+	waitContent([]byte{1, 2, 3, 4, 5, 6})
+	if follower.Position(int(si)) != position+2 {
+		t.Fatalf("position should be %d but get %d", position+2, follower.Position(int(si)))
+	}
+	if err := follower.Stop(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	errors := shardWal.CloseAll()
+	if errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+}
+
+func TestReplicationShardCountMismatch(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+	os.MkdirAll(conf.WalArchiveFolder, 0744)
+
+	leader := InitReplicationLeader(*conf, logger)
+	if err := leader.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer leader.Close()
+
+	followerConf := *conf
+	followerConf.ShardCount = conf.ShardCount + 1
+	followerConf.WALFolder = "data-test/follower"
+	followerConf.ReplicationActiveFolder = "data-test/follower/active"
+	followerConf.ReplicationFollowOf = leader.Addr().String()
+	follower, err := InitReplicationFollower(followerConf, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer follower.Stop()
+	if err := follower.follow(); err == nil {
+		t.Fatalf("follower with another shard count should be rejected")
+	}
+}
+
+func TestReplicationFollowerApply(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	writeArchivedWalFiles(t, conf, cf, []byte{1}, []byte{2}, []byte{3})
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 3 {
+		t.Fatalf("should have 3 archived wal files: %v %v", paths, err)
+	}
+	contents := make([][]byte, len(paths))
+	for i, p := range paths {
+		if contents[i], err = ioutil.ReadFile(p); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	followerConf := *conf
+	followerConf.WALFolder = "data-test/follower"
+	followerConf.ReplicationActiveFolder = "data-test/follower/active"
+	followerConf.ReplicationFollowOf = "127.0.0.1:0"
+	follower, err := InitReplicationFollower(followerConf, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer follower.Stop()
+
+	if err := follower.apply(si, 1, contents[0]); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := follower.apply(si, 3, contents[2]); !errors.Is(err, ErrMissingWalFile) {
+		t.Fatalf("a wal index gap should be rejected: %v", err)
+	}
+	if follower.Position(int(si)) != 2 {
+		t.Fatalf("position should stay 2 but get %d", follower.Position(int(si)))
+	}
+
+	// the replay fails: the active folder can not be created
+	os.RemoveAll(followerConf.ReplicationActiveFolder)
+	ioutil.WriteFile(followerConf.ReplicationActiveFolder, []byte{0}, 0744)
+	if err := follower.apply(si, 2, contents[1]); err == nil {
+		t.Fatalf("a failed replay should be returned")
+	}
+	if follower.Position(int(si)) != 2 {
+		t.Fatalf("position should stay 2 after a failed replay but get %d", follower.Position(int(si)))
+	}
+
+	// the same file is applied again
+	os.Remove(followerConf.ReplicationActiveFolder)
+	for i := 1; i < len(contents); i++ {
+		if err := follower.apply(si, uint64(i+1), contents[i]); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	content, _ := ioutil.ReadFile(cf.PathToFileFromFolder(followerConf.ReplicationActiveFolder))
+	if !bytes.HasSuffix(content, []byte{2, 3}) {
+		t.Fatalf("bad follower content %v", content)
+	}
+}
+
+func TestReplicationAuthentication(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+	conf.ReplicationSecret = "leader secret"
+
+	os.RemoveAll("data-test")
+	os.MkdirAll(conf.WalArchiveFolder, 0744)
+
+	leader := InitReplicationLeader(*conf, logger)
+	if err := leader.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer leader.Close()
+
+	followerConf := *conf
+	followerConf.ReplicationSecret = "another secret"
+	followerConf.ReplicationFollowerName = "f1"
+	followerConf.WALFolder = "data-test/follower"
+	followerConf.ReplicationActiveFolder = "data-test/follower/active"
+	followerConf.ReplicationFollowOf = leader.Addr().String()
+	follower, err := InitReplicationFollower(followerConf, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer follower.Stop()
+	if err := follower.follow(); !errors.Is(err, ErrReplicationAuth) {
+		t.Fatalf("a follower without the secret should be rejected: %v", err)
+	}
+	if slots, err := ReplicationSlots(conf.WalArchiveFolder); err != nil || len(slots) != 0 {
+		t.Fatalf("a rejected follower should have no slot: %v %v", slots, err)
+	}
+}
+
+func TestReplicationMissingWalFile(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	writeArchivedWalFiles(t, conf, cf, []byte{1}, []byte{2}, []byte{3})
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 3 {
+		t.Fatalf("should have 3 archived wal files: %v %v", paths, err)
+	}
+	content, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	leader := InitReplicationLeader(*conf, logger)
+	if err := leader.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer leader.Close()
+
+	followerConf := *conf
+	followerConf.ReplicationFollowerName = "f1"
+	followerConf.WALFolder = "data-test/follower"
+	followerConf.ReplicationActiveFolder = "data-test/follower/active"
+	followerConf.ReplicationFollowOf = leader.Addr().String()
+	follower, err := InitReplicationFollower(followerConf, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer follower.Stop()
+	if err := follower.apply(si, 1, content); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the wal index 2 is deleted before the follower got it
+	if err := os.Remove(paths[1]); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := follower.follow(); !errors.Is(err, ErrMissingWalFile) {
+		t.Fatalf("the leader should report the missing wal file: %v", err)
+	}
+	slots, err := ReplicationSlots(conf.WalArchiveFolder)
+	if err != nil || len(slots) != 1 || slots[0].Name != "f1" || slots[0].Next[si] != 2 {
+		t.Fatalf("the slot should hold the position of the follower: %v %v", slots, err)
+	}
+}
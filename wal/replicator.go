@@ -8,6 +8,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
 	"go.uber.org/zap"
 )
 
@@ -23,8 +26,21 @@ type Replicator struct {
 	wg               *sync.WaitGroup
 	end              bool
 	archiveCmd       string // if archiveCmd is empty: no archive cmd is launched
+	// retention the wal files are kept this duration after being processed, if positions is not nil
+	retention time.Duration
+	// positions next wal index to process per shard, per wal archive folder. If nil the wal files are
+	// deleted once processed.
+	positions map[string]*walPositions
+	// storage of the replicated files
+	storage storage.Storage
+	// keys of the encrypted wal files
+	keys crypt.KeyProvider
+	// layout of the replicated files, the default one if nil
+	layout config.Layout
 }
 
+const replicatorPositionsFilename = "replicator-state.bin"
+
 // InitReplicator init a replicator
 func InitReplicator(archiveEventChans []chan string, activeFolder, archiveFolder string, archiveCmd string, logger *zap.Logger) *Replicator {
 	var archiveEventChan chan string = mergeStringChans(archiveEventChans, 1000000)
@@ -35,6 +51,7 @@ func InitReplicator(archiveEventChans []chan string, activeFolder, archiveFolder
 		logger:           logger,
 		wg:               &sync.WaitGroup{},
 		archiveCmd:       archiveCmd,
+		storage:          storage.Local{},
 	}
 }
 
@@ -49,9 +66,34 @@ func InitReplicatorWithOneFile(path string, activeFolder, archiveFolder string,
 		logger:           logger,
 		wg:               &sync.WaitGroup{},
 		archiveCmd:       archiveCmd,
+		storage:          storage.Local{},
 	}
 }
 
+// SetRetention keep the wal files for retention after processing them, and until the replication
+// followers of the ReplicationSlots have applied them. A zero retention keeps them for the followers
+// only. The processed wal indexes are saved in the wal archive folder so kept files are not processed
+// again after a restart.
+func (r *Replicator) SetRetention(retention time.Duration) {
+	r.retention = retention
+	r.positions = make(map[string]*walPositions)
+}
+
+// SetStorage replicate the files to store instead of the local disk
+func (r *Replicator) SetStorage(store storage.Storage) {
+	r.storage = store
+}
+
+// SetKeyProvider read the encrypted wal files with the keys of keys
+func (r *Replicator) SetKeyProvider(keys crypt.KeyProvider) {
+	r.keys = keys
+}
+
+// SetLayout replicate the files in layout instead of the default one
+func (r *Replicator) SetLayout(layout config.Layout) {
+	r.layout = layout
+}
+
 func (r *Replicator) replicationActivated() bool {
 	return r.activeFolder != ""
 }
@@ -63,15 +105,26 @@ func (r *Replicator) archiveCmdActivated() bool {
 // Execute synchronously the replicator
 func (r *Replicator) Execute() error {
 	for archiveWalFilePath := range r.archiveEventChan {
-		walFile, err := ReadFileFromPath(archiveWalFilePath)
+		walFile, err := ReadFileFromPath(archiveWalFilePath, r.keys)
+		if err != nil {
+			return err
+		}
+		processed, err := r.alreadyProcessed(archiveWalFilePath, walFile)
 		if err != nil {
 			return err
 		}
+		if processed {
+			continue
+		}
 		err = r.coldReplay(archiveWalFilePath, walFile)
 		if err != nil {
 			return err
 		}
+		if err := r.processed(archiveWalFilePath, walFile); err != nil {
+			return err
+		}
 	}
+	r.closePositions()
 	return nil
 }
 
@@ -86,18 +139,35 @@ func (r *Replicator) Start() {
 func (r *Replicator) Stop() {
 	r.end = true
 	r.wg.Wait()
+	r.closePositions()
 	backgroundReplicatorStarted = false
 }
 
 func (r *Replicator) loop() {
 	defer r.wg.Done()
 	for archiveWalFilePath := range r.archiveEventChan {
-		if r.replicationActivated() {
-			walFile, err := ReadFileFromPath(archiveWalFilePath)
+		replicatorQueueMetric.Set(float64(len(r.archiveEventChan)))
+		if st, err := os.Stat(archiveWalFilePath); err == nil {
+			replicatorLagMetric.Set(time.Since(st.ModTime()).Seconds())
+		}
+		var walFile *File
+		if r.replicationActivated() || r.positions != nil {
+			var err error
+			walFile, err = ReadFileFromPath(archiveWalFilePath, r.keys)
 			if err != nil {
 				r.logger.Error("Replicator: could not read wal file", zap.String("archive path", archiveWalFilePath), zap.Error(err))
 				return
 			}
+		}
+		processed, err := r.alreadyProcessed(archiveWalFilePath, walFile)
+		if err != nil {
+			r.logger.Error("Replicator: could not read positions", zap.String("archive path", archiveWalFilePath), zap.Error(err))
+			return
+		}
+		if processed {
+			continue
+		}
+		if r.replicationActivated() {
 			var retryCount = 0
 			for retryCount < 3 {
 				err := r.coldReplay(archiveWalFilePath, walFile)
@@ -127,6 +197,10 @@ func (r *Replicator) loop() {
 				retryCount++
 			}
 		}
+		if err := r.processed(archiveWalFilePath, walFile); err != nil {
+			r.logger.Error("Replicator: could not save positions", zap.String("archive path", archiveWalFilePath), zap.Error(err))
+			return
+		}
 		if r.end {
 			r.logger.Info("Replicator: stop due to end")
 			return
@@ -136,12 +210,15 @@ func (r *Replicator) loop() {
 }
 
 func (r *Replicator) coldReplay(archiveWalFilePath string, walFile *File) error {
-	errors := walFile.ColdReplay(r.activeFolder, r.archiveFolder)
+	errors := walFile.ColdReplayOn(r.storage, r.layout, r.activeFolder, r.archiveFolder)
 	if errors.Err() != nil {
 
 		r.logger.Error("Replicator: fail cold replay", zap.String("archive-path", archiveWalFilePath), zap.Error(errors.Err()))
 	}
 
+	if r.positions != nil {
+		return nil
+	}
 	err := os.Remove(archiveWalFilePath)
 	if err != nil {
 		r.logger.Info("Replicator: fail delete wal file", zap.String("archive-path", archiveWalFilePath))
@@ -151,6 +228,67 @@ func (r *Replicator) coldReplay(archiveWalFilePath string, walFile *File) error
 	return nil
 }
 
+func (r *Replicator) folderPositions(archiveWalFilePath string) (*walPositions, error) {
+	folder := path.Dir(archiveWalFilePath)
+	if positions, exists := r.positions[folder]; exists {
+		return positions, nil
+	}
+	positions, err := openWalPositions(path.Join(folder, replicatorPositionsFilename), 0)
+	if err != nil {
+		return nil, err
+	}
+	r.positions[folder] = positions
+	return positions, nil
+}
+
+func (r *Replicator) closePositions() {
+	for folder, positions := range r.positions {
+		positions.close()
+		delete(r.positions, folder)
+	}
+}
+
+// alreadyProcessed the kept wal file has been processed before a restart
+func (r *Replicator) alreadyProcessed(archiveWalFilePath string, walFile *File) (bool, error) {
+	if r.positions == nil {
+		return false, nil
+	}
+	positions, err := r.folderPositions(archiveWalFilePath)
+	if err != nil {
+		return false, err
+	}
+	return walFile.walIndex < positions.get(walFile.shardIndex), nil
+}
+
+// processed save the position of the kept wal file and delete the files out of the retention and
+// applied by the replication followers
+func (r *Replicator) processed(archiveWalFilePath string, walFile *File) error {
+	if r.positions == nil {
+		return nil
+	}
+	positions, err := r.folderPositions(archiveWalFilePath)
+	if err != nil {
+		return err
+	}
+	if err := positions.set(walFile.shardIndex, walFile.walIndex+1); err != nil {
+		return err
+	}
+	next := make(map[uint64]uint64, len(positions.next))
+	for shardIndex, walIndex := range positions.next {
+		next[uint64(shardIndex)] = walIndex
+	}
+	slots, err := ReplicationSlots(path.Dir(archiveWalFilePath))
+	if err != nil {
+		return err
+	}
+	holdForReplicationSlots(next, slots)
+	deleted, err := PruneArchivedWALFiles(path.Dir(archiveWalFilePath), r.retention, next)
+	for _, p := range deleted {
+		r.logger.Info("Replicator: wal file out of retention deleted", zap.String("archive-path", p))
+	}
+	return err
+}
+
 func mergeStringChans(cs []chan string, lenChan int) chan string {
 	out := make(chan string, lenChan)
 	var wg sync.WaitGroup
@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -27,6 +28,8 @@ func TestReplication(t *testing.T) {
 	conf.ReplicationActiveFolder = "data-test/rep-active"
 	conf.ReplicationArchiveFolder = "data-test/rep-archive"
 	conf.ArchiveCommand = "echo \"%f %p\" > data-test/rsyn-test.txt"
+	// the replicator reads the compressed commands
+	conf.WALCompression = config.WALCompressionSnappy
 
 	os.RemoveAll("data-test")
 
@@ -43,8 +46,8 @@ func TestReplication(t *testing.T) {
 	si := cf.ShardIndex(uint32(conf.ShardCount))
 	shardWal.LockShardIndex(si)
 	wal := shardWal.GetWalForShardIndex(si)
-	buf := [3]byte{1, 2, 3}
-	wal.AppendWrite(cf, buf[:])
+	buf := bytes.Repeat([]byte{1, 2, 3}, 1000)
+	wal.AppendWrite(cf, buf)
 	shardWal.UnlockShardIndex(si)
 
 	errors := shardWal.CloseAll()
@@ -59,8 +62,8 @@ func TestReplication(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 
-	if contentB[len(contentB)-3] != 1 || contentB[len(contentB)-2] != 2 || contentB[len(contentB)-1] != 3 {
-		t.Fatalf("%v", err)
+	if !bytes.HasSuffix(contentB, buf) {
+		t.Fatalf("replicated file should end with the written data")
 	}
 }
 
@@ -163,3 +166,79 @@ func TestRsyncCmd(t *testing.T) {
 		t.Fatalf("'%s' expected '%s'", content, expectedContent)
 	}
 }
+
+func TestReplicationLayout(t *testing.T) {
+	conf := config.InitDefaultTestConfig()
+	conf.ReplicationActiveFolder = "data-test/rep-active"
+	conf.ReplicationArchiveFolder = "data-test/rep-archive"
+	conf.Layout = "hashed:2x2"
+
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(*conf, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	rep := InitReplicator(shardWal.GetArchiveEventChan(), conf.ReplicationActiveFolder, conf.ReplicationArchiveFolder, "", zap.NewNop())
+	rep.SetLayout(conf.GetLayout())
+	rep.Start()
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	shardWal.LockShardIndex(si)
+	shardWal.GetWalForShardIndex(si).AppendWrite(cf, []byte{1, 2, 3})
+	shardWal.UnlockShardIndex(si)
+
+	errors := shardWal.CloseAll()
+	if errors != nil && errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+	rep.Stop()
+
+	// the replicated file is in the layout of the config, as the active file
+	contentB, err := ioutil.ReadFile(cf.PathInLayout(conf.GetLayout(), conf.ReplicationActiveFolder))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.HasSuffix(contentB, []byte{1, 2, 3}) {
+		t.Fatalf("replicated file should end with the written data")
+	}
+}
+
+func TestReplicatorKeepsFilesForFollowers(t *testing.T) {
+	conf := config.InitDefaultTestConfig()
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := uint64(cf.ShardIndex(uint32(conf.ShardCount)))
+	writeArchivedWalFiles(t, conf, cf, []byte{1}, []byte{2})
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("should have 2 archived wal files: %v %v", paths, err)
+	}
+	// a follower has applied the wal index 1 only
+	slot, err := openWalPositions(replicationSlotPath(conf.WalArchiveFolder, "f1"), conf.ShardCount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := slot.set(si, 2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	slot.close()
+
+	events := make(chan string, len(paths))
+	for _, p := range paths {
+		events <- p
+	}
+	close(events)
+	rep := InitReplicator([]chan string{events}, "data-test/rep-active", "", "", zap.NewNop())
+	rep.SetRetention(0)
+	if err := rep.Execute(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	remaining, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(remaining) != 1 || remaining[0] != paths[1] {
+		t.Fatalf("the wal file not applied by the follower should be kept: %v %v", remaining, err)
+	}
+}
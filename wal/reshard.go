@@ -0,0 +1,132 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/chamot1111/waldb/config"
+	"go.uber.org/zap"
+)
+
+const shardCountFilename = "shard-count.bin"
+
+// ErrShardCountMismatch the wal folder has been written with another shard count
+var ErrShardCountMismatch = errors.New("shard count mismatch")
+
+func shardCountPath(c config.Config) string {
+	return path.Join(c.WALFolder, shardCountFilename)
+}
+
+// readShardCount shard count saved in the wal folder, 0 if none
+func readShardCount(c config.Config) (int, error) {
+	content, err := ioutil.ReadFile(shardCountPath(c))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(content) != 8 {
+		return 0, fmt.Errorf("bad shard count file %s", shardCountPath(c))
+	}
+	return int(binary.BigEndian.Uint64(content)), nil
+}
+
+// writeShardCount save the shard count in the wal folder. The file is replaced atomically.
+func writeShardCount(c config.Config, shardCount int) error {
+	var buffer [8]byte
+	binary.BigEndian.PutUint64(buffer[:], uint64(shardCount))
+	tmpPath := shardCountPath(c) + ".tmp"
+	if err := writeSyncedFile(tmpPath, buffer[:]); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, shardCountPath(c))
+}
+
+// checkShardCount refuse a shard count different from the one saved in the wal folder: the
+// container files would be routed to other shards. The shard count is saved on first use.
+func checkShardCount(c config.Config) error {
+	shardCount, err := readShardCount(c)
+	if err != nil {
+		return err
+	}
+	if shardCount == 0 {
+		return writeShardCount(c, c.ShardCount)
+	}
+	if shardCount != c.ShardCount {
+		return fmt.Errorf("%w: wal folder %s has %d shards, config has %d: use waldb reshard", ErrShardCountMismatch, c.WALFolder, shardCount, c.ShardCount)
+	}
+	return nil
+}
+
+// Reshard change the shard count of a stopped database from conf.ShardCount to shardCount.
+// Every shard is checkpointed with the old shard count so no wal file is pending, then the wal
+// states are rewritten: all the new shards start at the next wal index of the most advanced old shard so
+// the names of the archived files stay unique. The archived wal files of different shard counts
+// can not be replayed together: a point-in-time recovery needs a base copy taken after the resharding.
+func Reshard(conf config.Config, shardCount int, logger *zap.Logger) error {
+	if shardCount <= 0 {
+		return fmt.Errorf("bad shard count %d", shardCount)
+	}
+	shardWal, err := InitShardWAL(conf, logger, nil)
+	if err != nil {
+		return err
+	}
+	if errs := shardWal.CloseAll(); errs.Err() != nil {
+		return errs.Err()
+	}
+
+	// the states hold the index of the next wal file of each shard
+	var nextWalIndex uint64
+	for i := 0; i < conf.ShardCount; i++ {
+		if _, err := os.Stat(getWalPath(conf, i)); err == nil {
+			return fmt.Errorf("wal file of shard %d still pending after checkpoint", i)
+		}
+		state, err := InitPersistentFileFromDisk(conf, i)
+		if err != nil {
+			return err
+		}
+		if state.WalIndex > nextWalIndex {
+			nextWalIndex = state.WalIndex
+		}
+		if err := state.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < shardCount; i++ {
+		if err := writeSyncedFile(persistentStatePath(conf, i), persistentStateBuffer(nextWalIndex)); err != nil {
+			return err
+		}
+	}
+	if err := writeShardCount(conf, shardCount); err != nil {
+		return err
+	}
+	for i := shardCount; i < conf.ShardCount; i++ {
+		if err := os.Remove(persistentStatePath(conf, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	logger.Info("Reshard done", zap.Int("from", conf.ShardCount), zap.Int("to", shardCount), zap.Uint64("wal-index", nextWalIndex))
+	return nil
+}
+
+func writeSyncedFile(p string, content []byte) error {
+	file, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,100 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"go.uber.org/zap"
+)
+
+func TestReshard(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+	conf.ShardCount = 4
+
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cfs := []config.ContainerFile{
+		config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		config.NewContainerFileWTableName("app1", "b1", "sb0", "inter"),
+		config.NewContainerFileWTableName("app2", "b2", "sb1", "inter"),
+	}
+	for i, cf := range cfs {
+		si := cf.ShardIndex(uint32(conf.ShardCount))
+		shardWal.LockShardIndex(si)
+		w := shardWal.GetWalForShardIndex(si)
+		if err := w.AppendWrite(cf, []byte{byte(i), 1}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		// the wal file is left pending as after a crash
+		if err := w.Sync(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		shardWal.UnlockShardIndex(si)
+	}
+
+	if err := Reshard(*conf, 16, logger); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, cf := range cfs {
+		content, err := ioutil.ReadFile(cf.PathToFileFromFolder(conf.ActiveFolder))
+		if err != nil || !bytes.HasSuffix(content, []byte{1}) {
+			t.Fatalf("pending wal should be applied: %v %v", content, err)
+		}
+	}
+
+	if _, err := InitShardWAL(*conf, logger, nil); !errors.Is(err, ErrShardCountMismatch) {
+		t.Fatalf("old shard count should be refused: %v", err)
+	}
+
+	conf.ShardCount = 16
+	shardWal, err = InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cf := cfs[0]
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	shardWal.LockShardIndex(si)
+	if err := shardWal.GetWalForShardIndex(si).AppendWrite(cf, []byte{2}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	shardWal.UnlockShardIndex(si)
+	if errs := shardWal.CloseAll(); errs.Err() != nil {
+		t.Fatalf("%v", errs.Err())
+	}
+	content, err := ioutil.ReadFile(cf.PathToFileFromFolder(conf.ActiveFolder))
+	if err != nil || !bytes.HasSuffix(content, []byte{0, 1, 2}) {
+		t.Fatalf("bad content after reshard %v %v", content, err)
+	}
+
+	// the archived wal file names of the old and the new shards do not collide
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(paths) != len(cfs)+1 {
+		t.Fatalf("should have %d archived wal files but get %d", len(cfs)+1, len(paths))
+	}
+	// the old shards have archived the wal index 1: the new shards start at the next one
+	var maxWalIndex uint64
+	for _, p := range paths {
+		f, err := readArchivedWalFileHeader(p)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if f.walIndex > maxWalIndex {
+			maxWalIndex = f.walIndex
+		}
+	}
+	if maxWalIndex != 2 {
+		t.Fatalf("the new shards should start at the wal index 2 but get %d", maxWalIndex)
+	}
+}
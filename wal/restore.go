@@ -0,0 +1,162 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+// ErrMissingWalFile a wal file between the first and the target wal index of a shard is not in the archive folder
+var ErrMissingWalFile = errors.New("missing archived wal file")
+
+// RestoreOptions describe a point-in-time recovery. ActiveFolder holds the base copy: it is updated in place.
+type RestoreOptions struct {
+	WalArchiveFolder string
+	ActiveFolder     string
+	ArchiveFolder    string
+	// FromWalIndex first wal index to replay per shard: the base copy already contains the previous ones.
+	// A missing shard replays from its first archived wal file.
+	FromWalIndex map[uint64]uint64
+	// ToWalIndex last wal index to replay per shard. A missing shard has no limit.
+	ToWalIndex map[uint64]uint64
+	// ToTime only the wal files created at or before this time are replayed. Zero means no limit.
+	// A wal file holds the writes until its checkpoint: the restore is at the granularity of a wal file.
+	ToTime time.Time
+	// Storage of ActiveFolder and ArchiveFolder, the local disk if nil
+	Storage storage.Storage
+	// Layout of ActiveFolder and ArchiveFolder, the default one if nil
+	Layout config.Layout
+	// KeyProvider keys of the encrypted wal files
+	KeyProvider crypt.KeyProvider
+}
+
+// RestoredShard wal files replayed for a shard
+type RestoredShard struct {
+	ShardIndex    uint64
+	FirstWalIndex uint64
+	LastWalIndex  uint64
+	Count         int
+}
+
+// Restore replay the archived wal files on the base copy in ActiveFolder, shard by shard and in wal index order,
+// with the same semantics as File.ColdReplay. It fails without replaying anything when a wal index is missing.
+func Restore(opts RestoreOptions, logger *zap.Logger) ([]RestoredShard, error) {
+	files, err := restoreFiles(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]RestoredShard, 0)
+	for _, f := range files {
+		if len(res) == 0 || res[len(res)-1].ShardIndex != f.shardIndex {
+			res = append(res, RestoredShard{ShardIndex: f.shardIndex, FirstWalIndex: f.walIndex})
+		}
+		restored := &res[len(res)-1]
+
+		walFile, err := ReadFileFromPath(f.path, opts.KeyProvider)
+		if err != nil {
+			return res, err
+		}
+		store := opts.Storage
+		if store == nil {
+			store = storage.Local{}
+		}
+		errs := walFile.ColdReplayOn(store, opts.Layout, opts.ActiveFolder, opts.ArchiveFolder)
+		if errs.Err() != nil {
+			return res, fmt.Errorf("replay of %s: %w", f.path, errs.Err())
+		}
+		restored.LastWalIndex = f.walIndex
+		restored.Count++
+		logger.Info("Restore: wal file replayed", zap.String("path", f.path), zap.Uint64("shard", f.shardIndex), zap.Uint64("wal-index", f.walIndex))
+	}
+	return res, nil
+}
+
+// restoreFiles archived wal files to replay, ordered by shard and wal index
+func restoreFiles(opts RestoreOptions) ([]archivedWalFile, error) {
+	paths, err := ArchivedWALFiles(opts.WalArchiveFolder)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]archivedWalFile, 0, len(paths))
+	for _, p := range paths {
+		f, err := readArchivedWalFileHeader(p)
+		if err != nil {
+			return nil, fmt.Errorf("could not read wal file header %s: %w", p, err)
+		}
+		if from, exists := opts.FromWalIndex[f.shardIndex]; exists && f.walIndex < from {
+			continue
+		}
+		if to, exists := opts.ToWalIndex[f.shardIndex]; exists && f.walIndex > to {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].shardIndex != files[j].shardIndex {
+			return files[i].shardIndex < files[j].shardIndex
+		}
+		return files[i].walIndex < files[j].walIndex
+	})
+
+	res := make([]archivedWalFile, 0, len(files))
+	// reached the target time for the current shard
+	reached := false
+	for i, f := range files {
+		if i == 0 || files[i-1].shardIndex != f.shardIndex {
+			if from, exists := opts.FromWalIndex[f.shardIndex]; exists && f.walIndex != from {
+				return nil, fmt.Errorf("%w: shard %d wal index %d", ErrMissingWalFile, f.shardIndex, from)
+			}
+			reached = false
+		} else if reached {
+			continue
+		} else if f.walIndex != files[i-1].walIndex+1 {
+			return nil, fmt.Errorf("%w: shard %d wal index %d", ErrMissingWalFile, f.shardIndex, files[i-1].walIndex+1)
+		}
+		if !opts.ToTime.IsZero() && int64(f.unixCreationTime) > opts.ToTime.Unix() {
+			reached = true
+			continue
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// PruneArchivedWALFiles delete the archived wal files modified before the retention and already processed
+// according to positions, the next wal index to process per shard. It returns the deleted paths.
+func PruneArchivedWALFiles(archiveWalFolder string, retention time.Duration, positions map[uint64]uint64) ([]string, error) {
+	paths, err := ArchivedWALFiles(archiveWalFolder)
+	if err != nil {
+		return nil, err
+	}
+	limit := time.Now().Add(-retention)
+	deleted := make([]string, 0)
+	for _, p := range paths {
+		st, err := os.Stat(p)
+		if err != nil {
+			return deleted, err
+		}
+		if !st.ModTime().Before(limit) {
+			continue
+		}
+		f, err := readArchivedWalFileHeader(p)
+		if err != nil {
+			return deleted, err
+		}
+		if f.walIndex >= positions[f.shardIndex] {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, p)
+	}
+	return deleted, nil
+}
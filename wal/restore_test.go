@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"go.uber.org/zap"
+)
+
+func writeArchivedWalFiles(t *testing.T, conf *config.Config, cf config.ContainerFile, contents ...[]byte) {
+	shardWal, err := InitShardWAL(*conf, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	for _, content := range contents {
+		shardWal.LockShardIndex(si)
+		err := shardWal.GetWalForShardIndex(si).AppendWrite(cf, content)
+		shardWal.UnlockShardIndex(si)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := shardWal.FlushShardIndex(si); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if errors := shardWal.CloseAll(); errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := uint64(cf.ShardIndex(uint32(conf.ShardCount)))
+	writeArchivedWalFiles(t, conf, cf, []byte{1, 2, 3}, []byte{4}, []byte{5})
+
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 3 {
+		t.Fatalf("should have 3 archived wal files: %v %v", paths, err)
+	}
+	first, err := readArchivedWalFileHeader(paths[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	opts := RestoreOptions{
+		WalArchiveFolder: conf.WalArchiveFolder,
+		ActiveFolder:     "data-test/restore/active",
+		ArchiveFolder:    "data-test/restore/archive",
+	}
+	content := func() []byte {
+		b, _ := ioutil.ReadFile(cf.PathToFileFromFolder(opts.ActiveFolder))
+		return b
+	}
+
+	opts.ToWalIndex = map[uint64]uint64{si: first.walIndex + 1}
+	restored, err := Restore(opts, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(restored) != 1 || restored[0].Count != 2 || restored[0].LastWalIndex != first.walIndex+1 {
+		t.Fatalf("bad restore result %v", restored)
+	}
+	if !bytes.HasSuffix(content(), []byte{1, 2, 3, 4}) {
+		t.Fatalf("bad restored content %v", content())
+	}
+
+	opts.FromWalIndex = map[uint64]uint64{si: first.walIndex + 2}
+	opts.ToWalIndex = nil
+	if _, err := Restore(opts, logger); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.HasSuffix(content(), []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("bad restored content %v", content())
+	}
+
+	opts.FromWalIndex = nil
+	opts.ToTime = time.Unix(int64(first.unixCreationTime)-1, 0)
+	restored, err = Restore(opts, logger)
+	if err != nil || len(restored) != 0 {
+		t.Fatalf("nothing should be restored before the first wal file: %v %v", restored, err)
+	}
+
+	os.Remove(paths[1])
+	opts.ToTime = time.Time{}
+	if _, err := Restore(opts, logger); !errors.Is(err, ErrMissingWalFile) {
+		t.Fatalf("should fail on a missing wal file: %v", err)
+	}
+}
+
+func TestRestoreAfterRestart(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	// each call restarts the shard wal
+	writeArchivedWalFiles(t, conf, cf, []byte{1, 2}, []byte{3})
+	writeArchivedWalFiles(t, conf, cf, []byte{4})
+	writeArchivedWalFiles(t, conf, cf, []byte{5})
+
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 4 {
+		t.Fatalf("should have 4 archived wal files: %v %v", paths, err)
+	}
+	for i, p := range paths {
+		f, err := readArchivedWalFileHeader(p)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if f.walIndex != uint64(i+1) || p != archivedWalPath(*conf, f.walIndex, int(si)) {
+			t.Fatalf("%s should be named after its wal index %d", p, i+1)
+		}
+	}
+
+	opts := RestoreOptions{
+		WalArchiveFolder: conf.WalArchiveFolder,
+		ActiveFolder:     "data-test/restore/active",
+		ArchiveFolder:    "data-test/restore/archive",
+	}
+	restored, err := Restore(opts, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(restored) != 1 || restored[0].Count != 4 {
+		t.Fatalf("bad restore result %v", restored)
+	}
+	content, _ := ioutil.ReadFile(cf.PathToFileFromFolder(opts.ActiveFolder))
+	if !bytes.HasSuffix(content, []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("bad restored content %v", content)
+	}
+}
+
+func TestReplicatorRetention(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rep := InitReplicator(shardWal.GetArchiveEventChan(), conf.ReplicationActiveFolder, conf.ReplicationArchiveFolder, "", logger)
+	rep.SetRetention(time.Hour)
+
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	for _, b := range [][]byte{{1, 2}, {3}} {
+		shardWal.LockShardIndex(si)
+		shardWal.GetWalForShardIndex(si).AppendWrite(cf, b)
+		shardWal.UnlockShardIndex(si)
+		if _, err := shardWal.FlushShardIndex(si); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if errors := shardWal.CloseAll(); errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+	if err := rep.Execute(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	contentB, err := ioutil.ReadFile(cf.PathToFileFromFolder(conf.ReplicationActiveFolder))
+	if err != nil || !bytes.HasSuffix(contentB, []byte{1, 2, 3}) {
+		t.Fatalf("bad replicated content %v %v", contentB, err)
+	}
+	paths, err := ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("wal files should be kept: %v %v", paths, err)
+	}
+
+	// after a restart, the kept wal files are not processed again: they would be pruned otherwise
+	c := make(chan string, len(paths))
+	if err := AddExistingWALFileToChan(c, conf.WalArchiveFolder); err != nil {
+		t.Fatalf("%v", err)
+	}
+	close(c)
+	rep = InitReplicator([]chan string{c}, conf.ReplicationActiveFolder, conf.ReplicationArchiveFolder, "", logger)
+	rep.SetRetention(time.Nanosecond)
+	if err := rep.Execute(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	paths, err = ArchivedWALFiles(conf.WalArchiveFolder)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("wal files should not be processed again: %v %v", paths, err)
+	}
+
+	deleted, err := PruneArchivedWALFiles(conf.WalArchiveFolder, time.Nanosecond, map[uint64]uint64{uint64(si): ^uint64(0)})
+	if err != nil || len(deleted) != 2 {
+		t.Fatalf("processed wal files out of retention should be deleted: %v %v", deleted, err)
+	}
+}
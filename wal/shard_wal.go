@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/chamot1111/waldb/config"
 	"github.com/chamot1111/waldb/fileop"
@@ -16,6 +17,11 @@ import (
 type shardWALRessource struct {
 	w     *WAL
 	mutex *sync.Mutex
+
+	// group commit: a single waiter syncs the wal for all the others
+	syncMutex *sync.Mutex
+	syncCond  *sync.Cond
+	syncing   bool
 }
 
 // ArchivedFileFuncter func called when a new archived file is created
@@ -34,11 +40,16 @@ type ShardWAL struct {
 	archivedFileFuncter         ArchivedFileFuncter
 	backgroundExclusiveTask     *sync.Mutex
 	archivedChan                chan string
+	// snapshotMutex one snapshot at a time
+	snapshotMutex sync.Mutex
 }
 
-// InitShardWAL init a shard wal
+// InitShardWAL init a shard wal. The config is rejected if Validate fails.
 func InitShardWAL(config config.Config, logger *zap.Logger, archivedFileFuncter ArchivedFileFuncter) (*ShardWAL, error) {
 	logger.Info("InitShardWAL")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	res := &ShardWAL{
 		config:                      config,
 		logger:                      logger,
@@ -47,6 +58,13 @@ func InitShardWAL(config config.Config, logger *zap.Logger, archivedFileFuncter
 		backgroundExclusiveTask:     &sync.Mutex{},
 	}
 
+	if err := os.MkdirAll(config.WALFolder, 0744); err != nil {
+		return nil, fmt.Errorf("could not create folder for wal file: %w", err)
+	}
+	if err := checkShardCount(config); err != nil {
+		return nil, err
+	}
+
 	wals := make([]*shardWALRessource, 0, config.ShardCount)
 
 	for i := 0; i < config.ShardCount; i++ {
@@ -60,18 +78,24 @@ func InitShardWAL(config config.Config, logger *zap.Logger, archivedFileFuncter
 		if err != nil {
 			return nil, err
 		}
+		syncMutex := &sync.Mutex{}
 		wr := &shardWALRessource{
-			w:     wal,
-			mutex: &sync.Mutex{},
+			w:         wal,
+			mutex:     &sync.Mutex{},
+			syncMutex: syncMutex,
+			syncCond:  sync.NewCond(syncMutex),
 		}
 
 		wals = append(wals, wr)
 	}
 
 	res.wals = wals
+	if err := res.repairActiveFiles(); err != nil {
+		return nil, fmt.Errorf("could not verify the active files: %w", err)
+	}
 	logger.Info("InitShardWAL::getArchiveFileCreatedEventChan")
 	res.archivedChan = res.getArchiveFileCreatedEventChan()
-	go archivedFileRountine(res.archivedChan, res.archivedFileFuncter, res.backgroundExclusiveTask, logger)
+	go archivedFileRountine(res.archivedChan, res.archivedFileFuncter, res.backgroundExclusiveTask, config.GetLayout(), logger)
 	return res, nil
 }
 
@@ -85,7 +109,7 @@ func (swa *ShardWAL) ExecRsyncCommand(params map[string][]string) ([]byte, error
 	}
 	defer func() {
 		swa.archivedChan = swa.getArchiveFileCreatedEventChan()
-		go archivedFileRountine(swa.archivedChan, swa.archivedFileFuncter, swa.backgroundExclusiveTask, swa.logger)
+		go archivedFileRountine(swa.archivedChan, swa.archivedFileFuncter, swa.backgroundExclusiveTask, swa.config.GetLayout(), swa.logger)
 	}()
 	if swa.config.RsyncCommand == "" {
 		swa.logger.Info("No rsync command")
@@ -135,6 +159,11 @@ func (swa *ShardWAL) ExecRsyncCommand(params map[string][]string) ([]byte, error
 	return out, err
 }
 
+// ShardIndex shard of the container file given by the router of the config
+func (swa *ShardWAL) ShardIndex(cf config.ContainerFile) uint32 {
+	return swa.config.GetRouter().ShardIndex(cf, uint32(len(swa.wals)))
+}
+
 // GetWalForShardIndex get wal for shard index
 func (swa *ShardWAL) GetWalForShardIndex(shardIndex uint32) *WAL {
 	return swa.wals[int(shardIndex)].w
@@ -150,6 +179,43 @@ func (swa *ShardWAL) UnlockShardIndex(shardIndex uint32) {
 	swa.wals[int(shardIndex)].mutex.Unlock()
 }
 
+// WaitDurable wait for the mutation sequence of the shard to be fsynced to the wal file, depending on
+// the durability mode. It must be called without the shard lock. Concurrent callers share the same fsync.
+func (swa *ShardWAL) WaitDurable(shardIndex uint32, seq uint64) error {
+	if swa.config.WALDurability != config.WALDurabilitySync && swa.config.WALDurability != config.WALDurabilityGroupCommit {
+		return nil
+	}
+	swr := swa.wals[int(shardIndex)]
+
+	swr.syncMutex.Lock()
+	for {
+		if swr.w.DurableSeq() >= seq {
+			swr.syncMutex.Unlock()
+			return nil
+		}
+		if !swr.syncing {
+			break
+		}
+		swr.syncCond.Wait()
+	}
+	swr.syncing = true
+	swr.syncMutex.Unlock()
+
+	if swa.config.WALDurability == config.WALDurabilityGroupCommit && swa.config.WALGroupCommitWindowMs > 0 {
+		time.Sleep(time.Duration(swa.config.WALGroupCommitWindowMs) * time.Millisecond)
+	}
+
+	swr.mutex.Lock()
+	err := swr.w.Sync()
+	swr.mutex.Unlock()
+
+	swr.syncMutex.Lock()
+	swr.syncing = false
+	swr.syncCond.Broadcast()
+	swr.syncMutex.Unlock()
+	return err
+}
+
 // FlushAll wal file. It's a blocking operation.
 func (swa *ShardWAL) FlushAll() (errOpsCount int, errors wutils.ErrorList) {
 	errors = wutils.ErrorList{}
@@ -196,19 +262,23 @@ func (swa *ShardWAL) GetArchiveEventChan() []chan string {
 	return res
 }
 
-func archivedFileRountine(ch chan string, archivedFileFunc ArchivedFileFuncter, mutex *sync.Mutex, logger *zap.Logger) {
+func archivedFileRountine(ch chan string, archivedFileFunc ArchivedFileFuncter, mutex *sync.Mutex, layout config.Layout, logger *zap.Logger) {
 	for s := range ch {
+		archivedFileQueueMetric.Set(float64(len(ch)))
 		if archivedFileFunc != nil {
-			archivedFileRountineWithLock(s, archivedFileFunc, mutex, logger)
+			archivedFileRountineWithLock(s, archivedFileFunc, mutex, layout, logger)
 		}
 	}
-	archivedFileFunc.Close()
+	archivedFileQueueMetric.Set(0)
+	if archivedFileFunc != nil {
+		archivedFileFunc.Close()
+	}
 }
 
-func archivedFileRountineWithLock(p string, archivedFileFunc ArchivedFileFuncter, mutex *sync.Mutex, logger *zap.Logger) {
+func archivedFileRountineWithLock(p string, archivedFileFunc ArchivedFileFuncter, mutex *sync.Mutex, layout config.Layout, logger *zap.Logger) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	cf, err := config.ParseContainerFileFromArchivePath(p)
+	cf, err := config.ParseArchivePathInLayout(layout, p)
 	if err != nil {
 		logger.Warn(fmt.Sprintf("file %s is not an archive file: discarded for resume archive routine", p), zap.String("path", p), zap.String("err", err.Error()))
 		return
@@ -240,18 +310,16 @@ func (swa *ShardWAL) renewArchiveFileCreatedEventChan() {
 }
 
 func (swa *ShardWAL) addExistingArchivedFileToChan(c chan string) error {
-	err := wutils.WalkFolderUnordered(swa.config.ArchiveFolder, func(path string, info os.FileInfo, err error) error {
+	paths, err := swa.config.GetStorage().List(swa.config.ArchiveFolder)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
 		if len(c) < cap(c) {
-			if info != nil && !info.IsDir() {
-				c <- path
-			}
+			c <- p
 		} else {
-			swa.logger.Warn("capacity reached, skip archive file", zap.String("path", path))
+			swa.logger.Warn("capacity reached, skip archive file", zap.String("path", p))
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 	return nil
 }
@@ -0,0 +1,309 @@
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/crypt"
+	"github.com/chamot1111/waldb/storage"
+	"github.com/chamot1111/waldb/wutils"
+	"go.uber.org/zap"
+)
+
+const (
+	snapshotFormatVersion  = 1
+	snapshotManifestName   = "manifest.json"
+	snapshotActiveFolder   = "active"
+	snapshotWALFolder      = "wal"
+	snapshotManifestTmpExt = ".tmp"
+)
+
+// SnapshotManifest describe a snapshot. It is written last: a snapshot folder without manifest is incomplete.
+type SnapshotManifest struct {
+	FormatVersion int
+	CreatedAt     time.Time
+	ShardCount    int
+	// ActiveFolder folder of the copy of the active files, relative to the snapshot folder
+	ActiveFolder string
+	// WALFolder folder of the state-*.bin and shard-count.bin files, relative to the snapshot folder
+	WALFolder string
+	Shards    []SnapshotShard
+}
+
+// SnapshotShard state of a shard in a snapshot
+type SnapshotShard struct {
+	ShardIndex int
+	// WalIndex first wal index not contained in the snapshot. A point-in-time recovery replays
+	// the archived wal files from this index.
+	WalIndex     uint64
+	CheckpointAt time.Time
+	Files        []SnapshotFile
+}
+
+// SnapshotFile active file of a snapshot
+type SnapshotFile struct {
+	// Path relative to the active folder
+	Path   string
+	Size   int64
+	CRC32C uint32
+}
+
+// ReadSnapshotManifest read the manifest of a snapshot folder
+func ReadSnapshotManifest(snapshotFolder string) (*SnapshotManifest, error) {
+	content, err := ioutil.ReadFile(path.Join(snapshotFolder, snapshotManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &SnapshotManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.FormatVersion != snapshotFormatVersion {
+		return nil, fmt.Errorf("unknown snapshot format version %d", manifest.FormatVersion)
+	}
+	return manifest, nil
+}
+
+// Snapshot copy the active files and the wal states to dest, which must not exist, without stopping the writes.
+// Each shard is checkpointed, then its checkpoints are deferred until its active files are copied:
+// the writes continue into the new wal file meanwhile. The copy of a shard is consistent with the
+// checkpoint of the shard.
+func (swa *ShardWAL) Snapshot(dest string) (*SnapshotManifest, error) {
+	swa.snapshotMutex.Lock()
+	defer swa.snapshotMutex.Unlock()
+
+	if err := os.MkdirAll(path.Dir(dest), 0744); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dest, 0744); err != nil {
+		return nil, err
+	}
+
+	manifest := &SnapshotManifest{
+		FormatVersion: snapshotFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		ShardCount:    len(swa.wals),
+		ActiveFolder:  snapshotActiveFolder,
+		WALFolder:     snapshotWALFolder,
+		Shards:        make([]SnapshotShard, len(swa.wals)),
+	}
+
+	holds := make([]chan struct{}, len(swa.wals))
+	defer func() {
+		for _, hold := range holds {
+			if hold != nil {
+				close(hold)
+			}
+		}
+	}()
+	for i, swr := range swa.wals {
+		swr.mutex.Lock()
+		_, err := swr.w.Flush()
+		if err == nil {
+			holds[i] = make(chan struct{})
+			swr.w.holdCheckpoints(holds[i])
+			manifest.Shards[i] = SnapshotShard{
+				ShardIndex:   i,
+				WalIndex:     swr.w.walFile.walIndex,
+				CheckpointAt: time.Now().UTC(),
+				Files:        make([]SnapshotFile, 0),
+			}
+		}
+		swr.mutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("could not checkpoint shard %d: %w", i, err)
+		}
+	}
+
+	filesPerShard, err := swa.activeFilesPerShard()
+	if err != nil {
+		return nil, err
+	}
+
+	store := swa.config.GetStorage()
+	destStore := snapshotStorage(swa.config.KeyProvider)
+	activeDest := path.Join(dest, snapshotActiveFolder)
+	for i, files := range filesPerShard {
+		for _, rel := range files {
+			err := copyStorageFile(destStore, path.Join(activeDest, rel), store, path.Join(swa.config.ActiveFolder, rel))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			manifest.Shards[i].Files = append(manifest.Shards[i].Files, SnapshotFile{Path: rel})
+		}
+		close(holds[i])
+		holds[i] = nil
+	}
+
+	// the copies do not change anymore: the checksums are computed once the writes resumed
+	for i := range manifest.Shards {
+		for j := range manifest.Shards[i].Files {
+			f := &manifest.Shards[i].Files[j]
+			f.Size, f.CRC32C, err = fileChecksum(destStore, path.Join(activeDest, f.Path))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	walDest := path.Join(dest, snapshotWALFolder)
+	if err := os.MkdirAll(walDest, 0744); err != nil {
+		return nil, err
+	}
+	if err := writeShardCount(config.Config{WALFolder: walDest}, len(swa.wals)); err != nil {
+		return nil, err
+	}
+	for _, shard := range manifest.Shards {
+		statePath := persistentStatePath(config.Config{WALFolder: walDest}, shard.ShardIndex)
+		if err := ioutil.WriteFile(statePath, persistentStateBuffer(shard.WalIndex), 0744); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeSnapshotManifest(dest, manifest); err != nil {
+		return nil, err
+	}
+	swa.logger.Info("Snapshot done", zap.String("dest", dest), zap.Duration("duration", time.Since(manifest.CreatedAt)))
+	return manifest, nil
+}
+
+// activeFilesPerShard paths of the active files relative to the active folder, per shard
+func (swa *ShardWAL) activeFilesPerShard() ([][]string, error) {
+	res := make([][]string, len(swa.wals))
+	paths, err := swa.config.GetStorage().List(swa.config.ActiveFolder)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		cf, err := config.ParseActivePathInLayout(swa.config.GetLayout(), p)
+		if err != nil {
+			swa.logger.Warn("Snapshot: skip unknown file of the active folder", zap.String("path", p), zap.Error(err))
+			continue
+		}
+		rel, err := filepath.Rel(swa.config.ActiveFolder, p)
+		if err != nil {
+			return nil, err
+		}
+		si := swa.ShardIndex(*cf)
+		res[si] = append(res[si], filepath.ToSlash(rel))
+	}
+	return res, nil
+}
+
+// snapshotStorage storage of the copies of a snapshot: the local disk, encrypted like the active files
+func snapshotStorage(keys crypt.KeyProvider) storage.Storage {
+	var s storage.Storage = storage.Local{}
+	if keys != nil {
+		s = storage.Encrypted(s, keys)
+	}
+	return s
+}
+
+// copyStorageFile copy src of srcStore to dst of dstStore, replaced. Between local files it clones the
+// file when the filesystem supports reflinks.
+func copyStorageFile(dstStore storage.Storage, dst string, srcStore storage.Storage, src string) error {
+	_, srcLocal := srcStore.(storage.Local)
+	_, dstLocal := dstStore.(storage.Local)
+	if srcLocal && dstLocal {
+		if err := os.MkdirAll(path.Dir(dst), 0744); err != nil {
+			return err
+		}
+		return wutils.CopyFile(src, dst)
+	}
+	srcFile, err := srcStore.OpenFile(src, false)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := dstStore.OpenFile(dst, true)
+	if err != nil {
+		return err
+	}
+	if err := dstFile.Truncate(0); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err := storage.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err := dstFile.Sync(); err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+// fileChecksum size and checksum of the content of a file
+func fileChecksum(store storage.Storage, p string) (int64, uint32, error) {
+	file, err := store.OpenFile(p, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return 0, 0, err
+	}
+	h := crc32.New(crc32cTable)
+	n, err := io.Copy(h, io.NewSectionReader(file, 0, size))
+	return n, h.Sum32(), err
+}
+
+func writeSnapshotManifest(dest string, manifest *SnapshotManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := path.Join(dest, snapshotManifestName)
+	tmpPath := manifestPath + snapshotManifestTmpExt
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, manifestPath)
+}
+
+// VerifySnapshot check the files of a snapshot against its manifest. keys are the keys of the encrypted
+// files, nil if they are not encrypted.
+func VerifySnapshot(snapshotFolder string, keys crypt.KeyProvider) (*SnapshotManifest, error) {
+	manifest, err := ReadSnapshotManifest(snapshotFolder)
+	if err != nil {
+		return nil, err
+	}
+	store := snapshotStorage(keys)
+	for _, shard := range manifest.Shards {
+		for _, f := range shard.Files {
+			size, crc, err := fileChecksum(store, path.Join(snapshotFolder, manifest.ActiveFolder, f.Path))
+			if err != nil {
+				return manifest, err
+			}
+			if size != f.Size || crc != f.CRC32C {
+				return manifest, fmt.Errorf("snapshot file %s of shard %d does not match the manifest", f.Path, shard.ShardIndex)
+			}
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,166 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/storage"
+	"go.uber.org/zap"
+)
+
+func TestSnapshot(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cfs := []config.ContainerFile{
+		config.NewContainerFileWTableName("app1", "b0", "sb0", "inter"),
+		config.NewContainerFileWTableName("app1", "b1", "sb0", "inter"),
+		config.NewContainerFileWTableName("app2", "b2", "sb1", "inter"),
+	}
+	write := func(cf config.ContainerFile, b ...byte) {
+		si := cf.ShardIndex(uint32(conf.ShardCount))
+		shardWal.LockShardIndex(si)
+		err := shardWal.GetWalForShardIndex(si).AppendWrite(cf, b)
+		shardWal.UnlockShardIndex(si)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	for i, cf := range cfs {
+		write(cf, byte(i), 1, 2)
+	}
+	// written to the wal only: the snapshot checkpoints it
+	write(cfs[0], 3)
+
+	// the writes continue during the snapshot
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				write(cfs[1], 9)
+			}
+		}
+	}()
+
+	dest := "data-test/snapshots/s1"
+	manifest, err := shardWal.Snapshot(dest)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err := shardWal.Snapshot(dest); err == nil {
+		t.Fatalf("snapshot in an existing folder should fail")
+	}
+
+	fileCount := 0
+	for _, shard := range manifest.Shards {
+		fileCount += len(shard.Files)
+		state, err := ioutil.ReadFile(persistentStatePath(config.Config{WALFolder: path.Join(dest, manifest.WALFolder)}, shard.ShardIndex))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !bytes.Equal(state, persistentStateBuffer(shard.WalIndex)) {
+			t.Fatalf("bad state for shard %d", shard.ShardIndex)
+		}
+	}
+	if fileCount != len(cfs) {
+		t.Fatalf("snapshot should have %d files but get %d", len(cfs), fileCount)
+	}
+
+	content, err := ioutil.ReadFile(cfs[0].PathToFileFromFolder(path.Join(dest, manifest.ActiveFolder)))
+	if err != nil || !bytes.HasSuffix(content, []byte{0, 1, 2, 3}) {
+		t.Fatalf("bad snapshot content %v %v", content, err)
+	}
+
+	if _, err := VerifySnapshot(dest, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ioutil.WriteFile(cfs[2].PathToFileFromFolder(path.Join(dest, manifest.ActiveFolder)), []byte{7}, 0744)
+	if _, err := VerifySnapshot(dest, nil); err == nil {
+		t.Fatalf("altered snapshot should not be valid")
+	}
+
+	if errors := shardWal.CloseAll(); errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+}
+
+func TestSnapshotRestoreAfterRestart(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+	conf.Storage = storage.NewMemory()
+
+	os.RemoveAll("data-test")
+
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	writeArchivedWalFiles(t, conf, cf, []byte{1, 2})
+
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	write := func(b ...byte) {
+		shardWal.LockShardIndex(si)
+		err := shardWal.GetWalForShardIndex(si).AppendWrite(cf, b)
+		shardWal.UnlockShardIndex(si)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	write(3)
+	dest := "data-test/snapshots/s1"
+	manifest, err := shardWal.Snapshot(dest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	write(4)
+	if errors := shardWal.CloseAll(); errors.Err() != nil {
+		t.Fatalf("%v", errors.Err())
+	}
+	writeArchivedWalFiles(t, conf, cf, []byte{5})
+
+	if _, err := VerifySnapshot(dest, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	opts := RestoreOptions{
+		WalArchiveFolder: conf.WalArchiveFolder,
+		ActiveFolder:     path.Join(dest, manifest.ActiveFolder),
+		ArchiveFolder:    "data-test/restore/archive",
+		FromWalIndex:     map[uint64]uint64{},
+	}
+	for _, shard := range manifest.Shards {
+		opts.FromWalIndex[uint64(shard.ShardIndex)] = shard.WalIndex
+	}
+	restored, err := Restore(opts, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(restored) != 1 || restored[0].Count != 2 {
+		t.Fatalf("bad restore result %v", restored)
+	}
+	content, _ := ioutil.ReadFile(cf.PathToFileFromFolder(opts.ActiveFolder))
+	if !bytes.HasSuffix(content, []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("bad restored content %v", content)
+	}
+}
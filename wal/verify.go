@@ -0,0 +1,192 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/fileop"
+	"go.uber.org/zap"
+)
+
+// verifyRecoveredFiles check the size header of the active files of the wal file pending at start
+// against their length. With lostOnly only the headers pointing past the end of their file are kept.
+func (w *WAL) verifyRecoveredFiles(lostOnly bool) ([]fileop.HeaderMismatch, error) {
+	paths := make([]string, 0, len(w.recoveredCmds))
+	for key := range w.recoveredCmds {
+		cf, err := config.ParseContainerFileKey(key)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, cf.PathToFile(w.config))
+	}
+	mismatches, err := w.fileExecutor.VerifyHeadersOf(paths)
+	if err != nil || !lostOnly {
+		return mismatches, err
+	}
+	res := mismatches[:0]
+	for _, m := range mismatches {
+		if lostDataMismatch(m) {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func lostDataMismatch(m fileop.HeaderMismatch) bool {
+	return m.Length >= 0 && (m.Header < 0 || m.Header > m.Length)
+}
+
+// repairActiveFiles check the size header of the active files of the wal files pending at start, once
+// they are applied: only a file written when the process stopped may disagree with its header.
+// Data past the header has never been acknowledged and is truncated. A file whose header pointed past
+// its end, before or after the replay, is rewritten with its whole content from the retained wal
+// files: the start fails when they do not hold it.
+func (swa *ShardWAL) repairActiveFiles() error {
+	mismatches := make(map[int][]fileop.HeaderMismatch)
+	for i, swr := range swa.wals {
+		current, err := swr.w.verifyRecoveredFiles(false)
+		if err != nil {
+			return err
+		}
+		// a lost end of file is repaired from the wal even if the replay has hidden it
+		shardMismatches := append(append([]fileop.HeaderMismatch(nil), swr.w.lostData...), current...)
+		if len(shardMismatches) > 0 {
+			mismatches[i] = shardMismatches
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	// the files are repaired outside of the bucket file operationners
+	for _, swr := range swa.wals {
+		swr.w.fileExecutor.Close()
+	}
+
+	for i, shardMismatches := range mismatches {
+		w := swa.wals[i].w
+		repaired := make(map[string]bool)
+		for _, m := range shardMismatches {
+			if repaired[m.Path] {
+				continue
+			}
+			repaired[m.Path] = true
+			swa.logger.Warn("size header disagrees with the active file", zap.String("path", m.Path), zap.Int64("header", m.Header), zap.Int64("length", m.Length))
+			if lostDataMismatch(m) {
+				cf, err := config.ParseActivePathInLayout(swa.config.GetLayout(), m.Path)
+				if err != nil {
+					return err
+				}
+				replayed, err := swa.replayFromWalFiles(w, *cf)
+				if err != nil {
+					return err
+				}
+				if !replayed {
+					return fmt.Errorf("size header of %s points past its end and the retained wal files do not hold its content: restore it from a snapshot", m.Path)
+				}
+				if m, err = swa.readHeader(m.Path); os.IsNotExist(err) {
+					swa.logger.Info("active file deleted by the replay of the wal files", zap.String("path", m.Path))
+					continue
+				} else if err != nil {
+					return err
+				}
+				if m.Header == m.Length {
+					swa.logger.Info("active file repaired from the wal files", zap.String("path", m.Path))
+					continue
+				}
+			}
+			if err := w.fileExecutor.RepairHeader(m); err != nil {
+				return err
+			}
+			swa.logger.Warn("data never acknowledged truncated from the active file", zap.String("path", m.Path), zap.Int64("header", m.Header), zap.Int64("length", m.Length))
+		}
+	}
+	return nil
+}
+
+func (swa *ShardWAL) readHeader(p string) (fileop.HeaderMismatch, error) {
+	m := fileop.HeaderMismatch{Path: p}
+	file, err := swa.config.GetStorage().OpenFile(p, false)
+	if err != nil {
+		return m, err
+	}
+	defer file.Close()
+	m.Header, m.Length, err = fileop.ReadHeader(file)
+	return m, err
+}
+
+// replayFromWalFiles rewrite the active file of cf from the commands of the archived wal files of the
+// shard of w, in wal index order, then of its recovered wal file. The commands are replayed from the
+// last one giving the whole content of the file: an archiving deleting the file, a truncation to zero
+// or a write of the whole file. Without it the content can not be proven and nothing is replayed.
+func (swa *ShardWAL) replayFromWalFiles(w *WAL, cf config.ContainerFile) (bool, error) {
+	key := cf.Key()
+	var history []*walCmd
+	if swa.config.WalArchiveFolder != "" {
+		paths, err := ArchivedWALFiles(swa.config.WalArchiveFolder)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		for _, p := range paths {
+			header, err := readArchivedWalFileHeader(p)
+			if err != nil {
+				return false, err
+			}
+			if header.shardIndex != uint64(w.shardIndex) || header.walIndex == w.recoveredWalIndex {
+				continue
+			}
+			wf, err := ReadFileFromPath(p, swa.config.KeyProvider)
+			if err != nil {
+				return false, err
+			}
+			history = appendFileHistory(history, wf.cmdsPerFile[key])
+		}
+	}
+	history = appendFileHistory(history, w.recoveredCmds[key])
+
+	start := -1
+	for i := len(history) - 1; i >= 0 && start < 0; i-- {
+		cmd := history[i]
+		switch {
+		case cmd == nil:
+			// archiving deleting the file
+			start = i + 1
+		case cmd.cmd == truncateCmd && cmd.writeOffset == 0:
+			start = i
+		case cmd.cmd == writeCmd && cmd.writeOffset == 0 && uint64(cmd.buffer.FullLen()) == cmd.fileSize:
+			start = i
+		}
+	}
+	if start < 0 {
+		return false, nil
+	}
+
+	store := swa.config.GetStorage()
+	p := cf.PathToFile(swa.config)
+	if err := store.Remove(p); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if start == len(history) {
+		return true, nil
+	}
+	replay := initFileForRead()
+	replay.cmdsPerFile[key] = history[start:]
+	if errs := replay.ColdReplayOn(store, swa.config.GetLayout(), swa.config.ActiveFolder, swa.config.ArchiveFolder); errs.Err() != nil {
+		return false, errs.Err()
+	}
+	return true, nil
+}
+
+// appendFileHistory append the commands of a file in a wal file changing its content. The archiving
+// deleting the file, the last command of the file in the wal file, is appended as nil: the others
+// leave the file unchanged.
+func appendFileHistory(history []*walCmd, cmds []*walCmd) []*walCmd {
+	for i, cmd := range cmds {
+		if cmd.cmd != archiveCmd {
+			history = append(history, cmd)
+		} else if i == len(cmds)-1 {
+			history = append(history, nil)
+		}
+	}
+	return history
+}
@@ -0,0 +1,109 @@
+package wal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/chamot1111/waldb/config"
+	"github.com/chamot1111/waldb/wutils"
+	"go.uber.org/zap"
+)
+
+// repairTestImage write cut and trailing, flush, write them again and copy the files with the
+// second writes pending in the wal, as left on the disk by a killed process
+func repairTestImage(t *testing.T, cut, trailing config.ContainerFile) config.Config {
+	conf := crashTestConfig("data-test/run")
+	conf.ShardCount = 1
+	image := crashTestConfig("data-test/image")
+	image.ShardCount = 1
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(conf, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	w := shardWal.GetWalForShardIndex(0)
+	for _, op := range []struct {
+		cf   config.ContainerFile
+		data []byte
+	}{{cut, []byte{1, 2, 3, 4}}, {trailing, []byte{7}}} {
+		if err := w.AppendWrite(op.cf, op.data); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if _, err := shardWal.FlushShardIndex(0); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, op := range []struct {
+		cf   config.ContainerFile
+		data []byte
+	}{{cut, []byte{5, 6}}, {trailing, []byte{8}}} {
+		if err := w.AppendWrite(op.cf, op.data); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := shardWal.WaitDurable(0, w.MutationSeq()); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := copyFolder(conf.WALFolder, image.WALFolder); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if errs := shardWal.CloseAll(); errs.Err() != nil {
+		t.Fatalf("%v", errs.Err())
+	}
+
+	// the end of the data is lost: the header points past the end of the file
+	if err := os.Truncate(cut.PathToFile(image), 8+2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// data never acknowledged past the end of the pending write
+	file, err := os.OpenFile(trailing.PathToFile(image), os.O_WRONLY|os.O_APPEND, 0744)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := file.Write([]byte{9, 9}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.Close()
+	return image
+}
+
+func TestRepairActiveFiles(t *testing.T) {
+	cut := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	trailing := config.NewContainerFileWTableName("app1", "b1", "sb0", "inter")
+	image := repairTestImage(t, cut, trailing)
+
+	shardWal, err := InitShardWAL(image, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer shardWal.CloseAll()
+	expected := map[config.ContainerFile][]byte{
+		cut:      {1, 2, 3, 4, 5, 6},
+		trailing: {7, 8},
+	}
+	for cf, exp := range expected {
+		fileBuf := &wutils.Buffer{}
+		if err := shardWal.GetWalForShardIndex(0).GetFileBuffer(cf, fileBuf); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !bytes.Equal(fileBuf.Bytes(), exp) {
+			t.Fatalf("bad content of %s after repair: %v, expected %v", cf.Key(), fileBuf.Bytes(), exp)
+		}
+	}
+}
+
+func TestRepairActiveFilesWithoutWal(t *testing.T) {
+	cut := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	trailing := config.NewContainerFileWTableName("app1", "b1", "sb0", "inter")
+	image := repairTestImage(t, cut, trailing)
+	// the first write of cut is no longer retained: its content can not be proven
+	if err := os.RemoveAll(image.WalArchiveFolder); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err := InitShardWAL(image, zap.NewNop(), nil); err == nil {
+		t.Fatalf("the start should fail on a file that can not be repaired from the wal")
+	}
+}
@@ -2,16 +2,20 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/chamot1111/waldb/config"
 	"github.com/chamot1111/waldb/fileop"
+	"github.com/chamot1111/waldb/storage"
 	"github.com/chamot1111/waldb/wutils"
 	"go.uber.org/zap"
 )
@@ -40,6 +44,24 @@ type WAL struct {
 	walFile                 File
 	walFileArchiveEvent     chan string
 	archiveFileCreatedEvent chan string
+
+	// count of commands of walFile already written to the file
+	persistedCmdCount int
+	// incremented by each write, truncate or archive
+	mutationSeq uint64
+	// mutationSeq covered by the last fsync. Read atomically.
+	durableSeq uint64
+	// snapshotHold defers the checkpoints while a snapshot copies the active files of the shard.
+	// The snapshot closes it when done.
+	snapshotHold chan struct{}
+	// opErrors last error of the failed operations of walFile, by operation index
+	opErrors map[uint32]string
+	// recoveredCmds commands per file of the wal file pending at start, their active files are verified
+	// once all the shards are loaded
+	recoveredCmds     map[string][]*walCmd
+	recoveredWalIndex uint64
+	// lostData active files of recoveredCmds whose size header pointed past their end before the replay
+	lostData []fileop.HeaderMismatch
 }
 
 // InitWAL init the wal file
@@ -74,13 +96,24 @@ func InitWAL(fileExecutor *fileop.BucketFileOperationner, c config.Config, shard
 	}
 
 	if walFile == nil {
-		persistentState.WalIndex++
+		// the state holds the index of the next wal file: the checkpoint has advanced it
+		if persistentState.WalIndex == 0 {
+			persistentState.WalIndex = 1
+		}
+		// the former versions named an archived wal file after the next index: it must not be replaced
+		for c.WalArchiveFolder != "" {
+			if _, err := os.Stat(archivedWalPath(c, persistentState.WalIndex, shardIndex)); err != nil {
+				break
+			}
+			persistentState.WalIndex++
+		}
 		err = persistentState.Save()
 		if err != nil {
 			return nil, err
 		}
 		logger.Info("InitWAL:initFile")
 		walFile = initFile(int(persistentState.WalIndex), shardIndex, c.ShardCount)
+		walFile.codec = codecForConfig(c)
 	}
 
 	resWal := &WAL{
@@ -98,7 +131,19 @@ func InitWAL(fileExecutor *fileop.BucketFileOperationner, c config.Config, shard
 	}
 
 	if len(walFile.cmdsOrder) > 0 {
-		n, err := resWal.checkPointing()
+		resWal.recoveredCmds = make(map[string][]*walCmd, len(walFile.cmdsPerFile))
+		for key, cmds := range walFile.cmdsPerFile {
+			resWal.recoveredCmds[key] = cmds
+		}
+		resWal.recoveredWalIndex = walFile.walIndex
+		// the replay may write past a lost end of file: the loss is detected before
+		if resWal.lostData, err = resWal.verifyRecoveredFiles(true); err != nil {
+			return resWal, fmt.Errorf("could not verify the active files: %w", err)
+		}
+		if err := resWal.rewriteLoadedFile(); err != nil {
+			return resWal, fmt.Errorf("could not rewrite existing wal file: %w", err)
+		}
+		n, err := resWal.checkPointing(checkpointTriggerRecovery)
 		if n > 0 {
 			return resWal, fmt.Errorf("load existing wal file has encountered several errors: %d", n)
 		}
@@ -131,9 +176,9 @@ func loadExistingWALFile(walFilePath string, config config.Config, shardIndex in
 		return nil, nil
 	}
 
-	walFile, err := ReadFileFromPath(walFilePath)
+	walFile, err := ReadFileFromPath(walFilePath, config.KeyProvider)
 	if err != nil {
-		if err != ErrBadWalFileCrcCommand {
+		if !isCorruptedCommandErr(err) {
 			return nil, err
 		}
 		logger.Warn("load existing wal file. Some commands are corrupted", zap.Error(err), zap.String("wal-path", walFilePath))
@@ -144,24 +189,74 @@ func loadExistingWALFile(walFilePath string, config config.Config, shardIndex in
 	if walFile.shardIndex != uint64(shardIndex) {
 		return nil, fmt.Errorf("try to flush wal with a different shard index")
 	}
+	// the commands are written again in a new file
+	walFile.codec = codecForConfig(config)
 	return walFile, nil
 }
 
 // AddExistingWALFileToChan add wal file in order to this channel
 func AddExistingWALFileToChan(c chan string, archiveWalFolder string) error {
-	files, err := ioutil.ReadDir(archiveWalFolder)
+	paths, err := ArchivedWALFiles(archiveWalFolder)
 	if err != nil {
 		return err
 	}
 
+	for _, p := range paths {
+		c <- p
+	}
+	return nil
+}
+
+// ArchivedWALFiles paths of the archived wal files of the folder, in order
+func ArchivedWALFiles(archiveWalFolder string) ([]string, error) {
+	files, err := ioutil.ReadDir(archiveWalFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(files))
 	for _, file := range files {
 		if file.IsDir() || !strings.HasPrefix(file.Name(), walArchiveFilePrefix) {
 			continue
 		}
-		p := path.Join(archiveWalFolder, file.Name())
-		c <- p
+		res = append(res, path.Join(archiveWalFolder, file.Name()))
 	}
-	return nil
+	return res, nil
+}
+
+// archivedWalFile header of an archived wal file
+type archivedWalFile struct {
+	path             string
+	walIndex         uint64
+	shardIndex       uint64
+	unixCreationTime uint64
+}
+
+// readArchivedWalFileHeader read the header of an archived wal file without its commands
+func readArchivedWalFileHeader(p string) (archivedWalFile, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return archivedWalFile{}, err
+	}
+	defer file.Close()
+	var header [offsetSuccessOperationBytes]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return archivedWalFile{}, err
+	}
+	wf := initFileForRead()
+	// the success operation bitmap following the header of the old versions is not needed
+	if err := wf.readHeader(bufio.NewReader(bytes.NewReader(header[:]))); err != nil && err != io.EOF {
+		return archivedWalFile{}, err
+	}
+	return archivedWalFile{
+		path:             p,
+		walIndex:         wf.walIndex,
+		shardIndex:       wf.shardIndex,
+		unixCreationTime: wf.unixCreationTime,
+	}, nil
 }
 
 // AppendWrite append write to a file
@@ -232,7 +327,8 @@ func (w *WAL) Truncate(cf config.ContainerFile, offset int64) error {
 			return fmt.Errorf("could not write wal file: %w", err)
 		}
 	}
-	w.walFile.addCmd(newCmd)
+	w.addCmd(newCmd)
+	w.mutationSeq++
 	return nil
 }
 
@@ -253,7 +349,8 @@ func (w *WAL) Archive(cf config.ContainerFile) error {
 			return fmt.Errorf("could not write wal file: %w", err)
 		}
 	}
-	w.walFile.addCmd(newCmd)
+	w.addCmd(newCmd)
+	w.mutationSeq++
 	return nil
 }
 
@@ -269,6 +366,108 @@ func (w *WAL) GetFileBuffer(cf config.ContainerFile, fileBuf *wutils.Buffer) err
 	return err
 }
 
+// FileReader is a random access view on a container file which takes into account the pending
+// commands of the wal. It is only valid while the shard is locked.
+type FileReader struct {
+	fileExecutor *fileop.BucketFileOperationner
+	cf           config.ContainerFile
+	diskSize     int64
+	pending      [][]byte
+	size         int64
+}
+
+// GetFileReader get a reader on the file without loading it in memory
+func (w *WAL) GetFileReader(cf config.ContainerFile) (*FileReader, error) {
+	diskSize, err := w.fileExecutor.DataSize(&cf)
+	if err != nil {
+		return nil, err
+	}
+	res := &FileReader{
+		fileExecutor: w.fileExecutor,
+		cf:           cf,
+		diskSize:     diskSize,
+		pending:      make([][]byte, 0),
+	}
+	res.applyCmds(w.walFile.cmdsPerFile[cf.Key()])
+	return res, nil
+}
+
+// same logic as updateReadBuffer without copying the pending buffers
+func (r *FileReader) applyCmds(cmds []*walCmd) {
+	for _, c := range cmds {
+		switch c.cmd {
+		case archiveCmd:
+			r.diskSize = 0
+			r.pending = r.pending[0:0]
+		case truncateCmd:
+			r.truncate(int64(c.writeOffset))
+		case writeCmd:
+			r.pending = append(r.pending, c.buffer.Bytes())
+		}
+	}
+	r.size = r.diskSize
+	for _, p := range r.pending {
+		r.size = r.size + int64(len(p))
+	}
+}
+
+func (r *FileReader) truncate(offset int64) {
+	if offset <= r.diskSize {
+		r.diskSize = offset
+		r.pending = r.pending[0:0]
+		return
+	}
+	cur := r.diskSize
+	for i, p := range r.pending {
+		if cur+int64(len(p)) >= offset {
+			r.pending[i] = p[0 : offset-cur]
+			r.pending = r.pending[0 : i+1]
+			return
+		}
+		cur = cur + int64(len(p))
+	}
+}
+
+// Size of the file
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= r.size {
+			return n, io.EOF
+		}
+		if cur < r.diskSize {
+			end := len(p)
+			if int64(end-n) > r.diskSize-cur {
+				end = n + int(r.diskSize-cur)
+			}
+			nn, err := r.fileExecutor.ReadAt(&r.cf, p[n:end], cur)
+			n = n + nn
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			if nn == 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+			continue
+		}
+		segOffset := r.diskSize
+		for _, seg := range r.pending {
+			if cur < segOffset+int64(len(seg)) {
+				n = n + copy(p[n:], seg[cur-segOffset:])
+				break
+			}
+			segOffset = segOffset + int64(len(seg))
+		}
+	}
+	return n, nil
+}
+
 func (w *WAL) Write(cf config.ContainerFile, fileOffset int64, fileSize int64, buffers ...[]byte) error {
 	if err := w.checkpointIfNecessary(); err != nil {
 		return err
@@ -321,9 +520,10 @@ func (w *WAL) Write(cf config.ContainerFile, fileOffset int64, fileSize int64, b
 			}
 		}
 
-		w.walFile.addCmd(newWriteCmd)
+		w.addCmd(newWriteCmd)
 	}
 
+	w.mutationSeq++
 	return nil
 }
 
@@ -367,13 +567,88 @@ func (w *WAL) updateReadBuffer(cf config.ContainerFile, buffer *wutils.Buffer) e
 	return nil
 }
 
+// MutationSeq sequence of the last write, truncate or archive. It can be given to a durable wait.
+func (w *WAL) MutationSeq() uint64 {
+	return w.mutationSeq
+}
+
+// DurableSeq last mutation sequence written and fsynced to the wal file. It can be called without lock.
+func (w *WAL) DurableSeq() uint64 {
+	return atomic.LoadUint64(&w.durableSeq)
+}
+
+// Sync append the commands not written yet to the wal file and fsync it. The written commands
+// can not be merged anymore.
+func (w *WAL) Sync() error {
+	if w.persistedCmdCount < len(w.walFile.cmdsOrder) {
+		if w.file == nil {
+			if err := w.createNewFile(); err != nil {
+				return fmt.Errorf("could not write wal file: %w", err)
+			}
+		}
+		if err := w.writePendingCmds(); err != nil {
+			return err
+		}
+		if err := w.buffer.Flush(); err != nil {
+			return err
+		}
+		if err := w.syncFile(); err != nil {
+			return err
+		}
+		w.mergeBarrierOperationIndex = int(w.walFile.cmdsOrder[len(w.walFile.cmdsOrder)-1].operationIndex)
+	}
+	atomic.StoreUint64(&w.durableSeq, w.mutationSeq)
+	return nil
+}
+
+// syncFile fsync the wal file
+func (w *WAL) syncFile() error {
+	if err := w.config.Faults.Inject(storage.FaultWALSync, nil); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *WAL) writePendingCmds() error {
+	written := 0
+	defer func() {
+		walBytesMetric.WithLabelValues(shardLabel(w.shardIndex)).Add(float64(written))
+	}()
+	for _, cmd := range w.walFile.cmdsOrder[w.persistedCmdCount:] {
+		n, err := w.walFile.writeCmdToFile(w.buffer, cmd)
+		written += n
+		if err != nil {
+			return err
+		}
+	}
+	w.persistedCmdCount = len(w.walFile.cmdsOrder)
+	return nil
+}
+
+func (w *WAL) addCmd(cmd *walCmd) {
+	w.walFile.addCmd(cmd)
+	walCommandsMetric.WithLabelValues(shardLabel(w.shardIndex), cmdKindLabel(cmd.cmd)).Inc()
+}
+
 // Flush current wal file
 func (w *WAL) Flush() (errOpsCount int, err error) {
-	return w.checkPointing()
+	return w.checkPointing(checkpointTriggerFlush)
 }
 
-// Close flush current wal file and close all files
+// Close flush current wal file and close all files. The failed operations waiting for a retry
+// are saved in the dead letter folder.
 func (w *WAL) Close() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	if len(w.walFile.cmdsOrder) > 0 {
+		w.deadLetter(w.walFile.cmdsOrder)
+		w.walFile.reset()
+	}
+	return nil
+}
+
+func (w *WAL) close() error {
 	_, err := w.Flush()
 	if err != nil {
 		return err
@@ -383,8 +658,9 @@ func (w *WAL) Close() error {
 	return nil
 }
 
+// suspend close the files, the failed operations are retried after the resume
 func (w *WAL) suspend() {
-	w.Close()
+	w.close()
 }
 
 func (w *WAL) resumeWALFileChan() {
@@ -395,10 +671,34 @@ func (w *WAL) resumeWALFileChan() {
 }
 
 func (w *WAL) createNewFile() error {
+	return w.createNewFileAt(getWalPath(w.config, w.shardIndex))
+}
+
+// rewriteLoadedFile write the commands loaded from an existing wal file with the current version
+// and open it for the checkpoint. The existing file is replaced only once the new one is synced.
+func (w *WAL) rewriteLoadedFile() error {
+	walPath := getWalPath(w.config, w.shardIndex)
+	tmpPath := walPath + ".tmp"
+	if err := w.createNewFileAt(tmpPath); err != nil {
+		return err
+	}
+	if err := w.writePendingCmds(); err != nil {
+		return err
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	if err := w.syncFile(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, walPath)
+}
+
+func (w *WAL) createNewFileAt(p string) error {
 	var err error
 	w.fileSize = 0
 
-	w.file, err = os.OpenFile(getWalPath(w.config, w.shardIndex), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	w.file, err = os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
 	if err != nil {
 		w.buffer = nil
 		return err
@@ -408,6 +708,11 @@ func (w *WAL) createNewFile() error {
 	} else {
 		w.buffer = bufio.NewWriter(w.file)
 	}
+	w.walFile.unixCreationTime = uint64(time.Now().Unix())
+	// each new wal file takes the current key
+	if err := w.walFile.encryptWith(w.config.KeyProvider); err != nil {
+		return err
+	}
 	err = w.walFile.writeHeader(w.buffer)
 	return err
 }
@@ -416,59 +721,92 @@ func getWalPath(c config.Config, shardIndex int) string {
 	return path.Join(c.WALFolder, fmt.Sprintf("wal-%05d.bin", shardIndex))
 }
 
+// archivedWalPath path of the archived wal file of a wal index
+func archivedWalPath(c config.Config, walIndex uint64, shardIndex int) string {
+	return path.Join(c.WalArchiveFolder, fmt.Sprintf(walArchiveFilePrefix+"%012d-s%05d.bin", walIndex, shardIndex))
+}
+
 func (w *WAL) checkpointIfNecessary() error {
-	doCheckpoint := false
+	if w.checkpointHeld() && !w.needCheckpointingHardLimit() {
+		return nil
+	}
+	trigger := ""
 	if w.needCheckpointingHardLimit() {
 		atomic.CompareAndSwapInt32(w.currentCheckpointShardIndex, -1, int32(w.shardIndex))
-		doCheckpoint = true
+		trigger = checkpointTriggerHard
 		w.logger.Info("checkpoint hard limit", zap.Int("shard-index", w.shardIndex))
 	} else {
-		if w.needCheckpointingSoftLimit() {
+		if softTrigger := w.softLimitTrigger(); softTrigger != "" {
 			if w.currentCheckpointShardIndex == nil {
-				doCheckpoint = true
+				trigger = softTrigger
 			} else {
 				ownedCheckpoint := atomic.CompareAndSwapInt32(w.currentCheckpointShardIndex, -1, int32(w.shardIndex))
 				if ownedCheckpoint {
-					doCheckpoint = true
+					trigger = softTrigger
 				}
 			}
 		}
 	}
 
-	if doCheckpoint {
-		_, err := w.checkPointing()
+	if trigger != "" {
+		_, err := w.checkPointing(trigger)
 		return err
 	}
 	return nil
 }
 
-func (w *WAL) needCheckpointingSoftLimit() bool {
-	return w.fileSize > w.config.MaxWALFileSize || time.Since(w.lastCheckpointingTime).Seconds() > float64(w.config.MaxWALFileDurationS)
+func (w *WAL) checkpointHeld() bool {
+	if w.snapshotHold == nil {
+		return false
+	}
+	select {
+	case <-w.snapshotHold:
+		w.snapshotHold = nil
+		return false
+	default:
+		return true
+	}
+}
+
+// holdCheckpoints until hold is closed. The shard lock must be held.
+func (w *WAL) holdCheckpoints(hold chan struct{}) {
+	w.snapshotHold = hold
+}
+
+// softLimitTrigger trigger of the checkpoint when a soft limit is reached, empty otherwise
+func (w *WAL) softLimitTrigger() string {
+	if w.fileSize > w.config.MaxWALFileSize {
+		return checkpointTriggerSoft
+	}
+	if time.Since(w.lastCheckpointingTime).Seconds() > float64(w.config.MaxWALFileDurationS) {
+		return checkpointTriggerTime
+	}
+	return ""
 }
 
 func (w *WAL) needCheckpointingHardLimit() bool {
-	return len(w.walFile.cmdsOrder) >= successOperationCount
+	return len(w.walFile.cmdsOrder) >= maxOperationCount
 }
 
 func (w *WAL) applying() (errOpsCount int, err error) {
 	errOpsCount = 0
+	w.opErrors = make(map[uint32]string)
 	opsPerFile := w.convertUnsucessfulWalCmdsToOps()
 	errors := w.fileExecutor.ApplyBatchOp(opsPerFile)
 	for _, fop := range opsPerFile {
-		var lastSuccessOperationIndex int64 = int64(fop.Ops[len(fop.Ops)-1].OperationIndex)
 		errFop := errors.GetErrorForFop(fop)
 		if errFop != nil {
 			errOpsCount++
+			applyFailedOpsMetric.WithLabelValues(shardLabel(w.shardIndex)).Inc()
 			w.logger.Error("wal write opreation", zap.Error(errFop.Err))
-			lastSuccessOperationIndex = int64(errFop.OperationIndex)
 		}
-		if lastSuccessOperationIndex >= 0 {
-			for _, op := range fop.Ops {
-				w.walFile.setSuccessOperation(int(op.OperationIndex), true)
-				if lastSuccessOperationIndex == int64(op.OperationIndex) {
-					break
-				}
+		// the operations of a file stop at the failed one, -1 when the sync of the file has failed
+		for _, op := range fop.Ops {
+			if errFop != nil && (errFop.OperationIndex < 0 || int(op.OperationIndex) >= errFop.OperationIndex) {
+				w.opErrors[uint32(op.OperationIndex)] = errFop.Err.Error()
+				continue
 			}
+			w.walFile.setSuccessOperation(int(op.OperationIndex), true)
 		}
 	}
 
@@ -476,7 +814,11 @@ func (w *WAL) applying() (errOpsCount int, err error) {
 	return
 }
 
-func (w *WAL) checkPointing() (errOpsCount int, err error) {
+func (w *WAL) checkPointing(trigger string) (errOpsCount int, err error) {
+	if w.snapshotHold != nil {
+		<-w.snapshotHold
+		w.snapshotHold = nil
+	}
 	defer func() {
 		if w.currentCheckpointShardIndex != nil {
 			atomic.CompareAndSwapInt32(w.currentCheckpointShardIndex, int32(w.shardIndex), -1)
@@ -485,20 +827,22 @@ func (w *WAL) checkPointing() (errOpsCount int, err error) {
 	if w.file == nil {
 		return 0, nil
 	}
-	for _, cmd := range w.walFile.cmdsOrder {
-		_, err := w.walFile.writeCmdToFile(w.buffer, cmd)
-		if err != nil {
-			return 0, err
-		}
+	start := time.Now()
+	defer func() {
+		checkpointDurationMetric.WithLabelValues(trigger).Observe(time.Since(start).Seconds())
+	}()
+	if err := w.writePendingCmds(); err != nil {
+		return 0, err
 	}
 
 	if err := w.buffer.Flush(); err != nil {
 		return 0, err
 	}
 
-	if err := w.file.Sync(); err != nil {
+	if err := w.syncFile(); err != nil {
 		return 0, err
 	}
+	atomic.StoreUint64(&w.durableSeq, w.mutationSeq)
 
 	if errOpsCount, err = w.applying(); err != nil {
 		return errOpsCount, err
@@ -521,7 +865,7 @@ func (w *WAL) checkPointing() (errOpsCount int, err error) {
 					w.logger.Error("could not parse container file key to send archive file", zap.String("key", cfStr), zap.Error(err))
 					continue
 				}
-				p := cf.ArchivePath(w.config.ArchiveFolder, w.shardIndex, int(w.walFile.walIndex), int(op.operationIndex))
+				p := cf.ArchivePathInLayout(w.config.GetLayout(), w.config.ArchiveFolder, w.shardIndex, int(w.walFile.walIndex), int(op.operationIndex))
 				w.archiveFileCreatedEvent <- p
 			}
 		}
@@ -529,22 +873,26 @@ func (w *WAL) checkPointing() (errOpsCount int, err error) {
 
 	w.file = nil
 
-	w.persistentState.WalIndex++
+	archivedWalIndex := w.walFile.walIndex
+	w.persistentState.WalIndex = archivedWalIndex + 1
 	if err := w.persistentState.Save(); err != nil {
 		return errOpsCount, err
 	}
 
 	newCmdsPerFile, newCmdsOrder := w.prepareFailedOperationsForNextWal()
 	w.walFile.resetWithNewElems(newCmdsPerFile, newCmdsOrder, w.persistentState.WalIndex)
+	w.persistedCmdCount = 0
 
 	w.fileSize = 0
 	w.mergeBarrierOperationIndex = -1
 
-	archiveFileName := fmt.Sprintf(walArchiveFilePrefix+"%012d-s%05d.bin", w.persistentState.WalIndex, w.shardIndex)
 	curWalPath := getWalPath(w.config, w.shardIndex)
 	if w.config.WalArchiveFolder != "" {
-		fullPathArchive := path.Join(w.config.WalArchiveFolder, archiveFileName)
-		err = wutils.MoveFile(curWalPath, fullPathArchive)
+		fullPathArchive := archivedWalPath(w.config, archivedWalIndex, w.shardIndex)
+		err = w.config.Faults.Inject(storage.FaultWALMove, nil)
+		if err == nil {
+			err = wutils.MoveFile(curWalPath, fullPathArchive)
+		}
 		if err != nil {
 			return errOpsCount, err
 		}
@@ -561,9 +909,14 @@ func (w *WAL) checkPointing() (errOpsCount int, err error) {
 	return errOpsCount, nil
 }
 
+// prepareFailedOperationsForNextWal failed operations to retry in the next wal file. The ones reaching
+// the max retry count go to the dead letter folder. The errors of the operations to retry are kept with
+// their new operation index.
 func (w *WAL) prepareFailedOperationsForNextWal() (map[string][]*walCmd, []*walCmd) {
 	perFile := make(map[string][]*walCmd, 0)
 	linear := make([]*walCmd, 0)
+	dropped := make([]*walCmd, 0)
+	opErrors := make(map[uint32]string)
 
 	var newOperationIndex uint32 = 0
 
@@ -578,6 +931,7 @@ func (w *WAL) prepareFailedOperationsForNextWal() (map[string][]*walCmd, []*walC
 				continue
 			}
 			if cmd.retryCount >= maxRetryCount {
+				dropped = append(dropped, cmd)
 				continue
 			}
 			newCmd := &walCmd{
@@ -589,6 +943,9 @@ func (w *WAL) prepareFailedOperationsForNextWal() (map[string][]*walCmd, []*walC
 				operationIndex: newOperationIndex,
 				retryCount:     cmd.retryCount + 1,
 			}
+			if opErr, exists := w.opErrors[cmd.operationIndex]; exists {
+				opErrors[newOperationIndex] = opErr
+			}
 			newOperationIndex++
 			fileCmds = append(fileCmds, newCmd)
 			linear = append(linear, newCmd)
@@ -597,6 +954,9 @@ func (w *WAL) prepareFailedOperationsForNextWal() (map[string][]*walCmd, []*walC
 			perFile[cf.Key()] = fileCmds
 		}
 	}
+	sort.Slice(dropped, func(i, j int) bool { return dropped[i].operationIndex < dropped[j].operationIndex })
+	w.deadLetter(dropped)
+	w.opErrors = opErrors
 
 	return perFile, linear
 }
@@ -628,7 +988,7 @@ func (w *WAL) convertUnsucessfulWalCmdsToOps() []*fileop.FileBatchOp {
 			case archiveCmd:
 				op.OpKind = fileop.ArchiveOp
 				if w.config.ArchiveFolder != "" {
-					op.ArchiveFileName = cf.ArchivePath(w.config.ArchiveFolder, w.shardIndex, int(w.walFile.walIndex), int(cmd.operationIndex))
+					op.ArchiveFileName = cf.ArchivePathInLayout(w.config.GetLayout(), w.config.ArchiveFolder, w.shardIndex, int(w.walFile.walIndex), int(cmd.operationIndex))
 				}
 			case truncateCmd:
 				op.OpKind = fileop.TruncateOp
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// walPositions next wal index to process per shard, saved in a file as big endian uint64s
+type walPositions struct {
+	file *os.File
+	next []uint64
+}
+
+func openWalPositions(p string, shardCount int) (*walPositions, error) {
+	file, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0744)
+	if err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if count := int(st.Size() / 8); count > shardCount {
+		shardCount = count
+	}
+	buffer := make([]byte, 8*shardCount)
+	// the positions of the shards never written are missing at the end of the file
+	if _, err := file.ReadAt(buffer, 0); err != nil && err != io.EOF {
+		file.Close()
+		return nil, fmt.Errorf("could not read wal positions %s: %w", p, err)
+	}
+	next := make([]uint64, shardCount)
+	for i := range next {
+		next[i] = binary.BigEndian.Uint64(buffer[i*8:])
+	}
+	return &walPositions{file: file, next: next}, nil
+}
+
+func (wp *walPositions) get(shardIndex uint64) uint64 {
+	if shardIndex >= uint64(len(wp.next)) {
+		return 0
+	}
+	return wp.next[shardIndex]
+}
+
+// set save the position of a shard and fsync it
+func (wp *walPositions) set(shardIndex uint64, next uint64) error {
+	for uint64(len(wp.next)) <= shardIndex {
+		wp.next = append(wp.next, 0)
+	}
+	wp.next[shardIndex] = next
+	var buffer [8]byte
+	binary.BigEndian.PutUint64(buffer[:], next)
+	if _, err := wp.file.WriteAt(buffer[:], int64(shardIndex)*8); err != nil {
+		return err
+	}
+	return wp.file.Sync()
+}
+
+func (wp *walPositions) close() error {
+	return wp.file.Close()
+}
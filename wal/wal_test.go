@@ -2,12 +2,15 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/chamot1111/waldb/config"
 	"github.com/chamot1111/waldb/fileop"
+	"github.com/chamot1111/waldb/storage"
 	"github.com/chamot1111/waldb/wutils"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -25,6 +28,9 @@ func TestWalWriteAndRead(t *testing.T) {
 	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
 	logger := zap.New(core).WithOptions()
 	logger = logger.WithOptions(zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level < zapcore.WarnLevel {
+			return nil
+		}
 		t.Fatalf("%v: %s", entry.Message, entry.Stack)
 		return fmt.Errorf("an error happened: %s", entry.Message)
 	}))
@@ -111,6 +117,9 @@ func TestSequentialWrite(t *testing.T) {
 	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
 	logger := zap.New(core).WithOptions()
 	logger = logger.WithOptions(zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level < zapcore.WarnLevel {
+			return nil
+		}
 		t.Fatalf("%v: %s", entry.Message, entry.Stack)
 		return fmt.Errorf("an error happened: %s", entry.Message)
 	}))
@@ -202,6 +211,9 @@ func TestFlushExistingWalFile(t *testing.T) {
 	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
 	logger := zap.New(core).WithOptions()
 	logger = logger.WithOptions(zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level < zapcore.WarnLevel {
+			return nil
+		}
 		t.Fatalf("%v: %s", entry.Message, entry.Stack)
 		return fmt.Errorf("an error happened: %s", entry.Message)
 	}))
@@ -307,6 +319,9 @@ func BenchmarkReads(b *testing.B) {
 	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
 	logger := zap.New(core).WithOptions()
 	logger = logger.WithOptions(zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level < zapcore.WarnLevel {
+			return nil
+		}
 		b.Fatalf("%v", entry.Message)
 		return fmt.Errorf("an error happened: %s", entry.Message)
 	}))
@@ -389,6 +404,9 @@ func BenchmarkWrites(b *testing.B) {
 	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
 	logger := zap.New(core).WithOptions()
 	logger = logger.WithOptions(zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level < zapcore.WarnLevel {
+			return nil
+		}
 		b.Fatalf("%v", entry.Message)
 		return fmt.Errorf("an error happened: %s", entry.Message)
 	}))
@@ -430,3 +448,181 @@ func BenchmarkWrites(b *testing.B) {
 		}
 	}
 }
+
+func TestWalSync(t *testing.T) {
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), os.Stdout, zap.DebugLevel)
+	logger := zap.New(core).WithOptions()
+
+	sc := config.InitDefaultTestConfig()
+	sc.ShardCount = 1
+
+	os.RemoveAll("data-test")
+
+	bfo, err := fileop.InitBucketFileOperationner(*sc, logger)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	wal, err := InitWAL(bfo, *sc, 0, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cf := config.NewContainerFileWTableName("app", "b1", "bb1", "interaction")
+	if err := wal.AppendWrite(cf, []byte{0, 1, 2}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	seq := wal.MutationSeq()
+	if wal.DurableSeq() >= seq {
+		t.Fatalf("write should not be durable before sync")
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if wal.DurableSeq() < seq {
+		t.Fatalf("write should be durable after sync")
+	}
+
+	// the synced command must not be modified by a following write
+	if err := wal.AppendWrite(cf, []byte{3, 4}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// what would be read after a crash
+	wf, err := ReadFileFromPath(getWalPath(*sc, 0), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(wf.cmdsOrder) != 2 || wf.cmdsOrder[0].buffer.Len() != 3 || wf.cmdsOrder[1].writeOffset != 3 {
+		t.Fatalf("synced commands not found in the wal file")
+	}
+
+	if _, err := wal.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	fileBuf := &wutils.Buffer{}
+	if err := wal.GetFileBuffer(cf, fileBuf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fileBuf.FullLen() != 5 || fileBuf.Bytes()[4] != 4 {
+		t.Fatalf("bad file after checkpoint: %v", fileBuf.Bytes())
+	}
+	wal.Close()
+}
+
+func TestDurableWriteAfterCrash(t *testing.T) {
+	logger := zap.NewNop()
+	for _, mode := range []string{config.WALDurabilitySync, config.WALDurabilityGroupCommit} {
+		conf := config.InitDefaultTestConfig()
+		conf.WALDurability = mode
+
+		os.RemoveAll("data-test")
+
+		shardWal, err := InitShardWAL(*conf, logger, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		cf := config.NewContainerFileWTableName("app", "b1", "bb1", "interaction")
+		si := cf.ShardIndex(uint32(conf.ShardCount))
+		for _, b := range [][]byte{{1, 2}, {3}} {
+			shardWal.LockShardIndex(si)
+			w := shardWal.GetWalForShardIndex(si)
+			err := w.AppendWrite(cf, b)
+			seq := w.MutationSeq()
+			shardWal.UnlockShardIndex(si)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := shardWal.WaitDurable(si, seq); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+
+		// the acknowledged writes are only in the wal file: the shard wal is dropped without close
+		if _, err := os.Stat(cf.PathToFile(*conf)); !os.IsNotExist(err) {
+			t.Fatalf("%s: the active file should not be written before the checkpoint", mode)
+		}
+		shardWal, err = InitShardWAL(*conf, logger, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		content, err := ioutil.ReadFile(cf.PathToFile(*conf))
+		if err != nil || !bytes.HasSuffix(content, []byte{1, 2, 3}) {
+			t.Fatalf("%s: the acknowledged writes should be applied at the restart: %v %v", mode, content, err)
+		}
+		if errors := shardWal.CloseAll(); errors.Err() != nil {
+			t.Fatalf("%v", errors.Err())
+		}
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	logger := zap.NewNop()
+	conf := config.InitDefaultTestConfig()
+	store := storage.NewMemory()
+	conf.Storage = store
+
+	os.RemoveAll("data-test")
+
+	shardWal, err := InitShardWAL(*conf, logger, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cf := config.NewContainerFileWTableName("app1", "b0", "sb0", "inter")
+	si := cf.ShardIndex(uint32(conf.ShardCount))
+	w := shardWal.GetWalForShardIndex(si)
+	if err := w.AppendWrite(cf, []byte{1, 2}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := shardWal.FlushShardIndex(si); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := w.AppendWrite(cf, []byte{3}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	fileBuf := &wutils.Buffer{}
+	if err := w.GetFileBuffer(cf, fileBuf); err != nil || !bytes.Equal(fileBuf.Bytes(), []byte{1, 2, 3}) {
+		t.Fatalf("bad content %v %v", fileBuf.Bytes(), err)
+	}
+	if err := w.Archive(cf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if errs := shardWal.CloseAll(); errs.Err() != nil {
+		t.Fatalf("%v", errs.Err())
+	}
+
+	if _, err := os.Stat(conf.ActiveFolder); !os.IsNotExist(err) {
+		t.Fatalf("the active folder should not be on the local disk")
+	}
+	paths, err := store.List(conf.ArchiveFolder)
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("should have one archived file: %v %v", paths, err)
+	}
+	f, err := store.OpenFile(paths[0], false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fileop.GetFileBufferFromFile(f, fileBuf); err != nil || !bytes.Equal(fileBuf.Bytes(), []byte{1, 2, 3}) {
+		t.Fatalf("bad archived content %v %v", fileBuf.Bytes(), err)
+	}
+	f.Close()
+}
+
+func TestInitShardWALInvalidConfig(t *testing.T) {
+	conf := config.InitDefaultTestConfig()
+	conf.SqliteArchiverJournalMode = "WAL; DROP TABLE x"
+	os.RemoveAll("data-test")
+	if _, err := InitShardWAL(*conf, zap.NewNop(), nil); err == nil {
+		t.Fatalf("an invalid config should be rejected")
+	}
+}
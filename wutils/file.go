@@ -7,8 +7,12 @@ import (
 )
 
 // MoveFile is use instead of os.Rename to avoid
-// invalid cross-device link
+// invalid cross-device link. It renames the file when possible so readers
+// of the destination never see a partial file.
 func MoveFile(sourcePath, destPath string) error {
+	if err := os.Rename(sourcePath, destPath); err == nil {
+		return nil
+	}
 	inputFile, err := os.Open(sourcePath)
 	if err != nil {
 		return fmt.Errorf("Couldn't open source file: %s", err)
@@ -31,3 +35,24 @@ func MoveFile(sourcePath, destPath string) error {
 	}
 	return nil
 }
+
+// CopyFile copy a file. It clones the file when the filesystem supports copy-on-write
+// (reflink), which is instantaneous, and fallbacks to a plain copy. The copy is fsynced.
+func CopyFile(sourcePath, destPath string) error {
+	inputFile, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+	outputFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0744)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	if err := cloneFile(outputFile, inputFile); err != nil {
+		if _, err := io.Copy(outputFile, inputFile); err != nil {
+			return err
+		}
+	}
+	return outputFile.Sync()
+}
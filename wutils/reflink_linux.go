@@ -0,0 +1,18 @@
+package wutils
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone ioctl FICLONE of linux/fs.h
+const ficlone = 0x40049409
+
+// cloneFile share the extents of src with dst
+func cloneFile(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package wutils
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile reflinks are only supported on linux
+func cloneFile(dst, src *os.File) error {
+	return errors.New("reflink not supported")
+}